@@ -0,0 +1,74 @@
+package handler
+
+import (
+	"filestore"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type archiveResponse struct {
+	Files   int      `json:"files"`
+	Skipped []string `json:"skipped"`
+}
+
+// NewExportHandler streams all stored files as a tar archive
+func NewExportHandler(store filestore.Store, logger log.FieldLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := requestLogger(logger, r)
+		logger.Debug("Processing request")
+
+		aw := &archiveWriter{w: w}
+
+		report, err := filestore.Export(store, aw)
+		if err != nil && aw.started {
+			// Status was sent already, the client gets a truncated archive
+			logger.WithError(err).Error("Error while processing request")
+			return
+		}
+		if err != nil {
+			respondWithStoreError(w, r, logger, err)
+			return
+		}
+
+		logger.WithField("files", report.Files).WithField("skipped", len(report.Skipped)).Info("Exported files")
+	}
+}
+
+// NewImportHandler stores files from a tar archive in the request body
+func NewImportHandler(store filestore.Store, logger log.FieldLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := requestLogger(logger, r)
+		logger.Debug("Processing request")
+
+		report, err := filestore.Import(store, r.Body)
+		if err != nil {
+			respondWithStoreError(w, r, logger, err)
+			return
+		}
+
+		skipped := report.Skipped
+		if skipped == nil {
+			skipped = []string{}
+		}
+
+		respondWithJSON(w, r, logger, http.StatusOK, archiveResponse{Files: report.Files, Skipped: skipped})
+	}
+}
+
+// archiveWriter sends response headers once the archive starts, until then errors can still be reported properly
+type archiveWriter struct {
+	w       http.ResponseWriter
+	started bool
+}
+
+func (aw *archiveWriter) Write(p []byte) (int, error) {
+	if !aw.started {
+		aw.w.Header().Set("Content-Type", "application/x-tar")
+		aw.w.Header().Set("Content-Disposition", `attachment; filename="filestore.tar"`)
+		aw.w.WriteHeader(http.StatusOK)
+		aw.started = true
+	}
+
+	return aw.w.Write(p)
+}
@@ -0,0 +1,65 @@
+package handler
+
+import (
+	"bytes"
+	"fileserver/mock"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHandler_ExportImport(t *testing.T) {
+	source := mock.NewFilestore(50)
+	for _, filename := range []string{"a.dat", "b.dat"} {
+		err := source.Store(filename, []byte("content of "+filename))
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	NewExportHandler(source, testLogger).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/admin/export", nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Export code: want %#v, got %#v", http.StatusOK, recorder.Code)
+	}
+
+	if recorder.Header().Get("Content-Type") != "application/x-tar" {
+		t.Errorf("Export content type: want %#v, got %#v", "application/x-tar", recorder.Header().Get("Content-Type"))
+	}
+
+	destination := mock.NewFilestore(50)
+	_ = destination.Store("a.dat", []byte("newer content"))
+
+	archive := recorder.Body.Bytes()
+	recorder = httptest.NewRecorder()
+	NewImportHandler(destination, testLogger).ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/admin/import", bytes.NewReader(archive)))
+
+	wantBody := []byte(`{
+  "files": 1,
+  "skipped": [
+    "a.dat"
+  ]
+}`)
+	if recorder.Code != http.StatusOK || !reflect.DeepEqual(recorder.Body.Bytes(), wantBody) {
+		t.Errorf("Import: want %#v %#v, got %#v %#v", http.StatusOK, string(wantBody), recorder.Code, recorder.Body.String())
+	}
+
+	contents, err := destination.Retrieve("b.dat")
+	if err != nil || string(contents) != "content of b.dat" {
+		t.Errorf("Imported file: want %#v, got %#v (%v)", "content of b.dat", string(contents), err)
+	}
+}
+
+func TestHandler_ImportInvalidArchive(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodPost, "/admin/import", strings.NewReader("not a tar archive"))
+
+	NewImportHandler(mock.NewFilestore(50), testLogger).ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Code: want %#v, got %#v", http.StatusBadRequest, recorder.Code)
+	}
+}
@@ -1,34 +1,26 @@
 package handler
 
 import (
-	"errors"
 	"net/http"
 
 	"filestore"
 
-	"github.com/bouk/httprouter"
 	log "github.com/sirupsen/logrus"
 )
 
-func NewDeleteFileHandler(store filestore.Store) http.HandlerFunc {
+func NewDeleteFileHandler(store filestore.Store, logger log.FieldLogger) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		log.WithField("request", *r).Debugf("Processing request %s %s", r.Method, r.URL.Path)
+		logger := requestLogger(logger, r)
+		logger.Debug("Processing request")
 
-		filename := httprouter.GetParam(r, "filename")
+		filename := filenameParam(r)
 
 		err := store.Delete(filename)
 		if err != nil {
-			log.WithError(err).Error("Error while processing request")
-
-			if errors.Is(err, filestore.ErrFileNotFound) {
-				respondWithError(w, r, http.StatusNotFound, err)
-				return
-			}
-
-			respondWithError(w, r, http.StatusInternalServerError, err)
+			respondWithStoreError(w, r, logger, err)
 			return
 		}
 
-		respondWithStatusCode(w, r, http.StatusOK)
+		respondWithStatusCode(w, r, logger, http.StatusOK)
 	}
 }
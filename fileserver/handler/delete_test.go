@@ -4,14 +4,56 @@ import (
 	"context"
 	"fileserver/mock"
 	"filestore"
+	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
 	"testing"
 
 	"github.com/bouk/httprouter"
+	log "github.com/sirupsen/logrus"
 )
 
+var testLogger = func() *log.Logger {
+	l := log.New()
+	l.SetOutput(ioutil.Discard)
+	return l
+}()
+
+// failingStore fails every operation with the given error
+type failingStore struct {
+	err error
+}
+
+func (s failingStore) Store(filename string, contents []byte) error {
+	return s.err
+}
+
+func (s failingStore) Retrieve(filename string) ([]byte, error) {
+	return []byte{}, s.err
+}
+
+func (s failingStore) Delete(filename string) error {
+	return s.err
+}
+
+func (s failingStore) Rename(from string, to string) error {
+	return s.err
+}
+
+func (s failingStore) Copy(from string, to string) error {
+	return s.err
+}
+
+func (s failingStore) Append(filename string, data []byte) error {
+	return s.err
+}
+
+func (s failingStore) WriteAt(filename string, offset int, data []byte) error {
+	return s.err
+}
+
 var notFoundResponse = []byte(`{
   "error": "File not found"
 }`)
@@ -84,13 +126,37 @@ func TestHandler_DeleteFileHandler(t *testing.T) {
 				wantHeader: http.Header{},
 			}
 		}(),
+
+		func() testCase {
+			filename := ".."
+
+			ctx := httprouter.WithParams(context.Background(), httprouter.Params{httprouter.Param{
+				Key:   "filename",
+				Value: filename,
+			}})
+
+			request := httptest.NewRequest(http.MethodDelete, "/files/"+filename, nil).WithContext(ctx)
+
+			return testCase{
+				name: "Deleting a file with invalid filename",
+				env: testEnv{
+					store: failingStore{err: fmt.Errorf("%w: filename can't contain \"..\"", filestore.ErrInvalidFilename)},
+				},
+				args:     args{request},
+				wantCode: http.StatusBadRequest,
+				wantBody: []byte(`{
+  "error": "Invalid filename: filename can't contain \"..\""
+}`),
+				wantHeader: http.Header{"Content-Type": []string{"application/json"}},
+			}
+		}(),
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			recorder := httptest.NewRecorder()
 
-			NewDeleteFileHandler(tt.env.store).ServeHTTP(recorder, tt.args.request)
+			NewDeleteFileHandler(tt.env.store, testLogger).ServeHTTP(recorder, tt.args.request)
 
 			if !reflect.DeepEqual(recorder.Code, tt.wantCode) {
 				t.Errorf("Code: want %#v, got %#v", tt.wantCode, recorder.Code)
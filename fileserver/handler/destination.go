@@ -0,0 +1,43 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/bouk/httprouter"
+)
+
+const filePathPrefix = "/file/"
+
+var (
+	errDestinationMissing = errors.New("Destination header is required")
+	errDestinationInvalid = errors.New("Destination header must point to " + filePathPrefix + ":filename")
+)
+
+// filenameParam reads the filename of the /file/*filename route, which may contain "/"
+func filenameParam(r *http.Request) string {
+	return strings.TrimPrefix(httprouter.GetParam(r, "filename"), "/")
+}
+
+// destinationFilename reads the target of MOVE and COPY requests from the Destination header,
+// which holds either a path or an absolute URL of the target file
+func destinationFilename(r *http.Request) (string, error) {
+	destination := r.Header.Get("Destination")
+	if destination == "" {
+		return "", errDestinationMissing
+	}
+
+	u, err := url.Parse(destination)
+	if err != nil {
+		return "", errDestinationInvalid
+	}
+
+	filename := strings.TrimPrefix(u.Path, filePathPrefix)
+	if filename == u.Path || filename == "" {
+		return "", errDestinationInvalid
+	}
+
+	return filename, nil
+}
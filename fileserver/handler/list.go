@@ -0,0 +1,32 @@
+package handler
+
+import (
+	"filestore"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type listResponse struct {
+	Files []string `json:"files"`
+}
+
+// NewListHandler returns names of stored files in alphabetical order, the store has to be able to list files
+func NewListHandler(store filestore.Store, logger log.FieldLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := requestLogger(logger, r)
+		logger.Debug("Processing request")
+
+		filenames, err := filestore.List(store)
+		if err != nil {
+			respondWithStoreError(w, r, logger, err)
+			return
+		}
+
+		if filenames == nil {
+			filenames = []string{}
+		}
+
+		respondWithJSON(w, r, logger, http.StatusOK, listResponse{Files: filenames})
+	}
+}
@@ -0,0 +1,40 @@
+package handler
+
+import (
+	"fileserver/mock"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestHandler_ListHandler(t *testing.T) {
+	store := mock.NewFilestore(50)
+	for _, filename := range []string{"b.dat", "a.dat"} {
+		err := store.Store(filename, []byte("content of "+filename))
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	NewListHandler(store, testLogger).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/admin/files", nil))
+
+	wantBody := []byte(`{
+  "files": [
+    "a.dat",
+    "b.dat"
+  ]
+}`)
+	if recorder.Code != http.StatusOK || !reflect.DeepEqual(recorder.Body.Bytes(), wantBody) {
+		t.Errorf("List: want %#v %#v, got %#v %#v", http.StatusOK, string(wantBody), recorder.Code, recorder.Body.String())
+	}
+
+	// Stores which can't list files
+	recorder = httptest.NewRecorder()
+	NewListHandler(basicStore{store}, testLogger).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/admin/files", nil))
+
+	if recorder.Code != http.StatusNotImplemented {
+		t.Errorf("List without Lister: want %#v, got %#v", http.StatusNotImplemented, recorder.Code)
+	}
+}
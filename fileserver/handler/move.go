@@ -0,0 +1,37 @@
+package handler
+
+import (
+	"filestore"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// NewMoveFileHandler renames the file on MOVE requests and copies it on COPY requests,
+// the new name is taken from the Destination header
+func NewMoveFileHandler(store filestore.Store, logger log.FieldLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := requestLogger(logger, r)
+		logger.Debug("Processing request")
+
+		filename := filenameParam(r)
+
+		destination, err := destinationFilename(r)
+		if err != nil {
+			respondWithError(w, r, logger, http.StatusBadRequest, err)
+			return
+		}
+
+		if r.Method == "COPY" {
+			err = filestore.Copy(store, filename, destination)
+		} else {
+			err = filestore.Rename(store, filename, destination)
+		}
+		if err != nil {
+			respondWithStoreError(w, r, logger, err)
+			return
+		}
+
+		respondWithStatusCode(w, r, logger, http.StatusCreated)
+	}
+}
@@ -0,0 +1,179 @@
+package handler
+
+import (
+	"context"
+	"fileserver/mock"
+	"filestore"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/bouk/httprouter"
+)
+
+var destinationMissingResponse = []byte(`{
+  "error": "Destination header is required"
+}`)
+
+var notSupportedResponse = []byte(`{
+  "error": "Operation is not supported: store can't rename files"
+}`)
+
+// basicStore hides the optional interfaces of the store it wraps
+type basicStore struct {
+	store filestore.Store
+}
+
+func (s basicStore) Store(filename string, contents []byte) error {
+	return s.store.Store(filename, contents)
+}
+
+func (s basicStore) Retrieve(filename string) ([]byte, error) {
+	return s.store.Retrieve(filename)
+}
+
+func (s basicStore) Delete(filename string) error {
+	return s.store.Delete(filename)
+}
+
+func TestHandler_MoveFileHandler(t *testing.T) {
+	type testEnv struct {
+		store filestore.Store
+	}
+
+	type args struct {
+		request *http.Request
+	}
+
+	type testCase struct {
+		name       string
+		env        testEnv
+		args       args
+		wantCode   int
+		wantBody   []byte
+		wantHeader http.Header
+	}
+
+	store := mock.NewFilestore(50)
+	for _, filename := range []string{"existing-file.dat", "other-file.dat"} {
+		err := store.Store(filename, []byte("some contents"))
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	defaultEnv := testEnv{
+		store: store,
+	}
+
+	newRequest := func(method string, filename string, destination string) *http.Request {
+		ctx := httprouter.WithParams(context.Background(), httprouter.Params{httprouter.Param{
+			Key:   "filename",
+			Value: filename,
+		}})
+
+		request := httptest.NewRequest(method, "/file/"+filename, nil).WithContext(ctx)
+		if destination != "" {
+			request.Header.Set("Destination", destination)
+		}
+
+		return request
+	}
+
+	tests := []testCase{
+		{
+			name:       "Renaming without destination",
+			env:        defaultEnv,
+			args:       args{newRequest("MOVE", "existing-file.dat", "")},
+			wantCode:   http.StatusBadRequest,
+			wantBody:   destinationMissingResponse,
+			wantHeader: http.Header{"Content-Type": []string{"application/json"}},
+		},
+		{
+			name:       "Renaming a non existing file",
+			env:        defaultEnv,
+			args:       args{newRequest("MOVE", "non-existing-file.dat", "/file/new-file.dat")},
+			wantCode:   http.StatusNotFound,
+			wantBody:   notFoundResponse,
+			wantHeader: http.Header{"Content-Type": []string{"application/json"}},
+		},
+		{
+			name:       "Renaming a file to an existing name",
+			env:        defaultEnv,
+			args:       args{newRequest("MOVE", "existing-file.dat", "/file/other-file.dat")},
+			wantCode:   http.StatusConflict,
+			wantBody:   fileAlreadyExistsResponse,
+			wantHeader: http.Header{"Content-Type": []string{"application/json"}},
+		},
+		{
+			name:       "Copying a non existing file",
+			env:        defaultEnv,
+			args:       args{newRequest("COPY", "non-existing-file.dat", "/file/new-file.dat")},
+			wantCode:   http.StatusNotFound,
+			wantBody:   notFoundResponse,
+			wantHeader: http.Header{"Content-Type": []string{"application/json"}},
+		},
+		{
+			name:       "Copying a file to an existing name",
+			env:        defaultEnv,
+			args:       args{newRequest("COPY", "existing-file.dat", "/file/other-file.dat")},
+			wantCode:   http.StatusConflict,
+			wantBody:   fileAlreadyExistsResponse,
+			wantHeader: http.Header{"Content-Type": []string{"application/json"}},
+		},
+		{
+			name:       "Copying an existing file",
+			env:        defaultEnv,
+			args:       args{newRequest("COPY", "existing-file.dat", "/file/copied.dat")},
+			wantCode:   http.StatusCreated,
+			wantBody:   nil,
+			wantHeader: http.Header{},
+		},
+		{
+			name:       "Renaming an existing file",
+			env:        defaultEnv,
+			args:       args{newRequest("MOVE", "existing-file.dat", "http://127.0.0.1:8080/file/new%20file.dat")},
+			wantCode:   http.StatusCreated,
+			wantBody:   nil,
+			wantHeader: http.Header{},
+		},
+		{
+			name:       "Renaming in a store which can't rename files",
+			env:        testEnv{store: basicStore{store}},
+			args:       args{newRequest("MOVE", "existing-file.dat", "/file/new-file.dat")},
+			wantCode:   http.StatusNotImplemented,
+			wantBody:   notSupportedResponse,
+			wantHeader: http.Header{"Content-Type": []string{"application/json"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+
+			NewMoveFileHandler(tt.env.store, testLogger).ServeHTTP(recorder, tt.args.request)
+
+			if !reflect.DeepEqual(recorder.Code, tt.wantCode) {
+				t.Errorf("Code: want %#v, got %#v", tt.wantCode, recorder.Code)
+			}
+
+			if !reflect.DeepEqual(recorder.Body.Bytes(), tt.wantBody) {
+				t.Errorf("Body: want %#v, got %#v", string(tt.wantBody), recorder.Body.String())
+			}
+
+			if !reflect.DeepEqual(recorder.Header(), tt.wantHeader) {
+				t.Errorf("Header: want %#v, got %#v", tt.wantHeader, recorder.Header())
+			}
+		})
+	}
+
+	for _, filename := range []string{"copied.dat", "new file.dat"} {
+		if _, err := store.Retrieve(filename); err != nil {
+			t.Errorf("File %s: want no error, got %#v", filename, err)
+		}
+	}
+	if _, err := store.Retrieve("existing-file.dat"); err == nil {
+		t.Errorf("Renamed file: want an error for the old name, got nil")
+	}
+}
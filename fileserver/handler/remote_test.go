@@ -0,0 +1,72 @@
+package handler
+
+import (
+	"errors"
+	"fileserver/mock"
+	"filestore"
+	"filestore/filestoretest"
+	"filestore/remote"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/bouk/httprouter"
+)
+
+// The remote store maps responses of the handlers back to store errors, so it conforms like the store behind them
+func TestRemoteStore_Conformance(t *testing.T) {
+	servers := []*httptest.Server{}
+	defer func() {
+		for _, server := range servers {
+			server.Close()
+		}
+	}()
+
+	filestoretest.RunConformance(t, filestoretest.ConformanceConfig{
+		NewStore: func(t *testing.T) filestore.Store {
+			store := mock.NewFilestore(100)
+
+			router := httprouter.New()
+			router.POST("/file/*filename", NewStoreFileHandler(store, testLogger))
+			router.GET("/file/*filename", NewRetrieveFileHandler(store, testLogger))
+			router.HEAD("/file/*filename", NewStatFileHandler(store, testLogger))
+			router.PATCH("/file/*filename", NewUpdateFileHandler(store, testLogger))
+			router.DELETE("/file/*filename", NewDeleteFileHandler(store, testLogger))
+			router.Handle("MOVE", "/file/*filename", NewMoveFileHandler(store, testLogger))
+			router.Handle("COPY", "/file/*filename", NewMoveFileHandler(store, testLogger))
+
+			server := httptest.NewServer(router)
+			servers = append(servers, server)
+
+			return remote.NewStore(server.URL, remote.Config{})
+		},
+		MaxFileSize: 100,
+	})
+}
+
+func TestRemoteStore_List(t *testing.T) {
+	store := mock.NewFilestore(100)
+	for _, filename := range []string{"b.dat", "a.dat"} {
+		err := store.Store(filename, []byte("content of "+filename))
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	router := httprouter.New()
+	router.GET("/admin/files", NewListHandler(store, testLogger))
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	filenames, err := filestore.List(remote.NewStore("http://127.0.0.1:1", remote.Config{AdminURL: server.URL}))
+	if err != nil || !reflect.DeepEqual(filenames, []string{"a.dat", "b.dat"}) {
+		t.Errorf("List: want %#v, got %#v (%v)", []string{"a.dat", "b.dat"}, filenames, err)
+	}
+
+	// Files can't be listed without the admin listener
+	_, err = filestore.List(remote.NewStore(server.URL, remote.Config{}))
+	if !errors.Is(err, filestore.ErrNotSupported) {
+		t.Errorf("List without admin URL: want %#v, got %#v", filestore.ErrNotSupported, err)
+	}
+}
@@ -2,38 +2,58 @@ package handler
 
 import (
 	"encoding/json"
+	"errors"
+	"filestore"
+	"filestore/httpstatus"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// Used when the store does not say when the backend is expected to recover
+const defaultRetryAfter = time.Second
+
 type errorResponse struct {
 	Error string `json:"error"`
 }
 
-func respondWithData(w http.ResponseWriter, r *http.Request, code int, body []byte) {
+// requestLogger enriches the logger with request scoped fields
+func requestLogger(logger log.FieldLogger, r *http.Request) log.FieldLogger {
+	return logger.WithField("method", r.Method).
+		WithField("path", r.URL.Path).
+		WithField("remote_addr", r.RemoteAddr)
+}
+
+func respondWithData(w http.ResponseWriter, r *http.Request, logger log.FieldLogger, code int, body []byte) {
 	w.Header().Set("Content-Type", "application/octet-stream")
 	w.WriteHeader(code)
 
 	_, err := w.Write(body)
 	if err != nil {
-		log.WithError(err).Error("Error while sending response")
+		logger.WithError(err).Error("Error while sending response")
 	}
 }
 
-func respondWithStatusCode(w http.ResponseWriter, r *http.Request, code int) {
+func respondWithStatusCode(w http.ResponseWriter, r *http.Request, logger log.FieldLogger, code int) {
 	w.WriteHeader(code)
 }
 
-func respondWithError(w http.ResponseWriter, r *http.Request, code int, responseErr error) {
+func respondWithError(w http.ResponseWriter, r *http.Request, logger log.FieldLogger, code int, responseErr error) {
 	// Build json error response
 	response := errorResponse{
 		Error: responseErr.Error(),
 	}
 
+	respondWithJSON(w, r, logger, code, response)
+}
+
+func respondWithJSON(w http.ResponseWriter, r *http.Request, logger log.FieldLogger, code int, response interface{}) {
 	body, err := json.MarshalIndent(response, "", "  ")
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatal(err)
 	}
 
 	// Send it
@@ -42,6 +62,32 @@ func respondWithError(w http.ResponseWriter, r *http.Request, code int, response
 
 	_, err = w.Write(body)
 	if err != nil {
-		log.WithError(err).Error("Error while sending response")
+		logger.WithError(err).Error("Error while sending response")
+	}
+}
+
+func respondWithUnavailable(w http.ResponseWriter, r *http.Request, logger log.FieldLogger, responseErr error) {
+	retryAfter := defaultRetryAfter
+
+	var unavailableErr *filestore.BackendUnavailableError
+	if errors.As(responseErr, &unavailableErr) && unavailableErr.RetryAfter > 0 {
+		retryAfter = unavailableErr.RetryAfter
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+
+	respondWithError(w, r, logger, http.StatusServiceUnavailable, responseErr)
+}
+
+// respondWithStoreError picks the status from the same table the remote store maps statuses back to errors with
+func respondWithStoreError(w http.ResponseWriter, r *http.Request, logger log.FieldLogger, responseErr error) {
+	logger.WithError(responseErr).Error("Error while processing request")
+
+	code := httpstatus.Code(responseErr)
+	if code == http.StatusServiceUnavailable {
+		respondWithUnavailable(w, r, logger, responseErr)
+		return
 	}
+
+	respondWithError(w, r, logger, code, responseErr)
 }
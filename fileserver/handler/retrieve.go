@@ -1,33 +1,47 @@
 package handler
 
 import (
+	"context"
 	"errors"
 	"filestore"
 	"net/http"
+	"strconv"
 
-	"github.com/bouk/httprouter"
 	log "github.com/sirupsen/logrus"
 )
 
-func NewRetrieveFileHandler(store filestore.Store) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		log.WithField("request", *r).Debugf("Processing request %s %s", r.Method, r.URL.Path)
+var errVersionInvalid = errors.New("Version must be a positive number")
 
-		filename := httprouter.GetParam(r, "filename")
+func NewRetrieveFileHandler(store filestore.Store, logger log.FieldLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := requestLogger(logger, r)
+		logger.Debug("Processing request")
 
-		contents, err := store.Retrieve(filename)
-		if err != nil {
-			log.WithError(err).Error("Error while processing request")
+		filename := filenameParam(r)
 
-			if errors.Is(err, filestore.ErrFileNotFound) {
-				respondWithError(w, r, http.StatusNotFound, err)
+		var contents []byte
+		var err error
+		if v := r.URL.Query().Get("version"); v != "" {
+			version, convErr := strconv.Atoi(v)
+			if convErr != nil || version < 1 {
+				respondWithError(w, r, logger, http.StatusBadRequest, errVersionInvalid)
 				return
 			}
 
-			respondWithError(w, r, http.StatusInternalServerError, err)
+			contents, err = filestore.RetrieveVersion(store, filename, version)
+		} else {
+			// Stop waiting if the client went away, concurrent requests for the same file share the fetch
+			contents, err = filestore.RetrieveContext(r.Context(), store, filename)
+		}
+		if errors.Is(err, context.Canceled) {
+			logger.Debug("Client went away")
+			return
+		}
+		if err != nil {
+			respondWithStoreError(w, r, logger, err)
 			return
 		}
 
-		respondWithData(w, r, http.StatusOK, contents)
+		respondWithData(w, r, logger, http.StatusOK, contents)
 	}
 }
@@ -4,10 +4,12 @@ import (
 	"context"
 	"fileserver/mock"
 	"filestore"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/bouk/httprouter"
 )
@@ -81,13 +83,123 @@ func TestHandler_RetrieveFileHandler(t *testing.T) {
 				wantHeader: http.Header{"Content-Type": []string{"application/octet-stream"}},
 			}
 		}(),
+
+		func() testCase {
+			filename := "existing-file.dat"
+
+			ctx := httprouter.WithParams(context.Background(), httprouter.Params{httprouter.Param{
+				Key:   "filename",
+				Value: filename,
+			}})
+
+			request := httptest.NewRequest(http.MethodGet, "/files/"+filename+"?version=1", nil).WithContext(ctx)
+
+			return testCase{
+				name:       "Retrieving a version of an existing file",
+				env:        defaultEnv,
+				args:       args{request},
+				wantCode:   http.StatusOK,
+				wantBody:   []byte("some content"),
+				wantHeader: http.Header{"Content-Type": []string{"application/octet-stream"}},
+			}
+		}(),
+
+		func() testCase {
+			filename := "existing-file.dat"
+
+			ctx := httprouter.WithParams(context.Background(), httprouter.Params{httprouter.Param{
+				Key:   "filename",
+				Value: filename,
+			}})
+
+			request := httptest.NewRequest(http.MethodGet, "/files/"+filename+"?version=2", nil).WithContext(ctx)
+
+			return testCase{
+				name:     "Retrieving a non existing version",
+				env:      defaultEnv,
+				args:     args{request},
+				wantCode: http.StatusNotFound,
+				wantBody: []byte(`{
+  "error": "Version not found"
+}`),
+				wantHeader: http.Header{"Content-Type": []string{"application/json"}},
+			}
+		}(),
+
+		func() testCase {
+			filename := "existing-file.dat"
+
+			ctx := httprouter.WithParams(context.Background(), httprouter.Params{httprouter.Param{
+				Key:   "filename",
+				Value: filename,
+			}})
+
+			request := httptest.NewRequest(http.MethodGet, "/files/"+filename+"?version=latest", nil).WithContext(ctx)
+
+			return testCase{
+				name:     "Retrieving an invalid version",
+				env:      defaultEnv,
+				args:     args{request},
+				wantCode: http.StatusBadRequest,
+				wantBody: []byte(`{
+  "error": "Version must be a positive number"
+}`),
+				wantHeader: http.Header{"Content-Type": []string{"application/json"}},
+			}
+		}(),
+
+		func() testCase {
+			filename := "existing-file.dat"
+
+			ctx := httprouter.WithParams(context.Background(), httprouter.Params{httprouter.Param{
+				Key:   "filename",
+				Value: filename,
+			}})
+
+			request := httptest.NewRequest(http.MethodGet, "/files/"+filename, nil).WithContext(ctx)
+
+			return testCase{
+				name: "Retrieving a file while the backend is unavailable",
+				env: testEnv{
+					store: failingStore{err: fmt.Errorf("Unable to retrieve file: %w", &filestore.BackendUnavailableError{RetryAfter: 1500 * time.Millisecond})},
+				},
+				args:     args{request},
+				wantCode: http.StatusServiceUnavailable,
+				wantBody: []byte(`{
+  "error": "Unable to retrieve file: Backend is unavailable, try again later"
+}`),
+				wantHeader: http.Header{"Content-Type": []string{"application/json"}, "Retry-After": []string{"2"}},
+			}
+		}(),
+
+		func() testCase {
+			filename := "existing-file.dat"
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			ctx = httprouter.WithParams(ctx, httprouter.Params{httprouter.Param{
+				Key:   "filename",
+				Value: filename,
+			}})
+
+			request := httptest.NewRequest(http.MethodGet, "/files/"+filename, nil).WithContext(ctx)
+
+			return testCase{
+				name:       "Retrieving a file for a client which went away",
+				env:        defaultEnv,
+				args:       args{request},
+				wantCode:   http.StatusOK,
+				wantBody:   nil,
+				wantHeader: http.Header{},
+			}
+		}(),
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			recorder := httptest.NewRecorder()
 
-			NewRetrieveFileHandler(tt.env.store).ServeHTTP(recorder, tt.args.request)
+			NewRetrieveFileHandler(tt.env.store, testLogger).ServeHTTP(recorder, tt.args.request)
 
 			if !reflect.DeepEqual(recorder.Code, tt.wantCode) {
 				t.Errorf("Code: want %#v, got %#v", tt.wantCode, recorder.Code)
@@ -0,0 +1,41 @@
+package handler
+
+import (
+	"filestore"
+	"net/http"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Header carrying the version of the current contents in responses to HEAD requests
+const fileVersionHeader = "X-File-Version"
+
+// NewStatFileHandler answers HEAD requests with the size of the file, its checksum as ETag and its version,
+// the contents are not retrieved
+func NewStatFileHandler(store filestore.Store, logger log.FieldLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := requestLogger(logger, r)
+		logger.Debug("Processing request")
+
+		filename := filenameParam(r)
+
+		info, err := filestore.Stat(store, filename)
+		if err != nil {
+			respondWithStoreError(w, r, logger, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		// Files stored by older versions of the store don't know their size
+		if info.Size >= 0 {
+			w.Header().Set("Content-Length", strconv.Itoa(info.Size))
+		}
+		w.Header().Set(fileVersionHeader, strconv.Itoa(info.Version))
+		if info.Checksum != "" {
+			w.Header().Set("ETag", strconv.Quote(info.Checksum))
+		}
+
+		respondWithStatusCode(w, r, logger, http.StatusOK)
+	}
+}
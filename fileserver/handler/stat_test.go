@@ -0,0 +1,71 @@
+package handler
+
+import (
+	"context"
+	"fileserver/mock"
+	"filestore"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bouk/httprouter"
+)
+
+func TestHandler_StatFileHandler(t *testing.T) {
+	store := mock.NewFilestore(50)
+	err := store.Store("existing-file.dat", []byte("some contents"))
+	if err != nil {
+		panic(err)
+	}
+
+	newRequest := func(filename string) *http.Request {
+		ctx := httprouter.WithParams(context.Background(), httprouter.Params{httprouter.Param{
+			Key:   "filename",
+			Value: filename,
+		}})
+
+		return httptest.NewRequest(http.MethodHead, "/file/"+filename, nil).WithContext(ctx)
+	}
+
+	recorder := httptest.NewRecorder()
+	NewStatFileHandler(store, testLogger).ServeHTTP(recorder, newRequest("existing-file.dat"))
+
+	if recorder.Code != http.StatusOK || recorder.Body.Len() != 0 {
+		t.Errorf("Stat: want %#v without body, got %#v %#v", http.StatusOK, recorder.Code, recorder.Body.String())
+	}
+
+	wantHeader := map[string]string{
+		"Content-Length": "13",
+		"X-File-Version": "1",
+		"ETag":           `"220c7810f41695d9a87d70b68ccf2aeb"`,
+	}
+	for key, want := range wantHeader {
+		if got := recorder.Header().Get(key); got != want {
+			t.Errorf("Header %s: want %#v, got %#v", key, want, got)
+		}
+	}
+
+	// Files stored by older versions of the store don't know their size
+	recorder = httptest.NewRecorder()
+	NewStatFileHandler(legacyStore{basicStore{store}}, testLogger).ServeHTTP(recorder, newRequest("existing-file.dat"))
+
+	if _, ok := recorder.Header()["Content-Length"]; recorder.Code != http.StatusOK || ok {
+		t.Errorf("Stat of a legacy file: want %#v without Content-Length, got %#v %#v", http.StatusOK, recorder.Code, recorder.Header())
+	}
+
+	recorder = httptest.NewRecorder()
+	NewStatFileHandler(store, testLogger).ServeHTTP(recorder, newRequest("non-existing-file.dat"))
+
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Stat of a non existing file: want %#v, got %#v", http.StatusNotFound, recorder.Code)
+	}
+}
+
+// legacyStore describes files like the store does for files stored by its older versions
+type legacyStore struct {
+	basicStore
+}
+
+func (s legacyStore) Stat(filename string) (filestore.FileInfo, error) {
+	return filestore.FileInfo{Size: -1, Version: 1}, nil
+}
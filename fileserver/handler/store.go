@@ -1,47 +1,37 @@
 package handler
 
 import (
-	"errors"
 	"filestore"
 	"io/ioutil"
 	"net/http"
 
-	"github.com/bouk/httprouter"
-
 	log "github.com/sirupsen/logrus"
 )
 
-func NewStoreFileHandler(store filestore.Store) http.HandlerFunc {
+func NewStoreFileHandler(store filestore.Store, logger log.FieldLogger) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		log.WithField("request", *r).Debugf("Processing request %s %s", r.Method, r.URL.Path)
+		logger := requestLogger(logger, r)
+		logger.Debug("Processing request")
 
-		filename := httprouter.GetParam(r, "filename")
+		filename := filenameParam(r)
 
 		contents, err := ioutil.ReadAll(r.Body)
 		if err != nil {
-			log.WithError(err).Error("Error while reading request body")
-			respondWithStatusCode(w, r, http.StatusBadRequest)
+			logger.WithError(err).Error("Error while reading request body")
+			respondWithStatusCode(w, r, logger, http.StatusBadRequest)
 			return
 		}
 
-		err = store.Store(filename, contents)
+		if r.URL.Query().Get("append") == "true" {
+			err = filestore.Append(store, filename, contents)
+		} else {
+			err = store.Store(filename, contents)
+		}
 		if err != nil {
-			log.WithError(err).Error("Error while processing request")
-
-			if errors.Is(err, filestore.ErrFileAlreadyExists) {
-				respondWithError(w, r, http.StatusConflict, err)
-				return
-			}
-
-			if errors.Is(err, filestore.ErrFileTooLarge) {
-				respondWithError(w, r, http.StatusBadRequest, err)
-				return
-			}
-
-			respondWithError(w, r, http.StatusInternalServerError, err)
+			respondWithStoreError(w, r, logger, err)
 			return
 		}
 
-		respondWithStatusCode(w, r, http.StatusOK)
+		respondWithStatusCode(w, r, logger, http.StatusOK)
 	}
 }
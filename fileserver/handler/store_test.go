@@ -4,6 +4,7 @@ import (
 	"context"
 	"fileserver/mock"
 	"filestore"
+	memcachemock "filestore/mock"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
@@ -37,6 +38,9 @@ func TestHandler_StoreFileHandler(t *testing.T) {
 		wantCode   int
 		wantBody   []byte
 		wantHeader http.Header
+
+		// Contents of the file after the request, not checked if nil
+		wantContents []byte
 	}
 
 	store := mock.NewFilestore(50)
@@ -112,13 +116,55 @@ func TestHandler_StoreFileHandler(t *testing.T) {
 				wantHeader: http.Header{"Content-Type": []string{"application/json"}},
 			}
 		}(),
+		func() testCase {
+			filename := "existing-file.dat"
+			contents := []byte(" and more")
+
+			ctx := httprouter.WithParams(context.Background(), httprouter.Params{httprouter.Param{
+				Key:   "filename",
+				Value: filename,
+			}})
+
+			request := httptest.NewRequest(http.MethodPost, "/files/"+filename+"?append=true", strings.NewReader(string(contents))).WithContext(ctx)
+
+			return testCase{
+				name:         "Appending to an existing file",
+				env:          defaultEnv,
+				args:         args{request},
+				wantCode:     http.StatusOK,
+				wantBody:     nil,
+				wantHeader:   http.Header{},
+				wantContents: []byte("some contents and more"),
+			}
+		}(),
+
+		func() testCase {
+			filename := "non-existing-file.dat"
+			contents := []byte("some content")
+
+			ctx := httprouter.WithParams(context.Background(), httprouter.Params{httprouter.Param{
+				Key:   "filename",
+				Value: filename,
+			}})
+
+			request := httptest.NewRequest(http.MethodPost, "/files/"+filename+"?append=true", strings.NewReader(string(contents))).WithContext(ctx)
+
+			return testCase{
+				name:       "Appending to a non existing file",
+				env:        defaultEnv,
+				args:       args{request},
+				wantCode:   http.StatusNotFound,
+				wantBody:   notFoundResponse,
+				wantHeader: http.Header{"Content-Type": []string{"application/json"}},
+			}
+		}(),
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			recorder := httptest.NewRecorder()
 
-			NewStoreFileHandler(tt.env.store).ServeHTTP(recorder, tt.args.request)
+			NewStoreFileHandler(tt.env.store, testLogger).ServeHTTP(recorder, tt.args.request)
 
 			if !reflect.DeepEqual(recorder.Code, tt.wantCode) {
 				t.Errorf("Code: want %#v, got %#v", tt.wantCode, recorder.Code)
@@ -131,6 +177,45 @@ func TestHandler_StoreFileHandler(t *testing.T) {
 			if !reflect.DeepEqual(recorder.Header(), tt.wantHeader) {
 				t.Errorf("Header: want %#v, got %#v", tt.wantHeader, recorder.Header())
 			}
+
+			if tt.wantContents != nil {
+				filename := httprouter.GetParam(tt.args.request, "filename")
+				contents, err := tt.env.store.Retrieve(filename)
+				if err != nil || !reflect.DeepEqual(contents, tt.wantContents) {
+					t.Errorf("Contents: want %#v, got %#v (%v)", string(tt.wantContents), string(contents), err)
+				}
+			}
 		})
 	}
 }
+
+// Filenames are routed with their "/", so every namespace gets its own quota
+func TestHandler_StoreFileHandler_Namespaces(t *testing.T) {
+	store := filestore.NewMemcacheWithClient(memcachemock.NewMemcacheClient(100), filestore.MemcacheConfig{
+		Quota: &filestore.QuotaConfig{MaxFiles: 1},
+	})
+
+	router := httprouter.New()
+	router.POST("/file/*filename", NewStoreFileHandler(store, testLogger))
+
+	for _, tt := range []struct {
+		path     string
+		wantCode int
+	}{
+		{"/file/first/a.dat", http.StatusOK},
+		{"/file/first/b.dat", http.StatusInsufficientStorage},
+		{"/file/second%2Fa.dat", http.StatusOK},
+		{"/file/a.dat", http.StatusOK},
+	} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader("some content")))
+
+		if recorder.Code != tt.wantCode {
+			t.Errorf("%s: want %d, got %d (%s)", tt.path, tt.wantCode, recorder.Code, recorder.Body.String())
+		}
+	}
+
+	if _, err := store.Retrieve("second/a.dat"); err != nil {
+		t.Errorf("Retrieve: want nil, got %#v", err)
+	}
+}
@@ -0,0 +1,87 @@
+package handler
+
+import (
+	"errors"
+	"filestore"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	errContentRangeMissing = errors.New("Content-Range header is required")
+	errContentRangeInvalid = errors.New("Content-Range header must be in format: bytes start-end/total")
+)
+
+func NewUpdateFileHandler(store filestore.Store, logger log.FieldLogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := requestLogger(logger, r)
+		logger.Debug("Processing request")
+
+		filename := filenameParam(r)
+
+		start, end, err := parseContentRange(r.Header.Get("Content-Range"))
+		if err != nil {
+			respondWithError(w, r, logger, http.StatusBadRequest, err)
+			return
+		}
+
+		contents, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			logger.WithError(err).Error("Error while reading request body")
+			respondWithStatusCode(w, r, logger, http.StatusBadRequest)
+			return
+		}
+
+		if len(contents) != end-start+1 {
+			err := fmt.Errorf("Content-Range covers %d bytes, got %d bytes", end-start+1, len(contents))
+			respondWithError(w, r, logger, http.StatusBadRequest, err)
+			return
+		}
+
+		err = filestore.WriteAt(store, filename, start, contents)
+		if err != nil {
+			respondWithStoreError(w, r, logger, err)
+			return
+		}
+
+		respondWithStatusCode(w, r, logger, http.StatusOK)
+	}
+}
+
+// parseContentRange parses "bytes start-end/total" where total may be "*", total is not used
+func parseContentRange(header string) (int, int, error) {
+	if header == "" {
+		return 0, 0, errContentRangeMissing
+	}
+
+	if !strings.HasPrefix(header, "bytes ") {
+		return 0, 0, errContentRangeInvalid
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(header, "bytes "), "/", 2)
+	if len(parts) != 2 {
+		return 0, 0, errContentRangeInvalid
+	}
+
+	bounds := strings.SplitN(parts[0], "-", 2)
+	if len(bounds) != 2 {
+		return 0, 0, errContentRangeInvalid
+	}
+
+	start, err := strconv.Atoi(bounds[0])
+	if err != nil || start < 0 {
+		return 0, 0, errContentRangeInvalid
+	}
+
+	end, err := strconv.Atoi(bounds[1])
+	if err != nil || end < start {
+		return 0, 0, errContentRangeInvalid
+	}
+
+	return start, end, nil
+}
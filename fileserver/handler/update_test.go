@@ -0,0 +1,152 @@
+package handler
+
+import (
+	"context"
+	"fileserver/mock"
+	"filestore"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bouk/httprouter"
+)
+
+func TestHandler_UpdateFileHandler(t *testing.T) {
+	type testEnv struct {
+		store filestore.Store
+	}
+
+	type args struct {
+		request *http.Request
+	}
+
+	type testCase struct {
+		name       string
+		env        testEnv
+		args       args
+		wantCode   int
+		wantBody   []byte
+		wantHeader http.Header
+	}
+
+	store := mock.NewFilestore(50)
+	err := store.Store("existing-file.dat", []byte("some content"))
+	if err != nil {
+		panic(err)
+	}
+
+	defaultEnv := testEnv{
+		store: store,
+	}
+
+	newRequest := func(filename string, contentRange string, contents string) *http.Request {
+		ctx := httprouter.WithParams(context.Background(), httprouter.Params{httprouter.Param{
+			Key:   "filename",
+			Value: filename,
+		}})
+
+		request := httptest.NewRequest(http.MethodPatch, "/file/"+filename, strings.NewReader(contents)).WithContext(ctx)
+		if contentRange != "" {
+			request.Header.Set("Content-Range", contentRange)
+		}
+
+		return request
+	}
+
+	tests := []testCase{
+		{
+			name:     "Updating without Content-Range",
+			env:      defaultEnv,
+			args:     args{newRequest("existing-file.dat", "", "X")},
+			wantCode: http.StatusBadRequest,
+			wantBody: []byte(`{
+  "error": "Content-Range header is required"
+}`),
+			wantHeader: http.Header{"Content-Type": []string{"application/json"}},
+		},
+		{
+			name:     "Updating with body not matching Content-Range",
+			env:      defaultEnv,
+			args:     args{newRequest("existing-file.dat", "bytes 0-3/*", "X")},
+			wantCode: http.StatusBadRequest,
+			wantBody: []byte(`{
+  "error": "Content-Range covers 4 bytes, got 1 bytes"
+}`),
+			wantHeader: http.Header{"Content-Type": []string{"application/json"}},
+		},
+		{
+			name:       "Updating a non existing file",
+			env:        defaultEnv,
+			args:       args{newRequest("non-existing-file.dat", "bytes 0-0/*", "X")},
+			wantCode:   http.StatusNotFound,
+			wantBody:   notFoundResponse,
+			wantHeader: http.Header{"Content-Type": []string{"application/json"}},
+		},
+		{
+			name:     "Updating a range past the end of the file",
+			env:      defaultEnv,
+			args:     args{newRequest("existing-file.dat", "bytes 20-20/*", "X")},
+			wantCode: http.StatusRequestedRangeNotSatisfiable,
+			wantBody: []byte(`{
+  "error": "Invalid range: offset 20 is past the end of the file (12 bytes)"
+}`),
+			wantHeader: http.Header{"Content-Type": []string{"application/json"}},
+		},
+		{
+			name:     "Updating a locked file",
+			env:      testEnv{store: failingStore{err: filestore.ErrFileLocked}},
+			args:     args{newRequest("existing-file.dat", "bytes 0-0/*", "X")},
+			wantCode: http.StatusLocked,
+			wantBody: []byte(`{
+  "error": "File is locked by another writer, try again"
+}`),
+			wantHeader: http.Header{"Content-Type": []string{"application/json"}},
+		},
+		{
+			name:     "Updating a file over the quota",
+			env:      testEnv{store: failingStore{err: fmt.Errorf("%w: namespace \"\" is limited to 10 bytes", filestore.ErrQuotaExceeded)}},
+			args:     args{newRequest("existing-file.dat", "bytes 0-0/*", "X")},
+			wantCode: http.StatusInsufficientStorage,
+			wantBody: []byte(`{
+  "error": "Storage quota exceeded: namespace \"\" is limited to 10 bytes"
+}`),
+			wantHeader: http.Header{"Content-Type": []string{"application/json"}},
+		},
+		{
+			name:       "Updating a range of an existing file",
+			env:        defaultEnv,
+			args:       args{newRequest("existing-file.dat", "bytes 5-11/12", "CONTENT")},
+			wantCode:   http.StatusOK,
+			wantBody:   nil,
+			wantHeader: http.Header{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+
+			NewUpdateFileHandler(tt.env.store, testLogger).ServeHTTP(recorder, tt.args.request)
+
+			if !reflect.DeepEqual(recorder.Code, tt.wantCode) {
+				t.Errorf("Code: want %#v, got %#v", tt.wantCode, recorder.Code)
+			}
+
+			if !reflect.DeepEqual(recorder.Body.Bytes(), tt.wantBody) {
+				t.Errorf("Body: want %#v, got %#v", string(tt.wantBody), recorder.Body.String())
+			}
+
+			if !reflect.DeepEqual(recorder.Header(), tt.wantHeader) {
+				t.Errorf("Header: want %#v, got %#v", tt.wantHeader, recorder.Header())
+			}
+		})
+	}
+
+	contents, _ := store.Retrieve("existing-file.dat")
+	if string(contents) != "some CONTENT" {
+		t.Errorf("Contents: want %#v, got %#v", "some CONTENT", string(contents))
+	}
+}
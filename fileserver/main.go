@@ -4,12 +4,14 @@ import (
 	"filestore"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/bouk/httprouter"
 	log "github.com/sirupsen/logrus"
 
 	"fileserver/handler"
+	"fileserver/metrics"
 )
 
 func main() {
@@ -22,34 +24,132 @@ func main() {
 		log.Fatalln("Server not provided")
 	}
 
+	logger := log.StandardLogger()
+
 	// Allow to specify log level via ENV var
 	if ll := os.Getenv("LOG_LEVEL"); ll != "" {
 		logLevel, err := log.ParseLevel(ll)
 		if err != nil {
-			log.WithError(err).Fatal("Unable to parse log level")
+			logger.WithError(err).Fatal("Unable to parse log level")
 		}
-		log.SetLevel(logLevel)
+		logger.SetLevel(logLevel)
+	}
+
+	// Keep previous versions of files so bad uploads can be rolled back, storing an existing file
+	// creates a new version instead of failing
+	versions := intEnv(logger, "FILE_VERSIONS")
+
+	// Limit how much every namespace (first part of the filename up to "/") can store
+	var quota *filestore.QuotaConfig
+	maxBytes, maxFiles := intEnv(logger, "QUOTA_MAX_BYTES"), intEnv(logger, "QUOTA_MAX_FILES")
+	if maxBytes > 0 || maxFiles > 0 {
+		quota = &filestore.QuotaConfig{MaxBytes: maxBytes, MaxFiles: maxFiles}
 	}
 
+	// FILENAME_POLICY=strict rejects filenames like "../file.dat" or ones with control characters and normalizes
+	// Unicode, any filename is accepted as is by default
+	var filenamePolicy *filestore.FilenamePolicy
+	switch policy := os.Getenv("FILENAME_POLICY"); policy {
+	case "":
+	case "strict":
+		filenamePolicy = &filestore.FilenamePolicy{}
+	default:
+		logger.WithField("policy", policy).Fatal("Unknown filename policy")
+	}
+
+	// Collect store metrics to be exposed via /metrics endpoint
+	collector := metrics.NewPrometheus()
+
 	// Create filestore client
-	store := filestore.NewMemcache(server, filestore.MemcacheConfig{
+	store, err := filestore.OpenMemcache(server, filestore.MemcacheConfig{
+		// MEMCACHE_PROTOCOL=meta talks to memcached 1.6+ with the meta protocol
+		Protocol: filestore.MemcacheProtocol(os.Getenv("MEMCACHE_PROTOCOL")),
+
 		// Things are not super fast when reading 50MB file, give it plenty of time
 		Timeout: 5 * time.Second,
 
-		// For some reason Memcache didnt like 1048576 byte values in my setup, the max value it would take is 1048470...
-		// Memcache logs show that it gets exactly specified number of bytes, no envelop seem to be added by
-		// third party Memcache client lib.
-		ChunkSize: 1048470,
+		// Derived from item size limit of the server unless CHUNK_SIZE is set
+		ChunkSize: intEnv(logger, "CHUNK_SIZE"),
+
+		// Fail fast while Memcache is down instead of waiting for the timeout on every request
+		CircuitBreaker: &filestore.CircuitBreakerConfig{
+			FailureThreshold: 5,
+			OpenTimeout:      10 * time.Second,
+		},
+
+		// TRACK_FILES=true keeps a record of stored files so they can be listed, exported and checked with
+		// filestore-admin. Every Store and Delete updates the record, so it's off by default
+		TrackFiles: os.Getenv("TRACK_FILES") == "true",
+
+		// Concurrent uploads of the same file wait for each other
+		Lock: &filestore.LockConfig{LeaseDuration: 30 * time.Second, WaitTimeout: 5 * time.Second},
+
+		Versions: versions,
+
+		Quota: quota,
+
+		// Serve hot files from memory, only checking their metadata in Memcache
+		Cache: &filestore.CacheConfig{MaxBytes: intEnv(logger, "CACHE_MAX_BYTES")},
+
+		FilenamePolicy: filenamePolicy,
+
+		// Purge corrupted files as soon as they are found so clients can upload them again
+		RepairCorrupted: true,
+		OnCorrupted: func(event filestore.CorruptionEvent) {
+			logger.WithField("filename", event.Filename).
+				WithField("repaired", event.Repaired).
+				Warning("Found corrupted file")
+		},
+
+		Metrics: collector,
+		Logger:  logger,
 	})
+	if err != nil {
+		logger.WithError(err).Fatal("Unable to create store")
+	}
 
 	// Configure routes
 	router := httprouter.New()
-	router.POST("/file/:filename", handler.NewStoreFileHandler(store))
-	router.GET("/file/:filename", handler.NewRetrieveFileHandler(store))
-	router.DELETE("/file/:filename", handler.NewDeleteFileHandler(store))
+	router.POST("/file/*filename", handler.NewStoreFileHandler(store, logger))
+	router.GET("/file/*filename", handler.NewRetrieveFileHandler(store, logger))
+	router.HEAD("/file/*filename", handler.NewStatFileHandler(store, logger))
+	router.PATCH("/file/*filename", handler.NewUpdateFileHandler(store, logger))
+	router.DELETE("/file/*filename", handler.NewDeleteFileHandler(store, logger))
+	router.Handle("MOVE", "/file/*filename", handler.NewMoveFileHandler(store, logger))
+	router.Handle("COPY", "/file/*filename", handler.NewMoveFileHandler(store, logger))
+	router.Handler(http.MethodGet, "/metrics", collector)
+
+	// Admin endpoints can read and overwrite every file and are not authenticated, they are only served
+	// on ADMIN_ADDR (e.g. 127.0.0.1:8081) which should not be reachable by clients
+	if adminAddr := os.Getenv("ADMIN_ADDR"); adminAddr != "" {
+		adminRouter := httprouter.New()
+		adminRouter.GET("/admin/files", handler.NewListHandler(store, logger))
+		adminRouter.GET("/admin/export", handler.NewExportHandler(store, logger))
+		adminRouter.POST("/admin/import", handler.NewImportHandler(store, logger))
+
+		go func() {
+			logger.WithField("addr", adminAddr).Info("Starting admin server")
+			logger.Fatal(http.ListenAndServe(adminAddr, adminRouter))
+		}()
+	}
 
 	// Start server
 	addr := ":8080"
-	log.WithField("addr", addr).Info("Starting server")
-	log.Fatal(http.ListenAndServe(addr, router))
+	logger.WithField("addr", addr).Info("Starting server")
+	logger.Fatal(http.ListenAndServe(addr, router))
+}
+
+// intEnv returns the ENV var as a number, zero if it's not set
+func intEnv(logger log.FieldLogger, name string) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return 0
+	}
+
+	value, err := strconv.Atoi(v)
+	if err != nil {
+		logger.WithError(err).WithField("name", name).Fatal("Unable to parse ENV var")
+	}
+
+	return value
 }
@@ -0,0 +1,208 @@
+package metrics
+
+import (
+	"bytes"
+	"filestore"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Latency buckets in seconds
+var defaultBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	counts []uint64 // one per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(buckets []float64, value float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(buckets))
+	}
+
+	for i, b := range buckets {
+		if value <= b {
+			h.counts[i]++
+			break
+		}
+	}
+
+	h.sum += value
+	h.count++
+}
+
+type opKey struct {
+	op     string
+	result string
+}
+
+// Prometheus collects filestore metrics and serves them in Prometheus text exposition format
+type Prometheus struct {
+	mu             sync.Mutex
+	buckets        []float64
+	operations     map[opKey]uint64
+	operationTimes map[string]*histogram
+	chunks         map[opKey]uint64
+	chunkTimes     map[string]*histogram
+	bytesIn        uint64
+	bytesOut       uint64
+	purgeFailures  uint64
+}
+
+func NewPrometheus() *Prometheus {
+	return &Prometheus{
+		buckets:        defaultBuckets,
+		operations:     map[opKey]uint64{},
+		operationTimes: map[string]*histogram{},
+		chunks:         map[opKey]uint64{},
+		chunkTimes:     map[string]*histogram{},
+	}
+}
+
+func (p *Prometheus) ObserveOperation(op string, duration time.Duration, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.operations[opKey{op, resultLabel(err)}]++
+	p.histogramFor(p.operationTimes, op).observe(p.buckets, duration.Seconds())
+}
+
+func (p *Prometheus) ObserveChunk(op string, duration time.Duration, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.chunks[opKey{op, resultLabel(err)}]++
+	p.histogramFor(p.chunkTimes, op).observe(p.buckets, duration.Seconds())
+}
+
+func (p *Prometheus) AddBytesIn(n int) {
+	p.mu.Lock()
+	p.bytesIn += uint64(n)
+	p.mu.Unlock()
+}
+
+func (p *Prometheus) AddBytesOut(n int) {
+	p.mu.Lock()
+	p.bytesOut += uint64(n)
+	p.mu.Unlock()
+}
+
+func (p *Prometheus) IncPurgeFailures() {
+	p.mu.Lock()
+	p.purgeFailures++
+	p.mu.Unlock()
+}
+
+func (p *Prometheus) histogramFor(histograms map[string]*histogram, op string) *histogram {
+	h, ok := histograms[op]
+	if !ok {
+		h = &histogram{}
+		histograms[op] = h
+	}
+
+	return h
+}
+
+// ServeHTTP renders all collected metrics
+func (p *Prometheus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body := p.render()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(http.StatusOK)
+
+	_, err := w.Write(body)
+	if err != nil {
+		log.WithError(err).Error("Error while sending response")
+	}
+}
+
+func (p *Prometheus) render() []byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	buf := &bytes.Buffer{}
+
+	writeHeader(buf, "filestore_operations_total", "counter", "Number of file operations by result.")
+	for _, k := range sortedOpKeys(p.operations) {
+		fmt.Fprintf(buf, "filestore_operations_total{operation=%q,result=%q} %d\n", k.op, k.result, p.operations[k])
+	}
+
+	writeHeader(buf, "filestore_operation_duration_seconds", "histogram", "File operation latency.")
+	p.writeHistograms(buf, "filestore_operation_duration_seconds", "operation", p.operationTimes)
+
+	writeHeader(buf, "filestore_chunk_requests_total", "counter", "Number of backend requests by result.")
+	for _, k := range sortedOpKeys(p.chunks) {
+		fmt.Fprintf(buf, "filestore_chunk_requests_total{request=%q,result=%q} %d\n", k.op, k.result, p.chunks[k])
+	}
+
+	writeHeader(buf, "filestore_chunk_request_duration_seconds", "histogram", "Backend request latency.")
+	p.writeHistograms(buf, "filestore_chunk_request_duration_seconds", "request", p.chunkTimes)
+
+	writeHeader(buf, "filestore_bytes_in_total", "counter", "Bytes accepted for storing.")
+	fmt.Fprintf(buf, "filestore_bytes_in_total %d\n", p.bytesIn)
+
+	writeHeader(buf, "filestore_bytes_out_total", "counter", "Bytes returned to clients.")
+	fmt.Fprintf(buf, "filestore_bytes_out_total %d\n", p.bytesOut)
+
+	writeHeader(buf, "filestore_purge_failures_total", "counter", "Failed attempts to clean up file chunks.")
+	fmt.Fprintf(buf, "filestore_purge_failures_total %d\n", p.purgeFailures)
+
+	return buf.Bytes()
+}
+
+func (p *Prometheus) writeHistograms(buf *bytes.Buffer, name string, label string, histograms map[string]*histogram) {
+	ops := make([]string, 0, len(histograms))
+	for op := range histograms {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+
+	for _, op := range ops {
+		h := histograms[op]
+
+		var cumulative uint64
+		for i, b := range p.buckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(buf, "%s_bucket{%s=%q,le=%q} %d\n", name, label, op, strconv.FormatFloat(b, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(buf, "%s_bucket{%s=%q,le=\"+Inf\"} %d\n", name, label, op, h.count)
+		fmt.Fprintf(buf, "%s_sum{%s=%q} %s\n", name, label, op, strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(buf, "%s_count{%s=%q} %d\n", name, label, op, h.count)
+	}
+}
+
+func writeHeader(buf *bytes.Buffer, name string, kind string, help string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(buf, "# TYPE %s %s\n", name, kind)
+}
+
+func resultLabel(err error) string {
+	if err == nil {
+		return "ok"
+	}
+
+	return filestore.ErrorLabel(err)
+}
+
+func sortedOpKeys(m map[opKey]uint64) []opKey {
+	keys := make([]opKey, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].op != keys[j].op {
+			return keys[i].op < keys[j].op
+		}
+		return keys[i].result < keys[j].result
+	})
+
+	return keys
+}
@@ -0,0 +1,51 @@
+package metrics
+
+import (
+	"filestore"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrometheus_ServeHTTP(t *testing.T) {
+	p := NewPrometheus()
+
+	p.ObserveOperation(filestore.OpStore, 3*time.Millisecond, nil)
+	p.ObserveOperation(filestore.OpRetrieve, 20*time.Millisecond, fmt.Errorf("Unable to retrieve file: %w", filestore.ErrFileCorrupted))
+	p.ObserveOperation(filestore.OpRetrieve, 2*time.Second, filestore.ErrFileNotFound)
+	p.ObserveChunk(filestore.ChunkOpSet, time.Millisecond, nil)
+	p.AddBytesIn(12)
+	p.AddBytesOut(7)
+	p.IncPurgeFailures()
+
+	recorder := httptest.NewRecorder()
+	p.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Code: want %#v, got %#v", http.StatusOK, recorder.Code)
+	}
+
+	body := recorder.Body.String()
+
+	wantLines := []string{
+		`filestore_operations_total{operation="retrieve",result="file_corrupted"} 1`,
+		`filestore_operations_total{operation="retrieve",result="file_not_found"} 1`,
+		`filestore_operations_total{operation="store",result="ok"} 1`,
+		`filestore_operation_duration_seconds_bucket{operation="retrieve",le="0.025"} 1`,
+		`filestore_operation_duration_seconds_bucket{operation="retrieve",le="+Inf"} 2`,
+		`filestore_operation_duration_seconds_count{operation="retrieve"} 2`,
+		`filestore_chunk_requests_total{request="set",result="ok"} 1`,
+		`filestore_bytes_in_total 12`,
+		`filestore_bytes_out_total 7`,
+		`filestore_purge_failures_total 1`,
+	}
+
+	for _, line := range wantLines {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Body: want line %q, got %s", line, body)
+		}
+	}
+}
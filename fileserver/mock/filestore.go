@@ -1,25 +1,37 @@
 package mock
 
 import (
+	"crypto/md5"
 	"filestore"
 	"fmt"
+	"sort"
+	"sync"
 
 	log "github.com/sirupsen/logrus"
 )
 
 type mockStore struct {
 	maxFileSize int
+	mu          *sync.Mutex
 	files       map[string][]byte
 }
 
 func NewFilestore(maxFileSize int) filestore.Store {
 	return mockStore{
 		maxFileSize: maxFileSize,
+		mu:          &sync.Mutex{},
 		files:       map[string][]byte{},
 	}
 }
 
 func (s mockStore) Store(filename string, contents []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.store(filename, contents)
+}
+
+func (s mockStore) store(filename string, contents []byte) error {
 	size := len(contents)
 
 	log.WithField("filename", filename).WithField("size", size).Debug("Storing file")
@@ -32,7 +44,8 @@ func (s mockStore) Store(filename string, contents []byte) error {
 		return filestore.ErrFileAlreadyExists
 	}
 
-	s.files[filename] = contents
+	// Callers may reuse the slice, same as with a real store
+	s.files[filename] = append([]byte{}, contents...)
 
 	log.WithField("filename", filename).WithField("size", len(contents)).Info("Stored file")
 
@@ -40,17 +53,23 @@ func (s mockStore) Store(filename string, contents []byte) error {
 }
 
 func (s mockStore) Retrieve(filename string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	log.WithField("filename", filename).Debug("Retrieving file")
 
 	if contents, ok := s.files[filename]; ok {
 		log.WithField("filename", filename).WithField("size", len(contents)).Info("Retrieved file")
-		return contents, nil
+		return append([]byte{}, contents...), nil
 	}
 
 	return []byte{}, filestore.ErrFileNotFound
 }
 
 func (s mockStore) Delete(filename string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	log.WithField("filename", filename).Debug("Deleting file")
 
 	if _, ok := s.files[filename]; ok {
@@ -61,3 +80,148 @@ func (s mockStore) Delete(filename string) error {
 
 	return filestore.ErrFileNotFound
 }
+
+func (s mockStore) Rename(from string, to string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	log.WithField("from", from).WithField("to", to).Debug("Renaming file")
+
+	contents, ok := s.files[from]
+	if !ok {
+		return filestore.ErrFileNotFound
+	}
+
+	if _, ok := s.files[to]; ok {
+		return filestore.ErrFileAlreadyExists
+	}
+
+	s.files[to] = contents
+	delete(s.files, from)
+
+	log.WithField("from", from).WithField("to", to).Info("Renamed file")
+
+	return nil
+}
+
+func (s mockStore) Copy(from string, to string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	log.WithField("from", from).WithField("to", to).Debug("Copying file")
+
+	contents, ok := s.files[from]
+	if !ok {
+		return filestore.ErrFileNotFound
+	}
+
+	return s.store(to, contents)
+}
+
+func (s mockStore) Append(filename string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	log.WithField("filename", filename).WithField("size", len(data)).Debug("Appending to file")
+
+	contents, ok := s.files[filename]
+	if !ok {
+		return filestore.ErrFileNotFound
+	}
+
+	if len(contents)+len(data) > s.maxFileSize {
+		return fmt.Errorf("%w: max file size is %d bytes", filestore.ErrFileTooLarge, s.maxFileSize)
+	}
+
+	appended := make([]byte, 0, len(contents)+len(data))
+	appended = append(appended, contents...)
+	s.files[filename] = append(appended, data...)
+
+	log.WithField("filename", filename).WithField("size", len(s.files[filename])).Info("Appended to file")
+
+	return nil
+}
+
+func (s mockStore) WriteAt(filename string, offset int, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	log.WithField("filename", filename).WithField("offset", offset).WithField("size", len(data)).Debug("Writing to file")
+
+	contents, ok := s.files[filename]
+	if !ok {
+		return filestore.ErrFileNotFound
+	}
+
+	if offset < 0 || offset > len(contents) {
+		return fmt.Errorf("%w: offset %d is past the end of the file (%d bytes)", filestore.ErrInvalidRange, offset, len(contents))
+	}
+
+	size := len(contents)
+	if offset+len(data) > size {
+		size = offset + len(data)
+	}
+
+	if size > s.maxFileSize {
+		return fmt.Errorf("%w: max file size is %d bytes", filestore.ErrFileTooLarge, s.maxFileSize)
+	}
+
+	updated := make([]byte, size)
+	copy(updated, contents)
+	copy(updated[offset:], data)
+	s.files[filename] = updated
+
+	log.WithField("filename", filename).WithField("size", size).Info("Updated file")
+
+	return nil
+}
+
+// RetrieveVersion only knows about the current version, the mock doesn't keep previous ones
+func (s mockStore) RetrieveVersion(filename string, version int) ([]byte, error) {
+	contents, err := s.Retrieve(filename)
+	if err != nil {
+		return contents, err
+	}
+
+	if version != 1 {
+		return []byte{}, filestore.ErrVersionNotFound
+	}
+
+	return contents, nil
+}
+
+func (s mockStore) Versions(filename string) ([]int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.files[filename]; !ok {
+		return nil, filestore.ErrFileNotFound
+	}
+
+	return []int{1}, nil
+}
+
+func (s mockStore) List() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	filenames := make([]string, 0, len(s.files))
+	for filename := range s.files {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+
+	return filenames, nil
+}
+
+func (s mockStore) Stat(filename string) (filestore.FileInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	contents, ok := s.files[filename]
+	if !ok {
+		return filestore.FileInfo{}, filestore.ErrFileNotFound
+	}
+
+	return filestore.FileInfo{Size: len(contents), Version: 1, Checksum: fmt.Sprintf("%x", md5.Sum(contents))}, nil
+}
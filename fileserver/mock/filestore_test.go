@@ -0,0 +1,16 @@
+package mock
+
+import (
+	"filestore"
+	"filestore/filestoretest"
+	"testing"
+)
+
+func TestFilestore_Conformance(t *testing.T) {
+	filestoretest.RunConformance(t, filestoretest.ConformanceConfig{
+		NewStore: func(t *testing.T) filestore.Store {
+			return NewFilestore(100)
+		},
+		MaxFileSize: 100,
+	})
+}
@@ -0,0 +1,224 @@
+package filestore
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"time"
+)
+
+// versionRecord is the PAX record carrying the version of a file in archives created by Export
+const versionRecord = "FILESTORE.version"
+
+type ArchiveReport struct {
+	// Number of files written to or read from the archive
+	Files int
+
+	// Files which weren't exported because they are missing or corrupted,
+	// or weren't imported because they exist already
+	Skipped []string
+}
+
+// archiveStore is implemented by the memcache store. Other stores only get the current version of
+// every file imported, and files up to the default max file size.
+type archiveStore interface {
+	keepsVersions() bool
+	maxSize() int
+}
+
+// Export writes every stored file into a tar archive named after the file. Versions kept by the store are
+// written oldest first as entries with the same name, each with its version number in a PAX record,
+// so extracting the archive with tar leaves the current versions. The store has to be able to list
+// files, see Lister.
+func Export(store Store, w io.Writer) (ArchiveReport, error) {
+	report := ArchiveReport{}
+
+	filenames, err := List(store)
+	if err != nil {
+		return report, err
+	}
+
+	tw := tar.NewWriter(w)
+	modTime := time.Now()
+
+	for _, filename := range filenames {
+		// Checked first, so no versions are written for a file which is skipped
+		contents, err := store.Retrieve(filename)
+		if errors.Is(err, ErrFileNotFound) || errors.Is(err, ErrFileCorrupted) {
+			// Evicted since it was listed, nothing to export
+			report.Skipped = append(report.Skipped, filename)
+			continue
+		} else if err != nil {
+			return report, fmt.Errorf("Unable to export file %s: %w", filename, err)
+		}
+
+		// Stores which don't keep versions only have the current one
+		versions, err := Versions(store, filename)
+		if err != nil {
+			versions = nil
+		}
+
+		// Versions pruned or evicted in the meantime are left out
+		for i := len(versions) - 1; i > 0; i-- {
+			previous, err := RetrieveVersion(store, filename, versions[i])
+			if errors.Is(err, ErrVersionNotFound) {
+				continue
+			} else if err != nil {
+				return report, fmt.Errorf("Unable to export file %s: %w", filename, err)
+			}
+
+			err = writeArchiveEntry(tw, filename, versions[i], previous, modTime)
+			if err != nil {
+				return report, fmt.Errorf("Unable to export file %s: %w", filename, err)
+			}
+		}
+
+		version := 0
+		if len(versions) > 0 {
+			version = versions[0]
+		}
+
+		err = writeArchiveEntry(tw, filename, version, contents, modTime)
+		if err != nil {
+			return report, fmt.Errorf("Unable to export file %s: %w", filename, err)
+		}
+
+		report.Files++
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return report, fmt.Errorf("Unable to export files: %w", err)
+	}
+
+	return report, nil
+}
+
+// writeArchiveEntry records the version unless it's unknown
+func writeArchiveEntry(tw *tar.Writer, filename string, version int, contents []byte, modTime time.Time) error {
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     filename,
+		Size:     int64(len(contents)),
+		Mode:     0644,
+		ModTime:  modTime,
+	}
+
+	if version > 0 {
+		header.PAXRecords = map[string]string{versionRecord: strconv.Itoa(version)}
+	}
+
+	err := tw.WriteHeader(header)
+	if err != nil {
+		return err
+	}
+
+	_, err = tw.Write(contents)
+
+	return err
+}
+
+// Import stores every file from a tar archive created by Export. Files which exist already are left alone,
+// unless the store keeps versions in which case the versions from the archive are added as new versions.
+// Version numbers start over from the next version of the file, older versions which were pruned before
+// the export are not counted.
+func Import(store Store, r io.Reader) (ArchiveReport, error) {
+	report := ArchiveReport{}
+
+	keepsVersions := false
+	maxSize := defaultMaxFileSize
+	if s, ok := store.(archiveStore); ok {
+		keepsVersions = s.keepsVersions()
+		maxSize = s.maxSize()
+	}
+
+	// Versions of a file follow each other and are stored as they are read, a store which doesn't keep
+	// versions only gets the last one. At most one entry is held in memory.
+	filename := ""
+	skipped := false
+	var last []byte
+	storeEntry := func(contents []byte) error {
+		err := store.Store(filename, contents)
+		if errors.Is(err, ErrFileAlreadyExists) {
+			report.Skipped = append(report.Skipped, filename)
+			skipped = true
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("Unable to import file %s: %w", filename, err)
+		}
+
+		return nil
+	}
+	finishFile := func() error {
+		if filename == "" {
+			return nil
+		}
+
+		if !keepsVersions {
+			err := storeEntry(last)
+			if err != nil {
+				return err
+			}
+		}
+
+		if !skipped {
+			report.Files++
+		}
+
+		return nil
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return report, finishFile()
+		} else if err != nil {
+			return report, fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+		}
+
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		// Checked before anything is read, the header could claim any size
+		if header.Size > int64(maxSize) {
+			return report, fmt.Errorf("Unable to import file %s: %w: max file size is %d bytes", header.Name, ErrFileTooLarge, maxSize)
+		}
+
+		contents, err := ioutil.ReadAll(io.LimitReader(tr, header.Size))
+		if err != nil {
+			return report, fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+		}
+
+		if header.Name != filename {
+			err = finishFile()
+			if err != nil {
+				return report, err
+			}
+
+			filename = header.Name
+			skipped = false
+		}
+
+		if !keepsVersions {
+			last = contents
+		} else if !skipped {
+			err = storeEntry(contents)
+			if err != nil {
+				return report, err
+			}
+		}
+	}
+}
+
+func (s memcacheStore) keepsVersions() bool {
+	return s.keepVersions > 0
+}
+
+func (s memcacheStore) maxSize() int {
+	return s.maxFileSize
+}
@@ -0,0 +1,172 @@
+package filestore
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"filestore/mock"
+	"reflect"
+	"testing"
+)
+
+func TestExportImport(t *testing.T) {
+	c := mock.NewMemcacheClient(100)
+	source := NewMemcacheWithClient(c, MemcacheConfig{ChunkSize: 5, TrackFiles: true})
+
+	files := map[string]string{
+		"a.dat":       "some content",
+		"dir/b.dat":   "other content",
+		"empty.dat":   "",
+		"evicted.dat": "gone",
+	}
+	for filename, contents := range files {
+		err := source.Store(filename, []byte(contents))
+		if err != nil {
+			panic(err)
+		}
+	}
+	_ = c.Delete(keyPrefix + MD5Key("evicted.dat"))
+
+	archive := &bytes.Buffer{}
+	report, err := Export(source, archive)
+	if err != nil {
+		t.Fatalf("Export: want nil, got %#v", err)
+	}
+
+	wantReport := ArchiveReport{Files: 3, Skipped: []string{"evicted.dat"}}
+	if !reflect.DeepEqual(report, wantReport) {
+		t.Errorf("Export report: want %#v, got %#v", wantReport, report)
+	}
+
+	destination := NewMemcacheWithClient(mock.NewMemcacheClient(100), MemcacheConfig{ChunkSize: 5, TrackFiles: true})
+	_ = destination.Store("a.dat", []byte("newer content"))
+
+	report, err = Import(destination, bytes.NewReader(archive.Bytes()))
+	if err != nil {
+		t.Fatalf("Import: want nil, got %#v", err)
+	}
+
+	wantReport = ArchiveReport{Files: 2, Skipped: []string{"a.dat"}}
+	if !reflect.DeepEqual(report, wantReport) {
+		t.Errorf("Import report: want %#v, got %#v", wantReport, report)
+	}
+
+	for filename, want := range map[string]string{"a.dat": "newer content", "dir/b.dat": "other content", "empty.dat": ""} {
+		contents, err := destination.Retrieve(filename)
+		if err != nil || string(contents) != want {
+			t.Errorf("File %s: want %#v, got %#v (%v)", filename, want, string(contents), err)
+		}
+	}
+
+	filenames, err := List(destination)
+	if err != nil || !reflect.DeepEqual(filenames, []string{"a.dat", "dir/b.dat", "empty.dat"}) {
+		t.Errorf("List: want 3 files, got %#v (%v)", filenames, err)
+	}
+}
+
+func TestExport_TrackingDisabled(t *testing.T) {
+	s := NewMemcacheWithClient(mock.NewMemcacheClient(100), MemcacheConfig{})
+
+	_, err := Export(s, &bytes.Buffer{})
+	if !errors.Is(err, ErrNotSupported) {
+		t.Errorf("Error: want %#v, got %#v", ErrNotSupported, err)
+	}
+}
+
+func TestExportImport_Versions(t *testing.T) {
+	source := NewMemcacheWithClient(mock.NewMemcacheClient(100), MemcacheConfig{ChunkSize: 5, TrackFiles: true, Versions: 2})
+	for _, contents := range []string{"first", "second", "third"} {
+		err := source.Store("file.dat", []byte(contents))
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	archive := &bytes.Buffer{}
+	_, err := Export(source, archive)
+	if err != nil {
+		t.Fatalf("Export: want nil, got %#v", err)
+	}
+
+	// Versions are recorded in the archive
+	tr := tar.NewReader(bytes.NewReader(archive.Bytes()))
+	recorded := []string{}
+	for header, err := tr.Next(); err == nil; header, err = tr.Next() {
+		recorded = append(recorded, header.PAXRecords[versionRecord])
+	}
+	if !reflect.DeepEqual(recorded, []string{"1", "2", "3"}) {
+		t.Errorf("Recorded versions: want %#v, got %#v", []string{"1", "2", "3"}, recorded)
+	}
+
+	// History is kept by a store which keeps versions
+	destination := NewMemcacheWithClient(mock.NewMemcacheClient(100), MemcacheConfig{ChunkSize: 5, Versions: 2})
+	report, err := Import(destination, bytes.NewReader(archive.Bytes()))
+	if err != nil || report.Files != 1 {
+		t.Fatalf("Import: want 1 file, got %#v (%v)", report, err)
+	}
+
+	for version, want := range map[int]string{1: "first", 2: "second", 3: "third"} {
+		contents, err := RetrieveVersion(destination, "file.dat", version)
+		if err != nil || string(contents) != want {
+			t.Errorf("Version %d: want %#v, got %#v (%v)", version, want, string(contents), err)
+		}
+	}
+
+	// Only the current version otherwise
+	destination = NewMemcacheWithClient(mock.NewMemcacheClient(100), MemcacheConfig{ChunkSize: 5})
+	report, err = Import(destination, bytes.NewReader(archive.Bytes()))
+	if err != nil || report.Files != 1 {
+		t.Fatalf("Import: want 1 file, got %#v (%v)", report, err)
+	}
+
+	contents, err := destination.Retrieve("file.dat")
+	if err != nil || string(contents) != "third" {
+		t.Errorf("Retrieve: want %#v, got %#v (%v)", "third", string(contents), err)
+	}
+}
+
+func TestExport_CorruptedCurrentVersion(t *testing.T) {
+	c := mock.NewMemcacheClient(100)
+	s := NewMemcacheWithClient(c, MemcacheConfig{ChunkSize: 5, TrackFiles: true, Versions: 2})
+	for _, contents := range []string{"first", "second", "third"} {
+		err := s.Store("file.dat", []byte(contents))
+		if err != nil {
+			panic(err)
+		}
+	}
+	_ = s.Store("other.dat", []byte("other"))
+
+	item, _ := c.Get(keyPrefix + MD5Key("file.dat"))
+	meta, _ := decodeMetadata(item.Value)
+	_ = c.Delete(meta.chunkKey(0))
+
+	archive := &bytes.Buffer{}
+	report, err := Export(s, archive)
+	wantReport := ArchiveReport{Files: 1, Skipped: []string{"file.dat"}}
+	if err != nil || !reflect.DeepEqual(report, wantReport) {
+		t.Fatalf("Export: want %#v, got %#v (%v)", wantReport, report, err)
+	}
+
+	// Previous versions of the skipped file are left out as well
+	tr := tar.NewReader(bytes.NewReader(archive.Bytes()))
+	names := []string{}
+	for header, err := tr.Next(); err == nil; header, err = tr.Next() {
+		names = append(names, header.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"other.dat"}) {
+		t.Errorf("Entries: want %#v, got %#v", []string{"other.dat"}, names)
+	}
+}
+
+func TestImport_TooLarge(t *testing.T) {
+	// Only the header, the contents are never read
+	archive := &bytes.Buffer{}
+	tw := tar.NewWriter(archive)
+	_ = tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "large.dat", Size: 1 << 40, Mode: 0644})
+
+	s := NewMemcacheWithClient(mock.NewMemcacheClient(100), MemcacheConfig{ChunkSize: 5, MaxFileSize: 100})
+	_, err := Import(s, archive)
+	if !errors.Is(err, ErrFileTooLarge) {
+		t.Errorf("Import: want %#v, got %#v", ErrFileTooLarge, err)
+	}
+}
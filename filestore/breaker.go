@@ -0,0 +1,196 @@
+package filestore
+
+import (
+	"filestore/client"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+const defaultFailureThreshold = 5
+const defaultOpenTimeout = 10 * time.Second
+
+type CircuitBreakerConfig struct {
+	// Number of consecutive failures after which requests start failing fast
+	FailureThreshold int
+
+	// How long to fail fast before letting a single probe request through
+	OpenTimeout time.Duration
+
+	// Decides if an error means the backend is unhealthy, defaults to IsRetryable
+	// so cache misses and other definite answers from the server do not trip the breaker
+	IsFailure func(err error) bool
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+type circuitBreaker struct {
+	client    client.Memcache
+	threshold int
+	timeout   time.Duration
+	isFailure func(err error) bool
+	now       func() time.Time
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+}
+
+// NewCircuitBreaker wraps the client so that after a number of consecutive failures requests
+// fail immediately with ErrBackendUnavailable instead of waiting for the backend to time out
+func NewCircuitBreaker(c client.Memcache, config CircuitBreakerConfig) client.Memcache {
+	threshold := config.FailureThreshold
+	if threshold <= 0 {
+		threshold = defaultFailureThreshold
+	}
+
+	timeout := config.OpenTimeout
+	if timeout <= 0 {
+		timeout = defaultOpenTimeout
+	}
+
+	isFailure := config.IsFailure
+	if isFailure == nil {
+		isFailure = IsRetryable
+	}
+
+	return &circuitBreaker{
+		client:    c,
+		threshold: threshold,
+		timeout:   timeout,
+		isFailure: isFailure,
+		now:       time.Now,
+	}
+}
+
+func (b *circuitBreaker) Set(item *memcache.Item) error {
+	return b.call(func() error {
+		return b.client.Set(item)
+	})
+}
+
+func (b *circuitBreaker) Add(item *memcache.Item) error {
+	return b.call(func() error {
+		return b.client.Add(item)
+	})
+}
+
+func (b *circuitBreaker) CompareAndSwap(item *memcache.Item) error {
+	return b.call(func() error {
+		return b.client.CompareAndSwap(item)
+	})
+}
+
+func (b *circuitBreaker) CompareAndSwapCAS(item *memcache.Item, cas uint64) error {
+	return b.call(func() error {
+		return client.CompareAndSwapCAS(b.client, item, cas)
+	})
+}
+
+func (b *circuitBreaker) Get(key string) (item *memcache.Item, err error) {
+	err = b.call(func() error {
+		item, err = b.client.Get(key)
+		return err
+	})
+
+	return item, err
+}
+
+func (b *circuitBreaker) GetCAS(key string) (item *memcache.Item, cas uint64, err error) {
+	err = b.call(func() error {
+		item, cas, err = client.GetCAS(b.client, key)
+		return err
+	})
+
+	return item, cas, err
+}
+
+func (b *circuitBreaker) GetMulti(keys []string) (items map[string]*memcache.Item, err error) {
+	err = b.call(func() error {
+		items, err = b.client.GetMulti(keys)
+		return err
+	})
+
+	return items, err
+}
+
+func (b *circuitBreaker) Delete(key string) error {
+	return b.call(func() error {
+		return b.client.Delete(key)
+	})
+}
+
+func (b *circuitBreaker) Increment(key string, delta uint64) (value uint64, err error) {
+	err = b.call(func() error {
+		value, err = b.client.Increment(key, delta)
+		return err
+	})
+
+	return value, err
+}
+
+func (b *circuitBreaker) Decrement(key string, delta uint64) (value uint64, err error) {
+	err = b.call(func() error {
+		value, err = b.client.Decrement(key, delta)
+		return err
+	})
+
+	return value, err
+}
+
+func (b *circuitBreaker) call(fn func() error) error {
+	err := b.allow()
+	if err != nil {
+		return err
+	}
+
+	err = fn()
+	b.record(err)
+
+	return err
+}
+
+// allow decides if a request can go through, only one probe is let through while half-open
+func (b *circuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		elapsed := b.now().Sub(b.openedAt)
+		if elapsed < b.timeout {
+			return &BackendUnavailableError{RetryAfter: b.timeout - elapsed}
+		}
+		b.state = breakerHalfOpen
+		return nil
+	case breakerHalfOpen:
+		return &BackendUnavailableError{RetryAfter: b.timeout}
+	default:
+		return nil
+	}
+}
+
+func (b *circuitBreaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err != nil && b.isFailure(err) {
+		b.failures++
+		if b.state == breakerHalfOpen || b.failures >= b.threshold {
+			b.state = breakerOpen
+			b.openedAt = b.now()
+		}
+		return
+	}
+
+	b.failures = 0
+	b.state = breakerClosed
+}
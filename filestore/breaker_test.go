@@ -0,0 +1,93 @@
+package filestore
+
+import (
+	"errors"
+	"filestore/client"
+	"filestore/mock"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// downClient fails every request with a timeout while down is set
+type downClient struct {
+	client.Memcache
+	down  bool
+	calls int
+}
+
+func (c *downClient) Get(key string) (*memcache.Item, error) {
+	c.calls++
+	if c.down {
+		return nil, &net.OpError{Op: "read", Net: "tcp", Err: timeoutError{}}
+	}
+
+	return c.Memcache.Get(key)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	c := &downClient{Memcache: mock.NewMemcacheClient(100), down: true}
+
+	now := time.Now()
+	b := NewCircuitBreaker(c, CircuitBreakerConfig{FailureThreshold: 2, OpenTimeout: time.Minute}).(*circuitBreaker)
+	b.now = func() time.Time { return now }
+
+	// Failures up to the threshold reach the backend
+	for i := 0; i < 2; i++ {
+		_, err := b.Get("key")
+		if errors.Is(err, ErrBackendUnavailable) {
+			t.Fatalf("Request %d: breaker tripped too early", i)
+		}
+	}
+
+	// Breaker is open, backend is not called
+	_, err := b.Get("key")
+	var unavailableErr *BackendUnavailableError
+	if !errors.As(err, &unavailableErr) {
+		t.Fatalf("Error: want %#v, got %#v", ErrBackendUnavailable, err)
+	}
+	if unavailableErr.RetryAfter != time.Minute {
+		t.Errorf("RetryAfter: want %v, got %v", time.Minute, unavailableErr.RetryAfter)
+	}
+	if c.calls != 2 {
+		t.Errorf("Calls: want %d, got %d", 2, c.calls)
+	}
+
+	// Probe fails, breaker opens again
+	now = now.Add(time.Minute)
+	_, err = b.Get("key")
+	if errors.Is(err, ErrBackendUnavailable) || c.calls != 3 {
+		t.Errorf("Probe: want backend call, got %#v", err)
+	}
+	_, err = b.Get("key")
+	if !errors.Is(err, ErrBackendUnavailable) {
+		t.Errorf("Error: want %#v, got %#v", ErrBackendUnavailable, err)
+	}
+
+	// Backend recovers, successful probe closes the breaker
+	c.down = false
+	now = now.Add(time.Minute)
+	for i := 0; i < 3; i++ {
+		_, err = b.Get("key")
+		if err != memcache.ErrCacheMiss {
+			t.Errorf("Request %d: want %#v, got %#v", i, memcache.ErrCacheMiss, err)
+		}
+	}
+}
+
+func TestCircuitBreaker_Store(t *testing.T) {
+	c := &downClient{Memcache: mock.NewMemcacheClient(100), down: true}
+	s := NewMemcacheWithClient(c, MemcacheConfig{CircuitBreaker: &CircuitBreakerConfig{FailureThreshold: 1}})
+
+	err := s.Store("file.dat", []byte("some content"))
+	if errors.Is(err, ErrBackendUnavailable) {
+		t.Errorf("First failure should reach the backend, got %#v", err)
+	}
+
+	_, err = s.Retrieve("file.dat")
+	if !errors.Is(err, ErrBackendUnavailable) {
+		t.Errorf("Error: want %#v, got %#v", ErrBackendUnavailable, err)
+	}
+}
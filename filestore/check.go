@@ -0,0 +1,220 @@
+package filestore
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// File statuses reported by Check
+const (
+	FileHealthy   = "healthy"
+	FileCorrupted = "corrupted" // metadata can't be read or some chunks are missing or damaged
+	FileOrphaned  = "orphaned"  // file is registered but its metadata is gone, chunks may be left behind
+	FileLocked    = "locked"    // file is being changed by a writer, it was not checked
+)
+
+type FileReport struct {
+	Filename string
+	Status   string
+	Problem  string
+	Purged   bool
+}
+
+type CheckReport struct {
+	Files []FileReport
+}
+
+// Count returns number of files with the given status
+func (r CheckReport) Count(status string) int {
+	count := 0
+	for _, f := range r.Files {
+		if f.Status == status {
+			count++
+		}
+	}
+
+	return count
+}
+
+// Checker is implemented by stores which can verify consistency of stored files
+type Checker interface {
+	Check(purge bool) (CheckReport, error)
+}
+
+// Check verifies every file the store knows about and, if purge is set, removes
+// corrupted files and chunks left behind by orphaned ones. Files locked by writers are skipped.
+func Check(store Store, purge bool) (CheckReport, error) {
+	checker, ok := store.(Checker)
+	if !ok {
+		return CheckReport{}, fmt.Errorf("%w: store can't be checked", ErrNotSupported)
+	}
+
+	return checker.Check(purge)
+}
+
+// Check requires TrackFiles to be enabled as Memcache can't enumerate keys
+func (s memcacheStore) Check(purge bool) (CheckReport, error) {
+	files, err := s.listFiles()
+	if err != nil {
+		return CheckReport{}, err
+	}
+
+	filenames := make([]string, 0, len(files))
+	for filename := range files {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+
+	report := CheckReport{}
+	for _, filename := range filenames {
+		var fileReport FileReport
+		check := func() error {
+			var err error
+			fileReport, err = s.checkFile(filename, files[filename], purge)
+			return err
+		}
+
+		// Only purging changes the file, a file which is being uploaded would look corrupted
+		var err error
+		if purge {
+			err = s.withLock([]string{filename}, check)
+		} else {
+			err = check()
+		}
+		if errors.Is(err, ErrFileLocked) {
+			fileReport = FileReport{Filename: filename, Status: FileLocked, Problem: "File is locked by a writer"}
+		} else if err != nil {
+			return report, fmt.Errorf("Unable to check file %s: %w", filename, err)
+		}
+
+		if fileReport.Status != FileHealthy {
+			s.logger.WithField("filename", filename).
+				WithField("status", fileReport.Status).
+				WithField("purged", fileReport.Purged).
+				Warning(fileReport.Problem)
+		}
+
+		report.Files = append(report.Files, fileReport)
+	}
+
+	return report, nil
+}
+
+func (s memcacheStore) checkFile(filename string, entry registryEntry, purge bool) (FileReport, error) {
+	report := FileReport{Filename: filename, Status: FileHealthy}
+
+	meta, err := s.getMetadata(filename)
+	if err == memcache.ErrCacheMiss {
+		report.Status = FileOrphaned
+		report.Problem = "Metadata is missing"
+
+		if purge {
+			err = s.purgeOrphanedChunks(entry)
+			if err == nil {
+				// Size is gone with the metadata, only the file count can be given back
+				s.releaseQuota(filename, usage{files: 1})
+				err = s.unregisterFile(filename)
+			}
+			report.Purged = err == nil
+
+			return report, err
+		}
+
+		return report, nil
+	}
+
+	if err == errMetadataInvalid {
+		report.Status = FileCorrupted
+		report.Problem = "Metadata can't be decoded"
+
+		if purge {
+			err = s.purgeOrphanedChunks(entry)
+			if err == nil {
+				err = s.purgeFile(filename, metadata{})
+			}
+			if err == nil {
+				s.releaseQuota(filename, fileUsage(metadata{}))
+				err = s.unregisterFile(filename)
+			}
+			report.Purged = err == nil
+
+			return report, err
+		}
+
+		return report, nil
+	}
+
+	if err != nil {
+		return report, err
+	}
+
+	if meta.ID != entry.ID {
+		// File was replaced without the registry noticing, chunks of the previous one may be left behind
+		// unless they are kept as a previous version
+		if purge {
+			if !meta.hasVersion(entry.ID) {
+				err = s.purgeOrphanedChunks(entry)
+			}
+			if err == nil {
+				err = s.registerFile(filename, meta)
+			}
+			if err != nil {
+				return report, err
+			}
+		}
+	}
+
+	_, err = s.getChunkRange(meta, 0, meta.Chunks)
+	if err == errKeysMissing {
+		report.Status = FileCorrupted
+		report.Problem = "Chunks are missing or damaged"
+
+		if purge {
+			err = s.purgeFile(filename, meta)
+			if err == nil {
+				s.releaseQuota(filename, fileUsage(meta))
+				err = s.unregisterFile(filename)
+			}
+			report.Purged = err == nil
+
+			return report, err
+		}
+
+		return report, nil
+	}
+
+	return report, err
+}
+
+// purgeOrphanedChunks deletes whatever chunks of the registered file are still there. Without metadata
+// only the registry knows how many chunks the file had.
+func (s memcacheStore) purgeOrphanedChunks(entry registryEntry) error {
+	for start := 0; start < entry.Chunks; start += s.getMultiBatchSize {
+		end := start + s.getMultiBatchSize
+		if end > entry.Chunks {
+			end = entry.Chunks
+		}
+
+		keys := make([]string, 0, end-start)
+		for i := start; i < end; i++ {
+			keys = append(keys, buildChunkKey(entry.ID, i))
+		}
+
+		found, err := s.findKeys(keys)
+		if err != nil {
+			return err
+		}
+
+		for key := range found {
+			err := s.deleteKey(key)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
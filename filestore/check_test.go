@@ -0,0 +1,147 @@
+package filestore
+
+import (
+	"errors"
+	"filestore/mock"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+func TestCheck(t *testing.T) {
+	c := mock.NewMemcacheClient(100)
+	s := NewMemcacheWithClient(c, MemcacheConfig{ChunkSize: 5, MaxFileSize: 50, TrackFiles: true})
+
+	ids := map[string]string{}
+	for _, filename := range []string{"healthy.dat", "partial.dat", "orphaned.dat", "broken.dat"} {
+		err := s.Store(filename, []byte("some content"))
+		if err != nil {
+			panic(err)
+		}
+
+		item, _ := c.Get(keyPrefix + MD5Key(filename))
+		meta, _ := decodeMetadata(item.Value)
+		ids[filename] = meta.ID
+	}
+
+	// A chunk got evicted
+	_ = c.Delete(buildChunkKey(ids["partial.dat"], 1))
+	// Metadata got evicted, chunks are left behind
+	_ = c.Delete(keyPrefix + MD5Key("orphaned.dat"))
+	// Metadata got damaged
+	_ = c.Set(&memcache.Item{Key: keyPrefix + MD5Key("broken.dat"), Value: []byte("{")})
+
+	report, err := Check(s, false)
+	if err != nil {
+		t.Fatalf("Error: want nil, got %#v", err)
+	}
+
+	wantReport := CheckReport{Files: []FileReport{
+		{Filename: "broken.dat", Status: FileCorrupted, Problem: "Metadata can't be decoded"},
+		{Filename: "healthy.dat", Status: FileHealthy},
+		{Filename: "orphaned.dat", Status: FileOrphaned, Problem: "Metadata is missing"},
+		{Filename: "partial.dat", Status: FileCorrupted, Problem: "Chunks are missing or damaged"},
+	}}
+	if !reflect.DeepEqual(report, wantReport) {
+		t.Errorf("Report: want %#v, got %#v", wantReport, report)
+	}
+
+	report, err = Check(s, true)
+	if err != nil {
+		t.Fatalf("Error: want nil, got %#v", err)
+	}
+	if report.Count(FileHealthy) != 1 || len(report.Files) != 4 {
+		t.Errorf("Report: want 1 healthy out of 4 files, got %#v", report)
+	}
+	for _, f := range report.Files {
+		if f.Status != FileHealthy && !f.Purged {
+			t.Errorf("File %s: want purged, got %#v", f.Filename, f)
+		}
+	}
+
+	// Chunks of purged files are gone
+	for _, filename := range []string{"partial.dat", "orphaned.dat", "broken.dat"} {
+		for i := 0; i < 3; i++ {
+			if _, err := c.Get(buildChunkKey(ids[filename], i)); err != memcache.ErrCacheMiss {
+				t.Errorf("Chunk %d of %s: want %#v, got %#v", i, filename, memcache.ErrCacheMiss, err)
+			}
+		}
+	}
+
+	// Purged files can be stored again
+	err = s.Store("partial.dat", []byte("some content"))
+	if err != nil {
+		t.Errorf("Store: want nil, got %#v", err)
+	}
+
+	report, err = Check(s, false)
+	if err != nil || report.Count(FileHealthy) != 2 || len(report.Files) != 2 {
+		t.Errorf("Report: want 2 healthy files, got %#v (%v)", report, err)
+	}
+}
+
+func TestCheck_TrackingDisabled(t *testing.T) {
+	s := NewMemcacheWithClient(mock.NewMemcacheClient(100), MemcacheConfig{})
+
+	_, err := Check(s, false)
+	if !errors.Is(err, ErrNotSupported) {
+		t.Errorf("Error: want %#v, got %#v", ErrNotSupported, err)
+	}
+}
+
+func TestCheck_ChunkSizeChanged(t *testing.T) {
+	defer func(f func() string) { newFileID = f }(newFileID)
+	newFileID = func() string { return "file-id" }
+
+	c := mock.NewMemcacheClient(100)
+	err := NewMemcacheWithClient(c, MemcacheConfig{ChunkSize: 2, TrackFiles: true}).Store("orphaned.dat", []byte("some content"))
+	if err != nil {
+		panic(err)
+	}
+	_ = c.Delete(keyPrefix + MD5Key("orphaned.dat"))
+
+	// Configured differently now, chunks are found from what the registry knows about the file
+	s := NewMemcacheWithClient(c, MemcacheConfig{ChunkSize: 5, MaxFileSize: 10, TrackFiles: true})
+	_, err = Check(s, true)
+	if err != nil {
+		t.Fatalf("Error: want nil, got %#v", err)
+	}
+
+	for i := 0; i < 6; i++ {
+		if _, err := c.Get(buildChunkKey("file-id", i)); err != memcache.ErrCacheMiss {
+			t.Errorf("Chunk %d: want %#v, got %#v", i, memcache.ErrCacheMiss, err)
+		}
+	}
+}
+
+func TestCheck_LockedFiles(t *testing.T) {
+	c := mock.NewMemcacheClient(100)
+	s := NewMemcacheWithClient(c, MemcacheConfig{
+		ChunkSize:  5,
+		TrackFiles: true,
+		Lock:       &LockConfig{WaitTimeout: 20 * time.Millisecond, RetryInterval: 5 * time.Millisecond},
+	}).(*memcacheStore)
+
+	err := s.Store("file.dat", []byte("some content"))
+	if err != nil {
+		panic(err)
+	}
+
+	// Being uploaded by someone else, it looks corrupted until all chunks are written
+	_ = c.Delete(s.buildKey("file.dat"))
+	_ = c.Add(&memcache.Item{Key: s.lockKey("file.dat"), Value: []byte("someone else")})
+
+	report, err := Check(s, true)
+	if err != nil {
+		t.Fatalf("Error: want nil, got %#v", err)
+	}
+
+	wantReport := CheckReport{Files: []FileReport{
+		{Filename: "file.dat", Status: FileLocked, Problem: "File is locked by a writer"},
+	}}
+	if !reflect.DeepEqual(report, wantReport) {
+		t.Errorf("Report: want %#v, got %#v", wantReport, report)
+	}
+}
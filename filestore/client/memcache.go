@@ -4,7 +4,42 @@ import "github.com/bradfitz/gomemcache/memcache"
 
 type Memcache interface {
 	Set(item *memcache.Item) error
+	Add(item *memcache.Item) error
+	CompareAndSwap(item *memcache.Item) error
 	Get(key string) (item *memcache.Item, err error)
 	GetMulti(keys []string) (map[string]*memcache.Item, error)
 	Delete(key string) error
+	Increment(key string, delta uint64) (newValue uint64, err error)
+	Decrement(key string, delta uint64) (newValue uint64, err error)
+}
+
+// CASClient is implemented by clients which hand out CAS ids explicitly. CAS ids can't be set on
+// memcache.Item outside of the memcache package, so only its text protocol client keeps them in the item.
+type CASClient interface {
+	// GetCAS returns the item along with the CAS id to swap it with
+	GetCAS(key string) (*memcache.Item, uint64, error)
+
+	// CompareAndSwapCAS fails with ErrCASConflict if the item changed since it had the CAS id
+	CompareAndSwapCAS(item *memcache.Item, cas uint64) error
+}
+
+// GetCAS returns the CAS id for CompareAndSwapCAS. Clients which don't implement CASClient keep it
+// in the item, zero is returned for them.
+func GetCAS(c Memcache, key string) (*memcache.Item, uint64, error) {
+	if casClient, ok := c.(CASClient); ok {
+		return casClient.GetCAS(key)
+	}
+
+	item, err := c.Get(key)
+
+	return item, 0, err
+}
+
+// CompareAndSwapCAS swaps an item returned by GetCAS
+func CompareAndSwapCAS(c Memcache, item *memcache.Item, cas uint64) error {
+	if casClient, ok := c.(CASClient); ok {
+		return casClient.CompareAndSwapCAS(item, cas)
+	}
+
+	return c.CompareAndSwap(item)
 }
@@ -0,0 +1,476 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+const defaultMetaTimeout = 100 * time.Millisecond
+const defaultMetaMaxIdleConns = 2
+
+var errCASMissing = errors.New("memcache: meta protocol client needs the CAS id, use CompareAndSwapCAS")
+
+type MetaConfig struct {
+	// Timeout of a single request including connecting, defaults to 100ms
+	Timeout time.Duration
+
+	// Number of idle connections kept open for reuse, defaults to 2
+	MaxIdleConns int
+}
+
+type metaClient struct {
+	network string
+	addr    string
+	timeout time.Duration
+	maxIdle int
+
+	mu   sync.Mutex
+	idle []*metaConn
+}
+
+type metaConn struct {
+	nc net.Conn
+	rw *bufio.ReadWriter
+}
+
+// NewMetaClient returns a client speaking the Memcache meta protocol (mg, ms, md, ma, mn), which
+// requires memcached 1.6 or newer. Connections are pooled and GetMulti is pipelined over one of them.
+// Server is either host:port or a path to a unix socket. The client implements CASClient, items it
+// returns don't carry CAS ids.
+func NewMetaClient(server string, config MetaConfig) Memcache {
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = defaultMetaTimeout
+	}
+
+	maxIdle := config.MaxIdleConns
+	if maxIdle <= 0 {
+		maxIdle = defaultMetaMaxIdleConns
+	}
+
+	network := "tcp"
+	if strings.Contains(server, "/") {
+		network = "unix"
+	}
+
+	return &metaClient{
+		network: network,
+		addr:    server,
+		timeout: timeout,
+		maxIdle: maxIdle,
+	}
+}
+
+func (c *metaClient) Set(item *memcache.Item) error {
+	return c.store(item, "S", 0)
+}
+
+func (c *metaClient) Add(item *memcache.Item) error {
+	return c.store(item, "E", 0)
+}
+
+// CompareAndSwap always fails, the CAS id has to be passed to CompareAndSwapCAS
+func (c *metaClient) CompareAndSwap(item *memcache.Item) error {
+	return errCASMissing
+}
+
+// CompareAndSwapCAS fails without a CAS id, which would store the item unconditionally
+func (c *metaClient) CompareAndSwapCAS(item *memcache.Item, cas uint64) error {
+	if cas == 0 {
+		return errCASMissing
+	}
+
+	return c.store(item, "S", cas)
+}
+
+func (c *metaClient) store(item *memcache.Item, mode string, cas uint64) error {
+	if !legalKey(item.Key) {
+		return memcache.ErrMalformedKey
+	}
+
+	flags := []string{"F" + strconv.FormatUint(uint64(item.Flags), 10), "M" + mode}
+	if item.Expiration != 0 {
+		// Negative expiration expires the item immediately, same as with the text protocol
+		flags = append(flags, "T"+strconv.Itoa(int(item.Expiration)))
+	}
+	if cas != 0 {
+		flags = append(flags, "C"+strconv.FormatUint(cas, 10))
+	}
+
+	return c.withConn(func(conn *metaConn) error {
+		_, err := fmt.Fprintf(conn.rw, "ms %s %d %s\r\n", item.Key, len(item.Value), strings.Join(flags, " "))
+		if err == nil {
+			_, err = conn.rw.Write(item.Value)
+		}
+		if err == nil {
+			_, err = conn.rw.WriteString("\r\n")
+		}
+		if err != nil {
+			return err
+		}
+
+		code, _, err := conn.roundTrip()
+		if err != nil {
+			return err
+		}
+
+		switch code {
+		case "HD":
+			return nil
+		case "NS":
+			return memcache.ErrNotStored
+		case "EX":
+			return memcache.ErrCASConflict
+		case "NF":
+			// Item to compare and swap is gone, nothing was stored
+			return memcache.ErrNotStored
+		}
+
+		return unexpectedResponse("ms", code)
+	})
+}
+
+func (c *metaClient) Get(key string) (*memcache.Item, error) {
+	item, _, err := c.GetCAS(key)
+
+	return item, err
+}
+
+func (c *metaClient) GetCAS(key string) (*memcache.Item, uint64, error) {
+	if !legalKey(key) {
+		return nil, 0, memcache.ErrMalformedKey
+	}
+
+	var item *memcache.Item
+	var cas uint64
+	err := c.withConn(func(conn *metaConn) error {
+		_, err := fmt.Fprintf(conn.rw, "mg %s v f c\r\n", key)
+		if err != nil {
+			return err
+		}
+
+		code, flags, err := conn.roundTrip()
+		if err != nil {
+			return err
+		}
+
+		switch code {
+		case "EN":
+			return memcache.ErrCacheMiss
+		case "VA":
+			item, cas, err = conn.readValue(key, flags)
+			return err
+		}
+
+		return unexpectedResponse("mg", code)
+	})
+
+	return item, cas, err
+}
+
+// GetMulti pipelines quiet gets, which don't report misses, terminated by a no-op
+func (c *metaClient) GetMulti(keys []string) (map[string]*memcache.Item, error) {
+	for _, key := range keys {
+		if !legalKey(key) {
+			return nil, memcache.ErrMalformedKey
+		}
+	}
+
+	items := map[string]*memcache.Item{}
+	if len(keys) == 0 {
+		return items, nil
+	}
+
+	err := c.withConn(func(conn *metaConn) error {
+		for _, key := range keys {
+			_, err := fmt.Fprintf(conn.rw, "mg %s v f k q\r\n", key)
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err := conn.rw.WriteString("mn\r\n")
+		if err == nil {
+			err = conn.rw.Flush()
+		}
+		if err != nil {
+			return err
+		}
+
+		for {
+			code, flags, err := conn.readResponse()
+			if err != nil {
+				return err
+			}
+
+			switch code {
+			case "MN":
+				return nil
+			case "VA":
+				item, _, err := conn.readValue("", flags)
+				if err != nil {
+					return err
+				}
+
+				item.Key = flagValue(flags[1:], 'k')
+				items[item.Key] = item
+			default:
+				return unexpectedResponse("mg", code)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return items, nil
+}
+
+func (c *metaClient) Delete(key string) error {
+	if !legalKey(key) {
+		return memcache.ErrMalformedKey
+	}
+
+	return c.withConn(func(conn *metaConn) error {
+		_, err := fmt.Fprintf(conn.rw, "md %s\r\n", key)
+		if err != nil {
+			return err
+		}
+
+		code, _, err := conn.roundTrip()
+		if err != nil {
+			return err
+		}
+
+		switch code {
+		case "HD":
+			return nil
+		case "NF":
+			return memcache.ErrCacheMiss
+		}
+
+		return unexpectedResponse("md", code)
+	})
+}
+
+func (c *metaClient) Increment(key string, delta uint64) (uint64, error) {
+	return c.arithmetic(key, "I", delta)
+}
+
+// Decrement doesn't go below zero
+func (c *metaClient) Decrement(key string, delta uint64) (uint64, error) {
+	return c.arithmetic(key, "D", delta)
+}
+
+func (c *metaClient) arithmetic(key string, mode string, delta uint64) (uint64, error) {
+	if !legalKey(key) {
+		return 0, memcache.ErrMalformedKey
+	}
+
+	var value uint64
+	err := c.withConn(func(conn *metaConn) error {
+		_, err := fmt.Fprintf(conn.rw, "ma %s v M%s D%d\r\n", key, mode, delta)
+		if err != nil {
+			return err
+		}
+
+		code, flags, err := conn.roundTrip()
+		if err != nil {
+			return err
+		}
+
+		switch code {
+		case "NF":
+			return memcache.ErrCacheMiss
+		case "VA":
+			item, _, err := conn.readValue(key, flags)
+			if err != nil {
+				return err
+			}
+
+			value, err = strconv.ParseUint(string(item.Value), 10, 64)
+			return err
+		}
+
+		return unexpectedResponse("ma", code)
+	})
+
+	return value, err
+}
+
+// withConn runs fn with a connection from the pool. The connection is returned to the pool
+// unless the request failed in a way which could leave unread data behind.
+func (c *metaClient) withConn(fn func(conn *metaConn) error) error {
+	conn, err := c.getConn()
+	if err != nil {
+		return err
+	}
+
+	err = conn.nc.SetDeadline(time.Now().Add(c.timeout))
+	if err == nil {
+		err = fn(conn)
+	}
+
+	if err == nil || resumableError(err) {
+		c.putConn(conn)
+	} else {
+		_ = conn.nc.Close()
+	}
+
+	return err
+}
+
+func (c *metaClient) getConn() (*metaConn, error) {
+	c.mu.Lock()
+	if n := len(c.idle); n > 0 {
+		conn := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mu.Unlock()
+
+		return conn, nil
+	}
+	c.mu.Unlock()
+
+	nc, err := net.DialTimeout(c.network, c.addr, c.timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return &metaConn{
+		nc: nc,
+		rw: bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc)),
+	}, nil
+}
+
+func (c *metaClient) putConn(conn *metaConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.idle) >= c.maxIdle {
+		_ = conn.nc.Close()
+		return
+	}
+
+	c.idle = append(c.idle, conn)
+}
+
+// roundTrip sends the buffered request and reads the response line
+func (conn *metaConn) roundTrip() (string, []string, error) {
+	err := conn.rw.Flush()
+	if err != nil {
+		return "", nil, err
+	}
+
+	return conn.readResponse()
+}
+
+// readResponse returns the response code and its flags, the size being the first one of a value
+func (conn *metaConn) readResponse() (string, []string, error) {
+	line, err := conn.rw.ReadString('\n')
+	if err != nil {
+		return "", nil, err
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", nil, fmt.Errorf("memcache: unexpected response line: %q", line)
+	}
+
+	switch fields[0] {
+	case "SERVER_ERROR":
+		return "", nil, fmt.Errorf("%w: %s", memcache.ErrServerError, strings.TrimSpace(line[len(fields[0]):]))
+	case "CLIENT_ERROR", "ERROR":
+		return "", nil, fmt.Errorf("memcache: %s", strings.TrimSpace(line))
+	}
+
+	return fields[0], fields[1:], nil
+}
+
+// readValue reads the value following a VA response line
+func (conn *metaConn) readValue(key string, flags []string) (*memcache.Item, uint64, error) {
+	if len(flags) == 0 {
+		return nil, 0, errors.New("memcache: value size missing in response")
+	}
+
+	size, err := strconv.Atoi(flags[0])
+	if err != nil || size < 0 {
+		return nil, 0, fmt.Errorf("memcache: invalid value size %q in response", flags[0])
+	}
+
+	value := make([]byte, size+2)
+	_, err = io.ReadFull(conn.rw, value)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if !bytes.HasSuffix(value, []byte("\r\n")) {
+		return nil, 0, errors.New("memcache: corrupt value in response")
+	}
+
+	item := &memcache.Item{Key: key, Value: value[:size]}
+	if f := flagValue(flags[1:], 'f'); f != "" {
+		clientFlags, err := strconv.ParseUint(f, 10, 32)
+		if err != nil {
+			return nil, 0, fmt.Errorf("memcache: invalid flags %q in response", f)
+		}
+		item.Flags = uint32(clientFlags)
+	}
+
+	var cas uint64
+	if c := flagValue(flags[1:], 'c'); c != "" {
+		cas, err = strconv.ParseUint(c, 10, 64)
+		if err != nil {
+			return nil, 0, fmt.Errorf("memcache: invalid CAS %q in response", c)
+		}
+	}
+
+	return item, cas, nil
+}
+
+func flagValue(flags []string, flag byte) string {
+	for _, f := range flags {
+		if len(f) > 0 && f[0] == flag {
+			return f[1:]
+		}
+	}
+
+	return ""
+}
+
+func unexpectedResponse(command string, code string) error {
+	return fmt.Errorf("memcache: unexpected response %q to %s", code, command)
+}
+
+// Same as in the memcache package
+func resumableError(err error) bool {
+	switch err {
+	case memcache.ErrCacheMiss, memcache.ErrCASConflict, memcache.ErrNotStored, memcache.ErrMalformedKey:
+		return true
+	}
+
+	return false
+}
+
+func legalKey(key string) bool {
+	if len(key) == 0 || len(key) > 250 {
+		return false
+	}
+
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,473 @@
+package client
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// fakeMetaServer speaks enough of the meta protocol to test the client
+type fakeMetaServer struct {
+	listener net.Listener
+
+	mu    sync.Mutex
+	items map[string]fakeItem
+	cas   uint64
+	conns int
+
+	// Answers every command with this line instead when set
+	failWith string
+}
+
+type fakeItem struct {
+	value []byte
+	flags string
+	cas   uint64
+}
+
+func newFakeMetaServer(t *testing.T) *fakeMetaServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %v", err)
+	}
+
+	s := &fakeMetaServer{listener: l, items: map[string]fakeItem{}}
+	go s.serve()
+
+	return s
+}
+
+func (s *fakeMetaServer) addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *fakeMetaServer) close() {
+	_ = s.listener.Close()
+}
+
+func (s *fakeMetaServer) connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.conns
+}
+
+func (s *fakeMetaServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		s.conns++
+		s.mu.Unlock()
+
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeMetaServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	for {
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			return
+		}
+
+		var data []byte
+		if fields[0] == "ms" && len(fields) > 2 {
+			size, _ := strconv.Atoi(fields[2])
+			data = make([]byte, size+2)
+			if _, err := io.ReadFull(rw, data); err != nil {
+				return
+			}
+			data = data[:size]
+		}
+
+		s.mu.Lock()
+		if s.failWith != "" {
+			_, _ = rw.WriteString(s.failWith + "\r\n")
+		} else {
+			s.execute(rw, fields, data)
+		}
+		s.mu.Unlock()
+
+		// Quiet commands are flushed by the no-op following them
+		if !hasFlag(fields, "q") {
+			if err := rw.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *fakeMetaServer) execute(w *bufio.ReadWriter, fields []string, data []byte) {
+	switch fields[0] {
+	case "mn":
+		fmt.Fprint(w, "MN\r\n")
+	case "stats":
+		fmt.Fprint(w, "STAT maxbytes 67108864\r\nSTAT item_size_max 2097152\r\nEND\r\n")
+	case "mg":
+		item, ok := s.items[fields[1]]
+		if !ok {
+			if !hasFlag(fields, "q") {
+				fmt.Fprint(w, "EN\r\n")
+			}
+			return
+		}
+
+		response := []string{"VA", strconv.Itoa(len(item.value))}
+		for _, f := range fields[2:] {
+			switch f {
+			case "f":
+				response = append(response, "f"+item.flags)
+			case "c":
+				response = append(response, "c"+strconv.FormatUint(item.cas, 10))
+			case "k":
+				response = append(response, "k"+fields[1])
+			}
+		}
+		fmt.Fprintf(w, "%s\r\n%s\r\n", strings.Join(response, " "), item.value)
+	case "ms":
+		key := fields[1]
+		item, exists := s.items[key]
+		switch {
+		case flagArg(fields, 'M') == "E" && exists:
+			fmt.Fprint(w, "NS\r\n")
+			return
+		case flagArg(fields, 'C') != "" && !exists:
+			fmt.Fprint(w, "NF\r\n")
+			return
+		case flagArg(fields, 'C') != "" && flagArg(fields, 'C') != strconv.FormatUint(item.cas, 10):
+			fmt.Fprint(w, "EX\r\n")
+			return
+		}
+
+		s.cas++
+		s.items[key] = fakeItem{value: data, flags: flagArg(fields, 'F'), cas: s.cas}
+		if strings.HasPrefix(flagArg(fields, 'T'), "-") {
+			delete(s.items, key)
+		}
+		fmt.Fprint(w, "HD\r\n")
+	case "md":
+		if _, ok := s.items[fields[1]]; !ok {
+			fmt.Fprint(w, "NF\r\n")
+			return
+		}
+		delete(s.items, fields[1])
+		fmt.Fprint(w, "HD\r\n")
+	case "ma":
+		item, ok := s.items[fields[1]]
+		if !ok {
+			fmt.Fprint(w, "NF\r\n")
+			return
+		}
+
+		value, err := strconv.ParseUint(string(item.value), 10, 64)
+		if err != nil {
+			fmt.Fprint(w, "CLIENT_ERROR cannot increment or decrement non-numeric value\r\n")
+			return
+		}
+
+		delta, _ := strconv.ParseUint(flagArg(fields, 'D'), 10, 64)
+		if flagArg(fields, 'M') == "D" {
+			if delta > value {
+				delta = value
+			}
+			value -= delta
+		} else {
+			value += delta
+		}
+
+		s.cas++
+		item.value = []byte(strconv.FormatUint(value, 10))
+		item.cas = s.cas
+		s.items[fields[1]] = item
+		fmt.Fprintf(w, "VA %d\r\n%s\r\n", len(item.value), item.value)
+	default:
+		fmt.Fprint(w, "ERROR\r\n")
+	}
+}
+
+func hasFlag(fields []string, flag string) bool {
+	for _, f := range fields[1:] {
+		if f == flag {
+			return true
+		}
+	}
+
+	return false
+}
+
+func flagArg(fields []string, flag byte) string {
+	for _, f := range fields[2:] {
+		if len(f) > 1 && f[0] == flag {
+			return f[1:]
+		}
+	}
+
+	return ""
+}
+
+func TestMetaClient(t *testing.T) {
+	s := newFakeMetaServer(t)
+	defer s.close()
+
+	c := NewMetaClient(s.addr(), MetaConfig{})
+
+	err := c.Set(&memcache.Item{Key: "key", Value: []byte("value"), Flags: 42})
+	if err != nil {
+		t.Fatalf("Set: want nil, got %#v", err)
+	}
+
+	item, err := c.Get("key")
+	if err != nil || string(item.Value) != "value" || item.Flags != 42 {
+		t.Errorf("Get: want %#v, got %#v (%v)", "value", item, err)
+	}
+
+	_, err = c.Get("missing")
+	if err != memcache.ErrCacheMiss {
+		t.Errorf("Get of a missing key: want %#v, got %#v", memcache.ErrCacheMiss, err)
+	}
+
+	err = c.Add(&memcache.Item{Key: "key", Value: []byte("other")})
+	if err != memcache.ErrNotStored {
+		t.Errorf("Add of an existing key: want %#v, got %#v", memcache.ErrNotStored, err)
+	}
+
+	err = c.Add(&memcache.Item{Key: "new", Value: []byte("")})
+	if err != nil {
+		t.Errorf("Add of a new key: want nil, got %#v", err)
+	}
+
+	// Compare and swap succeeds only with the latest version of the item
+	stale, staleCAS, _ := GetCAS(c, "key")
+	fresh, freshCAS, _ := GetCAS(c, "key")
+	fresh.Value = []byte("swapped")
+	err = CompareAndSwapCAS(c, fresh, freshCAS)
+	if err != nil {
+		t.Errorf("CompareAndSwapCAS: want nil, got %#v", err)
+	}
+
+	err = CompareAndSwapCAS(c, stale, staleCAS)
+	if err != memcache.ErrCASConflict {
+		t.Errorf("CompareAndSwapCAS of a stale item: want %#v, got %#v", memcache.ErrCASConflict, err)
+	}
+
+	// Items don't carry the CAS id
+	err = c.CompareAndSwap(fresh)
+	if err != errCASMissing {
+		t.Errorf("CompareAndSwap: want %#v, got %#v", errCASMissing, err)
+	}
+
+	// Without a CAS id nothing is swapped
+	err = CompareAndSwapCAS(c, &memcache.Item{Key: "key", Value: []byte("unconditional")}, 0)
+	if err != errCASMissing {
+		t.Errorf("CompareAndSwapCAS without CAS id: want %#v, got %#v", errCASMissing, err)
+	}
+
+	gone, goneCAS, _ := GetCAS(c, "new")
+	_ = c.Delete("new")
+	err = CompareAndSwapCAS(c, gone, goneCAS)
+	if err != memcache.ErrNotStored {
+		t.Errorf("CompareAndSwapCAS of a deleted item: want %#v, got %#v", memcache.ErrNotStored, err)
+	}
+
+	items, err := c.GetMulti([]string{"key", "missing", "other"})
+	if err != nil || len(items) != 1 || string(items["key"].Value) != "swapped" {
+		t.Errorf("GetMulti: want %#v, got %#v (%v)", "swapped", items, err)
+	}
+
+	err = c.Delete("key")
+	if err != nil {
+		t.Errorf("Delete: want nil, got %#v", err)
+	}
+
+	err = c.Delete("key")
+	if err != memcache.ErrCacheMiss {
+		t.Errorf("Delete of a missing key: want %#v, got %#v", memcache.ErrCacheMiss, err)
+	}
+
+	// Negative expiration removes the item immediately
+	_ = c.Set(&memcache.Item{Key: "expired", Value: []byte("value"), Expiration: -1})
+	_, err = c.Get("expired")
+	if err != memcache.ErrCacheMiss {
+		t.Errorf("Get of an expired key: want %#v, got %#v", memcache.ErrCacheMiss, err)
+	}
+
+	_, err = c.Get("with space")
+	if err != memcache.ErrMalformedKey {
+		t.Errorf("Get of a malformed key: want %#v, got %#v", memcache.ErrMalformedKey, err)
+	}
+}
+
+func TestMetaClient_IncrementDecrement(t *testing.T) {
+	s := newFakeMetaServer(t)
+	defer s.close()
+
+	c := NewMetaClient(s.addr(), MetaConfig{})
+
+	_, err := c.Increment("counter", 1)
+	if err != memcache.ErrCacheMiss {
+		t.Errorf("Increment of a missing key: want %#v, got %#v", memcache.ErrCacheMiss, err)
+	}
+
+	_ = c.Set(&memcache.Item{Key: "counter", Value: []byte("10")})
+
+	value, err := c.Increment("counter", 5)
+	if err != nil || value != 15 {
+		t.Errorf("Increment: want %d, got %d (%v)", 15, value, err)
+	}
+
+	value, err = c.Decrement("counter", 20)
+	if err != nil || value != 0 {
+		t.Errorf("Decrement: want %d, got %d (%v)", 0, value, err)
+	}
+
+	_ = c.Set(&memcache.Item{Key: "text", Value: []byte("abc")})
+	_, err = c.Increment("text", 1)
+	if err == nil {
+		t.Errorf("Increment of a non-numeric value: want error, got nil")
+	}
+}
+
+func TestMetaClient_Pool(t *testing.T) {
+	s := newFakeMetaServer(t)
+	defer s.close()
+
+	c := NewMetaClient(s.addr(), MetaConfig{MaxIdleConns: 2})
+
+	for i := 0; i < 10; i++ {
+		_ = c.Set(&memcache.Item{Key: fmt.Sprintf("key%d", i), Value: []byte("value")})
+		_, _ = c.Get("missing")
+	}
+
+	if s.connections() != 1 {
+		t.Errorf("Connections: want %d, got %d", 1, s.connections())
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = c.Get("key1")
+		}()
+	}
+	wg.Wait()
+
+	// The pool keeps just two of the connections concurrent requests needed
+	before := s.connections()
+	_, _ = c.Get("key1")
+	_, _ = c.Get("key1")
+	if s.connections() != before {
+		t.Errorf("Connections: want %d, got %d", before, s.connections())
+	}
+}
+
+func TestMetaClient_Errors(t *testing.T) {
+	s := newFakeMetaServer(t)
+	defer s.close()
+
+	c := NewMetaClient(s.addr(), MetaConfig{})
+
+	s.mu.Lock()
+	s.failWith = "SERVER_ERROR out of memory"
+	s.mu.Unlock()
+
+	err := c.Set(&memcache.Item{Key: "key", Value: []byte("value")})
+	if !errors.Is(err, memcache.ErrServerError) {
+		t.Errorf("Set: want %#v, got %#v", memcache.ErrServerError, err)
+	}
+
+	s.mu.Lock()
+	s.failWith = ""
+	s.mu.Unlock()
+
+	// Connection which failed is not reused
+	err = c.Set(&memcache.Item{Key: "key", Value: []byte("value")})
+	if err != nil || s.connections() != 2 {
+		t.Errorf("Set: want nil on a new connection, got %#v on %d connections", err, s.connections())
+	}
+}
+
+func TestMetaClient_Timeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %v", err)
+	}
+	defer l.Close()
+
+	// Accepts connections but never responds
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	c := NewMetaClient(l.Addr().String(), MetaConfig{Timeout: 20 * time.Millisecond})
+
+	_, err = c.Get("key")
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("Get: want timeout, got %#v", err)
+	}
+}
+
+func TestItemSizeMax(t *testing.T) {
+	s := newFakeMetaServer(t)
+	defer s.close()
+
+	size, err := ItemSizeMax(s.addr(), 0)
+	if err != nil || size != 2097152 {
+		t.Errorf("ItemSizeMax: want %d, got %d (%v)", 2097152, size, err)
+	}
+
+	s.close()
+	_, err = ItemSizeMax(s.addr(), 0)
+	if err == nil {
+		t.Errorf("ItemSizeMax of a stopped server: want error, got nil")
+	}
+}
+
+func TestLegalKey(t *testing.T) {
+	tests := map[string]bool{
+		"":                       false,
+		"key":                    true,
+		"with space":             false,
+		"with\nnewline":          false,
+		strings.Repeat("k", 250): true,
+		strings.Repeat("k", 251): false,
+	}
+
+	got := map[string]bool{}
+	for key := range tests {
+		got[key] = legalKey(key)
+	}
+
+	if !reflect.DeepEqual(got, tests) {
+		t.Errorf("Legal keys: want %v, got %v", tests, got)
+	}
+}
@@ -0,0 +1,81 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// ItemSizeMax asks the server for the largest item it accepts (item_size_max of `stats settings`),
+// which includes the key and other per-item overhead besides the value. Fails with ErrNoStats
+// if the server doesn't report it.
+func ItemSizeMax(server string, timeout time.Duration) (int, error) {
+	settings, err := statsSettings(server, timeout)
+	if err != nil {
+		return 0, err
+	}
+
+	value, ok := settings["item_size_max"]
+	if !ok {
+		return 0, memcache.ErrNoStats
+	}
+
+	size, err := strconv.Atoi(value)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("memcache: invalid item_size_max %q", value)
+	}
+
+	return size, nil
+}
+
+// statsSettings works with both the text and meta protocols, stats are the same in both
+func statsSettings(server string, timeout time.Duration) (map[string]string, error) {
+	if timeout <= 0 {
+		timeout = defaultMetaTimeout
+	}
+
+	network := "tcp"
+	if strings.Contains(server, "/") {
+		network = "unix"
+	}
+
+	nc, err := net.DialTimeout(network, server, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer nc.Close()
+
+	err = nc.SetDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = nc.Write([]byte("stats settings\r\n"))
+	if err != nil {
+		return nil, err
+	}
+
+	settings := map[string]string{}
+	r := bufio.NewReader(nc)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 1 && fields[0] == "END":
+			return settings, nil
+		case len(fields) == 3 && fields[0] == "STAT":
+			settings[fields[1]] = fields[2]
+		default:
+			return nil, fmt.Errorf("memcache: unexpected response line from stats: %q", line)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"filestore"
+	"filestore/cmd/internal/storeflags"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const usage = `Usage: filestore-admin [flags] <command> [command flags]
+
+Commands:
+  fsck    Check stored files for corruption and orphaned chunks
+  export  Write all stored files into a tar archive
+  import  Store files from a tar archive
+
+Flags:
+`
+
+func main() {
+	flags := flag.NewFlagSet("filestore-admin", flag.ExitOnError)
+	storeFlags := storeflags.Register(flags, 5*time.Second)
+	logLevel := flags.String("log-level", "warning", "Log level")
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), usage)
+		flags.PrintDefaults()
+	}
+
+	_ = flags.Parse(os.Args[1:])
+
+	level, err := log.ParseLevel(*logLevel)
+	if err != nil {
+		log.WithError(err).Fatal("Unable to parse log level")
+	}
+	log.SetLevel(level)
+
+	if flags.NArg() < 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	store, err := storeFlags.Open()
+	if err != nil {
+		log.WithError(err).Fatal("Unable to open store")
+	}
+
+	command, args := flags.Arg(0), flags.Args()[1:]
+
+	switch command {
+	case "fsck":
+		os.Exit(fsck(store, args))
+	case "export":
+		os.Exit(export(store, args))
+	case "import":
+		os.Exit(importArchive(store, args))
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", command)
+		flags.Usage()
+		os.Exit(2)
+	}
+}
+
+// fsck exits with 1 if any problems were found, like fsck(8)
+func fsck(store filestore.Store, args []string) int {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	purge := flags.Bool("purge", false, "Remove corrupted files and chunks left behind by orphaned ones")
+	_ = flags.Parse(args)
+
+	report, err := filestore.Check(store, *purge)
+	if err != nil {
+		log.WithError(err).Error("Unable to check files")
+		return 2
+	}
+
+	for _, f := range report.Files {
+		if f.Status == filestore.FileHealthy {
+			continue
+		}
+
+		purged := ""
+		if f.Purged {
+			purged = " (purged)"
+		}
+		fmt.Printf("%s\t%s\t%s%s\n", f.Status, f.Filename, f.Problem, purged)
+	}
+
+	fmt.Printf("%d files checked: %d healthy, %d corrupted, %d orphaned, %d locked\n",
+		len(report.Files),
+		report.Count(filestore.FileHealthy),
+		report.Count(filestore.FileCorrupted),
+		report.Count(filestore.FileOrphaned),
+		report.Count(filestore.FileLocked))
+
+	// Locked files are being written, that's not a problem
+	if report.Count(filestore.FileHealthy)+report.Count(filestore.FileLocked) != len(report.Files) {
+		return 1
+	}
+
+	return 0
+}
+
+func export(store filestore.Store, args []string) int {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	path := flags.String("file", "-", "Archive to write, - for stdout")
+	_ = flags.Parse(args)
+
+	w := os.Stdout
+	if *path != "-" {
+		f, err := os.Create(*path)
+		if err != nil {
+			log.WithError(err).Error("Unable to create archive")
+			return 2
+		}
+		defer f.Close()
+
+		w = f
+	}
+
+	report, err := filestore.Export(store, w)
+	if err != nil {
+		log.WithError(err).Error("Unable to export files")
+		return 2
+	}
+
+	printArchiveReport("exported", report)
+
+	return 0
+}
+
+// importArchive can't be called import, which is a keyword
+func importArchive(store filestore.Store, args []string) int {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	path := flags.String("file", "-", "Archive to read, - for stdin")
+	_ = flags.Parse(args)
+
+	r := os.Stdin
+	if *path != "-" {
+		f, err := os.Open(*path)
+		if err != nil {
+			log.WithError(err).Error("Unable to open archive")
+			return 2
+		}
+		defer f.Close()
+
+		r = f
+	}
+
+	report, err := filestore.Import(store, r)
+	if err != nil {
+		log.WithError(err).Error("Unable to import files")
+		return 2
+	}
+
+	printArchiveReport("imported", report)
+
+	return 0
+}
+
+// printArchiveReport writes to stderr as stdout may carry the archive
+func printArchiveReport(action string, report filestore.ArchiveReport) {
+	for _, filename := range report.Skipped {
+		fmt.Fprintf(os.Stderr, "skipped\t%s\n", filename)
+	}
+
+	fmt.Fprintf(os.Stderr, "%d files %s, %d skipped\n", report.Files, action, len(report.Skipped))
+}
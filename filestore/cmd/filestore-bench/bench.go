@@ -0,0 +1,444 @@
+package main
+
+import (
+	"errors"
+	"filestore"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	opStore    = "store"
+	opRetrieve = "retrieve"
+	opDelete   = "delete"
+)
+
+var operations = []string{opStore, opRetrieve, opDelete}
+
+type benchConfig struct {
+	Duration    time.Duration
+	Concurrency int
+
+	// Stops every worker after this many operations if set, otherwise after Duration
+	Operations int
+
+	// Relative weights of operations
+	Mix map[string]int
+
+	Sizes []sizeRange
+
+	// Number of files every worker works with
+	Files int
+
+	Seed int64
+}
+
+// sizeRange picks file sizes uniformly between min and max
+type sizeRange struct {
+	min    int
+	max    int
+	weight int
+}
+
+type opStats struct {
+	count     int
+	errors    int
+	bytes     int64
+	latencies []time.Duration
+}
+
+// stats of a single worker, merged into the report when the benchmark is over
+type stats struct {
+	ops map[string]*opStats
+
+	// Retrieves of files the benchmark stored and didn't delete which came back corrupted or not at all.
+	// Missing files were evicted, deletes of evicted files are counted as well
+	corrupted int
+	missing   int
+
+	errorMessages map[string]int
+}
+
+func newStats() *stats {
+	s := &stats{ops: map[string]*opStats{}, errorMessages: map[string]int{}}
+	for _, op := range operations {
+		s.ops[op] = &opStats{}
+	}
+
+	return s
+}
+
+func (s *stats) merge(other *stats) {
+	for op, o := range other.ops {
+		s.ops[op].count += o.count
+		s.ops[op].errors += o.errors
+		s.ops[op].bytes += o.bytes
+		s.ops[op].latencies = append(s.ops[op].latencies, o.latencies...)
+	}
+
+	s.corrupted += other.corrupted
+	s.missing += other.missing
+
+	for message, count := range other.errorMessages {
+		s.errorMessages[message] += count
+	}
+}
+
+// worker owns its files, so it knows which of them should exist and what they contain
+type worker struct {
+	id     string
+	store  filestore.Store
+	config benchConfig
+	rand   *rand.Rand
+	stats  *stats
+
+	// Random data file contents are sliced from
+	data []byte
+
+	// Checksums of files which should exist, by file index
+	files map[int]uint32
+}
+
+func runBenchmark(store filestore.Store, config benchConfig, cleanup bool) (*stats, time.Duration) {
+	runID := strconv.FormatInt(time.Now().UnixNano(), 36)
+
+	maxSize := 0
+	for _, r := range config.Sizes {
+		if r.max > maxSize {
+			maxSize = r.max
+		}
+	}
+
+	workers := make([]*worker, config.Concurrency)
+	for i := range workers {
+		rnd := rand.New(rand.NewSource(config.Seed + int64(i)))
+		data := make([]byte, 2*maxSize)
+		_, _ = rnd.Read(data)
+
+		workers[i] = &worker{
+			id:     fmt.Sprintf("bench-%s-%d", runID, i),
+			store:  store,
+			config: config,
+			rand:   rnd,
+			stats:  newStats(),
+			data:   data,
+			files:  map[int]uint32{},
+		}
+	}
+
+	started := time.Now()
+	deadline := started.Add(config.Duration)
+
+	wg := sync.WaitGroup{}
+	for _, w := range workers {
+		wg.Add(1)
+		go func(w *worker) {
+			defer wg.Done()
+
+			for i := 0; ; i++ {
+				if config.Operations > 0 && i >= config.Operations || config.Operations == 0 && time.Now().After(deadline) {
+					return
+				}
+
+				w.step()
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	elapsed := time.Since(started)
+
+	total := newStats()
+	for _, w := range workers {
+		total.merge(w.stats)
+
+		if cleanup {
+			w.cleanup()
+		}
+	}
+
+	return total, elapsed
+}
+
+func (w *worker) step() {
+	switch op := w.pickOperation(); op {
+	case opStore:
+		w.storeFile()
+	case opRetrieve:
+		w.retrieveFile()
+	case opDelete:
+		w.deleteFile()
+	}
+}
+
+// pickOperation falls back to storing when there is nothing to retrieve or delete and the other way round
+func (w *worker) pickOperation() string {
+	total := 0
+	for _, op := range operations {
+		total += w.config.Mix[op]
+	}
+
+	op := opStore
+	n := w.rand.Intn(total)
+	for _, o := range operations {
+		if n < w.config.Mix[o] {
+			op = o
+			break
+		}
+		n -= w.config.Mix[o]
+	}
+
+	if op == opStore && len(w.files) == w.config.Files {
+		return opRetrieve
+	}
+
+	if op != opStore && len(w.files) == 0 {
+		return opStore
+	}
+
+	return op
+}
+
+func (w *worker) storeFile() {
+	index := w.pickFile(false)
+	contents := w.contents()
+
+	started := time.Now()
+	err := w.store.Store(w.filename(index), contents)
+	w.record(opStore, started, len(contents), err)
+
+	if err == nil {
+		w.files[index] = crc32.ChecksumIEEE(contents)
+	}
+}
+
+func (w *worker) retrieveFile() {
+	index := w.pickFile(true)
+
+	started := time.Now()
+	contents, err := w.store.Retrieve(w.filename(index))
+
+	if err == nil && crc32.ChecksumIEEE(contents) != w.files[index] {
+		err = fmt.Errorf("%w: contents differ from what was stored", filestore.ErrFileCorrupted)
+	}
+	w.record(opRetrieve, started, len(contents), err)
+
+	if errors.Is(err, filestore.ErrFileNotFound) {
+		w.stats.missing++
+		delete(w.files, index)
+	}
+
+	if errors.Is(err, filestore.ErrFileCorrupted) {
+		w.stats.corrupted++
+
+		// Free the filename, storing it again would fail otherwise
+		_ = w.store.Delete(w.filename(index))
+		delete(w.files, index)
+	}
+}
+
+func (w *worker) deleteFile() {
+	index := w.pickFile(true)
+
+	started := time.Now()
+	err := w.store.Delete(w.filename(index))
+	w.record(opDelete, started, 0, err)
+
+	if errors.Is(err, filestore.ErrFileNotFound) {
+		w.stats.missing++
+	}
+
+	if err == nil || errors.Is(err, filestore.ErrFileNotFound) {
+		delete(w.files, index)
+	}
+}
+
+func (w *worker) record(op string, started time.Time, size int, err error) {
+	s := w.stats.ops[op]
+	s.count++
+	s.latencies = append(s.latencies, time.Since(started))
+
+	if err != nil {
+		s.errors++
+		w.stats.errorMessages[op+": "+err.Error()]++
+		return
+	}
+
+	s.bytes += int64(size)
+}
+
+// pickFile returns a random index of a stored file if stored is set, of a file which isn't stored otherwise
+func (w *worker) pickFile(stored bool) int {
+	for {
+		index := w.rand.Intn(w.config.Files)
+		if _, ok := w.files[index]; ok == stored {
+			return index
+		}
+	}
+}
+
+func (w *worker) contents() []byte {
+	total := 0
+	for _, r := range w.config.Sizes {
+		total += r.weight
+	}
+
+	r := w.config.Sizes[0]
+	n := w.rand.Intn(total)
+	for _, candidate := range w.config.Sizes {
+		if n < candidate.weight {
+			r = candidate
+			break
+		}
+		n -= candidate.weight
+	}
+
+	size := r.min + w.rand.Intn(r.max-r.min+1)
+	offset := w.rand.Intn(len(w.data) - size + 1)
+
+	return w.data[offset : offset+size]
+}
+
+func (w *worker) filename(index int) string {
+	return fmt.Sprintf("%s-%d.dat", w.id, index)
+}
+
+func (w *worker) cleanup() {
+	for index := range w.files {
+		_ = w.store.Delete(w.filename(index))
+	}
+}
+
+// parseMix parses weights of operations, e.g. "store=1,retrieve=8,delete=1"
+func parseMix(value string) (map[string]int, error) {
+	mix := map[string]int{}
+	total := 0
+
+	for _, part := range strings.Split(value, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Invalid operation weight %q, expected operation=weight", part)
+		}
+
+		known := false
+		for _, op := range operations {
+			known = known || op == kv[0]
+		}
+		if !known {
+			return nil, fmt.Errorf("Unknown operation %q, expected one of %s", kv[0], strings.Join(operations, ", "))
+		}
+
+		weight, err := strconv.Atoi(kv[1])
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("Invalid weight %q of %s", kv[1], kv[0])
+		}
+
+		mix[kv[0]] = weight
+		total += weight
+	}
+
+	if total == 0 {
+		return nil, errors.New("At least one operation needs a positive weight")
+	}
+
+	return mix, nil
+}
+
+// parseSizes parses a weighted distribution of file sizes, e.g. "1KB:50,64KB-1MB:40,4MB:10".
+// Ranges are picked from uniformly, weights default to 1
+func parseSizes(value string) ([]sizeRange, error) {
+	sizes := []sizeRange{}
+
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		r := sizeRange{weight: 1}
+
+		if i := strings.LastIndex(part, ":"); i >= 0 {
+			weight, err := strconv.Atoi(part[i+1:])
+			if err != nil || weight <= 0 {
+				return nil, fmt.Errorf("Invalid weight of %q", part)
+			}
+
+			r.weight = weight
+			part = part[:i]
+		}
+
+		bounds := strings.SplitN(part, "-", 2)
+
+		var err error
+		r.min, err = parseSize(bounds[0])
+		if err != nil {
+			return nil, err
+		}
+
+		r.max = r.min
+		if len(bounds) == 2 {
+			r.max, err = parseSize(bounds[1])
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if r.max < r.min {
+			return nil, fmt.Errorf("Invalid size range %q", part)
+		}
+
+		sizes = append(sizes, r)
+	}
+
+	return sizes, nil
+}
+
+// parseSize accepts sizes in bytes with an optional B, KB, MB or GB suffix, multiples of 1024
+func parseSize(value string) (int, error) {
+	original := value
+	value = strings.ToUpper(strings.TrimSpace(value))
+
+	multiplier := 1
+	for _, unit := range []struct {
+		suffix     string
+		multiplier int
+	}{{"KB", 1 << 10}, {"MB", 1 << 20}, {"GB", 1 << 30}, {"B", 1}} {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSuffix(value, unit.suffix)
+			multiplier = unit.multiplier
+			break
+		}
+	}
+
+	size, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("Invalid size %q", original)
+	}
+
+	return size * multiplier, nil
+}
+
+// percentile uses the nearest rank method, latencies have to be sorted
+func percentile(latencies []time.Duration, p float64) time.Duration {
+	if len(latencies) == 0 {
+		return 0
+	}
+
+	rank := int(math.Ceil(p*float64(len(latencies)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+
+	return latencies[rank]
+}
+
+func sortLatencies(s *stats) {
+	for _, o := range s.ops {
+		sort.Slice(o.latencies, func(i, j int) bool {
+			return o.latencies[i] < o.latencies[j]
+		})
+	}
+}
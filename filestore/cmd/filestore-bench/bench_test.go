@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"filestore"
+	"filestore/mock"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestParseSizes(t *testing.T) {
+	sizes, err := parseSizes("100, 1KB-64kb:40,2MB:5")
+	want := []sizeRange{{100, 100, 1}, {1024, 65536, 40}, {2 << 20, 2 << 20, 5}}
+	if err != nil || !reflect.DeepEqual(sizes, want) {
+		t.Errorf("parseSizes: want %#v, got %#v (%v)", want, sizes, err)
+	}
+
+	for _, value := range []string{"", "1XB", "2KB-1KB", "1KB:0", "-1"} {
+		if _, err := parseSizes(value); err == nil {
+			t.Errorf("parseSizes of %q: want error, got nil", value)
+		}
+	}
+}
+
+func TestParseMix(t *testing.T) {
+	mix, err := parseMix("store=1, retrieve=8,delete=0")
+	want := map[string]int{opStore: 1, opRetrieve: 8, opDelete: 0}
+	if err != nil || !reflect.DeepEqual(mix, want) {
+		t.Errorf("parseMix: want %#v, got %#v (%v)", want, mix, err)
+	}
+
+	for _, value := range []string{"", "store", "update=1", "store=-1", "store=0,delete=0"} {
+		if _, err := parseMix(value); err == nil {
+			t.Errorf("parseMix of %q: want error, got nil", value)
+		}
+	}
+}
+
+func TestRunBenchmark(t *testing.T) {
+	m := mock.NewMemcacheClient(100000)
+
+	// Chunks are evicted every now and then after they were verified
+	c := mock.NewFaultyClient(m, mock.FaultConfig{Faults: []mock.Fault{
+		{Ops: []string{mock.OpGetMulti}, Keys: regexp.MustCompile(`::3$`), EvictAfter: 20},
+	}})
+	store := filestore.NewMemcacheWithClient(c, filestore.MemcacheConfig{ChunkSize: 100})
+
+	config := benchConfig{
+		Concurrency: 4,
+		Operations:  200,
+		Mix:         map[string]int{opStore: 2, opRetrieve: 6, opDelete: 1},
+		Sizes:       []sizeRange{{min: 0, max: 1000, weight: 1}},
+		Files:       20,
+	}
+
+	s, _ := runBenchmark(store, config, true)
+
+	total := 0
+	for _, o := range s.ops {
+		total += o.count
+	}
+	if total != 800 {
+		t.Errorf("Operations: want %d, got %d", 800, total)
+	}
+
+	if s.corrupted == 0 {
+		t.Errorf("Corrupted: want some, got none")
+	}
+
+	out := &bytes.Buffer{}
+	printReport(out, s, 1)
+	for _, want := range []string{"retrieve", "Corrupted:", "Evicted:", "Errors:"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Report: want %q in\n%s", want, out.String())
+		}
+	}
+}
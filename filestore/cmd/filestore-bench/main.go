@@ -0,0 +1,169 @@
+package main
+
+import (
+	"filestore"
+	"filestore/remote"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const usage = `Usage: filestore-bench [flags]
+
+Drives a mix of store, retrieve and delete operations against Memcache through the library,
+or against a running file server if -url is set, and reports throughput and latencies.
+Every worker works with its own set of files, so retrieves of files which were stored but are
+missing or corrupted are attributed to evictions and corruption.
+
+Flags:
+`
+
+func main() {
+	flags := flag.NewFlagSet("filestore-bench", flag.ExitOnError)
+	server := flags.String("server", "127.0.0.1:11211", "Memcache server")
+	protocol := flags.String("protocol", "text", "Memcache protocol, text or meta")
+	url := flags.String("url", "", "Base URL of a file server to benchmark instead of Memcache, e.g. http://127.0.0.1:8000")
+	timeout := flags.Duration("timeout", 5*time.Second, "Request timeout")
+	chunkSize := flags.Int("chunk-size", 0, "Chunk size, derived from the server settings by default")
+	maxFileSize := flags.Int("max-file-size", 0, "Max file size the store is configured with, in bytes")
+	duration := flags.Duration("duration", 30*time.Second, "How long to run")
+	operations := flags.Int("operations", 0, "Operations per worker, overrides -duration if set")
+	concurrency := flags.Int("concurrency", 10, "Number of workers")
+	mix := flags.String("mix", "store=1,retrieve=8,delete=1", "Relative weights of operations")
+	sizes := flags.String("sizes", "1KB-64KB:80,64KB-1MB:15,1MB-4MB:5", "File sizes or size ranges with optional weights")
+	files := flags.Int("files", 100, "Number of files every worker works with")
+	seed := flags.Int64("seed", 1, "Seed of the random number generators")
+	keep := flags.Bool("keep", false, "Keep the stored files when done")
+	logLevel := flags.String("log-level", "error", "Log level")
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), usage)
+		flags.PrintDefaults()
+	}
+
+	_ = flags.Parse(os.Args[1:])
+
+	level, err := log.ParseLevel(*logLevel)
+	if err != nil {
+		log.WithError(err).Fatal("Unable to parse log level")
+	}
+	log.SetLevel(level)
+
+	config := benchConfig{
+		Duration:    *duration,
+		Operations:  *operations,
+		Concurrency: *concurrency,
+		Files:       *files,
+		Seed:        *seed,
+	}
+
+	config.Mix, err = parseMix(*mix)
+	if err != nil {
+		log.WithError(err).Fatal("Unable to parse operation mix")
+	}
+
+	config.Sizes, err = parseSizes(*sizes)
+	if err != nil {
+		log.WithError(err).Fatal("Unable to parse file sizes")
+	}
+
+	if config.Concurrency < 1 || config.Files < 1 {
+		log.Fatal("Concurrency and number of files have to be positive")
+	}
+
+	var store filestore.Store
+	target := "memcache " + *server
+	if *url != "" {
+		store = remote.NewStore(*url, remote.Config{Timeout: *timeout})
+		target = "file server " + *url
+	} else {
+		store, err = filestore.OpenMemcache(*server, filestore.MemcacheConfig{
+			Protocol:    filestore.MemcacheProtocol(*protocol),
+			Timeout:     *timeout,
+			ChunkSize:   *chunkSize,
+			MaxFileSize: *maxFileSize,
+		})
+		if err != nil {
+			log.WithError(err).Fatal("Unable to open store")
+		}
+	}
+
+	fmt.Printf("Benchmarking %s with %d workers\n\n", target, config.Concurrency)
+
+	s, elapsed := runBenchmark(store, config, !*keep)
+	printReport(os.Stdout, s, elapsed)
+}
+
+func printReport(out io.Writer, s *stats, elapsed time.Duration) {
+	sortLatencies(s)
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "operation\tcount\tops/s\terrors\tMB/s\tp50\tp90\tp99\tmax\t")
+
+	total := 0
+	for _, op := range operations {
+		o := s.ops[op]
+		total += o.count
+
+		max := time.Duration(0)
+		if len(o.latencies) > 0 {
+			max = o.latencies[len(o.latencies)-1]
+		}
+
+		fmt.Fprintf(w, "%s\t%d\t%.1f\t%d\t%.2f\t%v\t%v\t%v\t%v\t\n",
+			op,
+			o.count,
+			float64(o.count)/elapsed.Seconds(),
+			o.errors,
+			float64(o.bytes)/(1<<20)/elapsed.Seconds(),
+			roundLatency(percentile(o.latencies, 0.5)),
+			roundLatency(percentile(o.latencies, 0.9)),
+			roundLatency(percentile(o.latencies, 0.99)),
+			roundLatency(max))
+	}
+	_ = w.Flush()
+
+	retrieves := s.ops[opRetrieve].count
+	fmt.Fprintf(out, "\n%d operations in %v (%.1f ops/s)\n", total, elapsed.Round(time.Millisecond), float64(total)/elapsed.Seconds())
+	fmt.Fprintf(out, "Corrupted: %d of %d retrieves (%.2f%%)\n", s.corrupted, retrieves, rate(s.corrupted, retrieves))
+	fmt.Fprintf(out, "Evicted: %d files found missing by retrieves and deletes (%.2f%% of them)\n",
+		s.missing, rate(s.missing, retrieves+s.ops[opDelete].count))
+
+	if len(s.errorMessages) == 0 {
+		return
+	}
+
+	messages := make([]string, 0, len(s.errorMessages))
+	for message := range s.errorMessages {
+		messages = append(messages, message)
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		return s.errorMessages[messages[i]] > s.errorMessages[messages[j]]
+	})
+
+	fmt.Fprintln(out, "\nErrors:")
+	for _, message := range messages {
+		fmt.Fprintf(out, "%8d  %s\n", s.errorMessages[message], message)
+	}
+}
+
+func roundLatency(d time.Duration) time.Duration {
+	if d > time.Second {
+		return d.Round(time.Millisecond)
+	}
+
+	return d.Round(time.Microsecond)
+}
+
+func rate(n int, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+
+	return 100 * float64(n) / float64(total)
+}
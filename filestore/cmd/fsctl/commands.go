@@ -0,0 +1,301 @@
+package main
+
+import (
+	"errors"
+	"filestore"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// put reads the whole file into memory before storing it, files are stored at once
+func put(c cli, args []string) error {
+	flags := newFlagSet(c, "put")
+	recursive := flags.Bool("r", false, "Store the files of a directory and its subdirectories, named after their path")
+	separator := flags.String("separator", "/", "Separator of directories in filenames with -r")
+	if err := parseFlags(flags, args, 1, 2); err != nil {
+		return err
+	}
+
+	src, dst := flags.Arg(0), flags.Arg(1)
+
+	if src == "-" {
+		if dst == "" {
+			return fmt.Errorf("%w: remote filename is required when reading stdin", errUsage)
+		}
+
+		contents, err := ioutil.ReadAll(c.stdin)
+		if err != nil {
+			return fmt.Errorf("Unable to read stdin: %w", err)
+		}
+
+		return withFilename(dst, c.store.Store(dst, contents))
+	}
+
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		if dst == "" {
+			dst = filepath.Base(src)
+		}
+
+		return withFilename(dst, putFile(c, src, dst))
+	}
+
+	if !*recursive {
+		return fmt.Errorf("%s is a directory, use -r to store its files", src)
+	}
+
+	// Walk doesn't follow symlinks, only regular files are stored
+	filenames := map[string]string{}
+	err = filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.Mode().IsRegular() {
+			rel, err := filepath.Rel(src, p)
+			if err != nil {
+				return err
+			}
+
+			filename := path.Join(dst, filepath.ToSlash(rel))
+			filenames[strings.Replace(filename, "/", *separator, -1)] = p
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return eachFile(c, "put", sortedKeys(filenames), func(filename string) error {
+		err := putFile(c, filenames[filename], filename)
+		if err == nil {
+			fmt.Fprintln(c.stdout, filename)
+		}
+
+		return err
+	})
+}
+
+func putFile(c cli, src string, dst string) error {
+	contents, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+
+	return c.store.Store(dst, contents)
+}
+
+func get(c cli, args []string) error {
+	flags := newFlagSet(c, "get")
+	version := flags.Int("version", 0, "Version to retrieve instead of the current one")
+	if err := parseFlags(flags, args, 1, 2); err != nil {
+		return err
+	}
+
+	src, dst := flags.Arg(0), flags.Arg(1)
+
+	var contents []byte
+	var err error
+	if *version > 0 {
+		contents, err = filestore.RetrieveVersion(c.store, src, *version)
+	} else {
+		contents, err = c.store.Retrieve(src)
+	}
+	if err != nil {
+		return withFilename(src, err)
+	}
+
+	if dst == "" || dst == "-" {
+		_, err = c.stdout.Write(contents)
+		return err
+	}
+
+	return ioutil.WriteFile(dst, contents, 0644)
+}
+
+func remove(c cli, args []string) error {
+	flags := newFlagSet(c, "rm")
+	if err := parseFlags(flags, args, 1, -1); err != nil {
+		return err
+	}
+
+	return eachFile(c, "rm", flags.Args(), c.store.Delete)
+}
+
+// stat only reads what the store keeps about files, the checksum can't be compared with checksums of local files
+func stat(c cli, args []string) error {
+	flags := newFlagSet(c, "stat")
+	if err := parseFlags(flags, args, 1, -1); err != nil {
+		return err
+	}
+
+	return eachFile(c, "stat", flags.Args(), func(filename string) error {
+		info, err := filestore.Stat(c.store, filename)
+		if err != nil {
+			return err
+		}
+
+		versions := "-"
+		if v, err := filestore.Versions(c.store, filename); err == nil {
+			s := make([]string, len(v))
+			for i, version := range v {
+				s[i] = strconv.Itoa(version)
+			}
+			versions = strings.Join(s, ",")
+		}
+
+		checksum := info.Checksum
+		if checksum == "" {
+			checksum = "-"
+		}
+
+		fmt.Fprintf(c.stdout, "%s\t%s\tchecksum:%s\tversions:%s\n", filename, formatSize(info.Size), checksum, versions)
+
+		return nil
+	})
+}
+
+func list(c cli, args []string) error {
+	flags := newFlagSet(c, "ls")
+	long := flags.Bool("l", false, "Show sizes")
+	if err := parseFlags(flags, args, 0, 1); err != nil {
+		return err
+	}
+
+	filenames, err := filestore.List(c.store)
+	if err != nil {
+		return err
+	}
+
+	for _, filename := range filenames {
+		if !strings.HasPrefix(filename, flags.Arg(0)) {
+			continue
+		}
+
+		if !*long {
+			fmt.Fprintln(c.stdout, filename)
+			continue
+		}
+
+		// Listed files may have been evicted since
+		size := "-"
+		if info, err := filestore.Stat(c.store, filename); err == nil {
+			size = formatSize(info.Size)
+		}
+		fmt.Fprintf(c.stdout, "%s\t%s\n", size, filename)
+	}
+
+	return nil
+}
+
+// formatSize shows unknown sizes of files stored by older versions as -
+func formatSize(size int) string {
+	if size < 0 {
+		return "-"
+	}
+
+	return strconv.Itoa(size)
+}
+
+// copyFile can't be called copy, which is a builtin
+func copyFile(c cli, args []string) error {
+	flags := newFlagSet(c, "cp")
+	if err := parseFlags(flags, args, 2, 2); err != nil {
+		return err
+	}
+
+	return withFilename(flags.Arg(0), filestore.Copy(c.store, flags.Arg(0), flags.Arg(1)))
+}
+
+func move(c cli, args []string) error {
+	flags := newFlagSet(c, "mv")
+	if err := parseFlags(flags, args, 2, 2); err != nil {
+		return err
+	}
+
+	return withFilename(flags.Arg(0), filestore.Rename(c.store, flags.Arg(0), flags.Arg(1)))
+}
+
+func newFlagSet(c cli, name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(c.stderr)
+
+	return flags
+}
+
+// parseFlags checks the number of arguments, max -1 means any number
+func parseFlags(flags *flag.FlagSet, args []string, min int, max int) error {
+	if err := flags.Parse(args); err != nil {
+		return fmt.Errorf("%w: %v", errUsage, err)
+	}
+
+	if flags.NArg() < min || max >= 0 && flags.NArg() > max {
+		return fmt.Errorf("%w: %s takes %s arguments, got %d", errUsage, flags.Name(), argumentCount(min, max), flags.NArg())
+	}
+
+	return nil
+}
+
+func argumentCount(min int, max int) string {
+	switch {
+	case max < 0:
+		return fmt.Sprintf("at least %d", min)
+	case min == max:
+		return strconv.Itoa(min)
+	default:
+		return fmt.Sprintf("%d to %d", min, max)
+	}
+}
+
+// eachFile carries on after failures, which are reported as they happen
+func eachFile(c cli, name string, filenames []string, fn func(filename string) error) error {
+	if len(filenames) == 1 {
+		return withFilename(filenames[0], fn(filenames[0]))
+	}
+
+	failed := 0
+	for _, filename := range filenames {
+		if err := fn(filename); err != nil {
+			fmt.Fprintf(c.stderr, "fsctl %s: %v\n", name, withFilename(filename, err))
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files failed", failed, len(filenames))
+	}
+
+	return nil
+}
+
+// withFilename prefixes store errors with the filename, errors of local files carry their path already
+func withFilename(filename string, err error) error {
+	var pathErr *os.PathError
+	if err == nil || errors.As(err, &pathErr) {
+		return err
+	}
+
+	return fmt.Errorf("%s: %w", filename, err)
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"filestore"
+	"filestore/mock"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type testCLI struct {
+	cli
+	stdout *bytes.Buffer
+	stderr *bytes.Buffer
+}
+
+func newTestCLI(stdin string) testCLI {
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	store := filestore.NewMemcacheWithClient(mock.NewMemcacheClient(1000), filestore.MemcacheConfig{
+		ChunkSize:  5,
+		TrackFiles: true,
+	})
+
+	return testCLI{
+		cli:    cli{store: store, stdin: strings.NewReader(stdin), stdout: stdout, stderr: stderr},
+		stdout: stdout,
+		stderr: stderr,
+	}
+}
+
+// run executes the command line and returns what it wrote to stdout
+func (c testCLI) run(t *testing.T, wantCode int, args ...string) string {
+	t.Helper()
+
+	c.stdout.Reset()
+	c.stderr.Reset()
+
+	code := run(c.cli, commands[args[0]], args[0], args[1:])
+	if code != wantCode {
+		t.Errorf("%s: want exit code %d, got %d (%s)", strings.Join(args, " "), wantCode, code, c.stderr.String())
+	}
+
+	return c.stdout.String()
+}
+
+func TestCommands(t *testing.T) {
+	c := newTestCLI("some content")
+
+	c.run(t, 0, "put", "-", "file.dat")
+	if got := c.run(t, 0, "get", "file.dat"); got != "some content" {
+		t.Errorf("get: want %#v, got %#v", "some content", got)
+	}
+
+	c.run(t, 1, "put", "-", "file.dat")
+	if want := "fsctl put: file.dat: File already exists\n"; c.stderr.String() != want {
+		t.Errorf("put of an existing file: want %#v, got %#v", want, c.stderr.String())
+	}
+
+	c.run(t, 0, "cp", "file.dat", "copy.dat")
+	c.run(t, 0, "mv", "copy.dat", "moved.dat")
+	if got := c.run(t, 0, "ls"); got != "file.dat\nmoved.dat\n" {
+		t.Errorf("ls: want %#v, got %#v", "file.dat\nmoved.dat\n", got)
+	}
+	if got := c.run(t, 0, "ls", "-l", "mov"); got != "12\tmoved.dat\n" {
+		t.Errorf("ls -l: want %#v, got %#v", "12\tmoved.dat\n", got)
+	}
+
+	want := "file.dat\t12\tchecksum:0fe8907ef7ae38e49785cba14f5193b6-3\tversions:1\n"
+	if got := c.run(t, 0, "stat", "file.dat"); got != want {
+		t.Errorf("stat: want %#v, got %#v", want, got)
+	}
+
+	// Failures of some files don't stop the others
+	c.run(t, 1, "rm", "file.dat", "missing.dat", "moved.dat")
+	if want := "fsctl rm: missing.dat: File not found\nfsctl rm: 1 of 3 files failed\n"; c.stderr.String() != want {
+		t.Errorf("rm: want %#v, got %#v", want, c.stderr.String())
+	}
+	if got := c.run(t, 0, "ls"); got != "" {
+		t.Errorf("ls after rm: want %#v, got %#v", "", got)
+	}
+
+	c.run(t, 1, "get", "file.dat")
+	c.run(t, 2, "cp", "file.dat")
+	c.run(t, 2, "put", "-")
+}
+
+func TestPut_Files(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsctl")
+	if err != nil {
+		t.Fatalf("Unable to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, contents := range map[string]string{
+		"a.txt":         "first",
+		"sub/b.txt":     "second",
+		"sub/sub/c.txt": "third",
+	} {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		_ = os.MkdirAll(filepath.Dir(p), 0755)
+		if err := ioutil.WriteFile(p, []byte(contents), 0644); err != nil {
+			t.Fatalf("Unable to write %s: %v", name, err)
+		}
+	}
+
+	c := newTestCLI("")
+
+	c.run(t, 0, "put", filepath.Join(dir, "a.txt"))
+	c.run(t, 1, "put", filepath.Join(dir, "sub"), "dir")
+
+	// Files already stored are reported, the rest is stored
+	c.run(t, 0, "put", filepath.Join(dir, "sub", "b.txt"), "backup/sub/b.txt")
+	got := c.run(t, 1, "put", "-r", dir, "backup")
+	if got != "backup/a.txt\nbackup/sub/sub/c.txt\n" {
+		t.Errorf("put -r: want %#v, got %#v", "backup/a.txt\nbackup/sub/sub/c.txt\n", got)
+	}
+	if !strings.Contains(c.stderr.String(), "backup/sub/b.txt: File already exists") {
+		t.Errorf("put -r: want the existing file reported, got %#v", c.stderr.String())
+	}
+
+	if got := c.run(t, 0, "get", "backup/sub/sub/c.txt"); got != "third" {
+		t.Errorf("get: want %#v, got %#v", "third", got)
+	}
+
+	got = c.run(t, 0, "put", "-r", "-separator", "_", filepath.Join(dir, "sub"), "flat")
+	if got != "flat_b.txt\nflat_sub_c.txt\n" {
+		t.Errorf("put -r -separator: want %#v, got %#v", "flat_b.txt\nflat_sub_c.txt\n", got)
+	}
+
+	c.run(t, 0, "rm", "a.txt")
+	c.run(t, 0, "put", filepath.Join(dir, "sub", "b.txt"), "a.txt")
+
+	out := filepath.Join(dir, "out.txt")
+	c.run(t, 0, "get", "a.txt", out)
+	if contents, err := ioutil.ReadFile(out); err != nil || string(contents) != "second" {
+		t.Errorf("get to a file: want %#v, got %#v (%v)", "second", string(contents), err)
+	}
+}
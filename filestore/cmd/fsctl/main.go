@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"filestore"
+	"filestore/cmd/internal/storeflags"
+	"filestore/remote"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const usage = `Usage: fsctl [flags] <command> [command flags] [arguments]
+
+Works with files in Memcache through the library, or with a running file server if -url is set.
+
+Commands:
+  put [-r [-separator s]] <local> [<remote>]
+                                Store a local file, - for stdin, or a directory with -r
+  get [-version n] <remote> [<local>]
+                                Write a file to stdout or a local file
+  rm <remote>...                Delete files
+  stat <remote>...              Show size, checksum and versions of files
+  ls [-l] [<prefix>]            List stored files
+  cp <from> <to>                Copy a file
+  mv <from> <to>                Rename a file
+
+Flags:
+`
+
+// errUsage makes the command exit with 2 after printing usage
+var errUsage = errors.New("Invalid arguments")
+
+// cli is what commands work with, the standard streams are replaced by tests
+type cli struct {
+	store  filestore.Store
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+var commands = map[string]func(c cli, args []string) error{
+	"put":  put,
+	"get":  get,
+	"rm":   remove,
+	"stat": stat,
+	"ls":   list,
+	"cp":   copyFile,
+	"mv":   move,
+}
+
+func main() {
+	flags := flag.NewFlagSet("fsctl", flag.ExitOnError)
+	storeFlags := storeflags.Register(flags, 30*time.Second)
+	url := flags.String("url", "", "Base URL of a file server to use instead of Memcache, e.g. http://127.0.0.1:8000")
+	adminURL := flags.String("admin-url", "", "Base URL of the admin listener of the file server, required by ls with -url")
+	logLevel := flags.String("log-level", "error", "Log level")
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), usage)
+		flags.PrintDefaults()
+	}
+
+	_ = flags.Parse(os.Args[1:])
+
+	level, err := log.ParseLevel(*logLevel)
+	if err != nil {
+		log.WithError(err).Fatal("Unable to parse log level")
+	}
+	log.SetLevel(level)
+
+	if flags.NArg() < 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	name, args := flags.Arg(0), flags.Args()[1:]
+
+	command, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", name)
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	var store filestore.Store
+	if *url != "" {
+		store = remote.NewStore(*url, remote.Config{Timeout: storeFlags.Timeout(), AdminURL: *adminURL})
+	} else {
+		store, err = storeFlags.Open()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "fsctl: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	os.Exit(run(cli{store: store, stdin: os.Stdin, stdout: os.Stdout, stderr: os.Stderr}, command, name, args))
+}
+
+// run exits with 1 if the command failed and with 2 if it was used the wrong way
+func run(c cli, command func(c cli, args []string) error, name string, args []string) int {
+	err := command(c, args)
+	if err == nil {
+		return 0
+	}
+
+	fmt.Fprintf(c.stderr, "fsctl %s: %v\n", name, err)
+
+	if errors.Is(err, errUsage) {
+		fmt.Fprintln(c.stderr, "Run fsctl -h for usage")
+		return 2
+	}
+
+	return 1
+}
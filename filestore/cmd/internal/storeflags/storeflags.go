@@ -0,0 +1,64 @@
+// Package storeflags opens the Memcache store the command line tools work with. The store is configured
+// like the file server's, so the tools wait for its locks and keep quota usage up to date.
+package storeflags
+
+import (
+	"filestore"
+	"flag"
+	"time"
+)
+
+// Flags are the store flags registered on a flag set
+type Flags struct {
+	server      *string
+	protocol    *string
+	timeout     *time.Duration
+	chunkSize   *int
+	maxFileSize *int
+	lockWait    *time.Duration
+	versions    *int
+	quota       *bool
+}
+
+// Register adds the store flags to the flag set, timeout is the default request timeout of the tool
+func Register(flags *flag.FlagSet, timeout time.Duration) *Flags {
+	return &Flags{
+		server:      flags.String("server", "127.0.0.1:11211", "Memcache server"),
+		protocol:    flags.String("protocol", "text", "Memcache protocol, text or meta"),
+		timeout:     flags.Duration("timeout", timeout, "Request timeout"),
+		chunkSize:   flags.Int("chunk-size", 0, "Chunk size, derived from the server settings by default"),
+		maxFileSize: flags.Int("max-file-size", 0, "Max file size the store is configured with, in bytes"),
+		lockWait:    flags.Duration("lock-wait", time.Second, "How long to wait for a file locked by the file server"),
+		versions:    flags.Int("versions", 0, "Previous versions the file server keeps (FILE_VERSIONS)"),
+		quota:       flags.Bool("quota", true, "Update quota usage of changed files like the file server does"),
+	}
+}
+
+// Timeout is also used by tools which talk to the file server instead
+func (f *Flags) Timeout() time.Duration {
+	return *f.timeout
+}
+
+// Open keeps track of files, so they can be listed and checked
+func (f *Flags) Open() (filestore.Store, error) {
+	// Quota usage is kept up to date, limits are enforced by the file server only
+	var quota *filestore.QuotaConfig
+	if *f.quota {
+		quota = &filestore.QuotaConfig{}
+	}
+
+	return filestore.OpenMemcache(*f.server, filestore.MemcacheConfig{
+		Protocol:    filestore.MemcacheProtocol(*f.protocol),
+		Timeout:     *f.timeout,
+		ChunkSize:   *f.chunkSize,
+		MaxFileSize: *f.maxFileSize,
+		TrackFiles:  true,
+
+		// Lock files like the file server does, so files being uploaded are not changed or purged
+		Lock: &filestore.LockConfig{LeaseDuration: 30 * time.Second, WaitTimeout: *f.lockWait},
+
+		Versions: *f.versions,
+
+		Quota: quota,
+	})
+}
@@ -0,0 +1,95 @@
+package filestore
+
+import (
+	"context"
+	"sync"
+)
+
+// ContextRetriever is implemented by stores which can stop waiting for a file when the context is done
+type ContextRetriever interface {
+	RetrieveContext(ctx context.Context, filename string) ([]byte, error)
+}
+
+// RetrieveContext returns ctx.Err() once the context is done even if the file is still being retrieved.
+// Stores which don't implement ContextRetriever are waited for.
+func RetrieveContext(ctx context.Context, store Store, filename string) ([]byte, error) {
+	if retriever, ok := store.(ContextRetriever); ok {
+		return retriever.RetrieveContext(ctx, filename)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return []byte{}, err
+	}
+
+	return store.Retrieve(filename)
+}
+
+// flightGroup lets concurrent retrieves of the same file share a single fetch
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+type flight struct {
+	done     chan struct{}
+	contents []byte
+	err      error
+
+	// Number of callers who joined the flight, if any they get copies of the contents
+	joined int
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{flights: map[string]*flight{}}
+}
+
+// do runs fn unless it's already running for the key, then waits for its result. Fn isn't interrupted
+// when ctx is done so callers who are still waiting get the result.
+func (g *flightGroup) do(ctx context.Context, key string, fn func() ([]byte, error)) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return []byte{}, err
+	}
+
+	g.mu.Lock()
+	f, ok := g.flights[key]
+	if ok {
+		f.joined++
+	} else {
+		f = &flight{done: make(chan struct{})}
+		g.flights[key] = f
+
+		go func() {
+			f.contents, f.err = fn()
+
+			g.mu.Lock()
+			if g.flights[key] == f {
+				delete(g.flights, key)
+			}
+			g.mu.Unlock()
+
+			close(f.done)
+		}()
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-f.done:
+	case <-ctx.Done():
+		return []byte{}, ctx.Err()
+	}
+
+	// Nobody can join once the flight is done
+	if f.joined > 0 && f.err == nil {
+		return copyBytes(f.contents), nil
+	}
+
+	return f.contents, f.err
+}
+
+// forget makes retrieves of the file which start from now on fetch it again instead of joining
+// a fetch which started before the file was changed
+func (g *flightGroup) forget(key string) {
+	g.mu.Lock()
+	delete(g.flights, key)
+	g.mu.Unlock()
+}
@@ -0,0 +1,186 @@
+package filestore
+
+import (
+	"context"
+	"filestore/client"
+	"filestore/mock"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// blockingClient holds chunk requests until released
+type blockingClient struct {
+	client.Memcache
+	release chan struct{}
+
+	mu        sync.Mutex
+	getMultis int
+}
+
+func (c *blockingClient) GetMulti(keys []string) (map[string]*memcache.Item, error) {
+	c.mu.Lock()
+	c.getMultis++
+	c.mu.Unlock()
+
+	<-c.release
+	return c.Memcache.GetMulti(keys)
+}
+
+// waitForJoined waits until the given number of callers joined the retrieve of the file
+func waitForJoined(t *testing.T, s *memcacheStore, filename string, joined int) {
+	t.Helper()
+
+	for i := 0; i < 1000; i++ {
+		s.flights.mu.Lock()
+		f, ok := s.flights.flights[filename]
+		done := ok && f.joined >= joined
+		s.flights.mu.Unlock()
+
+		if done {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Fatalf("Retrieves of %s: want %d joined", filename, joined)
+}
+
+func newBlockingStore() (*memcacheStore, *blockingClient) {
+	m := mock.NewMemcacheClient(100)
+	err := NewMemcacheWithClient(m, MemcacheConfig{}).Store("file.dat", []byte("some content"))
+	if err != nil {
+		panic(err)
+	}
+
+	c := &blockingClient{Memcache: m, release: make(chan struct{})}
+	return NewMemcacheWithClient(c, MemcacheConfig{}).(*memcacheStore), c
+}
+
+func TestRetrieve_Coalesced(t *testing.T) {
+	s, c := newBlockingStore()
+
+	results := make(chan []byte, 10)
+	for i := 0; i < 10; i++ {
+		go func() {
+			contents, err := s.Retrieve("file.dat")
+			if err != nil {
+				t.Errorf("Retrieve: want nil, got %#v", err)
+			}
+			results <- contents
+		}()
+	}
+
+	waitForJoined(t, s, "file.dat", 9)
+	close(c.release)
+
+	for i := 0; i < 10; i++ {
+		contents := <-results
+		if string(contents) != "some content" {
+			t.Errorf("Retrieve: want %#v, got %#v", "some content", string(contents))
+		}
+
+		// Every caller has its own copy
+		contents[0] = 'X'
+	}
+
+	if c.getMultis != 1 {
+		t.Errorf("Chunk requests: want %d, got %d", 1, c.getMultis)
+	}
+}
+
+func TestRetrieve_CoalescedCancel(t *testing.T) {
+	s, c := newBlockingStore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := make(chan error)
+	go func() {
+		_, err := s.RetrieveContext(ctx, "file.dat")
+		canceled <- err
+	}()
+
+	waiting := make(chan []byte)
+	go func() {
+		contents, _ := s.Retrieve("file.dat")
+		waiting <- contents
+	}()
+
+	waitForJoined(t, s, "file.dat", 1)
+
+	cancel()
+	if err := <-canceled; err != context.Canceled {
+		t.Errorf("Canceled retrieve: want %#v, got %#v", context.Canceled, err)
+	}
+
+	// The other caller still gets the file
+	close(c.release)
+	if contents := <-waiting; string(contents) != "some content" {
+		t.Errorf("Retrieve: want %#v, got %#v", "some content", string(contents))
+	}
+}
+
+func TestRetrieve_NotCoalescedAfterChange(t *testing.T) {
+	s, c := newBlockingStore()
+
+	results := make(chan []byte, 2)
+	go func() {
+		contents, _ := s.Retrieve("file.dat")
+		results <- contents
+	}()
+
+	waitForJoined(t, s, "file.dat", 0)
+
+	// As if the file was stored again meanwhile
+	s.changed("file.dat")
+
+	go func() {
+		contents, _ := s.Retrieve("file.dat")
+		results <- contents
+	}()
+
+	waitForJoined(t, s, "file.dat", 0)
+	close(c.release)
+	<-results
+	<-results
+
+	if c.getMultis != 2 {
+		t.Errorf("Chunk requests: want %d, got %d", 2, c.getMultis)
+	}
+}
+
+type storeOnly interface {
+	Store
+}
+
+// plainStore hides optional interfaces of the store
+type plainStore struct {
+	storeOnly
+}
+
+func TestRetrieveContext(t *testing.T) {
+	s := NewMemcacheWithClient(mock.NewMemcacheClient(100), MemcacheConfig{})
+	err := s.Store("file.dat", []byte("some content"))
+	if err != nil {
+		panic(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	for _, store := range []Store{s, plainStore{s}} {
+		contents, err := RetrieveContext(ctx, store, "file.dat")
+		if err != nil || string(contents) != "some content" {
+			t.Errorf("RetrieveContext: want %#v, got %#v (%v)", "some content", string(contents), err)
+		}
+	}
+
+	cancel()
+
+	for _, store := range []Store{s, plainStore{s}} {
+		_, err := RetrieveContext(ctx, store, "file.dat")
+		if err != context.Canceled {
+			t.Errorf("RetrieveContext with canceled context: want %#v, got %#v", context.Canceled, err)
+		}
+	}
+}
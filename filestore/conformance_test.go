@@ -0,0 +1,93 @@
+package filestore_test
+
+import (
+	"filestore"
+	"filestore/client"
+	"filestore/filestoretest"
+	"filestore/mock"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+func TestConformance(t *testing.T) {
+	type testCase struct {
+		name   string
+		config filestore.MemcacheConfig
+	}
+
+	tests := []testCase{
+		{
+			name:   "Default",
+			config: filestore.MemcacheConfig{},
+		},
+		{
+			name: "All features",
+			config: filestore.MemcacheConfig{
+				TrackFiles:      true,
+				RepairCorrupted: true,
+				Lock:            &filestore.LockConfig{RetryInterval: time.Millisecond},
+				FilenamePolicy:  &filestore.FilenamePolicy{},
+				Quota:           &filestore.QuotaConfig{MaxBytes: 1 << 20},
+				Cache:           &filestore.CacheConfig{MaxBytes: 1 << 20},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.ChunkSize = 5
+			tt.config.MaxFileSize = 100
+
+			var c client.Memcache
+			filestoretest.RunConformance(t, filestoretest.ConformanceConfig{
+				NewStore: func(t *testing.T) filestore.Store {
+					c = mock.NewMemcacheClient(10000)
+					return filestore.NewMemcacheWithClient(c, tt.config)
+				},
+				MaxFileSize: tt.config.MaxFileSize,
+				Corrupt: func(t *testing.T, filename string) {
+					corruptMetadata(t, c, filename)
+				},
+			})
+		})
+	}
+}
+
+func TestConformance_Server(t *testing.T) {
+	server := newServer(t, filestoretest.Config{})
+	defer server.Close()
+
+	for _, protocol := range []filestore.MemcacheProtocol{filestore.ProtocolText, filestore.ProtocolMeta} {
+		t.Run(string(protocol), func(t *testing.T) {
+			var c client.Memcache
+			filestoretest.RunConformance(t, filestoretest.ConformanceConfig{
+				NewStore: func(t *testing.T) filestore.Store {
+					c = memcache.New(server.Addr())
+					if err := c.(*memcache.Client).FlushAll(); err != nil {
+						t.Fatalf("Unable to flush server: %v", err)
+					}
+
+					return filestore.NewMemcache(server.Addr(), filestore.MemcacheConfig{
+						Protocol:    protocol,
+						ChunkSize:   1024,
+						MaxFileSize: 4096,
+					})
+				},
+				MaxFileSize: 4096,
+				Corrupt: func(t *testing.T, filename string) {
+					corruptMetadata(t, c, filename)
+				},
+			})
+		})
+	}
+}
+
+// corruptMetadata overwrites the metadata of a file stored with the default key function
+func corruptMetadata(t *testing.T, c client.Memcache, filename string) {
+	err := c.Set(&memcache.Item{Key: "filestore:" + filestore.MD5Key(filename), Value: []byte("garbage")})
+	if err != nil {
+		t.Fatalf("Unable to corrupt %s: %v", filename, err)
+	}
+}
@@ -30,15 +30,14 @@ func main() {
 
 	log.SetLevel(log.DebugLevel)
 
-	c := filestore.NewMemcache(server, filestore.MemcacheConfig{
+	// Chunk size is derived from item size limit of the server
+	c, err := filestore.OpenMemcache(server, filestore.MemcacheConfig{
 		// Things are not super fast when reading 50MB file, give it plenty of time
 		Timeout: 5 * time.Second,
-
-		// For some reason Memcache didnt like 1048576 byte values in my setup, the max value it would take is 1048470...
-		// Memcache logs show that it gets exactly specified number of bytes, no envelop seem to be added by the used
-		// Memcache client lib.
-		ChunkSize: 1048470,
 	})
+	if err != nil {
+		log.WithError(err).Fatal("Unable to create store")
+	}
 
 	contents, err := ioutil.ReadFile(filename)
 	if err != nil {
@@ -0,0 +1,148 @@
+package filestore
+
+import (
+	"filestore/mock"
+	"fmt"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+func TestStore_PurgeOnFailure(t *testing.T) {
+	type testCase struct {
+		name  string
+		fault mock.Fault
+	}
+
+	tests := []testCase{
+		{
+			name:  "Chunk write fails",
+			fault: mock.Fault{Ops: []string{mock.OpSet}, Keys: regexp.MustCompile(`::2$`), ErrorRate: 1},
+		},
+		{
+			name:  "Chunk write times out after the chunk was stored",
+			fault: mock.Fault{Ops: []string{mock.OpSet}, Keys: regexp.MustCompile(`::2$`), ErrorRate: 1, FailAfterRequest: true},
+		},
+		{
+			name:  "Chunk evicted right after it was written",
+			fault: mock.Fault{Ops: []string{mock.OpSet}, Keys: regexp.MustCompile(`::1$`), EvictAfter: 1},
+		},
+		{
+			name:  "Verification fails",
+			fault: mock.Fault{Ops: []string{mock.OpGetMulti}, ErrorRate: 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(f func() string) { newFileID = f }(newFileID)
+			newFileID = func() string { return "file-id" }
+
+			m := mock.NewMemcacheClient(100)
+			config := MemcacheConfig{ChunkSize: 5, TrackFiles: true, Quota: &QuotaConfig{MaxBytes: 1000}}
+			s := NewMemcacheWithClient(mock.NewFaultyClient(m, mock.FaultConfig{Faults: []mock.Fault{tt.fault}}), config)
+
+			err := s.Store("ns/file.dat", []byte("some content"))
+			if err == nil {
+				t.Fatalf("Store: want error, got nil")
+			}
+
+			// Nothing is left behind
+			keys := []string{keyPrefix + MD5Key("ns/file.dat")}
+			for i := 0; i < 3; i++ {
+				keys = append(keys, buildChunkKey("file-id", i))
+			}
+			for _, key := range keys {
+				if _, err := m.Get(key); err != memcache.ErrCacheMiss {
+					t.Errorf("Key %s: want %#v, got %#v", key, memcache.ErrCacheMiss, err)
+				}
+			}
+			assertQuotaUsage(t, m, "ns", 0, 0)
+
+			// The file can be stored again once the backend recovers
+			err = NewMemcacheWithClient(m, config).Store("ns/file.dat", []byte("some content"))
+			if err != nil {
+				t.Errorf("Store again: want nil, got %#v", err)
+			}
+		})
+	}
+}
+
+func TestRetrieve_EvictedChunk(t *testing.T) {
+	for _, repair := range []bool{false, true} {
+		t.Run(fmt.Sprintf("Repair %v", repair), func(t *testing.T) {
+			m := mock.NewMemcacheClient(100)
+
+			// Store verifies the file with the first GetMulti, the chunk is evicted right after
+			c := mock.NewFaultyClient(m, mock.FaultConfig{Faults: []mock.Fault{
+				{Ops: []string{mock.OpGetMulti}, Keys: regexp.MustCompile(`::1$`), EvictAfter: 1},
+			}})
+			s := NewMemcacheWithClient(c, MemcacheConfig{ChunkSize: 5, RepairCorrupted: repair})
+
+			err := s.Store("file.dat", []byte("some content"))
+			if err != nil {
+				t.Fatalf("Store: want nil, got %#v", err)
+			}
+
+			_, err = s.Retrieve("file.dat")
+			if err != ErrFileCorrupted {
+				t.Errorf("Retrieve: want %#v, got %#v", ErrFileCorrupted, err)
+			}
+
+			// Repaired file is gone, the corrupted one stays until it's deleted
+			wantErr, wantStoreErr := ErrFileCorrupted, ErrFileAlreadyExists
+			if repair {
+				wantErr, wantStoreErr = ErrFileNotFound, nil
+			}
+
+			_, err = s.Retrieve("file.dat")
+			if err != wantErr {
+				t.Errorf("Retrieve again: want %#v, got %#v", wantErr, err)
+			}
+
+			err = s.Store("file.dat", []byte("some content"))
+			if err != wantStoreErr {
+				t.Errorf("Store again: want %#v, got %#v", wantStoreErr, err)
+			}
+		})
+	}
+}
+
+func TestFaults_Retried(t *testing.T) {
+	c := mock.NewFaultyClient(mock.NewMemcacheClient(1000), mock.FaultConfig{
+		Seed: 42,
+		Faults: []mock.Fault{
+			// Only requests which are retried fail
+			{
+				Ops:           []string{mock.OpSet, mock.OpGet, mock.OpGetMulti, mock.OpDelete},
+				ErrorRate:     0.3,
+				Err:           timeoutError{},
+				LatencyJitter: time.Millisecond,
+			},
+		},
+	})
+	s := NewMemcacheWithClient(c, MemcacheConfig{
+		ChunkSize: 5,
+		Retry:     RetryPolicy{MaxAttempts: 10, InitialBackoff: time.Microsecond},
+	})
+
+	for i := 0; i < 10; i++ {
+		filename := fmt.Sprintf("file%d.dat", i)
+
+		err := s.Store(filename, []byte("some content"))
+		if err != nil {
+			t.Fatalf("Store of %s: want nil, got %#v", filename, err)
+		}
+
+		contents, err := s.Retrieve(filename)
+		if err != nil || string(contents) != "some content" {
+			t.Errorf("Retrieve of %s: want %#v, got %#v (%v)", filename, "some content", string(contents), err)
+		}
+	}
+
+	if c.Injected() == 0 {
+		t.Errorf("Injected faults: want some, got none")
+	}
+}
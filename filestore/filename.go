@@ -0,0 +1,94 @@
+package filestore
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+const defaultMaxFilenameLength = 255
+
+// Allowed by default besides letters, marks and digits
+const defaultFilenameChars = " ._-+/()@,=~"
+
+// FilenamePolicy restricts which filenames are accepted and normalizes them, so every operation refers
+// to a file by the same name. Filenames are brought to Unicode normalization form C (NFC), so "café"
+// typed with a combining accent is the same file as with a precomposed one. Empty filenames, invalid UTF-8,
+// control characters and "." or ".." path segments are always rejected.
+type FilenamePolicy struct {
+	// Max length in bytes after normalization. Defaults to 255.
+	MaxLength int
+
+	// Character classes filenames may consist of, defaults to letters, marks and digits
+	AllowedClasses []*unicode.RangeTable
+
+	// Other characters allowed in filenames. Defaults to space and ._-+/()@,=~
+	AllowedChars string
+
+	// Optional, applied before anything else, e.g. to trim whitespace
+	Normalize func(filename string) string
+
+	// File.dat and file.dat are the same file
+	CaseInsensitive bool
+}
+
+// apply returns the normalized filename or ErrInvalidFilename, any filename is accepted as is without a policy
+func (p *FilenamePolicy) apply(filename string) (string, error) {
+	if p == nil {
+		return filename, nil
+	}
+
+	if p.Normalize != nil {
+		filename = p.Normalize(filename)
+	}
+
+	// Invalid UTF-8 is left as is and rejected below
+	filename = norm.NFC.String(filename)
+
+	if p.CaseInsensitive {
+		filename = strings.ToLower(filename)
+	}
+
+	if filename == "" {
+		return "", fmt.Errorf("%w: filename is empty", ErrInvalidFilename)
+	}
+
+	maxLength := p.MaxLength
+	if maxLength <= 0 {
+		maxLength = defaultMaxFilenameLength
+	}
+	if len(filename) > maxLength {
+		return "", fmt.Errorf("%w: filename is longer than %d bytes", ErrInvalidFilename, maxLength)
+	}
+
+	if !utf8.ValidString(filename) {
+		return "", fmt.Errorf("%w: filename is not valid UTF-8", ErrInvalidFilename)
+	}
+
+	for _, segment := range strings.Split(filename, "/") {
+		if segment == "." || segment == ".." {
+			return "", fmt.Errorf("%w: filename can't contain %q", ErrInvalidFilename, segment)
+		}
+	}
+
+	classes := p.AllowedClasses
+	if classes == nil {
+		classes = []*unicode.RangeTable{unicode.Letter, unicode.Mark, unicode.Digit}
+	}
+
+	chars := p.AllowedChars
+	if chars == "" {
+		chars = defaultFilenameChars
+	}
+
+	for _, r := range filename {
+		if unicode.IsControl(r) || !(unicode.In(r, classes...) || strings.ContainsRune(chars, r)) {
+			return "", fmt.Errorf("%w: character %q is not allowed", ErrInvalidFilename, r)
+		}
+	}
+
+	return filename, nil
+}
@@ -0,0 +1,94 @@
+package filestore
+
+import (
+	"errors"
+	"filestore/mock"
+	"strings"
+	"testing"
+	"unicode"
+)
+
+func TestFilenamePolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   *FilenamePolicy
+		filename string
+		want     string
+		wantErr  error
+	}{
+		{"No policy", nil, "../weird\x00name", "../weird\x00name", nil},
+		{"Valid filename", &FilenamePolicy{}, "dir/my file (1).dat", "dir/my file (1).dat", nil},
+		{"Unicode letters", &FilenamePolicy{}, "café.dat", "café.dat", nil},
+		{"Empty", &FilenamePolicy{}, "", "", ErrInvalidFilename},
+		{"Parent directory", &FilenamePolicy{}, "dir/../file.dat", "", ErrInvalidFilename},
+		{"Current directory", &FilenamePolicy{}, "./file.dat", "", ErrInvalidFilename},
+		{"Dots within a name", &FilenamePolicy{}, "file..dat", "file..dat", nil},
+		{"Control character", &FilenamePolicy{}, "file\n.dat", "", ErrInvalidFilename},
+		{"Invalid UTF-8", &FilenamePolicy{}, "file\xff.dat", "", ErrInvalidFilename},
+		{"Not allowed character", &FilenamePolicy{}, "file*.dat", "", ErrInvalidFilename},
+		{"Too long", &FilenamePolicy{MaxLength: 8}, "file.dat1", "", ErrInvalidFilename},
+		{"Default max length", &FilenamePolicy{}, strings.Repeat("a", 256), "", ErrInvalidFilename},
+		{"Custom classes", &FilenamePolicy{AllowedClasses: []*unicode.RangeTable{unicode.ASCII_Hex_Digit}}, "cafe.dad", "cafe.dad", nil},
+		{"Custom classes rejecting", &FilenamePolicy{AllowedClasses: []*unicode.RangeTable{unicode.ASCII_Hex_Digit}}, "café.dad", "", ErrInvalidFilename},
+		{"Custom chars", &FilenamePolicy{AllowedChars: "."}, "file-1.dat", "", ErrInvalidFilename},
+		{"Case insensitive", &FilenamePolicy{CaseInsensitive: true}, "Dir/File.DAT", "dir/file.dat", nil},
+		{"Normalized", &FilenamePolicy{Normalize: strings.TrimSpace}, " file.dat ", "file.dat", nil},
+		{"Combining accent", &FilenamePolicy{}, "cafe\u0301.dat", "caf\u00e9.dat", nil},
+		{"Angstrom sign", &FilenamePolicy{}, "\u212bngstr\u00f6m.dat", "\u00c5ngstr\u00f6m.dat", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.policy.apply(tt.filename)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Error: want %#v, got %#v", tt.wantErr, err)
+			}
+
+			if got != tt.want {
+				t.Errorf("Filename: want %#v, got %#v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestFilenamePolicy_Store(t *testing.T) {
+	s := NewMemcacheWithClient(mock.NewMemcacheClient(100), MemcacheConfig{
+		FilenamePolicy: &FilenamePolicy{CaseInsensitive: true},
+	})
+
+	err := s.Store("../file.dat", []byte("some content"))
+	if !errors.Is(err, ErrInvalidFilename) {
+		t.Errorf("Store: want %#v, got %#v", ErrInvalidFilename, err)
+	}
+
+	err = s.Store("File.dat", []byte("some content"))
+	if err != nil {
+		t.Fatalf("Store: want nil, got %#v", err)
+	}
+
+	contents, err := s.Retrieve("FILE.DAT")
+	if err != nil || string(contents) != "some content" {
+		t.Errorf("Retrieve: want %#v, got %#v (%v)", "some content", string(contents), err)
+	}
+
+	_, err = s.Retrieve("file\x00.dat")
+	if !errors.Is(err, ErrInvalidFilename) {
+		t.Errorf("Retrieve: want %#v, got %#v", ErrInvalidFilename, err)
+	}
+
+	err = s.Delete("file.DAT")
+	if err != nil {
+		t.Errorf("Delete: want nil, got %#v", err)
+	}
+
+	// Decomposed and precomposed accents refer to the same file
+	err = s.Store("cafe\u0301.dat", []byte("some content"))
+	if err != nil {
+		t.Fatalf("Store: want nil, got %#v", err)
+	}
+
+	contents, err = s.Retrieve("caf\u00e9.dat")
+	if err != nil || string(contents) != "some content" {
+		t.Errorf("Retrieve: want %#v, got %#v (%v)", "some content", string(contents), err)
+	}
+}
@@ -2,6 +2,8 @@ package filestore
 
 import (
 	"errors"
+	"fmt"
+	"time"
 )
 
 var (
@@ -10,12 +12,101 @@ var (
 	ErrFileTooLarge      = errors.New("File is too large")
 	ErrFileCorrupted     = errors.New("File is corrupted, try storing it again")
 	ErrChecksumFailed    = errors.New("Unable to store file: checksum verification failed")
+	ErrFileModified      = errors.New("File was modified concurrently, try again")
+	ErrInvalidRange      = errors.New("Invalid range")
+	ErrNotSupported      = errors.New("Operation is not supported")
+	ErrFileLocked        = errors.New("File is locked by another writer, try again")
+	ErrVersionNotFound   = errors.New("Version not found")
+	ErrInvalidArchive    = errors.New("Invalid archive")
+	ErrInvalidFilename   = errors.New("Invalid filename")
+	ErrQuotaExceeded     = errors.New("Storage quota exceeded")
+	ErrChunkSizeTooLarge = errors.New("Chunk size exceeds Memcache item size limit")
+	ErrRegistryFull      = errors.New("File registry is full")
 
-	errKeysMissing = errors.New("Some keys are missing")
+	ErrBackendUnavailable = errors.New("Backend is unavailable, try again later")
+
+	errKeysMissing     = errors.New("Some keys are missing")
+	errMetadataInvalid = errors.New("Unable to decode metadata")
+	errLegacyMetadata  = errors.New("File was stored by an older version and has to be stored again")
+	errFileChanged     = errors.New("File was changed while it was retrieved")
 )
 
+// BackendUnavailableError is returned when requests to the backend are not attempted
+// because it has been failing recently, it matches ErrBackendUnavailable with errors.Is
+type BackendUnavailableError struct {
+	RetryAfter time.Duration
+}
+
+func (e *BackendUnavailableError) Error() string {
+	return ErrBackendUnavailable.Error()
+}
+
+func (e *BackendUnavailableError) Unwrap() error {
+	return ErrBackendUnavailable
+}
+
 type Store interface {
 	Store(filename string, contents []byte) error
 	Retrieve(filename string) ([]byte, error)
 	Delete(filename string) error
 }
+
+// Renamer is implemented by stores which can rename files without retrieving them
+type Renamer interface {
+	Rename(from string, to string) error
+}
+
+// Copier is implemented by stores which can copy files to a new name by themselves
+type Copier interface {
+	Copy(from string, to string) error
+}
+
+// Appender is implemented by stores which can add data to the end of files
+type Appender interface {
+	Append(filename string, data []byte) error
+}
+
+// RangeWriter is implemented by stores which can overwrite parts of files
+type RangeWriter interface {
+	WriteAt(filename string, offset int, data []byte) error
+}
+
+// Rename fails with ErrFileAlreadyExists if a file with the new name exists
+func Rename(store Store, from string, to string) error {
+	renamer, ok := store.(Renamer)
+	if !ok {
+		return fmt.Errorf("%w: store can't rename files", ErrNotSupported)
+	}
+
+	return renamer.Rename(from, to)
+}
+
+// Copy fails with ErrFileAlreadyExists if a file with the new name exists
+func Copy(store Store, from string, to string) error {
+	copier, ok := store.(Copier)
+	if !ok {
+		return fmt.Errorf("%w: store can't copy files", ErrNotSupported)
+	}
+
+	return copier.Copy(from, to)
+}
+
+// Append fails with ErrFileNotFound if the file doesn't exist
+func Append(store Store, filename string, data []byte) error {
+	appender, ok := store.(Appender)
+	if !ok {
+		return fmt.Errorf("%w: store can't append to files", ErrNotSupported)
+	}
+
+	return appender.Append(filename, data)
+}
+
+// WriteAt fails with ErrInvalidRange if the offset is past the end of the file
+func WriteAt(store Store, filename string, offset int, data []byte) error {
+	writer, ok := store.(RangeWriter)
+	if !ok {
+		return fmt.Errorf("%w: store can't write ranges of files", ErrNotSupported)
+	}
+
+	return writer.WriteAt(filename, offset, data)
+}
@@ -0,0 +1,591 @@
+package filestoretest
+
+import (
+	"bytes"
+	"errors"
+	"filestore"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// ConformanceConfig describes the store under test
+type ConformanceConfig struct {
+	// NewStore returns an empty store, it's called once for every test
+	NewStore func(t *testing.T) filestore.Store
+
+	// Max file size the store is configured with, size limit tests are skipped if zero
+	MaxFileSize int
+
+	// Corrupt damages a file of the store NewStore returned last so it can't be retrieved anymore,
+	// corruption tests are skipped if nil
+	Corrupt func(t *testing.T, filename string)
+
+	// Number of goroutines of the concurrency tests, defaults to 10
+	Concurrency int
+}
+
+// RunConformance checks the store behaves the way the Store interface promises:
+// duplicates, size limits, zero-length files, missing files and concurrent access.
+// Operations of optional interfaces like Renamer are checked if the store implements them.
+func RunConformance(t *testing.T, config ConformanceConfig) {
+	if config.Concurrency <= 0 {
+		config.Concurrency = 10
+	}
+
+	tests := []struct {
+		name string
+		test func(t *testing.T, s filestore.Store, config ConformanceConfig)
+	}{
+		{"Store and retrieve", testStoreRetrieve},
+		{"Zero-length file", testZeroLength},
+		{"Duplicate", testDuplicate},
+		{"Not found", testNotFound},
+		{"Size limit", testSizeLimit},
+		{"Delete", testDelete},
+		{"Rename", testRename},
+		{"Copy", testCopy},
+		{"Append", testAppend},
+		{"Write at", testWriteAt},
+		{"Stat", testStat},
+		{"Corrupted", testCorrupted},
+		{"Concurrent access", testConcurrentAccess},
+		{"Concurrent writers", testConcurrentWriters},
+		{"Concurrent appends", testConcurrentAppends},
+		{"Concurrent writes at", testConcurrentWritesAt},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, config.NewStore(t), config)
+		})
+	}
+}
+
+func testStoreRetrieve(t *testing.T, s filestore.Store, config ConformanceConfig) {
+	contents := []byte("some content")
+	mustStore(t, s, "file.dat", contents)
+
+	// Neither the stored nor the retrieved slice is shared with the store
+	contents[0] = 'X'
+	retrieved := assertContents(t, s, "file.dat", "some content")
+	if len(retrieved) > 0 {
+		retrieved[0] = 'X'
+	}
+	assertContents(t, s, "file.dat", "some content")
+
+	mustStore(t, s, "other.dat", []byte("other content"))
+	assertContents(t, s, "other.dat", "other content")
+	assertContents(t, s, "file.dat", "some content")
+}
+
+func testZeroLength(t *testing.T, s filestore.Store, config ConformanceConfig) {
+	mustStore(t, s, "empty.dat", []byte{})
+	assertContents(t, s, "empty.dat", "")
+
+	err := s.Store("empty.dat", nil)
+	assertError(t, "Store of an existing empty file", filestore.ErrFileAlreadyExists, err)
+
+	mustStore(t, s, "nil.dat", nil)
+	assertContents(t, s, "nil.dat", "")
+
+	if _, ok := s.(filestore.Appender); ok {
+		err = filestore.Append(s, "empty.dat", []byte("content"))
+		assertError(t, "Append to an empty file", nil, err)
+		assertContents(t, s, "empty.dat", "content")
+	}
+
+	if _, ok := s.(filestore.RangeWriter); ok {
+		err = filestore.WriteAt(s, "nil.dat", 0, []byte("content"))
+		assertError(t, "WriteAt to an empty file", nil, err)
+		assertContents(t, s, "nil.dat", "content")
+	}
+
+	if _, ok := s.(filestore.Copier); ok {
+		err = filestore.Copy(s, "missing.dat", "empty-copy.dat")
+		assertError(t, "Copy of a missing file", filestore.ErrFileNotFound, err)
+
+		mustStore(t, s, "another-empty.dat", []byte{})
+		err = filestore.Copy(s, "another-empty.dat", "empty-copy.dat")
+		assertError(t, "Copy of an empty file", nil, err)
+		assertContents(t, s, "empty-copy.dat", "")
+	}
+}
+
+func testDuplicate(t *testing.T, s filestore.Store, config ConformanceConfig) {
+	mustStore(t, s, "file.dat", []byte("some content"))
+
+	err := s.Store("file.dat", []byte("other content"))
+	assertError(t, "Store of an existing file", filestore.ErrFileAlreadyExists, err)
+	assertContents(t, s, "file.dat", "some content")
+
+	// A file can be stored again once it's deleted
+	err = s.Delete("file.dat")
+	assertError(t, "Delete", nil, err)
+
+	err = s.Store("file.dat", []byte("other content"))
+	assertError(t, "Store of a deleted file", nil, err)
+	assertContents(t, s, "file.dat", "other content")
+}
+
+func testNotFound(t *testing.T, s filestore.Store, config ConformanceConfig) {
+	_, err := s.Retrieve("missing.dat")
+	assertError(t, "Retrieve", filestore.ErrFileNotFound, err)
+
+	err = s.Delete("missing.dat")
+	assertError(t, "Delete", filestore.ErrFileNotFound, err)
+
+	// Optional operations the store doesn't support fail with ErrNotSupported instead
+	err = filestore.Rename(s, "missing.dat", "other.dat")
+	assertOptional(t, "Rename", filestore.ErrFileNotFound, err)
+
+	err = filestore.Copy(s, "missing.dat", "other.dat")
+	assertOptional(t, "Copy", filestore.ErrFileNotFound, err)
+
+	err = filestore.Append(s, "missing.dat", []byte("data"))
+	assertOptional(t, "Append", filestore.ErrFileNotFound, err)
+
+	err = filestore.WriteAt(s, "missing.dat", 0, []byte("data"))
+	assertOptional(t, "WriteAt", filestore.ErrFileNotFound, err)
+
+	// Failed operations don't create files
+	for _, filename := range []string{"missing.dat", "other.dat"} {
+		_, err := s.Retrieve(filename)
+		assertError(t, "Retrieve of "+filename, filestore.ErrFileNotFound, err)
+	}
+}
+
+func testSizeLimit(t *testing.T, s filestore.Store, config ConformanceConfig) {
+	max := config.MaxFileSize
+	if max == 0 {
+		t.Skip("MaxFileSize is not configured")
+	}
+
+	largest := bytes.Repeat([]byte("x"), max)
+	err := s.Store("largest.dat", largest)
+	assertError(t, "Store of the largest file", nil, err)
+
+	retrieved, err := s.Retrieve("largest.dat")
+	if err != nil || !bytes.Equal(retrieved, largest) {
+		t.Errorf("Retrieve of the largest file: want %d bytes, got %d bytes (%v)", max, len(retrieved), err)
+	}
+
+	err = s.Store("too-large.dat", append(largest, 'x'))
+	assertError(t, "Store of a too large file", filestore.ErrFileTooLarge, err)
+
+	_, err = s.Retrieve("too-large.dat")
+	assertError(t, "Retrieve of a too large file", filestore.ErrFileNotFound, err)
+
+	// Growing a file past the limit fails and leaves it unchanged
+	err = filestore.Append(s, "largest.dat", []byte("x"))
+	assertOptional(t, "Append past the limit", filestore.ErrFileTooLarge, err)
+
+	err = filestore.WriteAt(s, "largest.dat", max-1, []byte("xx"))
+	assertOptional(t, "WriteAt past the limit", filestore.ErrFileTooLarge, err)
+
+	retrieved, err = s.Retrieve("largest.dat")
+	if err != nil || !bytes.Equal(retrieved, largest) {
+		t.Errorf("Retrieve after failed writes: want %d bytes, got %d bytes (%v)", max, len(retrieved), err)
+	}
+}
+
+func testDelete(t *testing.T, s filestore.Store, config ConformanceConfig) {
+	mustStore(t, s, "file.dat", []byte("some content"))
+	mustStore(t, s, "other.dat", []byte("other content"))
+
+	err := s.Delete("file.dat")
+	assertError(t, "Delete", nil, err)
+
+	_, err = s.Retrieve("file.dat")
+	assertError(t, "Retrieve of a deleted file", filestore.ErrFileNotFound, err)
+
+	err = s.Delete("file.dat")
+	assertError(t, "Delete of a deleted file", filestore.ErrFileNotFound, err)
+
+	assertContents(t, s, "other.dat", "other content")
+}
+
+func testRename(t *testing.T, s filestore.Store, config ConformanceConfig) {
+	if _, ok := s.(filestore.Renamer); !ok {
+		t.Skip("Store can't rename files")
+	}
+
+	mustStore(t, s, "file.dat", []byte("some content"))
+
+	err := filestore.Rename(s, "file.dat", "renamed.dat")
+	assertError(t, "Rename", nil, err)
+	assertContents(t, s, "renamed.dat", "some content")
+
+	_, err = s.Retrieve("file.dat")
+	assertError(t, "Retrieve of the renamed file", filestore.ErrFileNotFound, err)
+
+	// The old name can be used again
+	mustStore(t, s, "file.dat", []byte("other content"))
+
+	err = filestore.Rename(s, "file.dat", "renamed.dat")
+	assertError(t, "Rename onto an existing file", filestore.ErrFileAlreadyExists, err)
+	assertContents(t, s, "file.dat", "other content")
+	assertContents(t, s, "renamed.dat", "some content")
+}
+
+func testCopy(t *testing.T, s filestore.Store, config ConformanceConfig) {
+	if _, ok := s.(filestore.Copier); !ok {
+		t.Skip("Store can't copy files")
+	}
+
+	mustStore(t, s, "file.dat", []byte("some content"))
+
+	err := filestore.Copy(s, "file.dat", "copy.dat")
+	assertError(t, "Copy", nil, err)
+	assertContents(t, s, "file.dat", "some content")
+	assertContents(t, s, "copy.dat", "some content")
+
+	err = filestore.Copy(s, "file.dat", "copy.dat")
+	assertError(t, "Copy onto an existing file", filestore.ErrFileAlreadyExists, err)
+
+	// Copies are independent of each other
+	err = s.Delete("file.dat")
+	assertError(t, "Delete of the original", nil, err)
+	assertContents(t, s, "copy.dat", "some content")
+
+	if _, ok := s.(filestore.Appender); ok {
+		mustStore(t, s, "file.dat", []byte("some content"))
+		err = filestore.Append(s, "copy.dat", []byte(" and more"))
+		assertError(t, "Append to the copy", nil, err)
+		assertContents(t, s, "file.dat", "some content")
+		assertContents(t, s, "copy.dat", "some content and more")
+	}
+}
+
+func testAppend(t *testing.T, s filestore.Store, config ConformanceConfig) {
+	if _, ok := s.(filestore.Appender); !ok {
+		t.Skip("Store can't append to files")
+	}
+
+	mustStore(t, s, "file.dat", []byte("some"))
+
+	for _, data := range []string{" content", "", " and more"} {
+		err := filestore.Append(s, "file.dat", []byte(data))
+		assertError(t, fmt.Sprintf("Append of %q", data), nil, err)
+	}
+
+	assertContents(t, s, "file.dat", "some content and more")
+}
+
+func testWriteAt(t *testing.T, s filestore.Store, config ConformanceConfig) {
+	if _, ok := s.(filestore.RangeWriter); !ok {
+		t.Skip("Store can't write ranges of files")
+	}
+
+	mustStore(t, s, "file.dat", []byte("some content"))
+
+	tests := []struct {
+		offset int
+		data   string
+		err    error
+		want   string
+	}{
+		{offset: 0, data: "SOME", want: "SOME content"},
+		{offset: 5, data: "CON", want: "SOME CONtent"},
+		{offset: 8, data: "TENT and more", want: "SOME CONTENT and more"},
+		{offset: 21, data: "!", want: "SOME CONTENT and more!"},
+		{offset: 23, data: "x", err: filestore.ErrInvalidRange, want: "SOME CONTENT and more!"},
+		{offset: -1, data: "x", err: filestore.ErrInvalidRange, want: "SOME CONTENT and more!"},
+	}
+
+	for _, tt := range tests {
+		err := filestore.WriteAt(s, "file.dat", tt.offset, []byte(tt.data))
+		assertError(t, fmt.Sprintf("WriteAt of %q at %d", tt.data, tt.offset), tt.err, err)
+		assertContents(t, s, "file.dat", tt.want)
+	}
+}
+
+func testStat(t *testing.T, s filestore.Store, config ConformanceConfig) {
+	if _, ok := s.(filestore.Stater); !ok {
+		t.Skip("Store can't describe files")
+	}
+
+	_, err := filestore.Stat(s, "missing.dat")
+	assertError(t, "Stat of a missing file", filestore.ErrFileNotFound, err)
+
+	mustStore(t, s, "file.dat", []byte("some content"))
+	mustStore(t, s, "empty.dat", []byte{})
+	mustStore(t, s, "other.dat", []byte("other content"))
+
+	info, err := filestore.Stat(s, "file.dat")
+	if err != nil || info.Size != 12 || info.Version < 1 {
+		t.Errorf("Stat: want size %d, got %#v (%v)", 12, info, err)
+	}
+
+	empty, err := filestore.Stat(s, "empty.dat")
+	if err != nil || empty.Size != 0 {
+		t.Errorf("Stat of an empty file: want size %d, got %#v (%v)", 0, empty, err)
+	}
+
+	other, err := filestore.Stat(s, "other.dat")
+	if err != nil || other.Checksum == info.Checksum {
+		t.Errorf("Stat of another file: want another checksum than %#v, got %#v (%v)", info.Checksum, other, err)
+	}
+}
+
+func testCorrupted(t *testing.T, s filestore.Store, config ConformanceConfig) {
+	if config.Corrupt == nil {
+		t.Skip("Corrupt is not configured")
+	}
+
+	mustStore(t, s, "file.dat", []byte("some content"))
+	config.Corrupt(t, "file.dat")
+
+	_, err := s.Retrieve("file.dat")
+	assertError(t, "Retrieve of a corrupted file", filestore.ErrFileCorrupted, err)
+
+	// Corrupted files can be deleted and stored again, unless the store already purged them
+	err = s.Delete("file.dat")
+	if err != nil && !errors.Is(err, filestore.ErrFileNotFound) {
+		t.Errorf("Delete of a corrupted file: want nil or %#v, got %#v", filestore.ErrFileNotFound, err)
+	}
+
+	mustStore(t, s, "file.dat", []byte("some content"))
+	assertContents(t, s, "file.dat", "some content")
+}
+
+// testConcurrentAccess works on separate files from every goroutine and shares one between them
+func testConcurrentAccess(t *testing.T, s filestore.Store, config ConformanceConfig) {
+	mustStore(t, s, "shared.dat", []byte("shared content"))
+
+	errs := make(chan error, config.Concurrency)
+	wg := sync.WaitGroup{}
+	for i := 0; i < config.Concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- concurrentClient(s, i)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	assertContents(t, s, "shared.dat", "shared content")
+}
+
+func concurrentClient(s filestore.Store, i int) error {
+	filename := fmt.Sprintf("file%d.dat", i)
+	contents := fmt.Sprintf("content of file %d", i)
+
+	if err := s.Store(filename, []byte(contents)); err != nil {
+		return fmt.Errorf("Store of %s: want nil, got %#v", filename, err)
+	}
+
+	for j := 0; j < 5; j++ {
+		retrieved, err := s.Retrieve(filename)
+		if err != nil || string(retrieved) != contents {
+			return fmt.Errorf("Retrieve of %s: want %#v, got %#v (%v)", filename, contents, string(retrieved), err)
+		}
+
+		shared, err := s.Retrieve("shared.dat")
+		if err != nil || string(shared) != "shared content" {
+			return fmt.Errorf("Retrieve of shared.dat: want %#v, got %#v (%v)", "shared content", string(shared), err)
+		}
+	}
+
+	if _, ok := s.(filestore.Renamer); ok {
+		renamed := fmt.Sprintf("renamed%d.dat", i)
+		if err := filestore.Rename(s, filename, renamed); err != nil {
+			return fmt.Errorf("Rename of %s: want nil, got %#v", filename, err)
+		}
+		filename = renamed
+	}
+
+	if err := s.Delete(filename); err != nil {
+		return fmt.Errorf("Delete of %s: want nil, got %#v", filename, err)
+	}
+
+	return nil
+}
+
+// testConcurrentWriters stores the same file from every goroutine, exactly one of them wins
+func testConcurrentWriters(t *testing.T, s filestore.Store, config ConformanceConfig) {
+	errs := make(chan error, config.Concurrency)
+	wg := sync.WaitGroup{}
+	for i := 0; i < config.Concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- s.Store("contended.dat", []byte(fmt.Sprintf("content %d", i)))
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	stored := 0
+	for err := range errs {
+		if err == nil {
+			stored++
+		} else if !errors.Is(err, filestore.ErrFileAlreadyExists) && !errors.Is(err, filestore.ErrFileLocked) {
+			t.Errorf("Concurrent Store: want nil or %#v, got %#v", filestore.ErrFileAlreadyExists, err)
+		}
+	}
+
+	if stored != 1 {
+		t.Errorf("Concurrent Store: want %d successful, got %d", 1, stored)
+	}
+
+	retrieved, err := s.Retrieve("contended.dat")
+	if err != nil || !bytes.HasPrefix(retrieved, []byte("content ")) {
+		t.Errorf("Retrieve: want the winning content, got %#v (%v)", string(retrieved), err)
+	}
+}
+
+// testConcurrentAppends appends a different record from every goroutine, successful appends show up exactly once
+// and failed ones not at all
+func testConcurrentAppends(t *testing.T, s filestore.Store, config ConformanceConfig) {
+	if _, ok := s.(filestore.Appender); !ok {
+		t.Skip("Store can't append to files")
+	}
+
+	mustStore(t, s, "appended.dat", []byte("start"))
+
+	errs := concurrently(config.Concurrency, func(i int) error {
+		return filestore.Append(s, "appended.dat", []byte(fmt.Sprintf("<%d>", i)))
+	})
+
+	want := map[string]bool{}
+	for i, err := range errs {
+		if err == nil {
+			want[fmt.Sprintf("<%d>", i)] = true
+		} else if !errors.Is(err, filestore.ErrFileModified) && !errors.Is(err, filestore.ErrFileLocked) {
+			t.Errorf("Concurrent Append: want nil or %#v, got %#v", filestore.ErrFileModified, err)
+		}
+	}
+	if len(want) == 0 {
+		t.Fatalf("Concurrent Append: want some successful, got none")
+	}
+
+	contents, err := s.Retrieve("appended.dat")
+	if err != nil || !bytes.HasPrefix(contents, []byte("start")) {
+		t.Fatalf("Retrieve: want the initial content followed by the appended records, got %#v (%v)", string(contents), err)
+	}
+
+	got := map[string]bool{}
+	for _, record := range strings.SplitAfter(string(contents[len("start"):]), ">") {
+		if record == "" {
+			continue
+		}
+
+		if got[record] || !want[record] {
+			t.Errorf("Retrieve: want each of the successful appends %v once, got %#v", want, string(contents))
+			break
+		}
+		got[record] = true
+	}
+
+	if len(got) != len(want) {
+		t.Errorf("Retrieve: want the successful appends %v, got %#v", want, string(contents))
+	}
+}
+
+// testConcurrentWritesAt writes a separate range of the same file from every goroutine. Ranges share chunks,
+// still successful writes show up and failed ones leave their range unchanged.
+func testConcurrentWritesAt(t *testing.T, s filestore.Store, config ConformanceConfig) {
+	if _, ok := s.(filestore.RangeWriter); !ok {
+		t.Skip("Store can't write ranges of files")
+	}
+
+	const size = 4
+	mustStore(t, s, "written.dat", bytes.Repeat([]byte("."), config.Concurrency*size))
+
+	record := func(i int) string {
+		return fmt.Sprintf("[%0*d]", size-2, i%100)
+	}
+
+	errs := concurrently(config.Concurrency, func(i int) error {
+		return filestore.WriteAt(s, "written.dat", i*size, []byte(record(i)))
+	})
+
+	contents, err := s.Retrieve("written.dat")
+	if err != nil || len(contents) != config.Concurrency*size {
+		t.Fatalf("Retrieve: want %d bytes, got %#v (%v)", config.Concurrency*size, string(contents), err)
+	}
+
+	written := 0
+	for i, err := range errs {
+		want := record(i)
+		if err == nil {
+			written++
+		} else if errors.Is(err, filestore.ErrFileModified) || errors.Is(err, filestore.ErrFileLocked) {
+			want = strings.Repeat(".", size)
+		} else {
+			t.Errorf("Concurrent WriteAt: want nil or %#v, got %#v", filestore.ErrFileModified, err)
+			continue
+		}
+
+		if got := string(contents[i*size : (i+1)*size]); got != want {
+			t.Errorf("Range of writer %d: want %#v, got %#v (%v)", i, want, got, err)
+		}
+	}
+
+	if written == 0 {
+		t.Errorf("Concurrent WriteAt: want some successful, got none")
+	}
+}
+
+// concurrently runs fn from n goroutines and returns their errors by index
+func concurrently(n int, fn func(i int) error) []error {
+	errs := make([]error, n)
+	wg := sync.WaitGroup{}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = fn(i)
+		}(i)
+	}
+	wg.Wait()
+
+	return errs
+}
+
+func mustStore(t *testing.T, s filestore.Store, filename string, contents []byte) {
+	t.Helper()
+
+	if err := s.Store(filename, contents); err != nil {
+		t.Fatalf("Store of %s: want nil, got %#v", filename, err)
+	}
+}
+
+func assertContents(t *testing.T, s filestore.Store, filename string, want string) []byte {
+	t.Helper()
+
+	contents, err := s.Retrieve(filename)
+	if err != nil || string(contents) != want {
+		t.Errorf("Retrieve of %s: want %#v, got %#v (%v)", filename, want, string(contents), err)
+	}
+
+	return contents
+}
+
+// assertOptional is assertError for operations of optional interfaces, which the store may not implement
+func assertOptional(t *testing.T, op string, want error, got error) {
+	t.Helper()
+
+	if errors.Is(got, filestore.ErrNotSupported) {
+		return
+	}
+
+	assertError(t, op, want, got)
+}
+
+func assertError(t *testing.T, op string, want error, got error) {
+	t.Helper()
+
+	if want == nil && got != nil || want != nil && !errors.Is(got, want) {
+		t.Errorf("%s: want %#v, got %#v", op, want, got)
+	}
+}
@@ -0,0 +1,299 @@
+package filestoretest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// metaFlag returns the token of the flag, e.g. "5" for T5, and if the flag was given
+func metaFlag(flags []string, flag byte) (string, bool) {
+	for _, f := range flags {
+		if len(f) > 0 && f[0] == flag {
+			return f[1:], true
+		}
+	}
+
+	return "", false
+}
+
+// metaWriter writes a response unless it's one the quiet flag suppresses
+type metaWriter struct {
+	w     *bufio.Writer
+	quiet bool
+}
+
+// status writes the response line, hide is the code the quiet flag suppresses
+func (m metaWriter) status(code string, hide string, returned []string) {
+	if m.quiet && code == hide {
+		return
+	}
+
+	fmt.Fprint(m.w, strings.Join(append([]string{code}, returned...), " ")+"\r\n")
+}
+
+// returnedFlags answers the flags of mg and ma which ask for something about the item
+func returnedFlags(i *item, flags []string) []string {
+	returned := []string{}
+	for _, f := range flags {
+		if f == "" {
+			continue
+		}
+
+		switch f[0] {
+		case 'f':
+			returned = append(returned, "f"+strconv.FormatUint(uint64(i.flags), 10))
+		case 'c':
+			returned = append(returned, "c"+strconv.FormatUint(i.cas, 10))
+		case 'k':
+			returned = append(returned, "k"+i.key)
+		case 's':
+			returned = append(returned, "s"+strconv.Itoa(len(i.value)))
+		case 't':
+			ttl := int64(-1)
+			if !i.expires.IsZero() {
+				ttl = int64(time.Until(i.expires).Seconds())
+			}
+			returned = append(returned, "t"+strconv.FormatInt(ttl, 10))
+		case 'O':
+			returned = append(returned, f)
+		}
+	}
+
+	return returned
+}
+
+func (s *Server) metaGet(w *bufio.Writer, args []string) {
+	if len(args) < 1 {
+		fmt.Fprint(w, "CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+
+	key, flags := args[0], args[1:]
+	_, quiet := metaFlag(flags, 'q')
+	_, withValue := metaFlag(flags, 'v')
+	m := metaWriter{w: w, quiet: quiet}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.get(key)
+	if i == nil {
+		m.status("EN", "EN", nil)
+		return
+	}
+
+	returned := returnedFlags(i, flags)
+	if !withValue {
+		m.status("HD", "", returned)
+		return
+	}
+
+	m.status("VA", "", append([]string{strconv.Itoa(len(i.value))}, returned...))
+	_, _ = w.Write(i.value)
+	_, _ = w.WriteString("\r\n")
+}
+
+// metaSet reads the data before anything else, so the connection stays usable after errors
+func (s *Server) metaSet(r *bufio.Reader, w *bufio.Writer, args []string) error {
+	if len(args) < 2 {
+		_, err := w.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return err
+	}
+
+	size, err := strconv.Atoi(args[1])
+	if err != nil || size < 0 {
+		_, err := w.WriteString("CLIENT_ERROR bad data chunk\r\n")
+		return err
+	}
+
+	data := make([]byte, size+2)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return err
+	}
+	if string(data[size:]) != "\r\n" {
+		_, _ = w.WriteString("CLIENT_ERROR bad data chunk\r\n")
+		return fmt.Errorf("Bad data chunk")
+	}
+
+	key, flags := args[0], args[2:]
+	if len(key) > 250 {
+		_, err := w.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return err
+	}
+
+	_, quiet := metaFlag(flags, 'q')
+	m := metaWriter{w: w, quiet: quiet}
+
+	clientFlags, exptime := uint64(0), int64(0)
+	var cas uint64
+	var err1, err2, err3 error
+	if f, ok := metaFlag(flags, 'F'); ok {
+		clientFlags, err1 = strconv.ParseUint(f, 10, 32)
+	}
+	if t, ok := metaFlag(flags, 'T'); ok {
+		exptime, err2 = strconv.ParseInt(t, 10, 64)
+	}
+	c, withCAS := metaFlag(flags, 'C')
+	if withCAS {
+		cas, err3 = strconv.ParseUint(c, 10, 64)
+	}
+	mode, _ := metaFlag(flags, 'M')
+	if err1 != nil || err2 != nil || err3 != nil || len(mode) > 1 || !strings.Contains("SEAPR", strings.ToUpper(mode)) {
+		_, err := w.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return err
+	}
+	mode = strings.ToUpper(mode)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing := s.get(key)
+	value := data[:size]
+
+	switch {
+	case withCAS && existing == nil:
+		m.status("NF", "", nil)
+		return nil
+	case withCAS && existing.cas != cas:
+		m.status("EX", "", nil)
+		return nil
+	case mode == "E" && existing != nil,
+		(mode == "A" || mode == "P" || mode == "R") && existing == nil:
+		m.status("NS", "", nil)
+		return nil
+	case mode == "A":
+		value = append(append([]byte{}, existing.value...), value...)
+	case mode == "P":
+		value = append(append([]byte{}, value...), existing.value...)
+	}
+
+	i := &item{key: key, value: value, flags: uint32(clientFlags)}
+	if existing != nil && (mode == "A" || mode == "P") {
+		i.flags, i.expires = existing.flags, existing.expires
+	} else {
+		i.expires = s.expiry(exptime)
+	}
+
+	if i.size() > s.itemSizeMax {
+		_, err = w.WriteString("SERVER_ERROR object too large for cache\r\n")
+		return err
+	}
+
+	if !s.set(i) {
+		_, err = w.WriteString("SERVER_ERROR out of memory storing object\r\n")
+		return err
+	}
+
+	m.status("HD", "HD", nil)
+
+	return nil
+}
+
+func (s *Server) metaDelete(w *bufio.Writer, args []string) {
+	if len(args) < 1 {
+		fmt.Fprint(w, "CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+
+	key, flags := args[0], args[1:]
+	_, quiet := metaFlag(flags, 'q')
+	m := metaWriter{w: w, quiet: quiet}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.get(key)
+	if i == nil {
+		m.status("NF", "", nil)
+		return
+	}
+
+	if c, ok := metaFlag(flags, 'C'); ok && c != strconv.FormatUint(i.cas, 10) {
+		m.status("EX", "", nil)
+		return
+	}
+
+	s.remove(key)
+	m.status("HD", "HD", nil)
+}
+
+// metaArithmetic doesn't create missing items, the N flag is not supported
+func (s *Server) metaArithmetic(w *bufio.Writer, args []string) {
+	if len(args) < 1 {
+		fmt.Fprint(w, "CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+
+	key, flags := args[0], args[1:]
+	_, quiet := metaFlag(flags, 'q')
+	_, withValue := metaFlag(flags, 'v')
+	m := metaWriter{w: w, quiet: quiet}
+
+	delta := uint64(1)
+	if d, ok := metaFlag(flags, 'D'); ok {
+		var err error
+		delta, err = strconv.ParseUint(d, 10, 64)
+		if err != nil {
+			fmt.Fprint(w, "CLIENT_ERROR invalid numeric delta argument\r\n")
+			return
+		}
+	}
+
+	mode, _ := metaFlag(flags, 'M')
+	decrement := false
+	switch mode {
+	case "", "I", "i", "+":
+	case "D", "d", "-":
+		decrement = true
+	default:
+		fmt.Fprint(w, "CLIENT_ERROR invalid mode for ma M token\r\n")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.get(key)
+	if i == nil {
+		m.status("NF", "", nil)
+		return
+	}
+
+	value, err := strconv.ParseUint(string(i.value), 10, 64)
+	if err != nil {
+		fmt.Fprint(w, "CLIENT_ERROR cannot increment or decrement non-numeric value\r\n")
+		return
+	}
+
+	switch {
+	case !decrement:
+		value += delta // wraps around like memcached
+	case delta > value:
+		value = 0
+	default:
+		value -= delta
+	}
+
+	updated := &item{
+		key:     i.key,
+		value:   []byte(strconv.FormatUint(value, 10)),
+		flags:   i.flags,
+		expires: i.expires,
+	}
+	s.set(updated)
+
+	returned := returnedFlags(updated, flags)
+	if !withValue {
+		m.status("HD", "HD", returned)
+		return
+	}
+
+	m.status("VA", "", append([]string{strconv.Itoa(len(updated.value))}, returned...))
+	_, _ = w.Write(updated.value)
+	_, _ = w.WriteString("\r\n")
+}
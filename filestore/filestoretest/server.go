@@ -0,0 +1,586 @@
+// Package filestoretest provides helpers for testing code which uses the file store
+package filestoretest
+
+import (
+	"bufio"
+	"container/list"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultMaxBytes = 64 * 1024 * 1024
+const defaultItemSizeMax = 1024 * 1024
+
+// Memory taken by every item besides its key and value, close to what memcached needs on 64-bit systems
+const itemHeaderSize = 56
+
+// Expiration up to 30 days is relative, larger one is a unix timestamp
+const maxRelativeExpiration = 30 * 24 * 60 * 60
+
+type Config struct {
+	// Memory limit, least recently used items are evicted to make room. Defaults to 64MB
+	MaxBytes int
+
+	// Largest item accepted, including the key and item header. Defaults to 1MB like memcached
+	ItemSizeMax int
+
+	// Delay of every response, see also SetLatency
+	Latency time.Duration
+}
+
+// Server is a fake memcached speaking the text protocol on a local listener, so clients can be tested
+// end to end without a real server. It supports get, gets, set, add, replace, append, prepend, cas,
+// delete, incr, decr, touch, stats, flush_all, version and quit, and the meta commands mg, ms, md, ma
+// and mn with their common flags.
+type Server struct {
+	listener    net.Listener
+	maxBytes    int
+	itemSizeMax int
+
+	mu        sync.Mutex
+	items     map[string]*list.Element
+	lru       *list.List // of *item, most recently used first
+	bytes     int
+	cas       uint64
+	evictions int
+	latency   time.Duration
+	conns     map[net.Conn]bool
+	wg        sync.WaitGroup
+}
+
+type item struct {
+	key     string
+	value   []byte
+	flags   uint32
+	expires time.Time // zero if the item doesn't expire
+	cas     uint64
+}
+
+func (i *item) size() int {
+	return itemHeaderSize + len(i.key) + len(i.value)
+}
+
+type Stats struct {
+	Items       int
+	Bytes       int
+	Evictions   int
+	Connections int
+}
+
+// NewServer starts the server on a random port of the loopback interface
+func NewServer(config Config) (*Server, error) {
+	maxBytes := config.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultMaxBytes
+	}
+
+	itemSizeMax := config.ItemSizeMax
+	if itemSizeMax <= 0 {
+		itemSizeMax = defaultItemSizeMax
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("Unable to listen: %w", err)
+	}
+
+	s := &Server{
+		listener:    l,
+		maxBytes:    maxBytes,
+		itemSizeMax: itemSizeMax,
+		items:       map[string]*list.Element{},
+		lru:         list.New(),
+		latency:     config.Latency,
+		conns:       map[net.Conn]bool{},
+	}
+
+	s.wg.Add(1)
+	go s.serve()
+
+	return s, nil
+}
+
+// Addr returns host:port to connect to
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Close stops the server and closes all connections
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	s.DropConnections()
+	s.wg.Wait()
+
+	return err
+}
+
+// SetLatency delays every response from now on, e.g. to make requests of clients time out
+func (s *Server) SetLatency(latency time.Duration) {
+	s.mu.Lock()
+	s.latency = latency
+	s.mu.Unlock()
+}
+
+// DropConnections closes all open connections, the server keeps accepting new ones
+func (s *Server) DropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+}
+
+// Evict removes the key as if memcached evicted it, reports if it was there
+func (s *Server) Evict(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.get(key) == nil {
+		return false
+	}
+
+	s.remove(key)
+	s.evictions++
+
+	return true
+}
+
+func (s *Server) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return Stats{
+		Items:       len(s.items),
+		Bytes:       s.bytes,
+		Evictions:   s.evictions,
+		Connections: len(s.conns),
+	}
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		s.conns[conn] = true
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(conn)
+
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+			_ = conn.Close()
+		}()
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			_, _ = w.WriteString("ERROR\r\n")
+		} else {
+			quit, err := s.execute(r, w, fields)
+			if err != nil || quit {
+				return
+			}
+		}
+
+		s.mu.Lock()
+		latency := s.latency
+		s.mu.Unlock()
+		time.Sleep(latency)
+
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// execute runs a single command, errors are only returned if the connection should be closed
+func (s *Server) execute(r *bufio.Reader, w *bufio.Writer, fields []string) (bool, error) {
+	command, args := fields[0], fields[1:]
+
+	noreply := len(args) > 0 && args[len(args)-1] == "noreply"
+	if noreply {
+		args = args[:len(args)-1]
+		w = bufio.NewWriter(ioutil.Discard)
+	}
+
+	for _, key := range keysOf(command, args) {
+		if len(key) > 250 {
+			_, err := w.WriteString("CLIENT_ERROR bad command line format\r\n")
+			return false, err
+		}
+	}
+
+	switch command {
+	case "get", "gets":
+		s.retrieve(w, args, command == "gets")
+	case "set", "add", "replace", "append", "prepend", "cas":
+		return false, s.storage(r, w, command, args)
+	case "delete":
+		s.delete(w, args)
+	case "incr", "decr":
+		s.arithmetic(w, command, args)
+	case "touch":
+		s.touch(w, args)
+	case "stats":
+		s.stats(w, args)
+	case "flush_all":
+		s.flush()
+		fmt.Fprint(w, "OK\r\n")
+	case "version":
+		fmt.Fprint(w, "VERSION 1.6.0-filestoretest\r\n")
+	case "quit":
+		return true, nil
+	case "mg":
+		s.metaGet(w, args)
+	case "ms":
+		return false, s.metaSet(r, w, args)
+	case "md":
+		s.metaDelete(w, args)
+	case "ma":
+		s.metaArithmetic(w, args)
+	case "mn":
+		fmt.Fprint(w, "MN\r\n")
+	default:
+		fmt.Fprint(w, "ERROR\r\n")
+	}
+
+	return false, nil
+}
+
+func keysOf(command string, args []string) []string {
+	switch command {
+	case "get", "gets":
+		return args
+	case "stats", "flush_all", "version", "quit", "mn":
+		return nil
+	case "set", "add", "replace", "append", "prepend", "cas", "ms":
+		// Checked once the data is read
+		return nil
+	}
+
+	if len(args) > 0 {
+		return args[:1]
+	}
+
+	return nil
+}
+
+func (s *Server) retrieve(w *bufio.Writer, keys []string, withCAS bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, key := range keys {
+		i := s.get(key)
+		if i == nil {
+			continue
+		}
+
+		if withCAS {
+			fmt.Fprintf(w, "VALUE %s %d %d %d\r\n", i.key, i.flags, len(i.value), i.cas)
+		} else {
+			fmt.Fprintf(w, "VALUE %s %d %d\r\n", i.key, i.flags, len(i.value))
+		}
+		_, _ = w.Write(i.value)
+		_, _ = w.WriteString("\r\n")
+	}
+
+	fmt.Fprint(w, "END\r\n")
+}
+
+func (s *Server) storage(r *bufio.Reader, w *bufio.Writer, command string, args []string) error {
+	wantArgs := 4
+	if command == "cas" {
+		wantArgs = 5
+	}
+	if len(args) != wantArgs {
+		_, err := w.WriteString("ERROR\r\n")
+		return err
+	}
+
+	flags, err1 := strconv.ParseUint(args[1], 10, 32)
+	exptime, err2 := strconv.ParseInt(args[2], 10, 64)
+	size, err3 := strconv.Atoi(args[3])
+	if err1 != nil || err2 != nil || err3 != nil || size < 0 {
+		_, err := w.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return err
+	}
+
+	data := make([]byte, size+2)
+	_, err := io.ReadFull(r, data)
+	if err != nil {
+		return err
+	}
+	if string(data[size:]) != "\r\n" {
+		_, _ = w.WriteString("CLIENT_ERROR bad data chunk\r\n")
+		return fmt.Errorf("Bad data chunk")
+	}
+
+	if len(args[0]) > 250 {
+		_, err := w.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return err
+	}
+
+	var cas uint64
+	if command == "cas" {
+		cas, err = strconv.ParseUint(args[4], 10, 64)
+		if err != nil {
+			_, err := w.WriteString("CLIENT_ERROR bad command line format\r\n")
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := args[0]
+	existing := s.get(key)
+	value := data[:size]
+
+	switch {
+	case command == "add" && existing != nil,
+		(command == "replace" || command == "append" || command == "prepend") && existing == nil:
+		_, err = w.WriteString("NOT_STORED\r\n")
+		return err
+	case command == "cas" && existing == nil:
+		_, err = w.WriteString("NOT_FOUND\r\n")
+		return err
+	case command == "cas" && existing.cas != cas:
+		_, err = w.WriteString("EXISTS\r\n")
+		return err
+	case command == "append":
+		value = append(append([]byte{}, existing.value...), value...)
+	case command == "prepend":
+		value = append(append([]byte{}, value...), existing.value...)
+	}
+
+	i := &item{key: key, value: value, flags: uint32(flags)}
+	if existing != nil && (command == "append" || command == "prepend") {
+		i.flags, i.expires = existing.flags, existing.expires
+	} else {
+		i.expires = s.expiry(exptime)
+	}
+
+	if i.size() > s.itemSizeMax {
+		_, err = w.WriteString("SERVER_ERROR object too large for cache\r\n")
+		return err
+	}
+
+	if !s.set(i) {
+		_, err = w.WriteString("SERVER_ERROR out of memory storing object\r\n")
+		return err
+	}
+
+	_, err = w.WriteString("STORED\r\n")
+	return err
+}
+
+func (s *Server) delete(w *bufio.Writer, args []string) {
+	if len(args) != 1 {
+		fmt.Fprint(w, "ERROR\r\n")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.get(args[0]) == nil {
+		fmt.Fprint(w, "NOT_FOUND\r\n")
+		return
+	}
+
+	s.remove(args[0])
+	fmt.Fprint(w, "DELETED\r\n")
+}
+
+func (s *Server) arithmetic(w *bufio.Writer, command string, args []string) {
+	if len(args) != 2 {
+		fmt.Fprint(w, "ERROR\r\n")
+		return
+	}
+
+	delta, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		fmt.Fprint(w, "CLIENT_ERROR invalid numeric delta argument\r\n")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.get(args[0])
+	if i == nil {
+		fmt.Fprint(w, "NOT_FOUND\r\n")
+		return
+	}
+
+	value, err := strconv.ParseUint(string(i.value), 10, 64)
+	if err != nil {
+		fmt.Fprint(w, "CLIENT_ERROR cannot increment or decrement non-numeric value\r\n")
+		return
+	}
+
+	switch {
+	case command == "incr":
+		value += delta // wraps around like memcached
+	case delta > value:
+		value = 0
+	default:
+		value -= delta
+	}
+
+	s.set(&item{
+		key:     i.key,
+		value:   []byte(strconv.FormatUint(value, 10)),
+		flags:   i.flags,
+		expires: i.expires,
+	})
+	fmt.Fprintf(w, "%d\r\n", value)
+}
+
+func (s *Server) touch(w *bufio.Writer, args []string) {
+	if len(args) != 2 {
+		fmt.Fprint(w, "ERROR\r\n")
+		return
+	}
+
+	exptime, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		fmt.Fprint(w, "CLIENT_ERROR invalid exptime argument\r\n")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.get(args[0])
+	if i == nil {
+		fmt.Fprint(w, "NOT_FOUND\r\n")
+		return
+	}
+
+	i.expires = s.expiry(exptime)
+	fmt.Fprint(w, "TOUCHED\r\n")
+}
+
+func (s *Server) stats(w *bufio.Writer, args []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case len(args) == 0:
+		fmt.Fprintf(w, "STAT curr_items %d\r\n", len(s.items))
+		fmt.Fprintf(w, "STAT bytes %d\r\n", s.bytes)
+		fmt.Fprintf(w, "STAT evictions %d\r\n", s.evictions)
+		fmt.Fprintf(w, "STAT curr_connections %d\r\n", len(s.conns))
+		fmt.Fprintf(w, "STAT limit_maxbytes %d\r\n", s.maxBytes)
+	case len(args) == 1 && args[0] == "settings":
+		fmt.Fprintf(w, "STAT maxbytes %d\r\n", s.maxBytes)
+		fmt.Fprintf(w, "STAT item_size_max %d\r\n", s.itemSizeMax)
+	default:
+		fmt.Fprint(w, "ERROR\r\n")
+		return
+	}
+
+	fmt.Fprint(w, "END\r\n")
+}
+
+func (s *Server) flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.items = map[string]*list.Element{}
+	s.lru.Init()
+	s.bytes = 0
+}
+
+// get returns the item and marks it as recently used, expired items are removed first
+func (s *Server) get(key string) *item {
+	e, ok := s.items[key]
+	if !ok {
+		return nil
+	}
+
+	i := e.Value.(*item)
+	if !i.expires.IsZero() && !time.Now().Before(i.expires) {
+		s.remove(key)
+		return nil
+	}
+
+	s.lru.MoveToFront(e)
+
+	return i
+}
+
+// set stores the item, evicting least recently used ones to make room. Fails if the item
+// doesn't fit even into an empty server.
+func (s *Server) set(i *item) bool {
+	if i.size() > s.maxBytes {
+		return false
+	}
+
+	s.remove(i.key)
+	for s.bytes+i.size() > s.maxBytes {
+		s.remove(s.lru.Back().Value.(*item).key)
+		s.evictions++
+	}
+
+	s.cas++
+	i.cas = s.cas
+	s.items[i.key] = s.lru.PushFront(i)
+	s.bytes += i.size()
+
+	return true
+}
+
+func (s *Server) remove(key string) {
+	e, ok := s.items[key]
+	if !ok {
+		return
+	}
+
+	s.lru.Remove(e)
+	delete(s.items, key)
+	s.bytes -= e.Value.(*item).size()
+}
+
+// expiry returns when an item stored with the expiration expires, negative expiration expires it immediately
+func (s *Server) expiry(exptime int64) time.Time {
+	switch {
+	case exptime == 0:
+		return time.Time{}
+	case exptime < 0:
+		return time.Unix(1, 0)
+	case exptime <= maxRelativeExpiration:
+		return time.Now().Add(time.Duration(exptime) * time.Second)
+	default:
+		return time.Unix(exptime, 0)
+	}
+}
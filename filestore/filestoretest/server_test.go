@@ -0,0 +1,318 @@
+package filestoretest
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"filestore/client"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+func newServer(t *testing.T, config Config) (*Server, *memcache.Client) {
+	s, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("Unable to start server: %v", err)
+	}
+
+	return s, memcache.New(s.Addr())
+}
+
+func TestServer(t *testing.T) {
+	s, c := newServer(t, Config{})
+	defer s.Close()
+
+	err := c.Set(&memcache.Item{Key: "key", Value: []byte("value"), Flags: 42})
+	if err != nil {
+		t.Fatalf("Set: want nil, got %#v", err)
+	}
+
+	item, err := c.Get("key")
+	if err != nil || string(item.Value) != "value" || item.Flags != 42 {
+		t.Errorf("Get: want %#v, got %#v (%v)", "value", item, err)
+	}
+
+	err = c.Add(&memcache.Item{Key: "key", Value: []byte("other")})
+	if err != memcache.ErrNotStored {
+		t.Errorf("Add of an existing key: want %#v, got %#v", memcache.ErrNotStored, err)
+	}
+
+	err = c.Replace(&memcache.Item{Key: "missing", Value: []byte("other")})
+	if err != memcache.ErrNotStored {
+		t.Errorf("Replace of a missing key: want %#v, got %#v", memcache.ErrNotStored, err)
+	}
+
+	// Compare and swap
+	stale, _ := c.Get("key")
+	fresh, _ := c.Get("key")
+	fresh.Value = []byte("swapped")
+	if err := c.CompareAndSwap(fresh); err != nil {
+		t.Errorf("CompareAndSwap: want nil, got %#v", err)
+	}
+	if err := c.CompareAndSwap(stale); err != memcache.ErrCASConflict {
+		t.Errorf("CompareAndSwap of a stale item: want %#v, got %#v", memcache.ErrCASConflict, err)
+	}
+
+	items, err := c.GetMulti([]string{"key", "missing"})
+	if err != nil || len(items) != 1 || string(items["key"].Value) != "swapped" {
+		t.Errorf("GetMulti: want %#v, got %#v (%v)", "swapped", items, err)
+	}
+
+	// Counters
+	_ = c.Set(&memcache.Item{Key: "counter", Value: []byte("10")})
+	if value, err := c.Increment("counter", 5); err != nil || value != 15 {
+		t.Errorf("Increment: want %d, got %d (%v)", 15, value, err)
+	}
+	if value, err := c.Decrement("counter", 20); err != nil || value != 0 {
+		t.Errorf("Decrement: want %d, got %d (%v)", 0, value, err)
+	}
+	if _, err := c.Increment("missing", 1); err != memcache.ErrCacheMiss {
+		t.Errorf("Increment of a missing key: want %#v, got %#v", memcache.ErrCacheMiss, err)
+	}
+	if _, err := c.Increment("key", 1); err == nil {
+		t.Errorf("Increment of a non-numeric value: want error, got nil")
+	}
+
+	// Expiration
+	_ = c.Set(&memcache.Item{Key: "expired", Value: []byte("value"), Expiration: -1})
+	if _, err := c.Get("expired"); err != memcache.ErrCacheMiss {
+		t.Errorf("Get of an expired key: want %#v, got %#v", memcache.ErrCacheMiss, err)
+	}
+
+	if err := c.Touch("key", 3600); err != nil {
+		t.Errorf("Touch: want nil, got %#v", err)
+	}
+
+	if err := c.Delete("key"); err != nil {
+		t.Errorf("Delete: want nil, got %#v", err)
+	}
+	if err := c.Delete("key"); err != memcache.ErrCacheMiss {
+		t.Errorf("Delete of a missing key: want %#v, got %#v", memcache.ErrCacheMiss, err)
+	}
+
+	if err := c.FlushAll(); err != nil {
+		t.Errorf("FlushAll: want nil, got %#v", err)
+	}
+	if stats := s.Stats(); stats.Items != 0 || stats.Bytes != 0 {
+		t.Errorf("Stats after FlushAll: want empty, got %#v", stats)
+	}
+}
+
+func TestServer_Meta(t *testing.T) {
+	s, text := newServer(t, Config{})
+	defer s.Close()
+
+	c := client.NewMetaClient(s.Addr(), client.MetaConfig{})
+
+	err := c.Set(&memcache.Item{Key: "key", Value: []byte("value"), Flags: 42})
+	if err != nil {
+		t.Fatalf("Set: want nil, got %#v", err)
+	}
+
+	// Both protocols work on the same items
+	item, err := text.Get("key")
+	if err != nil || string(item.Value) != "value" || item.Flags != 42 {
+		t.Errorf("Get with the text protocol: want %#v, got %#v (%v)", "value", item, err)
+	}
+
+	err = c.Add(&memcache.Item{Key: "key", Value: []byte("other")})
+	if err != memcache.ErrNotStored {
+		t.Errorf("Add of an existing key: want %#v, got %#v", memcache.ErrNotStored, err)
+	}
+
+	stale, staleCAS, _ := client.GetCAS(c, "key")
+	fresh, freshCAS, _ := client.GetCAS(c, "key")
+	fresh.Value = []byte("swapped")
+	if err := client.CompareAndSwapCAS(c, fresh, freshCAS); err != nil {
+		t.Errorf("CompareAndSwapCAS: want nil, got %#v", err)
+	}
+	if err := client.CompareAndSwapCAS(c, stale, staleCAS); err != memcache.ErrCASConflict {
+		t.Errorf("CompareAndSwapCAS of a stale item: want %#v, got %#v", memcache.ErrCASConflict, err)
+	}
+
+	// Quiet gets of missing keys are only answered by the no-op
+	items, err := c.GetMulti([]string{"key", "missing"})
+	if err != nil || len(items) != 1 || string(items["key"].Value) != "swapped" {
+		t.Errorf("GetMulti: want %#v, got %#v (%v)", "swapped", items, err)
+	}
+
+	_ = c.Set(&memcache.Item{Key: "counter", Value: []byte("10")})
+	if value, err := c.Increment("counter", 5); err != nil || value != 15 {
+		t.Errorf("Increment: want %d, got %d (%v)", 15, value, err)
+	}
+	if value, err := c.Decrement("counter", 20); err != nil || value != 0 {
+		t.Errorf("Decrement: want %d, got %d (%v)", 0, value, err)
+	}
+	if _, err := c.Increment("missing", 1); err != memcache.ErrCacheMiss {
+		t.Errorf("Increment of a missing key: want %#v, got %#v", memcache.ErrCacheMiss, err)
+	}
+	if _, err := c.Increment("key", 1); err == nil {
+		t.Errorf("Increment of a non-numeric value: want error, got nil")
+	}
+
+	_ = c.Set(&memcache.Item{Key: "expired", Value: []byte("value"), Expiration: -1})
+	if _, err := c.Get("expired"); err != memcache.ErrCacheMiss {
+		t.Errorf("Get of an expired key: want %#v, got %#v", memcache.ErrCacheMiss, err)
+	}
+
+	if err := c.Delete("key"); err != nil {
+		t.Errorf("Delete: want nil, got %#v", err)
+	}
+	if err := c.Delete("key"); err != memcache.ErrCacheMiss {
+		t.Errorf("Delete of a missing key: want %#v, got %#v", memcache.ErrCacheMiss, err)
+	}
+}
+
+// TestServer_MetaFlags talks to the server directly for the flags the client doesn't use
+func TestServer_MetaFlags(t *testing.T) {
+	s, _ := newServer(t, Config{})
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatalf("Unable to connect: %v", err)
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	tests := []struct {
+		request string
+		want    string
+	}{
+		{"ms key 5 T0 F7 q\r\nvalue\r\nmn\r\n", "MN\r\n"},
+		{"mg key s f k t\r\n", "HD s5 f7 kkey t-1\r\n"},
+		{"ms key 5 MA\r\n more\r\n", "HD\r\n"},
+		{"mg key v O123\r\n", "VA 10 O123\r\nvalue more\r\n"},
+		{"ms other 1 MR\r\nx\r\n", "NS\r\n"},
+		{"ms key 1 C1\r\nx\r\n", "EX\r\n"},
+		{"md key C1\r\n", "EX\r\n"},
+		{"md missing q\r\nmn\r\n", "NF\r\nMN\r\n"},
+		{"ms counter 1\r\n9\r\n", "HD\r\n"},
+		{"ma counter v\r\n", "VA 2\r\n10\r\n"},
+		{"ma counter MD D20 q\r\nmg counter v\r\n", "VA 1\r\n0\r\n"},
+		{"mg missing v q\r\nmn\r\n", "MN\r\n"},
+	}
+
+	for _, tt := range tests {
+		if _, err := conn.Write([]byte(tt.request)); err != nil {
+			t.Fatalf("Unable to write %q: %v", tt.request, err)
+		}
+
+		got := make([]byte, len(tt.want))
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := io.ReadFull(r, got); err != nil || string(got) != tt.want {
+			t.Errorf("%q: want %q, got %q (%v)", tt.request, tt.want, string(got), err)
+		}
+	}
+}
+
+func TestServer_ItemSizeMax(t *testing.T) {
+	s, c := newServer(t, Config{ItemSizeMax: 1024})
+	defer s.Close()
+
+	// The key and item header count towards the limit
+	fits := bytes.Repeat([]byte("x"), 1024-itemHeaderSize-len("key"))
+
+	err := c.Set(&memcache.Item{Key: "key", Value: fits})
+	if err != nil {
+		t.Errorf("Set of the largest item: want nil, got %#v", err)
+	}
+
+	err = c.Set(&memcache.Item{Key: "key", Value: append(fits, 'x')})
+	if err == nil {
+		t.Errorf("Set of a too large item: want error, got nil")
+	}
+
+	// The connection is still usable
+	if _, err := c.Get("key"); err != nil {
+		t.Errorf("Get: want nil, got %#v", err)
+	}
+}
+
+func TestServer_Eviction(t *testing.T) {
+	s, c := newServer(t, Config{MaxBytes: 3 * (itemHeaderSize + 4 + 100)})
+	defer s.Close()
+
+	value := bytes.Repeat([]byte("x"), 100)
+	for i := 0; i < 3; i++ {
+		_ = c.Set(&memcache.Item{Key: fmt.Sprintf("key%d", i), Value: value})
+	}
+
+	// key0 is used recently, key1 is the one to go
+	_, _ = c.Get("key0")
+	_ = c.Set(&memcache.Item{Key: "key3", Value: value})
+
+	items, err := c.GetMulti([]string{"key0", "key1", "key2", "key3"})
+	if err != nil || len(items) != 3 || items["key1"] != nil {
+		t.Errorf("GetMulti: want all but key1, got %d items (%v)", len(items), err)
+	}
+
+	if stats := s.Stats(); stats.Evictions != 1 {
+		t.Errorf("Evictions: want %d, got %d", 1, stats.Evictions)
+	}
+
+	if !s.Evict("key2") || s.Evict("key2") {
+		t.Errorf("Evict: want the key evicted once")
+	}
+}
+
+func TestServer_Settings(t *testing.T) {
+	s, err := NewServer(Config{MaxBytes: 1 << 20, ItemSizeMax: 1 << 10})
+	if err != nil {
+		t.Fatalf("Unable to start server: %v", err)
+	}
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatalf("Unable to connect: %v", err)
+	}
+	defer conn.Close()
+
+	_, _ = conn.Write([]byte("stats settings\r\n"))
+
+	want := "STAT maxbytes 1048576\r\nSTAT item_size_max 1024\r\nEND\r\n"
+	got := make([]byte, len(want))
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(got)
+	if err != nil || string(got) != want {
+		t.Errorf("Stats settings: want %q, got %q (%v)", want, got, err)
+	}
+}
+
+func TestServer_Faults(t *testing.T) {
+	s, c := newServer(t, Config{})
+	defer s.Close()
+
+	c.Timeout = 20 * time.Millisecond
+
+	_ = c.Set(&memcache.Item{Key: "key", Value: []byte("value")})
+
+	s.SetLatency(50 * time.Millisecond)
+	_, err := c.Get("key")
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("Get of a slow server: want timeout, got %#v", err)
+	}
+
+	s.SetLatency(0)
+	c.Timeout = time.Second
+
+	// Connections are dropped, new ones are accepted
+	_, _ = c.Get("key")
+	s.DropConnections()
+	_, err = c.Get("key")
+	if err == nil {
+		t.Errorf("Get on a dropped connection: want error, got nil")
+	}
+
+	_, err = c.Get("key")
+	if err != nil {
+		t.Errorf("Get on a new connection: want nil, got %#v", err)
+	}
+}
@@ -1,8 +1,14 @@
 module filestore
 
-go 1.13
+go 1.21
 
 require (
 	github.com/bradfitz/gomemcache v0.0.0-20190913173617-a41fca850d0b
 	github.com/sirupsen/logrus v1.6.0
+	golang.org/x/text v0.14.0
+)
+
+require (
+	github.com/konsorten/go-windows-terminal-sequences v1.0.3 // indirect
+	golang.org/x/sys v0.5.0 // indirect
 )
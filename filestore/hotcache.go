@@ -0,0 +1,182 @@
+package filestore
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// CacheConfig keeps recently retrieved files in memory, so Retrieve of a popular file doesn't fetch
+// its chunks from Memcache every time. Files changed through the same store are dropped from the cache
+// right away, changes made by other processes are noticed by comparing metadata.
+type CacheConfig struct {
+	// Total size of cached files in bytes, least recently used files are dropped to make room.
+	// The cache is disabled if zero
+	MaxBytes int
+
+	// Larger files are not cached, defaults to a quarter of MaxBytes
+	MaxFileSize int
+
+	// How long a cached file is returned without checking its metadata, so files changed by other processes
+	// may be returned stale for this long. Zero checks metadata on every Retrieve.
+	MaxAge time.Duration
+}
+
+type hotCache struct {
+	maxBytes    int
+	maxFileSize int
+	maxAge      time.Duration
+	now         func() time.Time
+
+	mu    sync.Mutex
+	bytes int
+	order *list.List // of *cachedFile, most recently used first
+	files map[string]*list.Element
+
+	// Changes with every invalidation, files retrieved meanwhile may be stale and are not cached
+	epoch uint64
+}
+
+type cachedFile struct {
+	filename string
+	meta     metadata
+	contents []byte
+	checked  time.Time
+}
+
+func newHotCache(config *CacheConfig) *hotCache {
+	if config == nil || config.MaxBytes <= 0 {
+		return nil
+	}
+
+	maxFileSize := config.MaxFileSize
+	if maxFileSize <= 0 {
+		maxFileSize = config.MaxBytes / 4
+	}
+
+	return &hotCache{
+		maxBytes:    config.MaxBytes,
+		maxFileSize: maxFileSize,
+		maxAge:      config.MaxAge,
+		now:         time.Now,
+		order:       list.New(),
+		files:       map[string]*list.Element{},
+	}
+}
+
+// retrieveCached is retrieve which returns cached contents when the file hasn't changed since it was cached
+func (s memcacheStore) retrieveCached(filename string) ([]byte, error) {
+	if s.cache == nil {
+		return s.retrieve(filename)
+	}
+
+	cached, epoch := s.cache.get(filename)
+	if cached != nil && s.cache.now().Sub(cached.checked) < s.cache.maxAge {
+		s.logger.WithField("filename", filename).Debug("Retrieved file from cache")
+		return copyBytes(cached.contents), nil
+	}
+
+	return retryChanged(func() ([]byte, error) {
+		meta, err := s.retrieveMetadata(filename)
+		if err != nil {
+			return []byte{}, err
+		}
+
+		if cached != nil && cached.meta.sameContents(meta) {
+			s.cache.touch(filename, epoch)
+			s.logger.WithField("filename", filename).Debug("Retrieved file from cache")
+			return copyBytes(cached.contents), nil
+		}
+
+		contents, err := s.retrieveChunks(filename, meta)
+		if err != nil {
+			return []byte{}, err
+		}
+
+		s.cache.put(filename, meta, copyBytes(contents), epoch)
+
+		return contents, nil
+	})
+}
+
+// get returns the cached file, if any, and the epoch to pass to put or touch
+func (c *hotCache) get(filename string) (*cachedFile, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.files[filename]
+	if !ok {
+		return nil, c.epoch
+	}
+
+	c.order.MoveToFront(e)
+	cached := *e.Value.(*cachedFile)
+
+	return &cached, c.epoch
+}
+
+// touch marks the cached file as checked against its metadata
+func (c *hotCache) touch(filename string, epoch uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.files[filename]; ok && epoch == c.epoch {
+		e.Value.(*cachedFile).checked = c.now()
+	}
+}
+
+func (c *hotCache) put(filename string, meta metadata, contents []byte, epoch uint64) {
+	if len(contents) > c.maxFileSize || len(contents) > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if epoch != c.epoch {
+		return
+	}
+
+	c.remove(filename)
+	for c.bytes+len(contents) > c.maxBytes {
+		c.remove(c.order.Back().Value.(*cachedFile).filename)
+	}
+
+	c.files[filename] = c.order.PushFront(&cachedFile{
+		filename: filename,
+		meta:     meta,
+		contents: contents,
+		checked:  c.now(),
+	})
+	c.bytes += len(contents)
+}
+
+// invalidate drops the files, it's safe to call on a nil cache
+func (c *hotCache) invalidate(filenames ...string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.epoch++
+	for _, filename := range filenames {
+		c.remove(filename)
+	}
+}
+
+func (c *hotCache) remove(filename string) {
+	e, ok := c.files[filename]
+	if !ok {
+		return
+	}
+
+	c.order.Remove(e)
+	delete(c.files, filename)
+	c.bytes -= len(e.Value.(*cachedFile).contents)
+}
+
+func copyBytes(b []byte) []byte {
+	return append([]byte{}, b...)
+}
@@ -0,0 +1,213 @@
+package filestore
+
+import (
+	"filestore/client"
+	"filestore/mock"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// getCountingClient counts requests reading chunks
+type getCountingClient struct {
+	client.Memcache
+	getMultis int
+}
+
+func (c *getCountingClient) GetMulti(keys []string) (map[string]*memcache.Item, error) {
+	c.getMultis++
+	return c.Memcache.GetMulti(keys)
+}
+
+func TestHotCache(t *testing.T) {
+	c := &getCountingClient{Memcache: mock.NewMemcacheClient(100)}
+	s := NewMemcacheWithClient(c, MemcacheConfig{ChunkSize: 5, Cache: &CacheConfig{MaxBytes: 100}})
+	other := NewMemcacheWithClient(c, MemcacheConfig{ChunkSize: 5})
+
+	err := s.Store("file.dat", []byte("some content"))
+	if err != nil {
+		panic(err)
+	}
+
+	assertRetrieved := func(name string, want string, wantGetMultis int) {
+		t.Helper()
+
+		c.getMultis = 0
+		contents, err := s.Retrieve("file.dat")
+		if err != nil || string(contents) != want {
+			t.Errorf("%s: want %#v, got %#v (%v)", name, want, string(contents), err)
+		}
+		if c.getMultis != wantGetMultis {
+			t.Errorf("%s: want %d chunk requests, got %d", name, wantGetMultis, c.getMultis)
+		}
+
+		// Callers can't change what is cached
+		if len(contents) > 0 {
+			contents[0] = 'X'
+		}
+	}
+
+	assertRetrieved("First retrieve", "some content", 1)
+	assertRetrieved("Cached retrieve", "some content", 0)
+
+	// Changed by another store, metadata doesn't match anymore
+	err = Append(other, "file.dat", []byte("!"))
+	if err != nil {
+		panic(err)
+	}
+	assertRetrieved("Retrieve after a change elsewhere", "some content!", 1)
+	assertRetrieved("Cached retrieve", "some content!", 0)
+
+	// Changed by the same store
+	err = WriteAt(s, "file.dat", 0, []byte("S"))
+	if err != nil {
+		panic(err)
+	}
+	assertRetrieved("Retrieve after WriteAt", "Some content!", 1)
+
+	err = s.Delete("file.dat")
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = s.Retrieve("file.dat")
+	if err != ErrFileNotFound {
+		t.Errorf("Retrieve after Delete: want %#v, got %#v", ErrFileNotFound, err)
+	}
+}
+
+func TestHotCache_MaxAge(t *testing.T) {
+	c := &getCountingClient{Memcache: mock.NewMemcacheClient(100)}
+	s := NewMemcacheWithClient(c, MemcacheConfig{ChunkSize: 5, Cache: &CacheConfig{MaxBytes: 100, MaxAge: time.Hour}})
+	other := NewMemcacheWithClient(c, MemcacheConfig{ChunkSize: 5})
+
+	err := s.Store("file.dat", []byte("some content"))
+	if err != nil {
+		panic(err)
+	}
+	_, _ = s.Retrieve("file.dat")
+
+	// Not noticed until the cached file gets old
+	_ = other.Delete("file.dat")
+
+	contents, err := s.Retrieve("file.dat")
+	if err != nil || string(contents) != "some content" {
+		t.Errorf("Retrieve: want %#v, got %#v (%v)", "some content", string(contents), err)
+	}
+
+	s.(*memcacheStore).cache.now = func() time.Time { return time.Now().Add(time.Hour) }
+
+	_, err = s.Retrieve("file.dat")
+	if err != ErrFileNotFound {
+		t.Errorf("Retrieve of an old cached file: want %#v, got %#v", ErrFileNotFound, err)
+	}
+}
+
+func TestHotCache_Eviction(t *testing.T) {
+	s := NewMemcacheWithClient(mock.NewMemcacheClient(100), MemcacheConfig{
+		ChunkSize: 5,
+		Cache:     &CacheConfig{MaxBytes: 30, MaxFileSize: 20},
+	}).(*memcacheStore)
+
+	files := map[string]string{
+		"a.dat":     "0123456789",
+		"b.dat":     "0123456789",
+		"c.dat":     "0123456789",
+		"d.dat":     "0123456789",
+		"large.dat": "012345678901234567890",
+	}
+	for filename, contents := range files {
+		err := s.Store(filename, []byte(contents))
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	for _, filename := range []string{"a.dat", "b.dat", "c.dat", "a.dat", "d.dat", "large.dat"} {
+		_, _ = s.Retrieve(filename)
+	}
+
+	// b.dat is the least recently used one, large.dat is too large to be cached
+	for filename, want := range map[string]bool{"a.dat": true, "b.dat": false, "c.dat": true, "d.dat": true, "large.dat": false} {
+		if _, cached := s.cache.files[filename]; cached != want {
+			t.Errorf("%s cached: want %v, got %v", filename, want, cached)
+		}
+	}
+
+	if s.cache.bytes != 30 {
+		t.Errorf("Cached bytes: want %d, got %d", 30, s.cache.bytes)
+	}
+}
+
+func TestHotCache_InvalidatedMeanwhile(t *testing.T) {
+	c := newHotCache(&CacheConfig{MaxBytes: 100})
+
+	_, epoch := c.get("file.dat")
+	c.invalidate("other.dat")
+	c.put("file.dat", metadata{ID: "id"}, []byte("stale"), epoch)
+
+	if cached, _ := c.get("file.dat"); cached != nil {
+		t.Errorf("Cached file: want nil, got %#v", cached)
+	}
+}
+
+// changingClient calls change before the first chunk is set, like another writer getting there first
+type changingClient struct {
+	client.Memcache
+	change func()
+}
+
+func (c *changingClient) Set(item *memcache.Item) error {
+	if c.change != nil && strings.Contains(item.Key, "::") {
+		change := c.change
+		c.change = nil
+		change()
+	}
+
+	return c.Memcache.Set(item)
+}
+
+func TestHotCache_InvalidatedAfterConflict(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(s Store) error
+	}{
+		{"Append", func(s Store) error { return Append(s, "file.dat", []byte("!")) }},
+		{"WriteAt", func(s Store) error { return WriteAt(s, "file.dat", 0, []byte("S")) }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := mock.NewMemcacheClient(100)
+			c := &changingClient{Memcache: m}
+
+			// Cached files are not checked against metadata for an hour
+			s := NewMemcacheWithClient(c, MemcacheConfig{ChunkSize: 5, Cache: &CacheConfig{MaxBytes: 100, MaxAge: time.Hour}})
+			other := NewMemcacheWithClient(m, MemcacheConfig{ChunkSize: 5})
+
+			err := s.Store("file.dat", []byte("some content"))
+			if err != nil {
+				panic(err)
+			}
+			_, _ = s.Retrieve("file.dat")
+
+			c.change = func() {
+				if err := Append(other, "file.dat", []byte("?")); err != nil {
+					panic(err)
+				}
+			}
+
+			err = tt.write(s)
+			if err != ErrFileModified {
+				t.Errorf("%s: want %#v, got %#v", tt.name, ErrFileModified, err)
+			}
+
+			contents, err := s.Retrieve("file.dat")
+			if err != nil || string(contents) != "some content?" {
+				t.Errorf("Retrieve: want %#v, got %#v (%v)", "some content?", string(contents), err)
+			}
+		})
+	}
+}
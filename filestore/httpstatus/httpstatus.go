@@ -0,0 +1,46 @@
+// Package httpstatus maps store errors to the response statuses the file server reports them with
+// and back, so the file server and its clients agree on them
+package httpstatus
+
+import (
+	"errors"
+	"filestore"
+	"net/http"
+)
+
+// Store errors grouped by response status. The first one is assumed when the response message
+// doesn't tell which one it was.
+var statusErrors = map[int][]error{
+	http.StatusNotFound:                     {filestore.ErrFileNotFound, filestore.ErrVersionNotFound},
+	http.StatusConflict:                     {filestore.ErrFileAlreadyExists, filestore.ErrFileModified},
+	http.StatusBadRequest:                   {nil, filestore.ErrFileTooLarge, filestore.ErrInvalidFilename, filestore.ErrInvalidArchive},
+	http.StatusRequestedRangeNotSatisfiable: {filestore.ErrInvalidRange},
+	http.StatusLocked:                       {filestore.ErrFileLocked},
+	http.StatusInsufficientStorage:          {filestore.ErrQuotaExceeded, filestore.ErrRegistryFull},
+	http.StatusNotImplemented:               {filestore.ErrNotSupported},
+}
+
+// Code returns the response status the store error is reported with,
+// errors of the store which aren't listed are internal server errors
+func Code(err error) int {
+	if errors.Is(err, filestore.ErrBackendUnavailable) {
+		return http.StatusServiceUnavailable
+	}
+
+	// Every store error is listed under a single status
+	for status, candidates := range statusErrors {
+		for _, candidate := range candidates {
+			if candidate != nil && errors.Is(err, candidate) {
+				return status
+			}
+		}
+	}
+
+	return http.StatusInternalServerError
+}
+
+// Errors returns the store errors reported with the status, the one to assume first.
+// A nil error stands for errors which aren't store errors.
+func Errors(status int) []error {
+	return statusErrors[status]
+}
@@ -0,0 +1,41 @@
+package httpstatus
+
+import (
+	"errors"
+	"filestore"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestCode(t *testing.T) {
+	tests := map[error]int{
+		filestore.ErrFileNotFound:                             http.StatusNotFound,
+		fmt.Errorf("%w: offset 3", filestore.ErrInvalidRange): http.StatusRequestedRangeNotSatisfiable,
+		filestore.ErrFileLocked:                               http.StatusLocked,
+		&filestore.BackendUnavailableError{RetryAfter: 0}:     http.StatusServiceUnavailable,
+		filestore.ErrFileCorrupted:                            http.StatusInternalServerError,
+		errors.New("Unable to reach Memcache"):                http.StatusInternalServerError,
+	}
+
+	for err, want := range tests {
+		if got := Code(err); got != want {
+			t.Errorf("Code of %v: want %d, got %d", err, want, got)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	// Every error is mapped back from the status it's reported with
+	for status, candidates := range statusErrors {
+		for _, err := range candidates {
+			if err != nil && Code(err) != status {
+				t.Errorf("Code of %v: want %d, got %d", err, status, Code(err))
+			}
+		}
+	}
+
+	if got := Errors(http.StatusNotFound); len(got) == 0 || got[0] != filestore.ErrFileNotFound {
+		t.Errorf("Errors of %d: want %#v first, got %#v", http.StatusNotFound, filestore.ErrFileNotFound, got)
+	}
+}
@@ -0,0 +1,45 @@
+package filestore
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// Leaves room for the key prefix and suffixes like the lock one within the 250 bytes Memcache allows
+const maxRawKeyLength = 200
+
+// KeyFunc derives the part of the Memcache key which identifies a file from its filename. The filename is
+// recorded in metadata, so files whose keys collide are told apart and the other file is treated as missing.
+type KeyFunc func(filename string) string
+
+// MD5Key is the default, files stored before the key function was configurable were stored with it
+func MD5Key(filename string) string {
+	hash := md5.Sum([]byte(filename))
+	return hex.EncodeToString(hash[:])
+}
+
+// SHA256Key makes collisions a lot less likely than MD5Key at the cost of longer keys
+func SHA256Key(filename string) string {
+	hash := sha256.Sum256([]byte(filename))
+	return "sha256:" + hex.EncodeToString(hash[:])
+}
+
+// RawKey keeps keys readable by using the filename itself when it's short enough and only has printable
+// ASCII characters, anything else is hashed with SHA256Key. Filenames with a colon are always hashed,
+// which keeps the two kinds of keys and the chunk keys apart.
+func RawKey(filename string) string {
+	if len(filename) == 0 || len(filename) > maxRawKeyLength || strings.Contains(filename, ":") {
+		return SHA256Key(filename)
+	}
+
+	for i := 0; i < len(filename); i++ {
+		// Memcache doesn't allow whitespace and control characters in keys
+		if filename[i] <= ' ' || filename[i] >= 0x7f {
+			return SHA256Key(filename)
+		}
+	}
+
+	return "file:" + filename
+}
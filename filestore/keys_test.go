@@ -0,0 +1,77 @@
+package filestore
+
+import (
+	"filestore/mock"
+	"strings"
+	"testing"
+)
+
+func TestKeyFuncs(t *testing.T) {
+	long := strings.Repeat("a", maxRawKeyLength+1)
+
+	tests := []struct {
+		name     string
+		keyFunc  KeyFunc
+		filename string
+		want     string
+	}{
+		{"MD5", MD5Key, "file.dat", "24132770615d6d79e8ba7123b86c1995"},
+		{"SHA256", SHA256Key, "file.dat", "sha256:a85c34be36a4c5d778bf2d164625cb59a556f45568315f57924967a7883fd9c4"},
+		{"Raw", RawKey, "dir/file.dat", "file:dir/file.dat"},
+		{"Raw with whitespace", RawKey, "my file.dat", SHA256Key("my file.dat")},
+		{"Raw with a colon", RawKey, "c:file.dat", SHA256Key("c:file.dat")},
+		{"Raw non ASCII", RawKey, "fíle.dat", SHA256Key("fíle.dat")},
+		{"Raw too long", RawKey, long, SHA256Key(long)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.keyFunc(tt.filename)
+			if got != tt.want {
+				t.Errorf("Key: want %#v, got %#v", tt.want, got)
+			}
+
+			if len(keyPrefix+got+"::lock") > 250 {
+				t.Errorf("Key: want at most 250 bytes, got %d", len(keyPrefix+got+"::lock"))
+			}
+		})
+	}
+}
+
+func TestKeyCollision(t *testing.T) {
+	// Every filename gets the same key
+	s := NewMemcacheWithClient(mock.NewMemcacheClient(100), MemcacheConfig{
+		ChunkSize: 5,
+		KeyFunc:   func(filename string) string { return "same" },
+	})
+
+	err := s.Store("a.dat", []byte("some content"))
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = s.Retrieve("b.dat")
+	if err != ErrFileNotFound {
+		t.Errorf("Retrieve: want %#v, got %#v", ErrFileNotFound, err)
+	}
+
+	err = s.Store("b.dat", []byte("other content"))
+	if err != ErrFileAlreadyExists {
+		t.Errorf("Store: want %#v, got %#v", ErrFileAlreadyExists, err)
+	}
+
+	err = s.Delete("b.dat")
+	if err != ErrFileNotFound {
+		t.Errorf("Delete: want %#v, got %#v", ErrFileNotFound, err)
+	}
+
+	err = Append(s, "b.dat", []byte("more"))
+	if err != ErrFileNotFound {
+		t.Errorf("Append: want %#v, got %#v", ErrFileNotFound, err)
+	}
+
+	contents, err := s.Retrieve("a.dat")
+	if err != nil || string(contents) != "some content" {
+		t.Errorf("Retrieve: want %#v, got %#v (%v)", "some content", string(contents), err)
+	}
+}
@@ -0,0 +1,158 @@
+package filestore
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+const defaultLeaseDuration = 30 * time.Second
+const defaultLockWaitTimeout = 5 * time.Second
+const defaultLockRetryInterval = 50 * time.Millisecond
+
+// LockConfig enables locking files while they are being changed. The lock is a lease: a key
+// added with an expiration, so a writer which crashed doesn't keep the file locked forever.
+type LockConfig struct {
+	// How long the lock is held at most, should be longer than the slowest write. Memcache
+	// expiration has a one second resolution, so it's rounded up to whole seconds. Defaults to 30s.
+	LeaseDuration time.Duration
+
+	// How long to wait for a file locked by someone else before giving up with ErrFileLocked. Defaults to 5s.
+	WaitTimeout time.Duration
+
+	// How often to try acquiring a lock while waiting. Defaults to 50ms.
+	RetryInterval time.Duration
+}
+
+func (c *LockConfig) withDefaults() *LockConfig {
+	if c == nil {
+		return nil
+	}
+
+	config := *c
+	if config.LeaseDuration <= 0 {
+		config.LeaseDuration = defaultLeaseDuration
+	}
+	if config.WaitTimeout <= 0 {
+		config.WaitTimeout = defaultLockWaitTimeout
+	}
+	if config.RetryInterval <= 0 {
+		config.RetryInterval = defaultLockRetryInterval
+	}
+
+	return &config
+}
+
+// leaseSeconds is the lease duration as Memcache expiration
+func (c *LockConfig) leaseSeconds() int32 {
+	seconds := int32((c.LeaseDuration + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	return seconds
+}
+
+type fileLock struct {
+	filename string
+	token    []byte
+}
+
+// withLock runs fn while holding locks of all the files, it does nothing more than calling fn if locking is disabled
+func (s memcacheStore) withLock(filenames []string, fn func() error) error {
+	if s.lock == nil {
+		return fn()
+	}
+
+	// Always lock in the same order so two writers locking the same files can't deadlock
+	sorted := make([]string, 0, len(filenames))
+	seen := map[string]bool{}
+	for _, filename := range filenames {
+		if !seen[filename] {
+			seen[filename] = true
+			sorted = append(sorted, filename)
+		}
+	}
+	sort.Strings(sorted)
+
+	locks := make([]fileLock, 0, len(sorted))
+	defer func() {
+		for i := len(locks) - 1; i >= 0; i-- {
+			s.releaseLock(locks[i])
+		}
+	}()
+
+	for _, filename := range sorted {
+		lock, err := s.acquireLock(filename)
+		if err != nil {
+			return err
+		}
+
+		locks = append(locks, lock)
+	}
+
+	return fn()
+}
+
+func (s memcacheStore) acquireLock(filename string) (fileLock, error) {
+	logger := s.logger.WithField("filename", filename)
+	lock := fileLock{filename: filename, token: []byte(newLockToken())}
+	deadline := time.Now().Add(s.lock.WaitTimeout)
+
+	for {
+		err := s.addItem(&memcache.Item{Key: s.lockKey(filename), Value: lock.token, Expiration: s.lock.leaseSeconds()})
+		if err == nil {
+			logger.Debug("Locked file")
+			return lock, nil
+		}
+
+		if err != memcache.ErrNotStored {
+			return fileLock{}, fmt.Errorf("Unable to lock file: %w", err)
+		}
+
+		if !time.Now().Add(s.lock.RetryInterval).Before(deadline) {
+			logger.Warning("Timed out waiting for file lock")
+			return fileLock{}, ErrFileLocked
+		}
+
+		time.Sleep(s.lock.RetryInterval)
+	}
+}
+
+// releaseLock removes the lock only if it's still ours, the lease may have expired and someone else
+// may hold the lock by now. Failing to release is not fatal, the lease expires eventually.
+func (s memcacheStore) releaseLock(lock fileLock) {
+	logger := s.logger.WithField("filename", lock.filename)
+
+	item, err := s.getItem(s.lockKey(lock.filename))
+	if err == memcache.ErrCacheMiss || (err == nil && !bytes.Equal(item.Value, lock.token)) {
+		logger.Warning("File lock expired before it was released, consider a longer lease")
+		return
+	} else if err != nil {
+		logger.WithError(err).Warning("Unable to release file lock")
+		return
+	}
+
+	// Swapping for an expired item removes it, unless someone else took over the lock in the meantime
+	item.Expiration = -1
+	err = s.compareAndSwapKey(item)
+	if err == memcache.ErrCASConflict || err == memcache.ErrNotStored {
+		logger.Warning("File lock expired before it was released, consider a longer lease")
+		return
+	} else if err != nil {
+		logger.WithError(err).Warning("Unable to release file lock")
+		return
+	}
+
+	logger.Debug("Unlocked file")
+}
+
+func (s memcacheStore) lockKey(filename string) string {
+	return s.buildKey(filename) + "::lock"
+}
+
+// newLockToken identifies the owner of a lock
+var newLockToken = randomID
@@ -0,0 +1,187 @@
+package filestore
+
+import (
+	"bytes"
+	"filestore/mock"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+func TestLock(t *testing.T) {
+	type testCase struct {
+		name      string
+		lockedBy  []string // files locked by someone else before the operation
+		operation func(s Store) error
+		wantErr   error
+	}
+
+	tests := []testCase{
+		{
+			name:      "Store of an unlocked file",
+			operation: func(s Store) error { return s.Store("new.dat", []byte("content")) },
+			wantErr:   nil,
+		},
+		{
+			name:      "Store of a locked file",
+			lockedBy:  []string{"new.dat"},
+			operation: func(s Store) error { return s.Store("new.dat", []byte("content")) },
+			wantErr:   ErrFileLocked,
+		},
+		{
+			name:      "Delete of a locked file",
+			lockedBy:  []string{"file.dat"},
+			operation: func(s Store) error { return s.Delete("file.dat") },
+			wantErr:   ErrFileLocked,
+		},
+		{
+			name:      "Append to a locked file",
+			lockedBy:  []string{"file.dat"},
+			operation: func(s Store) error { return Append(s, "file.dat", []byte("more")) },
+			wantErr:   ErrFileLocked,
+		},
+		{
+			name:      "WriteAt to a locked file",
+			lockedBy:  []string{"file.dat"},
+			operation: func(s Store) error { return WriteAt(s, "file.dat", 0, []byte("more")) },
+			wantErr:   ErrFileLocked,
+		},
+		{
+			name:      "Rename to a locked file",
+			lockedBy:  []string{"new.dat"},
+			operation: func(s Store) error { return Rename(s, "file.dat", "new.dat") },
+			wantErr:   ErrFileLocked,
+		},
+		{
+			name:      "Copy from a locked file",
+			lockedBy:  []string{"file.dat"},
+			operation: func(s Store) error { return Copy(s, "file.dat", "new.dat") },
+			wantErr:   nil,
+		},
+		{
+			name:      "Copy to a locked file",
+			lockedBy:  []string{"new.dat"},
+			operation: func(s Store) error { return Copy(s, "file.dat", "new.dat") },
+			wantErr:   ErrFileLocked,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := mock.NewMemcacheClient(100)
+			s := NewMemcacheWithClient(c, MemcacheConfig{
+				ChunkSize: 5,
+				Lock:      &LockConfig{WaitTimeout: 20 * time.Millisecond, RetryInterval: 5 * time.Millisecond},
+			}).(*memcacheStore)
+
+			err := s.Store("file.dat", []byte("some content"))
+			if err != nil {
+				panic(err)
+			}
+
+			for _, filename := range tt.lockedBy {
+				_ = c.Add(&memcache.Item{Key: s.lockKey(filename), Value: []byte("someone else")})
+			}
+
+			err = tt.operation(s)
+			if err != tt.wantErr {
+				t.Errorf("Error: want %#v, got %#v", tt.wantErr, err)
+			}
+
+			// Locks of others are left alone, ours are released
+			for _, filename := range []string{"file.dat", "new.dat"} {
+				locked := false
+				for _, l := range tt.lockedBy {
+					locked = locked || l == filename
+				}
+
+				_, err := c.Get(s.lockKey(filename))
+				if locked && err != nil {
+					t.Errorf("Lock of %s: want kept, got %#v", filename, err)
+				}
+				if !locked && err != memcache.ErrCacheMiss {
+					t.Errorf("Lock of %s: want %#v, got %#v", filename, memcache.ErrCacheMiss, err)
+				}
+			}
+		})
+	}
+}
+
+func TestLock_ConcurrentWriters(t *testing.T) {
+	c := mock.NewMemcacheClient(1000)
+	s := NewMemcacheWithClient(c, MemcacheConfig{
+		ChunkSize: 5,
+		Lock:      &LockConfig{WaitTimeout: 5 * time.Second, RetryInterval: time.Millisecond},
+	})
+
+	err := s.Store("file.dat", []byte{})
+	if err != nil {
+		panic(err)
+	}
+
+	// Without the lock some of the appends would fail with ErrFileModified
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- Append(s, "file.dat", []byte("abc"))
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Append: want nil, got %#v", err)
+		}
+	}
+
+	contents, err := s.Retrieve("file.dat")
+	if err != nil || !bytes.Equal(contents, bytes.Repeat([]byte("abc"), 20)) {
+		t.Errorf("Contents: want %d bytes, got %d bytes (%v)", 60, len(contents), err)
+	}
+}
+
+func TestLock_ExpiredLease(t *testing.T) {
+	c := mock.NewMemcacheClient(100)
+	s := NewMemcacheWithClient(c, MemcacheConfig{Lock: &LockConfig{}}).(*memcacheStore)
+
+	lock, err := s.acquireLock("file.dat")
+	if err != nil {
+		t.Fatalf("Error: want nil, got %#v", err)
+	}
+
+	// Our lease expired and someone else took the lock over
+	_ = c.Delete(s.lockKey("file.dat"))
+	_ = c.Add(&memcache.Item{Key: s.lockKey("file.dat"), Value: []byte("someone else")})
+
+	s.releaseLock(lock)
+
+	item, err := c.Get(s.lockKey("file.dat"))
+	if err != nil || string(item.Value) != "someone else" {
+		t.Errorf("Lock: want kept, got %#v (%v)", item, err)
+	}
+}
+
+func TestLockConfig_LeaseSeconds(t *testing.T) {
+	tests := []struct {
+		lease time.Duration
+		want  int32
+	}{
+		{0, 30},
+		{500 * time.Millisecond, 1},
+		{time.Second, 1},
+		{1500 * time.Millisecond, 2},
+	}
+
+	for _, tt := range tests {
+		got := (&LockConfig{LeaseDuration: tt.lease}).withDefaults().leaseSeconds()
+		if got != tt.want {
+			t.Errorf("Lease %s: want %d, got %d", tt.lease, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package filestore
+
+import (
+	"context"
+	"io/ioutil"
+	"log/slog"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// NewSlogLogger returns a logrus logger which forwards every entry to the given slog logger,
+// so the store can be plugged into applications using log/slog. Level filtering is left to the slog handler.
+func NewSlogLogger(logger *slog.Logger) *log.Logger {
+	l := log.New()
+	l.SetOutput(ioutil.Discard)
+	l.SetLevel(log.TraceLevel)
+	l.AddHook(slogHook{logger: logger})
+
+	return l
+}
+
+type slogHook struct {
+	logger *slog.Logger
+}
+
+func (h slogHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h slogHook) Fire(entry *log.Entry) error {
+	ctx := entry.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	level := slogLevel(entry.Level)
+	if !h.logger.Enabled(ctx, level) {
+		return nil
+	}
+
+	keys := make([]string, 0, len(entry.Data))
+	for key := range entry.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	attrs := make([]slog.Attr, 0, len(keys))
+	for _, key := range keys {
+		value := entry.Data[key]
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		attrs = append(attrs, slog.Any(key, value))
+	}
+
+	h.logger.LogAttrs(ctx, level, entry.Message, attrs...)
+
+	return nil
+}
+
+func slogLevel(level log.Level) slog.Level {
+	switch level {
+	case log.PanicLevel, log.FatalLevel, log.ErrorLevel:
+		return slog.LevelError
+	case log.WarnLevel:
+		return slog.LevelWarn
+	case log.InfoLevel:
+		return slog.LevelInfo
+	default:
+		return slog.LevelDebug
+	}
+}
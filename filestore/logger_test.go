@@ -0,0 +1,28 @@
+package filestore
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestNewSlogLogger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := NewSlogLogger(slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{Level: slog.LevelInfo})))
+
+	logger.WithField("key", "some-key").Debug("Getting key")
+	logger.WithField("filename", "file.dat").WithError(errors.New("timeout")).Warning("Unable to cleanup")
+
+	got := buf.String()
+
+	if strings.Contains(got, "Getting key") {
+		t.Errorf("Debug entry should have been filtered out, got %s", got)
+	}
+
+	want := `level=WARN msg="Unable to cleanup" error=timeout filename=file.dat`
+	if !strings.Contains(got, want) {
+		t.Errorf("Output: want %q, got %q", want, got)
+	}
+}
@@ -1,11 +1,14 @@
 package filestore
 
 import (
-	"crypto/md5"
+	"context"
+	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"filestore/client"
 	"fmt"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/bradfitz/gomemcache/memcache"
@@ -14,30 +17,174 @@ import (
 
 const defaultChunkSize = 1024 * 1024        // 1MB
 const defaultMaxFileSize = 50 * 1024 * 1024 // 50MB
+const defaultGetMultiBatchSize = 10
+const defaultItemSizeMax = 1024 * 1024 // Memcache default
+
+// Room for the item header, CAS, key and flags Memcache stores along with the value,
+// chunks of item_size_max - itemOverhead bytes are always accepted
+const itemOverhead = 512
 const keyPrefix = "filestore:"
 
+// Retrieve starts over this often when the file is written to while its chunks are fetched
+const maxRetrieveAttempts = 3
+
 type memcacheStore struct {
-	client      client.Memcache
-	chunkSize   int
-	maxFileSize int
+	client              client.Memcache
+	chunkSize           int
+	maxFileSize         int
+	getMultiBatchSize   int
+	getMultiConcurrency int
+	metrics             Metrics
+	logger              log.FieldLogger
+	retry               RetryPolicy
+	trackFiles          bool
+	repairCorrupted     bool
+	onCorrupted         func(event CorruptionEvent)
+	lock                *LockConfig
+	keepVersions        int
+	keyFunc             KeyFunc
+	filenamePolicy      *FilenamePolicy
+	quota               *QuotaConfig
+	cache               *hotCache
+	flights             *flightGroup
 }
 
+// MemcacheProtocol is the protocol NewMemcache talks to the server with
+type MemcacheProtocol string
+
+const (
+	// Classic text protocol via gomemcache
+	ProtocolText MemcacheProtocol = "text"
+
+	// Meta protocol via client.NewMetaClient, requires memcached 1.6 or newer
+	ProtocolMeta MemcacheProtocol = "meta"
+)
+
 type MemcacheConfig struct {
+	// Defaults to ProtocolText, ignored by NewMemcacheWithClient
+	Protocol MemcacheProtocol
+
+	// Max number of idle connections to the server, defaults to 2
+	MaxIdleConns int
+
 	Timeout     time.Duration
 	ChunkSize   int
 	MaxFileSize int
+
+	// Max number of chunks requested with a single GetMulti when retrieving a file
+	// and how many of these requests can be in flight at once (defaults to one at a time)
+	GetMultiBatchSize   int
+	GetMultiConcurrency int
+
+	// Optional, receives operation counts, latencies and errors
+	Metrics Metrics
+
+	// Optional, defaults to the standard logrus logger. See NewSlogLogger to log via log/slog
+	Logger log.FieldLogger
+
+	// Optional, retries failed backend requests. Applied to every chunk level operation
+	Retry RetryPolicy
+
+	// Optional, fail fast with ErrBackendUnavailable while the backend is down
+	CircuitBreaker *CircuitBreakerConfig
+
+	// Keep a record of stored files, required to check the store for orphaned and corrupted files
+	TrackFiles bool
+
+	// Purge corrupted files when Retrieve finds them, so storing the same filename again succeeds
+	// instead of failing with ErrFileAlreadyExists. The purge takes the lock if Lock is set
+	RepairCorrupted bool
+
+	// Optional, called when Retrieve finds a corrupted file, e.g. to fetch it from origin again
+	OnCorrupted func(event CorruptionEvent)
+
+	// Optional, lock files while they are being changed so concurrent writers to the same filename
+	// wait for each other instead of producing undefined results
+	Lock *LockConfig
+
+	// Number of previous versions kept when a file is stored again, see RetrieveVersion. If zero,
+	// storing an existing file fails with ErrFileAlreadyExists
+	Versions int
+
+	// Optional, derives Memcache keys from filenames, defaults to MD5Key. Files stored with
+	// a different key function can't be found after changing it
+	KeyFunc KeyFunc
+
+	// Optional, rejects filenames which don't comply with ErrInvalidFilename and normalizes the rest.
+	// Any filename is accepted as is without it
+	FilenamePolicy *FilenamePolicy
+
+	// Optional, limits how much every namespace can store, Store fails with ErrQuotaExceeded over the limit
+	Quota *QuotaConfig
+
+	// Optional, keeps recently retrieved files in memory
+	Cache *CacheConfig
 }
 
+// NewMemcache doesn't talk to the server until the store is used, see OpenMemcache to derive
+// the chunk size from the server settings and validate the protocol
 func NewMemcache(server string, config MemcacheConfig) Store {
+	if config.Protocol == ProtocolMeta {
+		c := client.NewMetaClient(server, client.MetaConfig{
+			Timeout:      config.Timeout,
+			MaxIdleConns: config.MaxIdleConns,
+		})
+
+		return NewMemcacheWithClient(c, config)
+	}
+
 	c := memcache.New(server)
 	if config.Timeout != 0 {
 		c.Timeout = config.Timeout
 	}
+	if config.MaxIdleConns > 0 {
+		c.MaxIdleConns = config.MaxIdleConns
+	}
 
 	return NewMemcacheWithClient(c, config)
 }
 
+// OpenMemcache asks the server for the largest item it accepts (item_size_max) before creating the store.
+// Without ChunkSize chunks are as large as the server allows, a larger ChunkSize fails with
+// ErrChunkSizeTooLarge. If the server can't be asked, its default limit of 1MB is assumed.
+// Fails if the protocol is unknown.
+func OpenMemcache(server string, config MemcacheConfig) (Store, error) {
+	if config.Protocol != "" && config.Protocol != ProtocolText && config.Protocol != ProtocolMeta {
+		return nil, fmt.Errorf("Unknown Memcache protocol %q, use %q or %q", config.Protocol, ProtocolText, ProtocolMeta)
+	}
+
+	itemSizeMax, err := client.ItemSizeMax(server, config.Timeout)
+	if err != nil {
+		logger := config.Logger
+		if logger == nil {
+			logger = log.StandardLogger()
+		}
+		logger.WithError(err).Warning("Unable to detect Memcache item size limit, assuming the default")
+
+		if config.ChunkSize <= 0 {
+			config.ChunkSize = defaultItemSizeMax - itemOverhead
+		}
+
+		return NewMemcache(server, config), nil
+	}
+
+	maxChunkSize := itemSizeMax - itemOverhead
+	if config.ChunkSize > maxChunkSize {
+		return nil, fmt.Errorf("%w: chunk size is %d bytes, Memcache accepts up to %d bytes (item_size_max %d)",
+			ErrChunkSizeTooLarge, config.ChunkSize, maxChunkSize, itemSizeMax)
+	}
+	if config.ChunkSize <= 0 {
+		config.ChunkSize = maxChunkSize
+	}
+
+	return NewMemcache(server, config), nil
+}
+
 func NewMemcacheWithClient(client client.Memcache, config MemcacheConfig) Store {
+	if config.CircuitBreaker != nil {
+		client = NewCircuitBreaker(client, *config.CircuitBreaker)
+	}
+
 	chunkSize := config.ChunkSize
 	if chunkSize <= 0 {
 		chunkSize = defaultChunkSize
@@ -48,25 +195,222 @@ func NewMemcacheWithClient(client client.Memcache, config MemcacheConfig) Store
 		maxFileSize = defaultMaxFileSize
 	}
 
+	getMultiBatchSize := config.GetMultiBatchSize
+	if getMultiBatchSize <= 0 {
+		getMultiBatchSize = defaultGetMultiBatchSize
+	}
+
+	getMultiConcurrency := config.GetMultiConcurrency
+	if getMultiConcurrency <= 0 {
+		getMultiConcurrency = 1
+	}
+
+	metrics := config.Metrics
+	if metrics == nil {
+		metrics = noopMetrics{}
+	}
+
+	logger := config.Logger
+	if logger == nil {
+		logger = log.StandardLogger()
+	}
+
+	keyFunc := config.KeyFunc
+	if keyFunc == nil {
+		keyFunc = MD5Key
+	}
+
 	return &memcacheStore{
-		client:      client,
-		chunkSize:   chunkSize,
-		maxFileSize: maxFileSize,
+		client:              client,
+		chunkSize:           chunkSize,
+		maxFileSize:         maxFileSize,
+		getMultiBatchSize:   getMultiBatchSize,
+		getMultiConcurrency: getMultiConcurrency,
+		metrics:             metrics,
+		logger:              logger,
+		retry:               config.Retry.withDefaults(),
+		trackFiles:          config.TrackFiles,
+		repairCorrupted:     config.RepairCorrupted,
+		onCorrupted:         config.OnCorrupted,
+		lock:                config.Lock.withDefaults(),
+		keepVersions:        config.Versions,
+		keyFunc:             keyFunc,
+		filenamePolicy:      config.FilenamePolicy,
+		quota:               config.Quota,
+		cache:               newHotCache(config.Cache),
+		flights:             newFlightGroup(),
 	}
 }
 
 func (s memcacheStore) Store(filename string, contents []byte) error {
+	start := time.Now()
+	s.metrics.AddBytesIn(len(contents))
+
+	err := s.normalizeFilenames(&filename)
+	if err == nil {
+		err = s.withLock([]string{filename}, func() error {
+			return s.store(filename, contents)
+		})
+		s.changed(filename)
+	}
+	s.metrics.ObserveOperation(OpStore, time.Since(start), err)
+
+	return err
+}
+
+func (s memcacheStore) Retrieve(filename string) ([]byte, error) {
+	return s.RetrieveContext(context.Background(), filename)
+}
+
+// RetrieveContext shares the fetch with concurrent retrieves of the same file. If ctx is done
+// the fetch goes on for the others.
+func (s memcacheStore) RetrieveContext(ctx context.Context, filename string) ([]byte, error) {
+	start := time.Now()
+
+	contents := []byte{}
+	err := s.normalizeFilenames(&filename)
+	if err == nil {
+		contents, err = s.flights.do(ctx, filename, func() ([]byte, error) {
+			contents, err := s.retrieveCached(filename)
+			if err == ErrFileCorrupted {
+				s.reportCorruption(filename)
+			}
+
+			return contents, err
+		})
+	}
+	s.metrics.ObserveOperation(OpRetrieve, time.Since(start), err)
+	if err == nil {
+		s.metrics.AddBytesOut(len(contents))
+	}
+
+	return contents, err
+}
+
+func (s memcacheStore) Delete(filename string) error {
+	start := time.Now()
+
+	err := s.normalizeFilenames(&filename)
+	if err == nil {
+		err = s.withLock([]string{filename}, func() error {
+			return s.delete(filename)
+		})
+		s.changed(filename)
+	}
+	s.metrics.ObserveOperation(OpDelete, time.Since(start), err)
+
+	return err
+}
+
+func (s memcacheStore) Rename(from string, to string) error {
+	start := time.Now()
+
+	err := s.normalizeFilenames(&from, &to)
+	if err == nil {
+		err = s.withLock([]string{from, to}, func() error {
+			return s.rename(from, to)
+		})
+		s.changed(from, to)
+	}
+	s.metrics.ObserveOperation(OpRename, time.Since(start), err)
+
+	return err
+}
+
+func (s memcacheStore) Copy(from string, to string) error {
+	start := time.Now()
+
+	err := s.normalizeFilenames(&from, &to)
+	if err == nil {
+		// The source is only read, like Retrieve it doesn't need a lock
+		err = s.withLock([]string{to}, func() error {
+			return s.copy(from, to)
+		})
+		s.changed(to)
+	}
+	s.metrics.ObserveOperation(OpCopy, time.Since(start), err)
+
+	return err
+}
+
+func (s memcacheStore) Append(filename string, data []byte) error {
+	start := time.Now()
+	s.metrics.AddBytesIn(len(data))
+
+	err := s.normalizeFilenames(&filename)
+	if err == nil {
+		err = s.withLock([]string{filename}, func() error {
+			return s.writeRange(filename, -1, data)
+		})
+		s.changed(filename)
+	}
+	s.metrics.ObserveOperation(OpAppend, time.Since(start), err)
+
+	return err
+}
+
+func (s memcacheStore) WriteAt(filename string, offset int, data []byte) error {
+	start := time.Now()
+	s.metrics.AddBytesIn(len(data))
+
+	err := s.normalizeFilenames(&filename)
+	if err == nil && offset < 0 {
+		err = fmt.Errorf("%w: negative offset %d", ErrInvalidRange, offset)
+	}
+	if err == nil {
+		err = s.withLock([]string{filename}, func() error {
+			return s.writeRange(filename, offset, data)
+		})
+		s.changed(filename)
+	}
+	s.metrics.ObserveOperation(OpWriteAt, time.Since(start), err)
+
+	return err
+}
+
+// changed drops the files from the cache and makes retrieves fetch them again
+func (s memcacheStore) changed(filenames ...string) {
+	s.cache.invalidate(filenames...)
+	for _, filename := range filenames {
+		s.flights.forget(filename)
+	}
+}
+
+// normalizeFilenames applies the filename policy to the filenames in place
+func (s memcacheStore) normalizeFilenames(filenames ...*string) error {
+	for _, filename := range filenames {
+		normalized, err := s.filenamePolicy.apply(*filename)
+		if err != nil {
+			return err
+		}
+
+		*filename = normalized
+	}
+
+	return nil
+}
+
+func (s memcacheStore) store(filename string, contents []byte) error {
 	size := len(contents)
 
-	log.WithField("filename", filename).WithField("size", size).Debug("Storing file")
+	s.logger.WithField("filename", filename).WithField("size", size).Debug("Storing file")
 
 	if size > s.maxFileSize {
 		return fmt.Errorf("%w: max file size is %d bytes", ErrFileTooLarge, s.maxFileSize)
 	}
 
-	metadataKey := buildKey(filename)
+	if s.keepVersions > 0 {
+		return s.storeVersion(filename, contents)
+	}
+
+	return s.storeNew(filename, contents)
+}
+
+// storeNew fails with ErrFileAlreadyExists if the file exists, even if the store keeps versions
+func (s memcacheStore) storeNew(filename string, contents []byte) error {
+	metadataKey := s.buildKey(filename)
 
-	// Check if the file already exists
+	// Existing files are turned away before any chunk is written, whoever adds metadata first wins a race
 	_, err := s.getKey(metadataKey)
 	if err == nil {
 		return ErrFileAlreadyExists
@@ -74,54 +418,48 @@ func (s memcacheStore) Store(filename string, contents []byte) error {
 		return fmt.Errorf("Unable to store file: %w", err)
 	}
 
-	totalChunks := size / s.chunkSize
-	if size%s.chunkSize > 0 {
-		totalChunks++
+	// Check quota before any chunk is written
+	meta := s.newMetadata(filename, contents)
+	err = s.reserveQuota(filename, fileUsage(meta))
+	if err != nil {
+		return err
 	}
 
-	// Create metadata key
-	err = s.setKey(metadataKey, []byte(strconv.Itoa(totalChunks)))
+	// Register the file before writing chunks so they can be found if cleanup fails later,
+	// a file which can't be listed and checked is not stored
+	err = s.registerFile(filename, meta)
 	if err != nil {
+		s.releaseQuota(filename, fileUsage(meta))
+
 		return fmt.Errorf("Unable to store file: %w", err)
 	}
 
-	// Create keys for each chunk
-	index := 0
-	for i := 0; i < size; i += s.chunkSize {
-		end := i + s.chunkSize
-		if end > size {
-			end = size
-		}
+	// Metadata is added last, so readers never find the file before all of its chunks are there
+	err = s.writeChunks(meta, contents)
+	if err != nil {
+		s.cleanupUnstoredFile(filename, meta, fileUsage(meta))
 
-		chunkKey := buildChunkKey(filename, index)
-		chunk := contents[i:end]
+		return fmt.Errorf("Unable to store file: %w", err)
+	}
 
-		err := s.setKey(chunkKey, chunk)
-		if err != nil {
-			purgeErr := s.purgeFile(filename, totalChunks)
-			if purgeErr != nil {
-				log.WithField("filename", filename).
-					WithError(purgeErr).
-					Error("Unable to cleanup file after storing failed")
-			}
+	err = s.addKey(metadataKey, meta.encode())
+	if err == memcache.ErrNotStored {
+		// The registry may point to our chunks instead of the file stored meanwhile, Check sorts that out
+		s.cleanupFailedChunks(filename, meta, fileUsage(meta))
 
-			return fmt.Errorf("Unable to store file: %w", err)
-		}
+		return ErrFileAlreadyExists
+	} else if err != nil {
+		s.cleanupUnstoredFile(filename, meta, fileUsage(meta))
 
-		index++
+		return fmt.Errorf("Unable to store file: %w", err)
 	}
 
 	// Check if file was stored completely
 	// This is a naive and expensive way to do it
 	// Memcache may offer a better way to verify if a key exists without actually retrieving it
-	storedContents, err := s.Retrieve(filename)
+	storedContents, err := s.retrieve(filename)
 	if err != nil {
-		purgeErr := s.purgeFile(filename, totalChunks)
-		if purgeErr != nil {
-			log.WithField("filename", filename).
-				WithError(purgeErr).
-				Error("Unable to cleanup file after storing failed")
-		}
+		s.cleanupFailedStore(filename, meta)
 
 		return fmt.Errorf("Unable to store file: %w", err)
 	}
@@ -130,36 +468,166 @@ func (s memcacheStore) Store(filename string, contents []byte) error {
 		return ErrChecksumFailed
 	}
 
-	log.WithField("filename", filename).WithField("size", len(storedContents)).Info("Stored file")
+	s.logger.WithField("filename", filename).WithField("size", len(storedContents)).Info("Stored file")
 
 	return nil
 }
 
-func (s memcacheStore) Retrieve(filename string) ([]byte, error) {
-	log.WithField("filename", filename).Debug("Retrieving file")
+// newMetadata describes contents about to be stored under a new file ID
+func (s memcacheStore) newMetadata(filename string, contents []byte) metadata {
+	size := len(contents)
+
+	totalChunks := size / s.chunkSize
+	if size%s.chunkSize > 0 {
+		totalChunks++
+	}
+
+	checksums := make([]string, 0, totalChunks)
+	for i := 0; i < size; i += s.chunkSize {
+		end := i + s.chunkSize
+		if end > size {
+			end = size
+		}
+
+		checksums = append(checksums, checksum(contents[i:end]))
+	}
+
+	return metadata{ID: newFileID(), Filename: filename, Chunks: totalChunks, Size: size, ChunkSize: s.chunkSize, Checksums: checksums}
+}
+
+// writeChunks creates keys for each chunk
+func (s memcacheStore) writeChunks(meta metadata, contents []byte) error {
+	index := 0
+	for i := 0; i < len(contents); i += meta.ChunkSize {
+		end := i + meta.ChunkSize
+		if end > len(contents) {
+			end = len(contents)
+		}
+
+		err := s.setKey(meta.chunkKey(index), contents[i:end])
+		if err != nil {
+			return err
+		}
+
+		index++
+	}
+
+	return nil
+}
 
-	metadataKey := buildKey(filename)
+func (s memcacheStore) cleanupFailedStore(filename string, meta metadata) {
+	s.releaseQuota(filename, fileUsage(meta))
 
-	metadata, err := s.getKey(metadataKey)
+	err := s.purgeFile(filename, meta)
 	if err != nil {
-		if err == memcache.ErrCacheMiss {
-			return []byte{}, ErrFileNotFound
+		s.metrics.IncPurgeFailures()
+		s.logger.WithField("filename", filename).
+			WithError(err).
+			Error("Unable to cleanup file after storing failed")
+		return
+	}
+
+	s.forgetFile(filename)
+}
+
+// cleanupFailedChunks gives back what was reserved for chunks which never got metadata referring to them
+func (s memcacheStore) cleanupFailedChunks(filename string, meta metadata, reserved usage) {
+	s.releaseQuota(filename, reserved)
+
+	err := s.purgeChunks(meta)
+	if err != nil {
+		s.metrics.IncPurgeFailures()
+		s.logger.WithField("filename", filename).
+			WithError(err).
+			Error("Unable to cleanup file after storing failed")
+	}
+}
+
+// cleanupUnstoredFile also removes the registry entry of a new file whose metadata was never added,
+// unless its chunks are left behind and Check has to find them
+func (s memcacheStore) cleanupUnstoredFile(filename string, meta metadata, reserved usage) {
+	s.releaseQuota(filename, reserved)
+
+	logger := s.logger.WithField("filename", filename)
+
+	err := s.purgeChunks(meta)
+	if err != nil {
+		s.metrics.IncPurgeFailures()
+		logger.WithError(err).Error("Unable to cleanup file after storing failed")
+		return
+	}
+
+	err = s.unregisterFileID(filename, meta.ID)
+	if err != nil {
+		s.metrics.IncPurgeFailures()
+		logger.WithError(err).Warning("Unable to unregister file")
+	}
+}
+
+// forgetFile removes the file from the registry. Failing to do so is counted as a purge failure but
+// doesn't fail the operation, the file is listed until Check finds that it does not exist anymore
+func (s memcacheStore) forgetFile(filename string) {
+	err := s.unregisterFile(filename)
+	if err != nil {
+		s.metrics.IncPurgeFailures()
+		s.logger.WithField("filename", filename).WithError(err).Warning("Unable to unregister file")
+	}
+}
+
+func (s memcacheStore) retrieve(filename string) ([]byte, error) {
+	return retryChanged(func() ([]byte, error) {
+		meta, err := s.retrieveMetadata(filename)
+		if err != nil {
+			return []byte{}, err
 		}
 
-		return []byte{}, fmt.Errorf("Unable to retrieve file: %w", err)
+		return s.retrieveChunks(filename, meta)
+	})
+}
+
+// retryChanged fetches the file again while it keeps changing under the fetch, a file written to
+// over and over is reported as modified in the end
+func retryChanged(fetch func() ([]byte, error)) ([]byte, error) {
+	for attempt := 1; ; attempt++ {
+		contents, err := fetch()
+		if err != errFileChanged {
+			return contents, err
+		}
+
+		if attempt == maxRetrieveAttempts {
+			return []byte{}, ErrFileModified
+		}
 	}
+}
+
+func (s memcacheStore) retrieveMetadata(filename string) (metadata, error) {
+	s.logger.WithField("filename", filename).Debug("Retrieving file")
 
-	totalChunks, _ := strconv.Atoi(string(metadata)) // skipping error checking, will trust metadata not to have anything funny
+	meta, err := s.getMetadata(filename)
+	if err != nil {
+		if err == memcache.ErrCacheMiss {
+			return metadata{}, ErrFileNotFound
+		}
 
-	allKeys := []string{}
-	for i := 0; i < totalChunks; i++ {
-		chunkKey := buildChunkKey(filename, i)
-		allKeys = append(allKeys, chunkKey)
+		if err == errMetadataInvalid {
+			return metadata{}, ErrFileCorrupted
+		}
+
+		return metadata{}, fmt.Errorf("Unable to retrieve file: %w", err)
 	}
 
-	values, err := s.getKeys(allKeys)
+	return meta, nil
+}
+
+func (s memcacheStore) retrieveChunks(filename string, meta metadata) ([]byte, error) {
+	contents, err := s.getChunks(meta)
 	if err != nil {
 		if err == errKeysMissing {
+			// Chunks are purged once they are replaced, the file may have been written to meanwhile
+			if s.modifiedSince(filename, meta) {
+				return []byte{}, errFileChanged
+			}
+
 			// There are less chunks than we expected, file is corrupted
 			return []byte{}, ErrFileCorrupted
 		}
@@ -167,24 +635,16 @@ func (s memcacheStore) Retrieve(filename string) ([]byte, error) {
 		return []byte{}, fmt.Errorf("Unable to retrieve file: %w", err)
 	}
 
-	// Iterate over all returned chunks and build up file contents
-	contents := []byte{}
-	for i := 0; i < totalChunks; i++ {
-		contents = append(contents, values[allKeys[i]]...)
-	}
-
-	log.WithField("filename", filename).WithField("size", len(contents)).Info("Retrieved file")
+	s.logger.WithField("filename", filename).WithField("size", len(contents)).Info("Retrieved file")
 
 	return contents, nil
 }
 
-func (s memcacheStore) Delete(filename string) error {
-	log.WithField("filename", filename).Debug("Deleting file")
-
-	metadataKey := buildKey(filename)
+func (s memcacheStore) delete(filename string) error {
+	s.logger.WithField("filename", filename).Debug("Deleting file")
 
-	metadata, err := s.getKey(metadataKey)
-	if err != nil {
+	meta, err := s.getMetadata(filename)
+	if err != nil && err != errMetadataInvalid {
 		if err == memcache.ErrCacheMiss {
 			// File not found. While we may just return nil here, returning an error is more explicit and
 			// can surface hidden issues in the code which uses the library
@@ -194,84 +654,629 @@ func (s memcacheStore) Delete(filename string) error {
 		return fmt.Errorf("Unable to delete file: %w", err)
 	}
 
-	totalChunks, _ := strconv.Atoi(string(metadata)) // skipping error checking, will trust metadata not to have anything funny
-
-	err = s.purgeFile(filename, totalChunks)
+	// With invalid metadata chunks can't be located, only the metadata key itself gets removed
+	err = s.purgeFile(filename, meta)
 	if err != nil {
+		s.metrics.IncPurgeFailures()
 		return fmt.Errorf("Unable to delete file: %w", err)
 	}
 
-	log.WithField("filename", filename).Info("Deleted file")
+	s.releaseQuota(filename, fileUsage(meta))
+
+	s.forgetFile(filename)
+
+	s.logger.WithField("filename", filename).Info("Deleted file")
 
 	return nil
 }
 
-func (s memcacheStore) purgeFile(filename string, totalChunks int) error {
-	for i := 0; i < totalChunks; i++ {
-		chunkKey := buildChunkKey(filename, i)
-		err := s.deleteKey(chunkKey)
+// writeRange overwrites part of a file. Chunks which overlap the range are written under a new file ID,
+// so the chunks of the file stay intact until its metadata is switched over to them, which only happens
+// if nobody else changed the file in the meantime. Negative offset appends to the end of the file.
+func (s memcacheStore) writeRange(filename string, offset int, data []byte) error {
+	logger := s.logger.WithField("filename", filename)
+	logger.WithField("offset", offset).WithField("size", len(data)).Debug("Writing to file")
+
+	metadataKey := s.buildKey(filename)
+
+	item, err := s.getItem(metadataKey)
+	if err != nil {
+		if err == memcache.ErrCacheMiss {
+			return ErrFileNotFound
+		}
+
+		return fmt.Errorf("Unable to update file: %w", err)
+	}
+
+	meta, err := decodeMetadata(item.Value)
+	if err != nil {
+		logger.WithError(err).Warning("Unable to decode metadata")
+		return ErrFileCorrupted
+	}
+
+	if !meta.belongsTo(filename) {
+		logger.WithField("owner", meta.Filename).Warning("Key collides with another file")
+		return ErrFileNotFound
+	}
+
+	if meta.Size < 0 || meta.ChunkSize <= 0 {
+		return fmt.Errorf("Unable to update file: %w", errLegacyMetadata)
+	}
+
+	if meta.ID == "" {
+		meta.ID = legacyFileID(filename)
+	}
+
+	if offset < 0 {
+		offset = meta.Size
+	}
+
+	// Writing past the end would leave a hole in the file
+	if offset > meta.Size {
+		return fmt.Errorf("%w: offset %d is past the end of the file (%d bytes)", ErrInvalidRange, offset, meta.Size)
+	}
+
+	if len(data) == 0 {
+		return nil
+	}
+
+	end := offset + len(data)
+	size := meta.Size
+	if end > size {
+		size = end
+	}
+
+	if size > s.maxFileSize {
+		return fmt.Errorf("%w: max file size is %d bytes", ErrFileTooLarge, s.maxFileSize)
+	}
+
+	// Only growing the file counts against the quota, it's given back unless the file gets updated
+	growth := usage{bytes: size - meta.Size}
+	err = s.reserveQuota(filename, growth)
+	if err != nil {
+		return err
+	}
+
+	updated := false
+	defer func() {
+		if !updated {
+			s.releaseQuota(filename, growth)
+		}
+	}()
+
+	// Chunk size of an existing file has to be preserved even if the store is configured differently now
+	chunkSize := meta.ChunkSize
+	first := offset / chunkSize
+	last := (end - 1) / chunkSize
+
+	// Existing chunks which are only partially overwritten have to be read first
+	existing := [][]byte{}
+	if first < meta.Chunks {
+		existingEnd := last + 1
+		if existingEnd > meta.Chunks {
+			existingEnd = meta.Chunks
+		}
+
+		existing, err = s.getChunkRange(meta, first, existingEnd)
+		if err == errKeysMissing {
+			// Chunks are purged once they are replaced, someone may have written to the file meanwhile
+			if s.modifiedSince(filename, meta) {
+				return ErrFileModified
+			}
+
+			return ErrFileCorrupted
+		} else if err != nil {
+			return fmt.Errorf("Unable to update file: %w", err)
+		}
+	}
+
+	updatedMeta := meta
+	updatedMeta.Size = size
+	updatedMeta.Chunks = meta.Chunks
+	if last+1 > updatedMeta.Chunks {
+		updatedMeta.Chunks = last + 1
+	}
+
+	// Slices are copied so that meta keeps describing the chunks being replaced
+	updatedMeta.Checksums = append([]string{}, meta.Checksums...)
+	if len(updatedMeta.Checksums) != meta.Chunks {
+		updatedMeta.Checksums = nil // not tracked for this file
+	}
+
+	updatedMeta.ChunkIDs = make([]string, updatedMeta.Chunks)
+	for index := range updatedMeta.ChunkIDs {
+		updatedMeta.ChunkIDs[index] = meta.ID
+		if index < len(meta.ChunkIDs) && meta.ChunkIDs[index] != "" {
+			updatedMeta.ChunkIDs[index] = meta.ChunkIDs[index]
+		}
+	}
+
+	writeID := newFileID()
+	written := []string{}
+	for index := first; index <= last; index++ {
+		chunkStart := index * chunkSize
+		chunkEnd := chunkStart + chunkSize
+		if chunkEnd > size {
+			chunkEnd = size
+		}
+
+		chunk := make([]byte, chunkEnd-chunkStart)
+		if index-first < len(existing) {
+			copy(chunk, existing[index-first])
+		}
+
+		// Overlay the part of the data which falls into this chunk
+		from := offset
+		if from < chunkStart {
+			from = chunkStart
+		}
+		to := end
+		if to > chunkEnd {
+			to = chunkEnd
+		}
+		copy(chunk[from-chunkStart:], data[from-offset:to-offset])
+
+		updatedMeta.ChunkIDs[index] = writeID
+		err := s.setKey(updatedMeta.chunkKey(index), chunk)
+		if err != nil {
+			s.purgeKeys(logger, append(written, updatedMeta.chunkKey(index)))
+			return fmt.Errorf("Unable to update file: %w", err)
+		}
+		written = append(written, updatedMeta.chunkKey(index))
+
+		if index < len(updatedMeta.Checksums) {
+			updatedMeta.Checksums[index] = checksum(chunk)
+		} else if updatedMeta.Checksums != nil || meta.Chunks == 0 {
+			updatedMeta.Checksums = append(updatedMeta.Checksums, checksum(chunk))
+		}
+	}
+
+	item.Value = updatedMeta.encode()
+
+	err = s.compareAndSwapKey(item)
+	if err != nil {
+		// The new chunks are not used by anyone, the file is as it was
+		s.purgeKeys(logger, written)
+
+		if err == memcache.ErrCASConflict || err == memcache.ErrNotStored {
+			// Someone else changed, replaced or deleted the file since we read metadata
+			return ErrFileModified
+		}
+
+		return fmt.Errorf("Unable to update file: %w", err)
+	}
+	updated = true
+
+	// Chunks which were replaced are not used anymore
+	replaced := []string{}
+	for index := first; index <= last && index < meta.Chunks; index++ {
+		replaced = append(replaced, meta.chunkKey(index))
+	}
+	s.purgeKeys(logger, replaced)
+
+	logger.WithField("size", size).Info("Updated file")
+
+	return nil
+}
+
+// modifiedSince reports if the file was changed, replaced or deleted since its metadata was read
+func (s memcacheStore) modifiedSince(filename string, meta metadata) bool {
+	current, err := s.getMetadata(filename)
+	if err == memcache.ErrCacheMiss {
+		return true
+	} else if err != nil {
+		return false
+	}
+
+	return !meta.sameContents(current)
+}
+
+// rollbackRename removes the new name of the file, the old one still refers to the same chunks
+func (s memcacheStore) rollbackRename(logger log.FieldLogger, to string, meta metadata, moved usage, registered bool) {
+	err := s.deleteKey(s.buildKey(to))
+	if err != nil {
+		logger.WithError(err).Error("Unable to rollback renaming file")
+	}
+
+	if registered {
+		err = s.unregisterFileID(to, meta.ID)
+		if err != nil {
+			s.metrics.IncPurgeFailures()
+			logger.WithError(err).Warning("Unable to unregister file")
+		}
+	}
+
+	s.releaseQuota(to, moved)
+}
+
+// purgeKeys deletes keys nobody refers to anymore, failing to do so only leaves them for Memcache to evict
+func (s memcacheStore) purgeKeys(logger log.FieldLogger, keys []string) {
+	for _, key := range keys {
+		err := s.deleteKey(key)
+		if err != nil {
+			s.metrics.IncPurgeFailures()
+			logger.WithField("key", key).WithError(err).Warning("Unable to purge unused chunk")
+		}
+	}
+}
+
+// rename only moves metadata to the new filename, chunks stay where they are
+func (s memcacheStore) rename(from string, to string) error {
+	logger := s.logger.WithField("from", from).WithField("to", to)
+	logger.Debug("Renaming file")
+
+	meta, err := s.getMetadata(from)
+	if err != nil {
+		if err == memcache.ErrCacheMiss {
+			return ErrFileNotFound
+		}
+
+		if err == errMetadataInvalid {
+			return ErrFileCorrupted
+		}
+
+		return fmt.Errorf("Unable to rename file: %w", err)
+	}
+
+	// Moving the file to another namespace counts against its quota
+	moved := usage{}
+	if s.quota != nil && s.quota.namespace(from) != s.quota.namespace(to) {
+		moved = fileUsage(meta)
+	}
+
+	err = s.reserveQuota(to, moved)
+	if err != nil {
+		return err
+	}
+
+	meta.Filename = to
+	err = s.addKey(s.buildKey(to), meta.encode())
+	if err == memcache.ErrNotStored {
+		s.releaseQuota(to, moved)
+		return ErrFileAlreadyExists
+	} else if err != nil {
+		s.releaseQuota(to, moved)
+		return fmt.Errorf("Unable to rename file: %w", err)
+	}
+
+	// Registered only once the new name is taken, registering it earlier would point the registry entry
+	// of a file which exists already to chunks of the renamed one
+	err = s.registerFile(to, meta)
+	if err != nil {
+		s.rollbackRename(logger, to, meta, moved, false)
+
+		return fmt.Errorf("Unable to rename file: %w", err)
+	}
+
+	err = s.deleteKey(s.buildKey(from))
+	if err != nil {
+		// Both names would share the same chunks and deleting one would corrupt the other, roll back
+		s.rollbackRename(logger, to, meta, moved, true)
+
+		return fmt.Errorf("Unable to rename file: %w", err)
+	}
+
+	s.releaseQuota(from, moved)
+
+	s.forgetFile(from)
+
+	logger.Info("Renamed file")
+
+	return nil
+}
+
+// copy has to duplicate chunks as files don't share them
+func (s memcacheStore) copy(from string, to string) error {
+	s.logger.WithField("from", from).WithField("to", to).Debug("Copying file")
+
+	contents, err := s.retrieve(from)
+	if err != nil {
+		if errors.Is(err, ErrFileNotFound) || errors.Is(err, ErrFileCorrupted) {
+			return err
+		}
+
+		return fmt.Errorf("Unable to copy file: %w", err)
+	}
+
+	// A copy never becomes a new version of an existing file
+	return s.storeNew(to, contents)
+}
+
+// getMetadata returns memcache.ErrCacheMiss if the file does not exist or its key belongs to another file
+// and errMetadataInvalid if metadata can't be decoded
+func (s memcacheStore) getMetadata(filename string) (metadata, error) {
+	data, err := s.getKey(s.buildKey(filename))
+	if err != nil {
+		return metadata{}, err
+	}
+
+	meta, err := decodeMetadata(data)
+	if err != nil {
+		s.logger.WithField("filename", filename).WithError(err).Warning("Unable to decode metadata")
+		return metadata{}, errMetadataInvalid
+	}
+
+	if !meta.belongsTo(filename) {
+		// Another file has the same key, as far as this filename goes there is no file
+		s.logger.WithField("filename", filename).WithField("owner", meta.Filename).Warning("Key collides with another file")
+		return metadata{}, memcache.ErrCacheMiss
+	}
+
+	if meta.ID == "" {
+		// Stored before files had IDs, chunks are keyed by the filename
+		meta.ID = legacyFileID(filename)
+	}
+
+	return meta, nil
+}
+
+// purgeFile deletes chunks of the file and all its versions, then the metadata
+func (s memcacheStore) purgeFile(filename string, meta metadata) error {
+	s.changed(filename)
+
+	for _, m := range append([]metadata{meta}, meta.Previous...) {
+		err := s.purgeChunks(m)
 		if err != nil {
 			return err
 		}
 	}
 
 	// Once all chunks deleted, delete the metadata key
-	metadataKey := buildKey(filename)
+	metadataKey := s.buildKey(filename)
 	return s.deleteKey(metadataKey)
 }
 
+func (s memcacheStore) purgeChunks(meta metadata) error {
+	for i := 0; i < meta.Chunks; i++ {
+		chunkKey := meta.chunkKey(i)
+		err := s.deleteKey(chunkKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (s memcacheStore) setKey(key string, value []byte) error {
-	log.WithField("key", key).WithField("size", len(value)).Debug("Setting key")
+	s.logger.WithField("key", key).WithField("size", len(value)).Debug("Setting key")
 
-	return s.client.Set(&memcache.Item{Key: key, Value: value})
+	return s.retry.do(s.logger.WithField("key", key), func() error {
+		start := time.Now()
+		err := s.client.Set(&memcache.Item{Key: key, Value: value})
+		s.metrics.ObserveChunk(ChunkOpSet, time.Since(start), err)
+
+		return err
+	})
 }
 
-func (s memcacheStore) getKey(key string) ([]byte, error) {
-	log.WithField("key", key).Debug("Getting key")
+func (s memcacheStore) addKey(key string, value []byte) error {
+	return s.addItem(&memcache.Item{Key: key, Value: value})
+}
+
+// addItem allows setting other item fields than the value, like expiration.
+// It is never retried: an add which timed out may have been applied and a retry would report
+// the key as already existing.
+func (s memcacheStore) addItem(item *memcache.Item) error {
+	s.logger.WithField("key", item.Key).WithField("size", len(item.Value)).Debug("Adding key")
 
-	item, err := s.client.Get(key)
+	start := time.Now()
+	err := s.client.Add(item)
+	s.metrics.ObserveChunk(ChunkOpAdd, time.Since(start), err)
 
+	return err
+}
+
+// compareAndSwapKey is never retried for the same reason as addItem, a retry of a swap which was
+// applied would fail with a conflict
+func (s memcacheStore) compareAndSwapKey(item casItem) error {
+	s.logger.WithField("key", item.Key).WithField("size", len(item.Value)).Debug("Swapping key")
+
+	start := time.Now()
+	err := client.CompareAndSwapCAS(s.client, item.Item, item.cas)
+	s.metrics.ObserveChunk(ChunkOpCompareAndSwap, time.Since(start), err)
+
+	return err
+}
+
+func (s memcacheStore) getKey(key string) ([]byte, error) {
+	item, err := s.getItem(key)
 	if err != nil {
 		return []byte{}, err
 	}
 
-	log.WithField("key", key).WithField("size", len(item.Value)).Debug("Got key")
-
 	return item.Value, nil
 }
 
-func (s memcacheStore) getKeys(keys []string) (map[string][]byte, error) {
-	log.WithField("keys", keys).Debug("Getting keys")
+// casItem keeps the CAS id along with the item, clients of the meta protocol can't store it in the item
+type casItem struct {
+	*memcache.Item
+	cas uint64
+}
+
+// getItem returns the whole item, which is needed for compare-and-swap
+func (s memcacheStore) getItem(key string) (casItem, error) {
+	s.logger.WithField("key", key).Debug("Getting key")
+
+	item := casItem{}
+	err := s.retry.do(s.logger.WithField("key", key), func() error {
+		var err error
+		start := time.Now()
+		item.Item, item.cas, err = client.GetCAS(s.client, key)
+		s.metrics.ObserveChunk(ChunkOpGet, time.Since(start), err)
 
-	items, err := s.client.GetMulti(keys)
+		return err
+	})
+	if err != nil {
+		return casItem{}, err
+	}
+
+	s.logger.WithField("key", key).WithField("size", len(item.Value)).Debug("Got key")
+
+	return item, nil
+}
+
+func (s memcacheStore) getKeys(keys []string) (map[string][]byte, error) {
+	values, err := s.findKeys(keys)
 	if err != nil {
 		return map[string][]byte{}, err
 	}
 
-	if len(items) < len(keys) {
-		log.WithField("returned", len(items)).
+	if len(values) < len(keys) {
+		s.logger.WithField("returned", len(values)).
 			WithField("expected", len(keys)).
 			Warning("Value count mismatch")
 
 		return map[string][]byte{}, errKeysMissing
 	}
 
+	return values, nil
+}
+
+// findKeys returns values of keys which exist, missing keys are skipped
+func (s memcacheStore) findKeys(keys []string) (map[string][]byte, error) {
+	s.logger.WithField("count", len(keys)).Debug("Getting keys")
+
+	var items map[string]*memcache.Item
+	err := s.retry.do(s.logger, func() error {
+		var err error
+		start := time.Now()
+		items, err = s.client.GetMulti(keys)
+		s.metrics.ObserveChunk(ChunkOpGetMulti, time.Since(start), err)
+
+		return err
+	})
+	if err != nil {
+		return map[string][]byte{}, err
+	}
+
 	values := map[string][]byte{}
 	for _, item := range items {
-		log.WithField("key", item.Key).WithField("size", len(item.Value)).Debug("Got key")
+		s.logger.WithField("key", item.Key).WithField("size", len(item.Value)).Debug("Got key")
 		values[item.Key] = item.Value
 	}
 
 	return values, nil
 }
 
+// getChunks fetches all chunks of a file and assembles them in order
+func (s memcacheStore) getChunks(meta metadata) ([]byte, error) {
+	chunks, err := s.getChunkRange(meta, 0, meta.Chunks)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	size := meta.Size
+	if size < 0 {
+		// Legacy metadata, size has to be worked out from chunks
+		size = 0
+		for _, chunk := range chunks {
+			size += len(chunk)
+		}
+	}
+
+	contents := make([]byte, size)
+	offset := 0
+	for _, chunk := range chunks {
+		if offset+len(chunk) > size {
+			return []byte{}, errKeysMissing
+		}
+
+		offset += copy(contents[offset:], chunk)
+	}
+
+	if offset != size {
+		return []byte{}, errKeysMissing
+	}
+
+	return contents, nil
+}
+
+// getChunkRange fetches chunks [from, to) in batches, possibly concurrently, and verifies their checksums
+func (s memcacheStore) getChunkRange(meta metadata, from int, to int) ([][]byte, error) {
+	chunks := make([][]byte, to-from)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+
+	sem := make(chan struct{}, s.getMultiConcurrency)
+
+	for start := from; start < to; start += s.getMultiBatchSize {
+		end := start + s.getMultiBatchSize
+		if end > to {
+			end = to
+		}
+
+		sem <- struct{}{}
+
+		// Don't bother requesting the rest once a batch failed
+		mu.Lock()
+		failed := firstErr != nil
+		mu.Unlock()
+		if failed {
+			<-sem
+			break
+		}
+
+		wg.Add(1)
+		go func(start, end int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			keys := make([]string, 0, end-start)
+			for i := start; i < end; i++ {
+				keys = append(keys, meta.chunkKey(i))
+			}
+
+			values, err := s.getKeys(keys)
+			if err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+				return
+			}
+
+			for i := start; i < end; i++ {
+				chunks[i-from] = values[keys[i-start]]
+			}
+		}(start, end)
+	}
+
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	// Chunk overwritten by a concurrent update or otherwise damaged
+	if len(meta.Checksums) == meta.Chunks {
+		for i, chunk := range chunks {
+			if checksum(chunk) != meta.Checksums[from+i] {
+				s.logger.WithField("key", meta.chunkKey(from+i)).Warning("Chunk checksum mismatch")
+				return nil, errKeysMissing
+			}
+		}
+	}
+
+	return chunks, nil
+}
+
 func (s memcacheStore) deleteKey(key string) error {
-	log.WithField("key", key).Debug("Deleting key")
+	s.logger.WithField("key", key).Debug("Deleting key")
+
+	err := s.retry.do(s.logger.WithField("key", key), func() error {
+		start := time.Now()
+		err := s.client.Delete(key)
+		s.metrics.ObserveChunk(ChunkOpDelete, time.Since(start), err)
 
-	err := s.client.Delete(key)
+		return err
+	})
 	if err == memcache.ErrCacheMiss {
 		// The key didnt exist, Memcache must have purged it
-		log.WithField("key", key).
+		s.logger.WithField("key", key).
 			WithError(err).
 			Warning("Tried to delete a non existing key")
 		return nil
@@ -280,16 +1285,31 @@ func (s memcacheStore) deleteKey(key string) error {
 	return err
 }
 
-func buildKey(key string) string {
-	// Memcache keys cant be longer than 250 chars so lets MD5 variable part of the key (filename)
-	// For better performance we can use base64 and md5 only if base64 is longer than 250
-	// (or something better than md5 to reduce a chance of collisions)
-	hash := md5.Sum([]byte(key))
-	hs := hex.EncodeToString(hash[:])
-	return keyPrefix + hs
+// buildKey returns the metadata key of the file
+func (s memcacheStore) buildKey(filename string) string {
+	return keyPrefix + s.keyFunc(filename)
+}
+
+func buildChunkKey(fileID string, index int) string {
+	// Use file ID + index to identify a specific chunk
+	return keyPrefix + fileID + "::" + strconv.Itoa(index)
+}
+
+// newFileID generates an ID for the file chunks, keeping them apart from the filename allows renaming
+// files without moving the data
+var newFileID = randomID
+
+func randomID() string {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(id)
 }
 
-func buildChunkKey(key string, index int) string {
-	// Use filename + index to identify a specific chunk
-	return buildKey(key) + "::" + strconv.Itoa(index)
+// legacyFileID is the ID of files stored before IDs were introduced, their chunks are keyed by the filename hash
+func legacyFileID(filename string) string {
+	return MD5Key(filename)
 }
@@ -0,0 +1,144 @@
+package filestore_test
+
+import (
+	"bytes"
+	"errors"
+	"filestore"
+	"filestore/filestoretest"
+	"testing"
+	"time"
+)
+
+// Tests below talk to a fake memcached over the network, so the real client and protocol are used
+
+func newServer(t *testing.T, config filestoretest.Config) *filestoretest.Server {
+	s, err := filestoretest.NewServer(config)
+	if err != nil {
+		t.Fatalf("Unable to start server: %v", err)
+	}
+
+	return s
+}
+
+func TestMemcacheServer_StoreRetrieve(t *testing.T) {
+	server := newServer(t, filestoretest.Config{ItemSizeMax: 64 * 1024})
+	defer server.Close()
+
+	s, err := filestore.OpenMemcache(server.Addr(), filestore.MemcacheConfig{})
+	if err != nil {
+		t.Fatalf("OpenMemcache: want nil, got %#v", err)
+	}
+
+	// Chunks are as large as the server accepts
+	contents := bytes.Repeat([]byte("0123456789"), 30*1024)
+	err = s.Store("file.dat", contents)
+	if err != nil {
+		t.Fatalf("Store: want nil, got %#v", err)
+	}
+
+	retrieved, err := s.Retrieve("file.dat")
+	if err != nil || !bytes.Equal(retrieved, contents) {
+		t.Errorf("Retrieve: want %d bytes, got %d bytes (%v)", len(contents), len(retrieved), err)
+	}
+
+	err = s.Delete("file.dat")
+	if err != nil {
+		t.Errorf("Delete: want nil, got %#v", err)
+	}
+
+	if stats := server.Stats(); stats.Items != 0 {
+		t.Errorf("Items left: want %d, got %d", 0, stats.Items)
+	}
+}
+
+func TestMemcacheServer_ChunkSizeTooLarge(t *testing.T) {
+	server := newServer(t, filestoretest.Config{ItemSizeMax: 64 * 1024})
+	defer server.Close()
+
+	_, err := filestore.OpenMemcache(server.Addr(), filestore.MemcacheConfig{ChunkSize: 64 * 1024})
+	if !errors.Is(err, filestore.ErrChunkSizeTooLarge) {
+		t.Errorf("OpenMemcache: want %#v, got %#v", filestore.ErrChunkSizeTooLarge, err)
+	}
+
+	// Without checking the limit chunks are rejected by the server
+	s := filestore.NewMemcache(server.Addr(), filestore.MemcacheConfig{ChunkSize: 64 * 1024})
+	err = s.Store("file.dat", bytes.Repeat([]byte("x"), 100*1024))
+	if err == nil {
+		t.Errorf("Store: want error, got nil")
+	}
+}
+
+func TestMemcacheServer_UnknownProtocol(t *testing.T) {
+	server := newServer(t, filestoretest.Config{})
+	defer server.Close()
+
+	_, err := filestore.OpenMemcache(server.Addr(), filestore.MemcacheConfig{Protocol: "binary"})
+	if err == nil {
+		t.Errorf("OpenMemcache with an unknown protocol: want error, got nil")
+	}
+
+	for _, protocol := range []filestore.MemcacheProtocol{"", filestore.ProtocolText, filestore.ProtocolMeta} {
+		_, err := filestore.OpenMemcache(server.Addr(), filestore.MemcacheConfig{Protocol: protocol})
+		if err != nil {
+			t.Errorf("OpenMemcache with protocol %q: want nil, got %#v", protocol, err)
+		}
+	}
+}
+
+func TestMemcacheServer_Eviction(t *testing.T) {
+	server := newServer(t, filestoretest.Config{MaxBytes: 64 * 1024, ItemSizeMax: 8 * 1024})
+	defer server.Close()
+
+	s, err := filestore.OpenMemcache(server.Addr(), filestore.MemcacheConfig{})
+	if err != nil {
+		t.Fatalf("OpenMemcache: want nil, got %#v", err)
+	}
+
+	for _, filename := range []string{"first.dat", "second.dat"} {
+		err := s.Store(filename, bytes.Repeat([]byte("x"), 40*1024))
+		if err != nil {
+			t.Fatalf("Store of %s: want nil, got %#v", filename, err)
+		}
+	}
+
+	// Storing the second file evicted parts of the first one
+	_, err = s.Retrieve("first.dat")
+	if !errors.Is(err, filestore.ErrFileNotFound) && !errors.Is(err, filestore.ErrFileCorrupted) {
+		t.Errorf("Retrieve of an evicted file: want %#v or %#v, got %#v", filestore.ErrFileNotFound, filestore.ErrFileCorrupted, err)
+	}
+
+	_, err = s.Retrieve("second.dat")
+	if err != nil {
+		t.Errorf("Retrieve: want nil, got %#v", err)
+	}
+}
+
+func TestMemcacheServer_Faults(t *testing.T) {
+	server := newServer(t, filestoretest.Config{})
+	defer server.Close()
+
+	s := filestore.NewMemcache(server.Addr(), filestore.MemcacheConfig{
+		Timeout: 50 * time.Millisecond,
+		Retry:   filestore.RetryPolicy{MaxAttempts: 2},
+	})
+
+	err := s.Store("file.dat", []byte("some content"))
+	if err != nil {
+		t.Fatalf("Store: want nil, got %#v", err)
+	}
+
+	// Requests on dropped connections are retried on new ones
+	server.DropConnections()
+
+	contents, err := s.Retrieve("file.dat")
+	if err != nil || string(contents) != "some content" {
+		t.Errorf("Retrieve after dropped connections: want %#v, got %#v (%v)", "some content", string(contents), err)
+	}
+
+	server.SetLatency(100 * time.Millisecond)
+
+	_, err = s.Retrieve("file.dat")
+	if err == nil || !filestore.IsRetryable(err) {
+		t.Errorf("Retrieve of a slow server: want timeout, got %#v", err)
+	}
+}
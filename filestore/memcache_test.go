@@ -1,11 +1,18 @@
 package filestore
 
 import (
+	"bufio"
+	"errors"
 	"filestore/client"
 	"filestore/mock"
 	"fmt"
+	"net"
 	"reflect"
+	"regexp"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/bradfitz/gomemcache/memcache"
 )
@@ -39,6 +46,14 @@ func TestHandler_Store(t *testing.T) {
 
 	c := mock.NewMemcacheClient(4) // allow to save up to 4 keys
 
+	defer func(f func() string) { newFileID = f }(newFileID)
+
+	ids := 0
+	newFileID = func() string {
+		ids++
+		return "file-id-" + strconv.Itoa(ids)
+	}
+
 	defaultEnv := testEnv{
 		client: c,
 		config: MemcacheConfig{
@@ -57,9 +72,10 @@ func TestHandler_Store(t *testing.T) {
 				env:  defaultEnv,
 				args: args{filename, contents},
 				wantKeys: map[string][]byte{
-					buildKey(filename):         []byte("2"),
-					buildChunkKey(filename, 0): []byte("some conte"),
-					buildChunkKey(filename, 1): []byte("nt"),
+					keyPrefix + MD5Key(filename): []byte(`{"id":"file-id-1","filename":"file.dat","chunks":2,"size":12,"chunk_size":10,` +
+						`"checksums":["` + checksum([]byte("some conte")) + `","` + checksum([]byte("nt")) + `"]}`),
+					buildChunkKey("file-id-1", 0): []byte("some conte"),
+					buildChunkKey("file-id-1", 1): []byte("nt"),
 				},
 				wantError: nil,
 			}
@@ -83,11 +99,11 @@ func TestHandler_Store(t *testing.T) {
 			contents := []byte("some too large content")
 
 			return testCase{
-				name:      "Failed to fit file to the storage, chunks lost",
+				name:      "Failed to fit file to the storage, keys lost",
 				env:       defaultEnv,
 				args:      args{filename, contents},
 				wantKeys:  map[string][]byte{},
-				wantError: fmt.Errorf("Unable to store file: %w", ErrFileCorrupted),
+				wantError: fmt.Errorf("Unable to store file: %w", ErrFileNotFound),
 			}
 		}(),
 	}
@@ -116,3 +132,631 @@ func TestHandler_Store(t *testing.T) {
 		})
 	}
 }
+
+func TestHandler_Retrieve(t *testing.T) {
+	type testEnv struct {
+		keys   map[string][]byte
+		config MemcacheConfig
+	}
+
+	type testCase struct {
+		name         string
+		env          testEnv
+		filename     string
+		wantContents []byte
+		wantError    error
+	}
+
+	filename := "file.dat"
+
+	chunkedKeys := map[string][]byte{
+		keyPrefix + MD5Key(filename):             []byte(`{"chunks":5,"size":22,"chunk_size":5}`),
+		buildChunkKey(legacyFileID(filename), 0): []byte("some "),
+		buildChunkKey(legacyFileID(filename), 1): []byte("chunk"),
+		buildChunkKey(legacyFileID(filename), 2): []byte("ed co"),
+		buildChunkKey(legacyFileID(filename), 3): []byte("ntent"),
+		buildChunkKey(legacyFileID(filename), 4): []byte("s!"),
+	}
+
+	tests := []testCase{
+		{
+			name: "Retrieving a file in a single batch",
+			env: testEnv{
+				keys:   chunkedKeys,
+				config: MemcacheConfig{GetMultiBatchSize: 10},
+			},
+			filename:     filename,
+			wantContents: []byte("some chunked contents!"),
+		},
+		{
+			name: "Retrieving a file in concurrent batches",
+			env: testEnv{
+				keys:   chunkedKeys,
+				config: MemcacheConfig{GetMultiBatchSize: 2, GetMultiConcurrency: 2},
+			},
+			filename:     filename,
+			wantContents: []byte("some chunked contents!"),
+		},
+		{
+			name: "Retrieving a file stored with legacy metadata",
+			env: testEnv{
+				keys: map[string][]byte{
+					keyPrefix + MD5Key(filename):             []byte("2"),
+					buildChunkKey(legacyFileID(filename), 0): []byte("some conte"),
+					buildChunkKey(legacyFileID(filename), 1): []byte("nt"),
+				},
+			},
+			filename:     filename,
+			wantContents: []byte("some content"),
+		},
+		{
+			name: "Retrieving a file with a missing chunk",
+			env: testEnv{
+				keys: map[string][]byte{
+					keyPrefix + MD5Key(filename):             []byte(`{"chunks":2,"size":12,"chunk_size":10}`),
+					buildChunkKey(legacyFileID(filename), 1): []byte("nt"),
+				},
+				config: MemcacheConfig{GetMultiBatchSize: 1, GetMultiConcurrency: 2},
+			},
+			filename:     filename,
+			wantContents: []byte{},
+			wantError:    ErrFileCorrupted,
+		},
+		{
+			name: "Retrieving a file with a truncated chunk",
+			env: testEnv{
+				keys: map[string][]byte{
+					keyPrefix + MD5Key(filename):             []byte(`{"chunks":2,"size":12,"chunk_size":10}`),
+					buildChunkKey(legacyFileID(filename), 0): []byte("some conte"),
+					buildChunkKey(legacyFileID(filename), 1): []byte("n"),
+				},
+			},
+			filename:     filename,
+			wantContents: []byte{},
+			wantError:    ErrFileCorrupted,
+		},
+		{
+			name:         "Retrieving a non existing file",
+			env:          testEnv{keys: map[string][]byte{}},
+			filename:     filename,
+			wantContents: []byte{},
+			wantError:    ErrFileNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := mock.NewMemcacheClient(100)
+			for key, value := range tt.env.keys {
+				err := c.Set(&memcache.Item{Key: key, Value: value})
+				if err != nil {
+					panic(err)
+				}
+			}
+
+			contents, err := NewMemcacheWithClient(c, tt.env.config).Retrieve(tt.filename)
+
+			if !reflect.DeepEqual(contents, tt.wantContents) {
+				t.Errorf("Contents: want %#v, got %#v", string(tt.wantContents), string(contents))
+			}
+
+			if !reflect.DeepEqual(err, tt.wantError) {
+				t.Errorf("Error: want %#v, got %#v", tt.wantError, err)
+			}
+		})
+	}
+}
+
+func TestHandler_RenameCopy(t *testing.T) {
+	type testCase struct {
+		name      string
+		operation func(s Store, from string, to string) error
+		from      string
+		to        string
+		wantFiles map[string][]byte
+		wantError error
+	}
+
+	renameOp := func(s Store, from string, to string) error { return Rename(s, from, to) }
+	copyOp := func(s Store, from string, to string) error { return Copy(s, from, to) }
+
+	tests := []testCase{
+		{
+			name:      "Renaming a file",
+			operation: renameOp,
+			from:      "a.dat",
+			to:        "c.dat",
+			wantFiles: map[string][]byte{"a.dat": nil, "b.dat": []byte("contents of b"), "c.dat": []byte("contents of a")},
+		},
+		{
+			name:      "Renaming a file to an existing name",
+			operation: renameOp,
+			from:      "a.dat",
+			to:        "b.dat",
+			wantFiles: map[string][]byte{"a.dat": []byte("contents of a"), "b.dat": []byte("contents of b")},
+			wantError: ErrFileAlreadyExists,
+		},
+		{
+			name:      "Renaming a non existing file",
+			operation: renameOp,
+			from:      "x.dat",
+			to:        "c.dat",
+			wantFiles: map[string][]byte{"c.dat": nil},
+			wantError: ErrFileNotFound,
+		},
+		{
+			name:      "Copying a file",
+			operation: copyOp,
+			from:      "a.dat",
+			to:        "c.dat",
+			wantFiles: map[string][]byte{"a.dat": []byte("contents of a"), "c.dat": []byte("contents of a")},
+		},
+		{
+			name:      "Copying a file to an existing name",
+			operation: copyOp,
+			from:      "a.dat",
+			to:        "b.dat",
+			wantFiles: map[string][]byte{"a.dat": []byte("contents of a"), "b.dat": []byte("contents of b")},
+			wantError: ErrFileAlreadyExists,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewMemcacheWithClient(mock.NewMemcacheClient(100), MemcacheConfig{ChunkSize: 5})
+			for filename, contents := range map[string][]byte{"a.dat": []byte("contents of a"), "b.dat": []byte("contents of b")} {
+				err := s.Store(filename, contents)
+				if err != nil {
+					panic(err)
+				}
+			}
+
+			err := tt.operation(s, tt.from, tt.to)
+			if !reflect.DeepEqual(err, tt.wantError) {
+				t.Errorf("Error: want %#v, got %#v", tt.wantError, err)
+			}
+
+			for filename, wantContents := range tt.wantFiles {
+				contents, err := s.Retrieve(filename)
+				if wantContents == nil {
+					if err != ErrFileNotFound {
+						t.Errorf("File %s: want %#v, got %#v", filename, ErrFileNotFound, err)
+					}
+					continue
+				}
+
+				if !reflect.DeepEqual(contents, wantContents) {
+					t.Errorf("File %s: want %#v, got %#v (%v)", filename, string(wantContents), string(contents), err)
+				}
+			}
+		})
+	}
+}
+
+// interferingClient rewrites a key the first time any chunk is set, simulating a concurrent writer
+type interferingClient struct {
+	client.Memcache
+	key  string
+	done bool
+}
+
+func (c *interferingClient) Set(item *memcache.Item) error {
+	if !c.done && item.Key != c.key {
+		c.done = true
+		value, _ := c.Memcache.Get(c.key)
+		_ = c.Memcache.Set(value)
+	}
+
+	return c.Memcache.Set(item)
+}
+
+func TestHandler_Append(t *testing.T) {
+	type testCase struct {
+		name         string
+		client       func(c client.Memcache) client.Memcache
+		filename     string
+		data         []byte
+		wantContents []byte
+		wantChunks   int
+		wantError    error
+	}
+
+	tests := []testCase{
+		{
+			name:         "Appending fills up the last chunk and adds new ones",
+			filename:     "file.dat",
+			data:         []byte(" and more content"),
+			wantContents: []byte("some content and more content"),
+			wantChunks:   3,
+		},
+		{
+			name:         "Appending within the last chunk",
+			filename:     "file.dat",
+			data:         []byte("!"),
+			wantContents: []byte("some content!"),
+			wantChunks:   2,
+		},
+		{
+			name:         "Appending nothing",
+			filename:     "file.dat",
+			data:         []byte{},
+			wantContents: []byte("some content"),
+			wantChunks:   2,
+		},
+		{
+			name:         "Appending over max file size",
+			filename:     "file.dat",
+			data:         []byte("some too large content"),
+			wantContents: []byte("some content"),
+			wantChunks:   2,
+			wantError:    fmt.Errorf("%w: max file size is %d bytes", ErrFileTooLarge, 30),
+		},
+		{
+			name:      "Appending to a non existing file",
+			filename:  "non-existing-file.dat",
+			data:      []byte("some content"),
+			wantError: ErrFileNotFound,
+		},
+		{
+			name: "Appending to a file modified concurrently",
+			client: func(c client.Memcache) client.Memcache {
+				return &interferingClient{Memcache: c, key: keyPrefix + MD5Key("file.dat")}
+			},
+			filename:     "file.dat",
+			data:         []byte("!"),
+			wantContents: []byte("some content"),
+			wantChunks:   2,
+			wantError:    ErrFileModified,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c client.Memcache = mock.NewMemcacheClient(100)
+			config := MemcacheConfig{ChunkSize: 10, MaxFileSize: 30}
+
+			err := NewMemcacheWithClient(c, config).Store("file.dat", []byte("some content"))
+			if err != nil {
+				panic(err)
+			}
+
+			if tt.client != nil {
+				c = tt.client(c)
+			}
+			s := NewMemcacheWithClient(c, config)
+
+			err = Append(s, tt.filename, tt.data)
+			if !reflect.DeepEqual(err, tt.wantError) {
+				t.Errorf("Error: want %#v, got %#v", tt.wantError, err)
+			}
+
+			if tt.wantContents != nil {
+				contents, err := s.Retrieve(tt.filename)
+				if err != nil || !reflect.DeepEqual(contents, tt.wantContents) {
+					t.Errorf("Contents: want %#v, got %#v (%v)", string(tt.wantContents), string(contents), err)
+				}
+			}
+
+			if tt.wantChunks == 0 {
+				return
+			}
+
+			item, _ := c.Get(keyPrefix + MD5Key(tt.filename))
+			meta, _ := decodeMetadata(item.Value)
+			if meta.Chunks != tt.wantChunks {
+				t.Errorf("Chunks: want %d, got %d", tt.wantChunks, meta.Chunks)
+			}
+		})
+	}
+}
+
+// countingClient records keys which were set
+type countingClient struct {
+	client.Memcache
+	setKeys []string
+}
+
+func (c *countingClient) Set(item *memcache.Item) error {
+	c.setKeys = append(c.setKeys, item.Key)
+	return c.Memcache.Set(item)
+}
+
+func TestHandler_WriteAt(t *testing.T) {
+	type testCase struct {
+		name         string
+		offset       int
+		data         []byte
+		wantContents []byte
+		wantSetKeys  []string
+		wantError    error
+	}
+
+	filename := "file.dat"
+
+	tests := []testCase{
+		{
+			name:         "Overwriting a range within a single chunk",
+			offset:       12,
+			data:         []byte("X"),
+			wantContents: []byte("0123456789abXdefghijklmnopqrstuvwxyz"),
+			wantSetKeys:  []string{buildChunkKey("write-id", 1)},
+		},
+		{
+			name:         "Overwriting a range spanning chunks",
+			offset:       8,
+			data:         []byte("XXXXXXXXXXXXX"),
+			wantContents: []byte("01234567XXXXXXXXXXXXXlmnopqrstuvwxyz"),
+			wantSetKeys:  []string{buildChunkKey("write-id", 0), buildChunkKey("write-id", 1), buildChunkKey("write-id", 2)},
+		},
+		{
+			name:         "Writing past the end of the file",
+			offset:       34,
+			data:         []byte("XXXX"),
+			wantContents: []byte("0123456789abcdefghijklmnopqrstuvwxXXXX"),
+			wantSetKeys:  []string{buildChunkKey("write-id", 3)},
+		},
+		{
+			name:         "Writing at an offset beyond the end of the file",
+			offset:       40,
+			data:         []byte("X"),
+			wantContents: []byte("0123456789abcdefghijklmnopqrstuvwxyz"),
+			wantError:    fmt.Errorf("%w: offset 40 is past the end of the file (36 bytes)", ErrInvalidRange),
+		},
+		{
+			name:         "Writing at a negative offset",
+			offset:       -1,
+			data:         []byte("X"),
+			wantContents: []byte("0123456789abcdefghijklmnopqrstuvwxyz"),
+			wantError:    fmt.Errorf("%w: negative offset -1", ErrInvalidRange),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Chunks are written under a new ID by every write
+			defer func(f func() string) { newFileID = f }(newFileID)
+			ids := []string{"file-id", "write-id"}
+			newFileID = func() string {
+				id := ids[0]
+				ids = ids[1:]
+				return id
+			}
+
+			c := &countingClient{Memcache: mock.NewMemcacheClient(100)}
+			s := NewMemcacheWithClient(c, MemcacheConfig{ChunkSize: 10})
+
+			err := s.Store(filename, []byte("0123456789abcdefghijklmnopqrstuvwxyz"))
+			if err != nil {
+				panic(err)
+			}
+			c.setKeys = nil
+
+			err = WriteAt(s, filename, tt.offset, tt.data)
+			if !reflect.DeepEqual(err, tt.wantError) {
+				t.Errorf("Error: want %#v, got %#v", tt.wantError, err)
+			}
+
+			if !reflect.DeepEqual(c.setKeys, tt.wantSetKeys) {
+				t.Errorf("Set keys: want %#v, got %#v", tt.wantSetKeys, c.setKeys)
+			}
+
+			contents, err := s.Retrieve(filename)
+			if err != nil || !reflect.DeepEqual(contents, tt.wantContents) {
+				t.Errorf("Contents: want %#v, got %#v (%v)", string(tt.wantContents), string(contents), err)
+			}
+		})
+	}
+}
+
+func TestHandler_WriteAtConcurrently(t *testing.T) {
+	original := "0123456789abcdefghijklmnopqrstuvwxyz"
+	writes := []string{"AAAAAAAAAAAAAAA", "BBBBBBBBBBBBBBB"}
+
+	// Slow chunk writes make both writers read the same metadata
+	c := mock.NewFaultyClient(mock.NewMemcacheClient(100), mock.FaultConfig{Faults: []mock.Fault{
+		{Ops: []string{mock.OpSet}, Keys: regexp.MustCompile(`::`), Latency: time.Millisecond},
+	}})
+	s := NewMemcacheWithClient(c, MemcacheConfig{ChunkSize: 10})
+
+	err := s.Store("file.dat", []byte(original))
+	if err != nil {
+		panic(err)
+	}
+
+	errs := make([]error, len(writes))
+	var wg sync.WaitGroup
+	for i, data := range writes {
+		wg.Add(1)
+		go func(i int, data string) {
+			defer wg.Done()
+			errs[i] = WriteAt(s, "file.dat", 5, []byte(data))
+		}(i, data)
+	}
+	wg.Wait()
+
+	succeeded := 0
+	for i, err := range errs {
+		if err == nil {
+			succeeded++
+		} else if err != ErrFileModified {
+			t.Errorf("WriteAt %d: want nil or %#v, got %#v", i, ErrFileModified, err)
+		}
+	}
+	if succeeded == 0 {
+		t.Errorf("WriteAt: want at least one to succeed, got %v", errs)
+	}
+
+	// The file is intact and has exactly one of the writes
+	contents, err := s.Retrieve("file.dat")
+	if err != nil {
+		t.Fatalf("Retrieve: want nil, got %#v", err)
+	}
+
+	found := false
+	for i, data := range writes {
+		want := original[:5] + data + original[5+len(data):]
+		found = found || string(contents) == want && errs[i] == nil
+	}
+	if !found {
+		t.Errorf("Contents: want one of the writes, got %#v", string(contents))
+	}
+}
+
+func TestHandler_WriteAtReplacedChunks(t *testing.T) {
+	m := mock.NewMemcacheClient(100)
+
+	// The slow writer reads chunks after the other one replaced and purged them
+	c := mock.NewFaultyClient(m, mock.FaultConfig{Faults: []mock.Fault{
+		{Ops: []string{mock.OpGetMulti}, Keys: regexp.MustCompile(`::`), Latency: 50 * time.Millisecond},
+	}})
+	slow := NewMemcacheWithClient(c, MemcacheConfig{ChunkSize: 10})
+	fast := NewMemcacheWithClient(m, MemcacheConfig{ChunkSize: 10})
+
+	err := fast.Store("file.dat", []byte("0123456789abcdefghij"))
+	if err != nil {
+		panic(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- WriteAt(slow, "file.dat", 5, []byte("AAAAAAAAAA"))
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	err = WriteAt(fast, "file.dat", 5, []byte("BBBBBBBBBB"))
+	if err != nil {
+		t.Fatalf("WriteAt: want nil, got %#v", err)
+	}
+
+	if err := <-done; err != ErrFileModified {
+		t.Errorf("WriteAt of replaced chunks: want %#v, got %#v", ErrFileModified, err)
+	}
+
+	contents, err := fast.Retrieve("file.dat")
+	if err != nil || string(contents) != "01234BBBBBBBBBBfghij" {
+		t.Errorf("Contents: want %#v, got %#v (%v)", "01234BBBBBBBBBBfghij", string(contents), err)
+	}
+}
+
+func TestHandler_RetrieveReplacedChunks(t *testing.T) {
+	m := mock.NewMemcacheClient(100)
+
+	// The slow reader fetches chunks after an append replaced and purged the last one
+	c := mock.NewFaultyClient(m, mock.FaultConfig{Faults: []mock.Fault{
+		{Ops: []string{mock.OpGetMulti}, Keys: regexp.MustCompile(`::`), Latency: 50 * time.Millisecond},
+	}})
+	events := 0
+	slow := NewMemcacheWithClient(c, MemcacheConfig{
+		ChunkSize: 10,
+		OnCorrupted: func(event CorruptionEvent) {
+			events++
+		},
+	})
+	fast := NewMemcacheWithClient(m, MemcacheConfig{ChunkSize: 10})
+
+	err := fast.Store("file.dat", []byte("0123456789abcde"))
+	if err != nil {
+		panic(err)
+	}
+
+	type result struct {
+		contents []byte
+		err      error
+	}
+	done := make(chan result)
+	go func() {
+		contents, err := slow.Retrieve("file.dat")
+		done <- result{contents, err}
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	err = Append(fast, "file.dat", []byte("!"))
+	if err != nil {
+		t.Fatalf("Append: want nil, got %#v", err)
+	}
+
+	// The file changed under the retrieve, which starts over instead of finding it corrupted
+	r := <-done
+	if r.err != nil || string(r.contents) != "0123456789abcde!" {
+		t.Errorf("Retrieve: want %#v, got %#v (%v)", "0123456789abcde!", string(r.contents), r.err)
+	}
+	if events != 0 {
+		t.Errorf("Corruption events: want 0, got %d", events)
+	}
+}
+
+func TestHandler_RetrieveChecksumMismatch(t *testing.T) {
+	defer func(f func() string) { newFileID = f }(newFileID)
+	newFileID = func() string { return "file-id" }
+
+	c := mock.NewMemcacheClient(100)
+	s := NewMemcacheWithClient(c, MemcacheConfig{ChunkSize: 10})
+
+	err := s.Store("file.dat", []byte("some content"))
+	if err != nil {
+		panic(err)
+	}
+
+	// Same length, different contents
+	err = c.Set(&memcache.Item{Key: buildChunkKey("file-id", 1), Value: []byte("NT")})
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = s.Retrieve("file.dat")
+	if err != ErrFileCorrupted {
+		t.Errorf("Error: want %#v, got %#v", ErrFileCorrupted, err)
+	}
+}
+
+func TestOpenMemcache(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %v", err)
+	}
+	defer l.Close()
+
+	// Reports 2MB item size limit to whoever asks
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			_, _ = bufio.NewReader(conn).ReadString('\n')
+			_, _ = conn.Write([]byte("STAT item_size_max 2097152\r\nEND\r\n"))
+			_ = conn.Close()
+		}
+	}()
+
+	tests := []struct {
+		name          string
+		server        string
+		chunkSize     int
+		wantChunkSize int
+		wantErr       error
+	}{
+		{"Derived chunk size", l.Addr().String(), 0, 2097152 - itemOverhead, nil},
+		{"Configured chunk size", l.Addr().String(), 1000, 1000, nil},
+		{"Chunk size over the limit", l.Addr().String(), 2097152, 0, ErrChunkSizeTooLarge},
+		{"Unavailable server", "127.0.0.1:1", 0, 1048576 - itemOverhead, nil},
+		{"Unavailable server with chunk size", "127.0.0.1:1", 2097152, 2097152, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := OpenMemcache(tt.server, MemcacheConfig{ChunkSize: tt.chunkSize})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Error: want %#v, got %#v", tt.wantErr, err)
+			}
+			if err != nil {
+				return
+			}
+
+			if chunkSize := s.(*memcacheStore).chunkSize; chunkSize != tt.wantChunkSize {
+				t.Errorf("Chunk size: want %d, got %d", tt.wantChunkSize, chunkSize)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package filestore
+
+import (
+	"encoding/json"
+	"strconv"
+)
+
+// metadata is stored under the file key, chunks are stored under separate keys
+type metadata struct {
+	ID        string `json:"id,omitempty"`
+	Filename  string `json:"filename,omitempty"`
+	Chunks    int    `json:"chunks"`
+	Size      int    `json:"size"`
+	ChunkSize int    `json:"chunk_size"`
+
+	// MD5 of every chunk, missing for files stored by older versions
+	Checksums []string `json:"checksums,omitempty"`
+
+	// File ID every chunk is stored under once writes to the file rewrote some of them, otherwise all
+	// chunks are stored under ID
+	ChunkIDs []string `json:"chunk_ids,omitempty"`
+
+	// Files stored without versioning are version 1
+	Version int `json:"version,omitempty"`
+
+	// Older versions of the file, newest first. Only kept in versioned mode
+	Previous []metadata `json:"previous,omitempty"`
+}
+
+func (m metadata) version() int {
+	if m.Version == 0 {
+		return 1
+	}
+
+	return m.Version
+}
+
+// belongsTo tells apart files whose keys collide, filename is missing in metadata stored by older versions
+func (m metadata) belongsTo(filename string) bool {
+	return m.Filename == "" || m.Filename == filename
+}
+
+// chunkKey returns the key of the chunk with the given index
+func (m metadata) chunkKey(index int) string {
+	if index < len(m.ChunkIDs) && m.ChunkIDs[index] != "" {
+		return buildChunkKey(m.ChunkIDs[index], index)
+	}
+
+	return buildChunkKey(m.ID, index)
+}
+
+// hasVersion reports if chunks with the file ID belong to one of the previous versions
+func (m metadata) hasVersion(fileID string) bool {
+	for _, previous := range m.Previous {
+		if previous.ID == fileID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sameContents reports if both describe the same contents of a file, chunks are written under a new ID
+// when a file is stored and checksums change with every write to the file
+func (m metadata) sameContents(other metadata) bool {
+	if m.ID == "" || m.ID != other.ID || m.Size != other.Size || len(m.Checksums) != len(other.Checksums) ||
+		len(m.ChunkIDs) != len(other.ChunkIDs) {
+		return false
+	}
+
+	for i := range m.Checksums {
+		if m.Checksums[i] != other.Checksums[i] {
+			return false
+		}
+	}
+
+	for i := range m.ChunkIDs {
+		if m.ChunkIDs[i] != other.ChunkIDs[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (m metadata) encode() []byte {
+	data, _ := json.Marshal(m) // can't fail for this struct
+
+	return data
+}
+
+func decodeMetadata(data []byte) (metadata, error) {
+	// Files stored by older versions only have the number of chunks in the metadata,
+	// size is unknown for them
+	if chunks, err := strconv.Atoi(string(data)); err == nil {
+		return metadata{Chunks: chunks, Size: -1}, nil
+	}
+
+	m := metadata{}
+	err := json.Unmarshal(data, &m)
+	if err != nil {
+		return metadata{}, err
+	}
+
+	return m, nil
+}
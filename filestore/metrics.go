@@ -0,0 +1,98 @@
+package filestore
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// Operation names reported to Metrics
+const (
+	OpStore           = "store"
+	OpRetrieve        = "retrieve"
+	OpDelete          = "delete"
+	OpRename          = "rename"
+	OpCopy            = "copy"
+	OpAppend          = "append"
+	OpWriteAt         = "write_at"
+	OpRetrieveVersion = "retrieve_version"
+	OpStat            = "stat"
+)
+
+// Chunk level (memcache key) operation names reported to Metrics
+const (
+	ChunkOpSet            = "set"
+	ChunkOpAdd            = "add"
+	ChunkOpCompareAndSwap = "cas"
+	ChunkOpGet            = "get"
+	ChunkOpGetMulti       = "get_multi"
+	ChunkOpDelete         = "delete"
+	ChunkOpIncrement      = "incr"
+	ChunkOpDecrement      = "decr"
+)
+
+// Metrics receives instrumentation events from the store.
+// Implementations must be safe for concurrent use.
+type Metrics interface {
+	// ObserveOperation is called once per store operation, err is nil if the operation succeeded
+	ObserveOperation(op string, duration time.Duration, err error)
+	// ObserveChunk is called for every request made to the backend
+	ObserveChunk(op string, duration time.Duration, err error)
+	// AddBytesIn counts bytes accepted for storing
+	AddBytesIn(n int)
+	// AddBytesOut counts bytes returned to callers
+	AddBytesOut(n int)
+	// IncPurgeFailures counts failed attempts to clean up a partially stored or deleted file
+	IncPurgeFailures()
+}
+
+var sentinelErrors = []struct {
+	err   error
+	label string
+}{
+	{ErrFileAlreadyExists, "file_already_exists"},
+	{ErrFileNotFound, "file_not_found"},
+	{ErrFileTooLarge, "file_too_large"},
+	{ErrFileCorrupted, "file_corrupted"},
+	{ErrChecksumFailed, "checksum_failed"},
+	{ErrFileModified, "file_modified"},
+	{ErrInvalidRange, "invalid_range"},
+	{ErrFileLocked, "file_locked"},
+	{ErrVersionNotFound, "version_not_found"},
+	{ErrInvalidFilename, "invalid_filename"},
+	{ErrQuotaExceeded, "quota_exceeded"},
+	{ErrRegistryFull, "registry_full"},
+	{ErrInvalidArchive, "invalid_archive"},
+	{ErrNotSupported, "not_supported"},
+	{ErrChunkSizeTooLarge, "chunk_size_too_large"},
+	{ErrBackendUnavailable, "backend_unavailable"},
+	{memcache.ErrCacheMiss, "cache_miss"},
+	{context.Canceled, "canceled"},
+	{context.DeadlineExceeded, "deadline_exceeded"},
+}
+
+// ErrorLabel maps an error returned by the store or the backend to a short label suitable for metrics,
+// errors which do not wrap any of the known sentinel errors are reported as "other"
+func ErrorLabel(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	for _, s := range sentinelErrors {
+		if errors.Is(err, s.err) {
+			return s.label
+		}
+	}
+
+	return "other"
+}
+
+type noopMetrics struct{}
+
+func (noopMetrics) ObserveOperation(op string, duration time.Duration, err error) {}
+func (noopMetrics) ObserveChunk(op string, duration time.Duration, err error)     {}
+func (noopMetrics) AddBytesIn(n int)                                              {}
+func (noopMetrics) AddBytesOut(n int)                                             {}
+func (noopMetrics) IncPurgeFailures()                                             {}
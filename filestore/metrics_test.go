@@ -0,0 +1,195 @@
+package filestore
+
+import (
+	"filestore/mock"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingMetrics keeps operations as "op" or "op:error label" in the order they were reported
+type recordingMetrics struct {
+	mu            sync.Mutex
+	operations    []string
+	chunks        []string
+	bytesIn       int
+	bytesOut      int
+	purgeFailures int
+}
+
+func (m *recordingMetrics) ObserveOperation(op string, duration time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.operations = append(m.operations, labeled(op, err))
+}
+
+func (m *recordingMetrics) ObserveChunk(op string, duration time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.chunks = append(m.chunks, labeled(op, err))
+}
+
+func (m *recordingMetrics) AddBytesIn(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.bytesIn += n
+}
+
+func (m *recordingMetrics) AddBytesOut(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.bytesOut += n
+}
+
+func (m *recordingMetrics) IncPurgeFailures() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.purgeFailures++
+}
+
+func labeled(op string, err error) string {
+	if err == nil {
+		return op
+	}
+
+	return fmt.Sprintf("%s:%s", op, ErrorLabel(err))
+}
+
+func TestMetrics_Operations(t *testing.T) {
+	m := &recordingMetrics{}
+	s := NewMemcacheWithClient(mock.NewMemcacheClient(100), MemcacheConfig{ChunkSize: 5, Metrics: m})
+
+	_ = s.Store("file.dat", []byte("some content"))
+	_ = s.Store("file.dat", []byte("other"))
+	_, _ = s.Retrieve("file.dat")
+	_, _ = s.Retrieve("missing.dat")
+	_ = Append(s, "file.dat", []byte("!"))
+	_ = s.Delete("file.dat")
+	_ = s.Delete("file.dat")
+
+	wantOperations := []string{
+		OpStore,
+		OpStore + ":file_already_exists",
+		OpRetrieve,
+		OpRetrieve + ":file_not_found",
+		OpAppend,
+		OpDelete,
+		OpDelete + ":file_not_found",
+	}
+	if !reflect.DeepEqual(m.operations, wantOperations) {
+		t.Errorf("Operations: want %#v, got %#v", wantOperations, m.operations)
+	}
+
+	// Bytes are counted as they come in, only retrieved files count as going out
+	if m.bytesIn != 18 || m.bytesOut != 12 {
+		t.Errorf("Bytes: want 18 in and 12 out, got %d in and %d out", m.bytesIn, m.bytesOut)
+	}
+
+	// Every backend request is reported, misses with their label
+	reported := map[string]bool{}
+	for _, op := range m.chunks {
+		reported[op] = true
+	}
+	for _, op := range []string{ChunkOpSet, ChunkOpAdd, ChunkOpGet + ":cache_miss", ChunkOpGetMulti, ChunkOpCompareAndSwap, ChunkOpDelete} {
+		if !reported[op] {
+			t.Errorf("Chunk operations: want %s reported, got %v", op, m.chunks)
+		}
+	}
+
+	if m.purgeFailures != 0 {
+		t.Errorf("Purge failures: want 0, got %d", m.purgeFailures)
+	}
+}
+
+func TestMetrics_PurgeFailures(t *testing.T) {
+	m := &recordingMetrics{}
+	c := mock.NewFaultyClient(mock.NewMemcacheClient(100), mock.FaultConfig{Faults: []mock.Fault{
+		{Ops: []string{mock.OpDelete}, Keys: regexp.MustCompile(`::`), ErrorRate: 1},
+	}})
+	s := NewMemcacheWithClient(c, MemcacheConfig{ChunkSize: 5, Metrics: m})
+
+	err := s.Store("file.dat", []byte("some content"))
+	if err != nil {
+		panic(err)
+	}
+
+	// Replaced chunks are left for Memcache to evict, the write itself succeeds
+	err = WriteAt(s, "file.dat", 0, []byte("SOME"))
+	if err != nil {
+		t.Errorf("WriteAt: want nil, got %#v", err)
+	}
+	if m.purgeFailures != 1 {
+		t.Errorf("Purge failures after WriteAt: want 1, got %d", m.purgeFailures)
+	}
+
+	err = s.Delete("file.dat")
+	if err == nil {
+		t.Errorf("Delete: want error, got nil")
+	}
+	if m.purgeFailures != 2 {
+		t.Errorf("Purge failures after Delete: want 2, got %d", m.purgeFailures)
+	}
+
+	want := []string{OpStore, OpWriteAt, OpDelete + ":other"}
+	if !reflect.DeepEqual(m.operations, want) {
+		t.Errorf("Operations: want %#v, got %#v", want, m.operations)
+	}
+}
+
+func TestErrorLabel(t *testing.T) {
+	sentinels := map[string]error{
+		"ErrFileAlreadyExists":  ErrFileAlreadyExists,
+		"ErrFileNotFound":       ErrFileNotFound,
+		"ErrFileTooLarge":       ErrFileTooLarge,
+		"ErrFileCorrupted":      ErrFileCorrupted,
+		"ErrChecksumFailed":     ErrChecksumFailed,
+		"ErrFileModified":       ErrFileModified,
+		"ErrInvalidRange":       ErrInvalidRange,
+		"ErrNotSupported":       ErrNotSupported,
+		"ErrFileLocked":         ErrFileLocked,
+		"ErrVersionNotFound":    ErrVersionNotFound,
+		"ErrInvalidArchive":     ErrInvalidArchive,
+		"ErrInvalidFilename":    ErrInvalidFilename,
+		"ErrQuotaExceeded":      ErrQuotaExceeded,
+		"ErrChunkSizeTooLarge":  ErrChunkSizeTooLarge,
+		"ErrRegistryFull":       ErrRegistryFull,
+		"ErrBackendUnavailable": ErrBackendUnavailable,
+	}
+
+	// Every exported error of the package is listed above
+	pkgs, err := parser.ParseDir(token.NewFileSet(), ".", nil, 0)
+	if err != nil {
+		t.Fatalf("Unable to parse package: %v", err)
+	}
+	for _, file := range pkgs["filestore"].Files {
+		for name, object := range file.Scope.Objects {
+			if object.Kind == ast.Var && strings.HasPrefix(name, "Err") && sentinels[name] == nil {
+				t.Errorf("Sentinel errors: want %s covered by the test", name)
+			}
+		}
+	}
+
+	labels := map[string]string{}
+	for name, err := range sentinels {
+		label := ErrorLabel(fmt.Errorf("Unable to do something: %w", err))
+		if label == "other" {
+			t.Errorf("ErrorLabel of %s: want a label of its own, got %#v", name, label)
+		}
+		if other, ok := labels[label]; ok {
+			t.Errorf("ErrorLabel of %s: want a label of its own, got %#v of %s", name, label, other)
+		}
+		labels[label] = name
+	}
+}
@@ -0,0 +1,252 @@
+package mock
+
+import (
+	"errors"
+	"filestore/client"
+	"math/rand"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// Operation names faults apply to, same as the chunk operations reported by the store
+const (
+	OpSet            = "set"
+	OpAdd            = "add"
+	OpCompareAndSwap = "cas"
+	OpGet            = "get"
+	OpGetMulti       = "get_multi"
+	OpDelete         = "delete"
+	OpIncrement      = "incr"
+	OpDecrement      = "decr"
+)
+
+// ErrInjected is returned by requests failed by a fault without Err
+var ErrInjected = errors.New("mock: injected fault")
+
+// Fault describes what goes wrong with requests it matches
+type Fault struct {
+	// Operations the fault applies to, all if empty
+	Ops []string
+
+	// Keys the fault applies to, all if nil. Requests with several keys match if any of them does
+	Keys *regexp.Regexp
+
+	// Probability (0..1) of a matching request failing with Err
+	ErrorRate float64
+
+	// Defaults to ErrInjected. Use a net.Error to make the store retry the request
+	Err error
+
+	// Fail after the request was made, like a timeout of a request the server received
+	FailAfterRequest bool
+
+	// Matching requests are delayed by Latency plus up to LatencyJitter
+	Latency       time.Duration
+	LatencyJitter time.Duration
+
+	// Matching keys are evicted right after every EvictAfter-th matching request
+	EvictAfter int
+}
+
+type FaultConfig struct {
+	// Seed of the random number generator, the same seed fails the same requests of a sequential test
+	Seed int64
+
+	Faults []Fault
+}
+
+// FaultyClient wraps a client and makes requests fail, slow down or lose keys as configured
+type FaultyClient struct {
+	client client.Memcache
+	faults []Fault
+
+	mu       sync.Mutex
+	rand     *rand.Rand
+	matched  []int
+	injected int
+}
+
+func NewFaultyClient(c client.Memcache, config FaultConfig) *FaultyClient {
+	return &FaultyClient{
+		client:  c,
+		faults:  config.Faults,
+		rand:    rand.New(rand.NewSource(config.Seed)),
+		matched: make([]int, len(config.Faults)),
+	}
+}
+
+// Injected returns the number of requests which were failed so far
+func (c *FaultyClient) Injected() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.injected
+}
+
+func (c *FaultyClient) Set(item *memcache.Item) error {
+	return c.do(OpSet, []string{item.Key}, func() error {
+		return c.client.Set(item)
+	})
+}
+
+func (c *FaultyClient) Add(item *memcache.Item) error {
+	return c.do(OpAdd, []string{item.Key}, func() error {
+		return c.client.Add(item)
+	})
+}
+
+func (c *FaultyClient) CompareAndSwap(item *memcache.Item) error {
+	return c.do(OpCompareAndSwap, []string{item.Key}, func() error {
+		return c.client.CompareAndSwap(item)
+	})
+}
+
+func (c *FaultyClient) CompareAndSwapCAS(item *memcache.Item, cas uint64) error {
+	return c.do(OpCompareAndSwap, []string{item.Key}, func() error {
+		return client.CompareAndSwapCAS(c.client, item, cas)
+	})
+}
+
+func (c *FaultyClient) Get(key string) (item *memcache.Item, err error) {
+	err = c.do(OpGet, []string{key}, func() error {
+		item, err = c.client.Get(key)
+		return err
+	})
+
+	return item, err
+}
+
+func (c *FaultyClient) GetCAS(key string) (item *memcache.Item, cas uint64, err error) {
+	err = c.do(OpGet, []string{key}, func() error {
+		item, cas, err = client.GetCAS(c.client, key)
+		return err
+	})
+
+	return item, cas, err
+}
+
+func (c *FaultyClient) GetMulti(keys []string) (items map[string]*memcache.Item, err error) {
+	err = c.do(OpGetMulti, keys, func() error {
+		items, err = c.client.GetMulti(keys)
+		return err
+	})
+
+	return items, err
+}
+
+func (c *FaultyClient) Delete(key string) error {
+	return c.do(OpDelete, []string{key}, func() error {
+		return c.client.Delete(key)
+	})
+}
+
+func (c *FaultyClient) Increment(key string, delta uint64) (value uint64, err error) {
+	err = c.do(OpIncrement, []string{key}, func() error {
+		value, err = c.client.Increment(key, delta)
+		return err
+	})
+
+	return value, err
+}
+
+func (c *FaultyClient) Decrement(key string, delta uint64) (value uint64, err error) {
+	err = c.do(OpDecrement, []string{key}, func() error {
+		value, err = c.client.Decrement(key, delta)
+		return err
+	})
+
+	return value, err
+}
+
+// plan decides what happens to a request, faults are applied in the order they are configured
+type plan struct {
+	latency     time.Duration
+	err         error
+	errAfter    bool
+	evictedKeys []string
+}
+
+func (c *FaultyClient) plan(op string, keys []string) plan {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p := plan{}
+	for i, f := range c.faults {
+		matchingKeys := f.matchingKeys(op, keys)
+		if len(matchingKeys) == 0 {
+			continue
+		}
+		c.matched[i]++
+
+		p.latency += f.Latency
+		if f.LatencyJitter > 0 {
+			p.latency += time.Duration(c.rand.Int63n(int64(f.LatencyJitter)))
+		}
+
+		if p.err == nil && f.ErrorRate > 0 && c.rand.Float64() < f.ErrorRate {
+			p.err = f.Err
+			if p.err == nil {
+				p.err = ErrInjected
+			}
+			p.errAfter = f.FailAfterRequest
+			c.injected++
+		}
+
+		if f.EvictAfter > 0 && c.matched[i]%f.EvictAfter == 0 {
+			p.evictedKeys = append(p.evictedKeys, matchingKeys...)
+		}
+	}
+
+	return p
+}
+
+func (f Fault) matchingKeys(op string, keys []string) []string {
+	if len(f.Ops) > 0 {
+		found := false
+		for _, o := range f.Ops {
+			found = found || o == op
+		}
+
+		if !found {
+			return nil
+		}
+	}
+
+	if f.Keys == nil {
+		return keys
+	}
+
+	matching := []string{}
+	for _, key := range keys {
+		if f.Keys.MatchString(key) {
+			matching = append(matching, key)
+		}
+	}
+
+	return matching
+}
+
+func (c *FaultyClient) do(op string, keys []string, request func() error) error {
+	p := c.plan(op, keys)
+
+	time.Sleep(p.latency)
+
+	if p.err != nil && !p.errAfter {
+		return p.err
+	}
+
+	err := request()
+
+	for _, key := range p.evictedKeys {
+		_ = c.client.Delete(key)
+	}
+
+	if p.err != nil {
+		return p.err
+	}
+
+	return err
+}
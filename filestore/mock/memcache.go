@@ -1,46 +1,96 @@
 package mock
 
 import (
+	"errors"
 	"filestore/client"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/bradfitz/gomemcache/memcache"
 )
 
 type mockMemcacheClient struct {
+	mu          sync.Mutex
 	store       map[string][]byte
+	expires     map[string]time.Time
 	maxCapacity int
+
+	// CAS ids can't be set on memcache.Item outside of the memcache package, instead remember
+	// the items returned for every key. They are forgotten once the key is replaced or deleted,
+	// which makes swapping them fail like a CAS id which doesn't match anymore
+	issued map[string]map[*memcache.Item]bool
 }
 
+// NewMemcacheClient keeps up to maxCapacity keys in memory, further keys are silently dropped
+// as if they were evicted right away. See NewFaultyClient to simulate errors and latency.
 func NewMemcacheClient(maxCapacity int) client.Memcache {
 	return &mockMemcacheClient{
 		store:       map[string][]byte{},
+		expires:     map[string]time.Time{},
 		maxCapacity: maxCapacity,
+		issued:      map[string]map[*memcache.Item]bool{},
 	}
 }
 
 func (c *mockMemcacheClient) Set(item *memcache.Item) error {
-	if len(c.store) > c.maxCapacity {
-		// No more room in the store
-		return nil
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.set(item)
+}
+
+func (c *mockMemcacheClient) Add(item *memcache.Item) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.exists(item.Key) {
+		return memcache.ErrNotStored
 	}
 
-	c.store[item.Key] = item.Value
-	return nil
+	return c.set(item)
+}
+
+func (c *mockMemcacheClient) CompareAndSwap(item *memcache.Item) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.exists(item.Key) {
+		return memcache.ErrNotStored
+	}
+
+	// Items returned before the key was replaced are gone
+	if !c.issued[item.Key][item] {
+		return memcache.ErrCASConflict
+	}
+
+	return c.set(item)
 }
 
 func (c *mockMemcacheClient) Get(key string) (item *memcache.Item, err error) {
-	if value, ok := c.store[key]; ok {
-		return &memcache.Item{Key: key, Value: value}, nil
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.exists(key) {
+		item := &memcache.Item{Key: key, Value: c.store[key]}
+		if c.issued[key] == nil {
+			c.issued[key] = map[*memcache.Item]bool{}
+		}
+		c.issued[key][item] = true
+		return item, nil
 	}
 
 	return nil, memcache.ErrCacheMiss
 }
 
 func (c *mockMemcacheClient) GetMulti(keys []string) (map[string]*memcache.Item, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	items := map[string]*memcache.Item{}
 	for _, key := range keys {
-		if value, ok := c.store[key]; ok {
-			items[key] = &memcache.Item{Key: key, Value: value}
+		if c.exists(key) {
+			items[key] = &memcache.Item{Key: key, Value: c.store[key]}
 		}
 	}
 
@@ -48,10 +98,87 @@ func (c *mockMemcacheClient) GetMulti(keys []string) (map[string]*memcache.Item,
 }
 
 func (c *mockMemcacheClient) Delete(key string) error {
-	if _, ok := c.store[key]; ok {
-		delete(c.store, key)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.exists(key) {
+		c.delete(key)
 		return nil
 	}
 
 	return memcache.ErrCacheMiss
 }
+
+func (c *mockMemcacheClient) Increment(key string, delta uint64) (uint64, error) {
+	return c.incrDecr(key, func(value uint64) uint64 {
+		return value + delta
+	})
+}
+
+// Decrement doesn't go below zero, same as Memcache
+func (c *mockMemcacheClient) Decrement(key string, delta uint64) (uint64, error) {
+	return c.incrDecr(key, func(value uint64) uint64 {
+		if delta > value {
+			return 0
+		}
+
+		return value - delta
+	})
+}
+
+func (c *mockMemcacheClient) incrDecr(key string, change func(value uint64) uint64) (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.exists(key) {
+		return 0, memcache.ErrCacheMiss
+	}
+
+	value, err := strconv.ParseUint(string(c.store[key]), 10, 64)
+	if err != nil {
+		return 0, errors.New("memcache: cannot increment or decrement non-numeric value")
+	}
+
+	value = change(value)
+	c.store[key] = []byte(strconv.FormatUint(value, 10))
+	delete(c.issued, key)
+
+	return value, nil
+}
+
+func (c *mockMemcacheClient) set(item *memcache.Item) error {
+	if len(c.store) > c.maxCapacity {
+		// No more room in the store
+		return nil
+	}
+
+	// Values are sent over the network by real clients, callers are free to reuse the slice
+	c.store[item.Key] = append([]byte{}, item.Value...)
+	delete(c.issued, item.Key)
+
+	// Same as Memcache: positive expiration is in seconds, negative expires the item immediately
+	delete(c.expires, item.Key)
+	if item.Expiration < 0 {
+		c.delete(item.Key)
+	} else if item.Expiration > 0 {
+		c.expires[item.Key] = time.Now().Add(time.Duration(item.Expiration) * time.Second)
+	}
+
+	return nil
+}
+
+// exists reports if the key is there, removing it first if it has expired
+func (c *mockMemcacheClient) exists(key string) bool {
+	if expires, ok := c.expires[key]; ok && !time.Now().Before(expires) {
+		c.delete(key)
+	}
+
+	_, ok := c.store[key]
+	return ok
+}
+
+func (c *mockMemcacheClient) delete(key string) {
+	delete(c.store, key)
+	delete(c.expires, key)
+	delete(c.issued, key)
+}
@@ -0,0 +1,180 @@
+package filestore
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// QuotaConfig limits how much every namespace can store. Usage is tracked with Memcache counters,
+// which only know about files being stored and deleted: files evicted by Memcache keep counting
+// against the quota until they are deleted, and evicted counters start over from zero.
+type QuotaConfig struct {
+	// Derives the namespace from a filename. Defaults to the part before the first "/",
+	// files without one share the "" namespace
+	Namespace func(filename string) string
+
+	// Limits of every namespace, zero means no limit
+	MaxBytes int
+	MaxFiles int
+
+	// Limits of specific namespaces, replacing the ones above
+	Namespaces map[string]QuotaLimit
+}
+
+type QuotaLimit struct {
+	MaxBytes int
+	MaxFiles int
+}
+
+func (c *QuotaConfig) namespace(filename string) string {
+	if c.Namespace != nil {
+		return c.Namespace(filename)
+	}
+
+	if i := strings.Index(filename, "/"); i >= 0 {
+		return filename[:i]
+	}
+
+	return ""
+}
+
+func (c *QuotaConfig) limit(namespace string) QuotaLimit {
+	if limit, ok := c.Namespaces[namespace]; ok {
+		return limit
+	}
+
+	return QuotaLimit{MaxBytes: c.MaxBytes, MaxFiles: c.MaxFiles}
+}
+
+// usage is what a file counts against the quota
+type usage struct {
+	bytes int
+	files int
+}
+
+// fileUsage includes all versions of the file, size of files stored by older versions is unknown
+func fileUsage(meta metadata) usage {
+	u := usage{files: 1}
+	for _, m := range append([]metadata{meta}, meta.Previous...) {
+		if m.Size > 0 {
+			u.bytes += m.Size
+		}
+	}
+
+	return u
+}
+
+// reserveQuota adds to the usage of the file's namespace, unless that would exceed its limits.
+// Only limits of what is being added are checked.
+func (s memcacheStore) reserveQuota(filename string, u usage) error {
+	if s.quota == nil {
+		return nil
+	}
+
+	namespace := s.quota.namespace(filename)
+	limit := s.quota.limit(namespace)
+
+	if u.bytes > 0 {
+		bytes, err := s.incrementKey(buildQuotaKey(namespace, "bytes"), u.bytes)
+		if err != nil {
+			return fmt.Errorf("Unable to check quota: %w", err)
+		}
+
+		if limit.MaxBytes > 0 && bytes > limit.MaxBytes {
+			s.releaseQuota(filename, usage{bytes: u.bytes})
+			return fmt.Errorf("%w: namespace %q is limited to %d bytes", ErrQuotaExceeded, namespace, limit.MaxBytes)
+		}
+	}
+
+	if u.files > 0 {
+		files, err := s.incrementKey(buildQuotaKey(namespace, "files"), u.files)
+		if err != nil {
+			s.releaseQuota(filename, usage{bytes: u.bytes})
+			return fmt.Errorf("Unable to check quota: %w", err)
+		}
+
+		if limit.MaxFiles > 0 && files > limit.MaxFiles {
+			s.releaseQuota(filename, u)
+			return fmt.Errorf("%w: namespace %q is limited to %d files", ErrQuotaExceeded, namespace, limit.MaxFiles)
+		}
+	}
+
+	return nil
+}
+
+// releaseQuota gives back usage of a file which was deleted or failed to be stored. Failing to do so
+// is not fatal, the namespace would just look fuller than it is.
+func (s memcacheStore) releaseQuota(filename string, u usage) {
+	if s.quota == nil {
+		return
+	}
+
+	namespace := s.quota.namespace(filename)
+
+	// Counters are independent, failing to release one doesn't keep the other
+	for _, counter := range []struct {
+		kind  string
+		delta int
+	}{{"bytes", u.bytes}, {"files", u.files}} {
+		err := s.decrementKey(buildQuotaKey(namespace, counter.kind), counter.delta)
+		if err != nil {
+			s.logger.WithField("namespace", namespace).
+				WithField("counter", counter.kind).
+				WithField("delta", counter.delta).
+				WithError(err).
+				Warning("Unable to release quota")
+		}
+	}
+}
+
+// incrementKey creates the counter if it doesn't exist yet and returns its new value.
+// Counters are never retried, an increment which timed out may have been applied and would count twice.
+func (s memcacheStore) incrementKey(key string, delta int) (int, error) {
+	s.logger.WithField("key", key).WithField("delta", delta).Debug("Incrementing key")
+
+	increment := func() (uint64, error) {
+		start := time.Now()
+		value, err := s.client.Increment(key, uint64(delta))
+		s.metrics.ObserveChunk(ChunkOpIncrement, time.Since(start), err)
+
+		return value, err
+	}
+
+	value, err := increment()
+	if err == memcache.ErrCacheMiss {
+		// Someone else may have created it in the meantime, either way it exists now
+		err = s.addKey(key, []byte("0"))
+		if err != nil && err != memcache.ErrNotStored {
+			return 0, err
+		}
+
+		value, err = increment()
+	}
+
+	return int(value), err
+}
+
+// decrementKey doesn't go below zero, missing counter has nothing to decrement. Not retried either.
+func (s memcacheStore) decrementKey(key string, delta int) error {
+	if delta <= 0 {
+		return nil
+	}
+
+	s.logger.WithField("key", key).WithField("delta", delta).Debug("Decrementing key")
+
+	start := time.Now()
+	_, err := s.client.Decrement(key, uint64(delta))
+	s.metrics.ObserveChunk(ChunkOpDecrement, time.Since(start), err)
+	if err == memcache.ErrCacheMiss {
+		return nil
+	}
+
+	return err
+}
+
+func buildQuotaKey(namespace string, kind string) string {
+	return keyPrefix + "quota:" + MD5Key(namespace) + ":" + kind
+}
@@ -0,0 +1,165 @@
+package filestore
+
+import (
+	"errors"
+	"filestore/mock"
+	"net"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"filestore/client"
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+func TestQuota(t *testing.T) {
+	c := mock.NewMemcacheClient(100)
+	s := NewMemcacheWithClient(c, MemcacheConfig{
+		ChunkSize: 5,
+		Quota: &QuotaConfig{
+			MaxBytes:   20,
+			MaxFiles:   2,
+			Namespaces: map[string]QuotaLimit{"big": {MaxBytes: 100}},
+		},
+	})
+
+	err := s.Store("alice/a.dat", []byte("0123456789"))
+	if err != nil {
+		t.Fatalf("Store: want nil, got %#v", err)
+	}
+
+	// Bytes over the limit
+	err = s.Store("alice/b.dat", []byte("0123456789!"))
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Store: want %#v, got %#v", ErrQuotaExceeded, err)
+	}
+	if _, err := s.Retrieve("alice/b.dat"); err != ErrFileNotFound {
+		t.Errorf("Retrieve: want %#v, got %#v", ErrFileNotFound, err)
+	}
+
+	err = Append(s, "alice/a.dat", []byte("0123456789!"))
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Append: want %#v, got %#v", ErrQuotaExceeded, err)
+	}
+
+	// Other namespaces are not affected
+	err = s.Store("bob/a.dat", []byte("0123456789"))
+	if err != nil {
+		t.Errorf("Store: want nil, got %#v", err)
+	}
+
+	err = s.Store("big/a.dat", []byte("0123456789012345678901234567890123456789"))
+	if err != nil {
+		t.Errorf("Store: want nil, got %#v", err)
+	}
+
+	// Failed operations don't count against the quota
+	assertQuotaUsage(t, c, "alice", 10, 1)
+
+	// Files over the limit
+	err = s.Store("alice/b.dat", []byte("01234"))
+	if err != nil {
+		t.Errorf("Store: want nil, got %#v", err)
+	}
+
+	err = s.Store("alice/c.dat", []byte("0"))
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Store: want %#v, got %#v", ErrQuotaExceeded, err)
+	}
+
+	err = s.Store("alice/a.dat", []byte("0"))
+	if err != ErrFileAlreadyExists {
+		t.Errorf("Store: want %#v, got %#v", ErrFileAlreadyExists, err)
+	}
+
+	assertQuotaUsage(t, c, "alice", 15, 2)
+
+	// Deleting and moving files frees the quota
+	err = s.Delete("alice/b.dat")
+	if err != nil {
+		t.Errorf("Delete: want nil, got %#v", err)
+	}
+
+	err = Rename(s, "alice/a.dat", "bob/b.dat")
+	if err != nil {
+		t.Errorf("Rename: want nil, got %#v", err)
+	}
+
+	assertQuotaUsage(t, c, "alice", 0, 0)
+	assertQuotaUsage(t, c, "bob", 20, 2)
+
+	err = Copy(s, "bob/b.dat", "bob/c.dat")
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Copy: want %#v, got %#v", ErrQuotaExceeded, err)
+	}
+}
+
+func TestQuota_CountersNotRetried(t *testing.T) {
+	m := mock.NewMemcacheClient(100)
+	_ = m.Set(&memcache.Item{Key: buildQuotaKey("alice", "bytes"), Value: []byte("0")})
+
+	// The bytes counter is incremented, but the reply times out
+	c := mock.NewFaultyClient(m, mock.FaultConfig{Faults: []mock.Fault{{
+		Ops:              []string{mock.OpIncrement},
+		Keys:             regexp.MustCompile(`:bytes$`),
+		ErrorRate:        1,
+		Err:              &net.OpError{Op: "read", Net: "tcp", Err: timeoutError{}},
+		FailAfterRequest: true,
+	}}})
+	s := NewMemcacheWithClient(c, MemcacheConfig{
+		ChunkSize: 5,
+		Retry:     RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond},
+		Quota:     &QuotaConfig{MaxBytes: 100},
+	})
+
+	err := s.Store("alice/a.dat", []byte("0123456789"))
+	var netErr net.Error
+	if !errors.As(err, &netErr) {
+		t.Errorf("Store: want timeout, got %#v", err)
+	}
+
+	// Counted once, a retry would have counted twice
+	assertQuotaUsage(t, m, "alice", 10, 0)
+}
+
+func TestQuota_ReleaseCountersIndependently(t *testing.T) {
+	m := mock.NewMemcacheClient(100)
+	c := mock.NewFaultyClient(m, mock.FaultConfig{Faults: []mock.Fault{{
+		Ops:       []string{mock.OpDecrement},
+		Keys:      regexp.MustCompile(`:bytes$`),
+		ErrorRate: 1,
+	}}})
+	s := NewMemcacheWithClient(c, MemcacheConfig{ChunkSize: 5, Quota: &QuotaConfig{MaxFiles: 10}})
+
+	err := s.Store("alice/a.dat", []byte("0123456789"))
+	if err != nil {
+		t.Fatalf("Store: want nil, got %#v", err)
+	}
+
+	err = s.Delete("alice/a.dat")
+	if err != nil {
+		t.Errorf("Delete: want nil, got %#v", err)
+	}
+
+	// Bytes failed to be released, files still are
+	assertQuotaUsage(t, m, "alice", 10, 0)
+}
+
+func assertQuotaUsage(t *testing.T, c client.Memcache, namespace string, wantBytes int, wantFiles int) {
+	t.Helper()
+
+	for kind, want := range map[string]int{"bytes": wantBytes, "files": wantFiles} {
+		got := 0
+		item, err := c.Get(buildQuotaKey(namespace, kind))
+		if err == nil {
+			got, _ = strconv.Atoi(string(item.Value))
+		} else if err != memcache.ErrCacheMiss {
+			t.Fatalf("Quota %s of %s: %v", kind, namespace, err)
+		}
+
+		if got != want {
+			t.Errorf("Quota %s of %s: want %d, got %d", kind, namespace, want, got)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package filestore
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// Memcache can't enumerate keys, so when file tracking is enabled the store keeps a record of
+// filenames, their file IDs and number of chunks. The record is split into shards by filename,
+// so concurrent updates rarely conflict. Every shard is a single item no larger than maxRegistryShardSize,
+// which is room for about 15k files per shard, registering more fails with ErrRegistryFull.
+// Shards can be evicted like any other key.
+const registryShards = 16
+const registryUpdateAttempts = 10
+
+// Shards have to fit into an item of a server with the default item size limit
+const maxRegistryShardSize = defaultItemSizeMax - itemOverhead
+
+type registry map[string]registryEntry // filename => file
+
+// registryEntry is enough to find chunks of a file whose metadata is gone. Chunks rewritten by
+// Append and WriteAt are stored under other IDs, those are left for Memcache to evict.
+type registryEntry struct {
+	ID     string `json:"id"`
+	Chunks int    `json:"chunks"`
+}
+
+// Lister is implemented by stores which can enumerate stored files
+type Lister interface {
+	List() ([]string, error)
+}
+
+// List returns names of stored files in alphabetical order
+func List(store Store) ([]string, error) {
+	lister, ok := store.(Lister)
+	if !ok {
+		return nil, fmt.Errorf("%w: store can't list files", ErrNotSupported)
+	}
+
+	return lister.List()
+}
+
+// List requires TrackFiles to be enabled. Files which were evicted may still be listed.
+func (s memcacheStore) List() ([]string, error) {
+	files, err := s.listFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	filenames := make([]string, 0, len(files))
+	for filename := range files {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+
+	return filenames, nil
+}
+
+func (s memcacheStore) registerFile(filename string, meta metadata) error {
+	if !s.trackFiles {
+		return nil
+	}
+
+	return s.updateRegistry(buildRegistryKey(filename), func(r registry) {
+		r[filename] = registryEntry{ID: meta.ID, Chunks: meta.Chunks}
+	})
+}
+
+func (s memcacheStore) unregisterFile(filename string) error {
+	if !s.trackFiles {
+		return nil
+	}
+
+	return s.updateRegistry(buildRegistryKey(filename), func(r registry) {
+		delete(r, filename)
+	})
+}
+
+// unregisterFileID leaves the file registered if it was registered again under another ID meanwhile
+func (s memcacheStore) unregisterFileID(filename string, id string) error {
+	if !s.trackFiles {
+		return nil
+	}
+
+	return s.updateRegistry(buildRegistryKey(filename), func(r registry) {
+		if r[filename].ID == id {
+			delete(r, filename)
+		}
+	})
+}
+
+// listFiles reads all shards at once, missing shards were evicted or have never been written
+func (s memcacheStore) listFiles() (registry, error) {
+	if !s.trackFiles {
+		return nil, fmt.Errorf("%w: file tracking is disabled", ErrNotSupported)
+	}
+
+	keys := make([]string, registryShards)
+	for i := range keys {
+		keys[i] = buildRegistryShardKey(i)
+	}
+
+	values, err := s.findKeys(keys)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read file registry: %w", err)
+	}
+
+	r := registry{}
+	for _, key := range keys {
+		data, ok := values[key]
+		if !ok {
+			continue
+		}
+
+		err = json.Unmarshal(data, &r)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read file registry: %w", err)
+		}
+	}
+
+	return r, nil
+}
+
+// updateRegistry applies the change to a shard using compare-and-swap, retrying if someone else updated it
+// at the same time. A shard which can't be decoded is not overwritten, that would lose track of its files.
+func (s memcacheStore) updateRegistry(key string, change func(r registry)) error {
+	for attempt := 0; attempt < registryUpdateAttempts; attempt++ {
+		item, err := s.getItem(key)
+		if err == memcache.ErrCacheMiss {
+			r := registry{}
+			change(r)
+
+			var data []byte
+			data, err = encodeRegistry(key, r)
+			if err != nil {
+				return err
+			}
+
+			err = s.addKey(key, data)
+			if err == memcache.ErrNotStored {
+				continue
+			}
+		} else if err == nil {
+			r := registry{}
+			err = json.Unmarshal(item.Value, &r)
+			if err != nil {
+				return fmt.Errorf("Unable to decode file registry: %w", err)
+			}
+			change(r)
+
+			item.Value, err = encodeRegistry(key, r)
+			if err != nil {
+				return err
+			}
+
+			err = s.compareAndSwapKey(item)
+			if err == memcache.ErrCASConflict || err == memcache.ErrNotStored {
+				continue
+			}
+		}
+
+		if err != nil {
+			return fmt.Errorf("Unable to update file registry: %w", err)
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("Unable to update file registry: %w", memcache.ErrCASConflict)
+}
+
+// encodeRegistry fails if the shard has grown too large for an item
+func encodeRegistry(key string, r registry) ([]byte, error) {
+	data, _ := json.Marshal(r) // can't fail for this map
+
+	if len(data) > maxRegistryShardSize {
+		return nil, fmt.Errorf("%w: shard %s of %d files takes %d bytes, up to %d fit", ErrRegistryFull, key, len(r), len(data), maxRegistryShardSize)
+	}
+
+	return data, nil
+}
+
+// buildRegistryKey returns the key of the shard the file is registered in
+func buildRegistryKey(filename string) string {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(filename))
+
+	return buildRegistryShardKey(int(h.Sum32() % registryShards))
+}
+
+func buildRegistryShardKey(shard int) string {
+	return keyPrefix + "registry:" + strconv.Itoa(shard)
+}
@@ -0,0 +1,131 @@
+package filestore
+
+import (
+	"errors"
+	"filestore/mock"
+	"fmt"
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+func TestRegistry_Shards(t *testing.T) {
+	c := mock.NewMemcacheClient(1000)
+	s := NewMemcacheWithClient(c, MemcacheConfig{ChunkSize: 5, TrackFiles: true})
+
+	want := []string{}
+	for i := 0; i < 50; i++ {
+		filename := fmt.Sprintf("file%02d.dat", i)
+		want = append(want, filename)
+
+		err := s.Store(filename, []byte("some content"))
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	filenames, err := List(s)
+	if err != nil || !reflect.DeepEqual(filenames, want) {
+		t.Errorf("List: want %#v, got %#v (%v)", want, filenames, err)
+	}
+
+	shards := 0
+	for i := 0; i < registryShards; i++ {
+		if _, err := c.Get(buildRegistryShardKey(i)); err == nil {
+			shards++
+		}
+	}
+	if shards < 2 {
+		t.Errorf("Shards: want files spread over several, got %d", shards)
+	}
+}
+
+func TestRegistry_UpdateFails(t *testing.T) {
+	c := mock.NewFaultyClient(mock.NewMemcacheClient(100), mock.FaultConfig{Faults: []mock.Fault{
+		{Keys: regexp.MustCompile(`registry`), ErrorRate: 1},
+	}})
+	s := NewMemcacheWithClient(c, MemcacheConfig{ChunkSize: 5, TrackFiles: true})
+
+	// A file which couldn't be listed is not stored
+	err := s.Store("file.dat", []byte("some content"))
+	if err == nil {
+		t.Errorf("Store: want error, got nil")
+	}
+
+	_, err = s.Retrieve("file.dat")
+	if err != ErrFileNotFound {
+		t.Errorf("Retrieve: want %#v, got %#v", ErrFileNotFound, err)
+	}
+}
+
+func TestRegistry_UnregisterFails(t *testing.T) {
+	// The shard is added by the first file, changing it fails afterwards
+	c := mock.NewFaultyClient(mock.NewMemcacheClient(100), mock.FaultConfig{Faults: []mock.Fault{
+		{Ops: []string{mock.OpCompareAndSwap}, Keys: regexp.MustCompile(`registry`), ErrorRate: 1},
+	}})
+	m := &recordingMetrics{}
+	s := NewMemcacheWithClient(c, MemcacheConfig{ChunkSize: 5, TrackFiles: true, Metrics: m})
+
+	err := s.Store("file.dat", []byte("some content"))
+	if err != nil {
+		panic(err)
+	}
+
+	// The file is deleted all the same, it stays listed until the store is checked
+	err = s.Delete("file.dat")
+	if err != nil {
+		t.Errorf("Delete: want nil, got %#v", err)
+	}
+
+	if m.purgeFailures != 1 {
+		t.Errorf("Purge failures: want 1, got %d", m.purgeFailures)
+	}
+
+	filenames, err := List(s)
+	if err != nil || !reflect.DeepEqual(filenames, []string{"file.dat"}) {
+		t.Errorf("List: want %#v, got %#v (%v)", []string{"file.dat"}, filenames, err)
+	}
+}
+
+func TestRegistry_ShardFull(t *testing.T) {
+	r := registry{"file.dat": registryEntry{ID: newFileID(), Chunks: 1}}
+	if _, err := encodeRegistry("shard", r); err != nil {
+		t.Errorf("Encode: want nil, got %#v", err)
+	}
+
+	// An entry takes about 60 bytes
+	for i := 0; i < maxRegistryShardSize/50; i++ {
+		r[fmt.Sprintf("file%06d.dat", i)] = registryEntry{ID: newFileID(), Chunks: 1}
+	}
+
+	_, err := encodeRegistry("shard", r)
+	if !errors.Is(err, ErrRegistryFull) {
+		t.Errorf("Encode: want %#v, got %#v", ErrRegistryFull, err)
+	}
+}
+
+func TestRegistry_Damaged(t *testing.T) {
+	c := mock.NewMemcacheClient(100)
+	s := NewMemcacheWithClient(c, MemcacheConfig{ChunkSize: 5, TrackFiles: true}).(*memcacheStore)
+
+	key := buildRegistryKey("file.dat")
+	_ = c.Set(&memcache.Item{Key: key, Value: []byte("{")})
+
+	_, err := List(s)
+	if err == nil {
+		t.Errorf("List: want error, got nil")
+	}
+
+	// Files registered in the damaged shard are not lost by overwriting it
+	err = s.registerFile("file.dat", metadata{ID: "file-id", Chunks: 1})
+	if err == nil {
+		t.Errorf("Register: want error, got nil")
+	}
+
+	item, _ := c.Get(key)
+	if item == nil || string(item.Value) != "{" {
+		t.Errorf("Shard: want kept, got %#v", item)
+	}
+}
@@ -0,0 +1,325 @@
+// Package remote implements the Store interface on top of the HTTP API of the file server,
+// so tools can work with a running file server the same way they work with the library
+package remote
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"filestore"
+	"filestore/httpstatus"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultTimeout = 30 * time.Second
+
+type Config struct {
+	// Optional, defaults to a client with Timeout
+	Client *http.Client
+
+	// Timeout of a whole request including the body, defaults to 30s. Ignored if Client is set
+	Timeout time.Duration
+
+	// Optional, base URL of the admin listener of the file server (see ADMIN_ADDR), required to list files
+	AdminURL string
+}
+
+type remoteStore struct {
+	baseURL  string
+	adminURL string
+	client   *http.Client
+}
+
+// NewStore talks to the file server at baseURL, e.g. http://127.0.0.1:8000. Filenames with empty, "." or ".."
+// path segments can't be addressed on the file server and fail with ErrInvalidFilename.
+func NewStore(baseURL string, config Config) filestore.Store {
+	client := config.Client
+	if client == nil {
+		timeout := config.Timeout
+		if timeout <= 0 {
+			timeout = defaultTimeout
+		}
+
+		client = &http.Client{Timeout: timeout}
+	}
+
+	return remoteStore{
+		baseURL:  strings.TrimSuffix(baseURL, "/"),
+		adminURL: strings.TrimSuffix(config.AdminURL, "/"),
+		client:   client,
+	}
+}
+
+// ResponseError is returned when the file server fails a request, it matches the store error
+// the server reported with errors.Is
+type ResponseError struct {
+	StatusCode int
+	Message    string
+
+	err error
+}
+
+func (e *ResponseError) Error() string {
+	return e.Message
+}
+
+func (e *ResponseError) Unwrap() error {
+	return e.err
+}
+
+func (s remoteStore) Store(filename string, contents []byte) error {
+	return s.do(context.Background(), http.MethodPost, filename, "", contents, nil, nil)
+}
+
+func (s remoteStore) Retrieve(filename string) ([]byte, error) {
+	return s.RetrieveContext(context.Background(), filename)
+}
+
+func (s remoteStore) RetrieveContext(ctx context.Context, filename string) ([]byte, error) {
+	contents := []byte{}
+	err := s.do(ctx, http.MethodGet, filename, "", nil, nil, &contents)
+
+	return contents, err
+}
+
+func (s remoteStore) RetrieveVersion(filename string, version int) ([]byte, error) {
+	contents := []byte{}
+	query := url.Values{"version": {strconv.Itoa(version)}}.Encode()
+	err := s.do(context.Background(), http.MethodGet, filename, query, nil, nil, &contents)
+
+	return contents, err
+}
+
+// Versions is not supported, the file server can only retrieve a version by its number
+func (s remoteStore) Versions(filename string) ([]int, error) {
+	return nil, fmt.Errorf("%w: file server can't list versions", filestore.ErrNotSupported)
+}
+
+// Stat makes a HEAD request, the file server describes the file in the response headers
+func (s remoteStore) Stat(filename string) (filestore.FileInfo, error) {
+	path, err := filePath(filename)
+	if err != nil {
+		return filestore.FileInfo{}, err
+	}
+
+	resp, err := s.request(context.Background(), http.MethodHead, s.baseURL+path, nil, nil)
+	if err != nil {
+		return filestore.FileInfo{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return filestore.FileInfo{}, responseError(resp)
+	}
+
+	version, _ := strconv.Atoi(resp.Header.Get("X-File-Version"))
+
+	return filestore.FileInfo{
+		Size:     int(resp.ContentLength),
+		Version:  version,
+		Checksum: strings.Trim(resp.Header.Get("ETag"), `"`),
+	}, nil
+}
+
+func (s remoteStore) Delete(filename string) error {
+	return s.do(context.Background(), http.MethodDelete, filename, "", nil, nil, nil)
+}
+
+func (s remoteStore) Rename(from string, to string) error {
+	return s.move("MOVE", from, to)
+}
+
+func (s remoteStore) Copy(from string, to string) error {
+	return s.move("COPY", from, to)
+}
+
+func (s remoteStore) Append(filename string, data []byte) error {
+	return s.do(context.Background(), http.MethodPost, filename, "append=true", data, nil, nil)
+}
+
+// WriteAt of no data doesn't make a request, the file server requires a non-empty range
+func (s remoteStore) WriteAt(filename string, offset int, data []byte) error {
+	if offset < 0 {
+		return fmt.Errorf("%w: offset %d is negative", filestore.ErrInvalidRange, offset)
+	}
+
+	if len(data) == 0 {
+		return nil
+	}
+
+	header := http.Header{}
+	header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/*", offset, offset+len(data)-1))
+
+	return s.do(context.Background(), http.MethodPatch, filename, "", data, header, nil)
+}
+
+// List asks the admin listener of the file server for the names of stored files, which it reads
+// from its file registry
+func (s remoteStore) List() ([]string, error) {
+	if s.adminURL == "" {
+		return nil, fmt.Errorf("%w: admin URL of the file server is not configured", filestore.ErrNotSupported)
+	}
+
+	resp, err := s.request(context.Background(), http.MethodGet, s.adminURL+"/admin/files", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp)
+	}
+
+	decoded := struct {
+		Files []string `json:"files"`
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&decoded)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read response: %w", err)
+	}
+	sort.Strings(decoded.Files)
+
+	return decoded.Files, nil
+}
+
+func (s remoteStore) move(method string, from string, to string) error {
+	path, err := filePath(to)
+	if err != nil {
+		return err
+	}
+
+	header := http.Header{}
+	header.Set("Destination", path)
+
+	return s.do(context.Background(), method, from, "", nil, header, nil)
+}
+
+// do requests a file and reads the response body into result if it's not nil
+func (s remoteStore) do(ctx context.Context, method string, filename string, query string, body []byte, header http.Header, result *[]byte) error {
+	path, err := filePath(filename)
+	if err != nil {
+		return err
+	}
+
+	u := s.baseURL + path
+	if query != "" {
+		u += "?" + query
+	}
+
+	resp, err := s.request(ctx, method, u, body, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return responseError(resp)
+	}
+
+	if result == nil {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+
+	*result, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("Unable to read response: %w", err)
+	}
+
+	return nil
+}
+
+func (s remoteStore) request(ctx context.Context, method string, u string, body []byte, header http.Header) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequest(method, u, r)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create request: %w", err)
+	}
+	req = req.WithContext(ctx)
+
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+
+		return nil, fmt.Errorf("Unable to reach file server: %w", err)
+	}
+
+	return resp, nil
+}
+
+// filePath escapes every segment of the filename, the file server would clean up empty, "." and ".." segments
+func filePath(filename string) (string, error) {
+	segments := strings.Split(filename, "/")
+	for i, segment := range segments {
+		if segment == "" || segment == "." || segment == ".." {
+			return "", fmt.Errorf("%w: file server can't address %q", filestore.ErrInvalidFilename, filename)
+		}
+
+		segments[i] = url.PathEscape(segment)
+	}
+
+	return "/file/" + strings.Join(segments, "/"), nil
+}
+
+func responseError(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	message := strings.TrimSpace(string(body))
+	decoded := struct {
+		Error string `json:"error"`
+	}{}
+	if json.Unmarshal(body, &decoded) == nil && decoded.Error != "" {
+		message = decoded.Error
+	}
+	if message == "" {
+		message = resp.Status
+	}
+
+	if resp.StatusCode == http.StatusServiceUnavailable {
+		retryAfter, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+		return &ResponseError{
+			StatusCode: resp.StatusCode,
+			Message:    message,
+			err:        &filestore.BackendUnavailableError{RetryAfter: time.Duration(retryAfter) * time.Second},
+		}
+	}
+
+	return &ResponseError{
+		StatusCode: resp.StatusCode,
+		Message:    message,
+		err:        matchError(httpstatus.Errors(resp.StatusCode), message),
+	}
+}
+
+// matchError picks the candidate the message contains, the first candidate otherwise
+func matchError(candidates []error, message string) error {
+	for _, err := range candidates {
+		if err != nil && strings.Contains(message, err.Error()) {
+			return err
+		}
+	}
+
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	return candidates[0]
+}
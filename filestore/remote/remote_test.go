@@ -0,0 +1,123 @@
+package remote
+
+import (
+	"errors"
+	"filestore"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestResponseError(t *testing.T) {
+	type testCase struct {
+		name       string
+		statusCode int
+		header     map[string]string
+		body       string
+		want       error
+	}
+
+	tests := []testCase{
+		{
+			name:       "Not found",
+			statusCode: http.StatusNotFound,
+			body:       `{"error": "File not found"}`,
+			want:       filestore.ErrFileNotFound,
+		},
+		{
+			name:       "Version not found",
+			statusCode: http.StatusNotFound,
+			body:       `{"error": "Version not found"}`,
+			want:       filestore.ErrVersionNotFound,
+		},
+		{
+			name:       "Conflict without a message",
+			statusCode: http.StatusConflict,
+			want:       filestore.ErrFileAlreadyExists,
+		},
+		{
+			name:       "Modified",
+			statusCode: http.StatusConflict,
+			body:       `{"error": "File was modified concurrently, try again"}`,
+			want:       filestore.ErrFileModified,
+		},
+		{
+			name:       "Too large",
+			statusCode: http.StatusBadRequest,
+			body:       `{"error": "File is too large: max file size is 10 bytes"}`,
+			want:       filestore.ErrFileTooLarge,
+		},
+		{
+			name:       "Backend unavailable",
+			statusCode: http.StatusServiceUnavailable,
+			header:     map[string]string{"Retry-After": "3"},
+			body:       `{"error": "Backend is unavailable, try again later"}`,
+			want:       &filestore.BackendUnavailableError{RetryAfter: 3 * time.Second},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				for key, value := range tt.header {
+					w.Header().Set(key, value)
+				}
+				w.WriteHeader(tt.statusCode)
+				_, _ = w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			_, err := NewStore(server.URL, Config{}).Retrieve("file.dat")
+
+			var responseErr *ResponseError
+			if !errors.As(err, &responseErr) || responseErr.StatusCode != tt.statusCode {
+				t.Fatalf("Retrieve: want status %d, got %#v", tt.statusCode, err)
+			}
+
+			unavailable, ok := tt.want.(*filestore.BackendUnavailableError)
+			if !ok {
+				if !errors.Is(err, tt.want) {
+					t.Errorf("Retrieve: want %#v, got %#v", tt.want, err)
+				}
+				return
+			}
+
+			var unavailableErr *filestore.BackendUnavailableError
+			if !errors.As(err, &unavailableErr) || unavailableErr.RetryAfter != unavailable.RetryAfter {
+				t.Errorf("Retrieve: want %#v, got %#v", unavailable, err)
+			}
+		})
+	}
+}
+
+func TestRemoteStore_Filenames(t *testing.T) {
+	paths := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.EscapedPath()+" "+r.Header.Get("Destination"))
+	}))
+	defer server.Close()
+
+	s := NewStore(server.URL+"/", Config{})
+
+	for _, filename := range []string{"dir//file.dat", "dir/../file.dat", "/file.dat"} {
+		err := s.Store(filename, []byte("some content"))
+		if !errors.Is(err, filestore.ErrInvalidFilename) {
+			t.Errorf("Store of %q: want %#v, got %#v", filename, filestore.ErrInvalidFilename, err)
+		}
+	}
+
+	if err := s.Store("dir/file name.dat", []byte("some content")); err != nil {
+		t.Errorf("Store: want nil, got %#v", err)
+	}
+
+	if err := filestore.Rename(s, "file name.dat", "dir/other?.dat"); err != nil {
+		t.Errorf("Rename: want nil, got %#v", err)
+	}
+
+	want := []string{"/file/dir/file%20name.dat ", "/file/file%20name.dat /file/dir/other%3F.dat"}
+	if !reflect.DeepEqual(paths, want) {
+		t.Errorf("Requests: want %#v, got %#v", want, paths)
+	}
+}
@@ -0,0 +1,74 @@
+package filestore
+
+import (
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// CorruptionEvent is reported when Retrieve finds a corrupted file
+type CorruptionEvent struct {
+	Filename string
+
+	// Set if the file was purged so it can be stored again, only when RepairCorrupted is enabled
+	Repaired bool
+
+	// Reason repairing failed
+	Err error
+}
+
+// reportCorruption lets the caller know a file is corrupted and, if enabled, purges it
+func (s memcacheStore) reportCorruption(filename string) {
+	event := CorruptionEvent{Filename: filename}
+
+	if s.repairCorrupted {
+		event.Err = s.withLock([]string{filename}, func() error {
+			var err error
+			event.Repaired, err = s.repairFile(filename)
+			return err
+		})
+
+		logger := s.logger.WithField("filename", filename)
+		if event.Err != nil {
+			s.metrics.IncPurgeFailures()
+			logger.WithError(event.Err).Error("Unable to purge corrupted file")
+		} else if event.Repaired {
+			logger.Info("Purged corrupted file")
+		}
+	}
+
+	if s.onCorrupted != nil {
+		s.onCorrupted(event)
+	}
+}
+
+// repairFile purges a corrupted file. The file is checked again first as it may have been
+// deleted or stored again since the corruption was found.
+func (s memcacheStore) repairFile(filename string) (bool, error) {
+	meta, err := s.getMetadata(filename)
+	if err == memcache.ErrCacheMiss {
+		return false, nil
+	}
+
+	if err == errMetadataInvalid {
+		// Chunks can't be located, only the metadata key can be removed
+		meta = metadata{}
+	} else if err != nil {
+		return false, err
+	} else {
+		_, err = s.getChunkRange(meta, 0, meta.Chunks)
+		if err == nil {
+			return false, nil
+		} else if err != errKeysMissing {
+			return false, err
+		}
+	}
+
+	err = s.purgeFile(filename, meta)
+	if err != nil {
+		return false, err
+	}
+
+	s.releaseQuota(filename, fileUsage(meta))
+	s.forgetFile(filename)
+
+	return true, nil
+}
@@ -0,0 +1,146 @@
+package filestore
+
+import (
+	"filestore/client"
+	"filestore/mock"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+func TestRepairCorrupted(t *testing.T) {
+	type testCase struct {
+		name          string
+		repair        bool
+		corrupt       func(c client.Memcache, id string)
+		wantEvents    []CorruptionEvent
+		wantStoreErr  error
+		wantRemaining int
+	}
+
+	tests := []testCase{
+		{
+			name:   "Corrupted file is reported but left in place",
+			repair: false,
+			corrupt: func(c client.Memcache, id string) {
+				_ = c.Delete(buildChunkKey(id, 0))
+			},
+			wantEvents:    []CorruptionEvent{{Filename: "file.dat"}},
+			wantStoreErr:  ErrFileAlreadyExists,
+			wantRemaining: 2,
+		},
+		{
+			name:   "File with missing chunks is purged",
+			repair: true,
+			corrupt: func(c client.Memcache, id string) {
+				_ = c.Delete(buildChunkKey(id, 0))
+			},
+			wantEvents:    []CorruptionEvent{{Filename: "file.dat", Repaired: true}},
+			wantStoreErr:  nil,
+			wantRemaining: 0,
+		},
+		{
+			name:   "File with invalid metadata is purged",
+			repair: true,
+			corrupt: func(c client.Memcache, id string) {
+				_ = c.Set(&memcache.Item{Key: keyPrefix + MD5Key("file.dat"), Value: []byte("{")})
+			},
+			wantEvents:    []CorruptionEvent{{Filename: "file.dat", Repaired: true}},
+			wantStoreErr:  nil,
+			wantRemaining: 3, // chunks can't be located without metadata
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := mock.NewMemcacheClient(100)
+
+			events := []CorruptionEvent{}
+			s := NewMemcacheWithClient(c, MemcacheConfig{
+				ChunkSize:       5,
+				RepairCorrupted: tt.repair,
+				OnCorrupted: func(event CorruptionEvent) {
+					events = append(events, event)
+				},
+			})
+
+			err := s.Store("file.dat", []byte("some content"))
+			if err != nil {
+				panic(err)
+			}
+
+			item, _ := c.Get(keyPrefix + MD5Key("file.dat"))
+			meta, _ := decodeMetadata(item.Value)
+			tt.corrupt(c, meta.ID)
+
+			_, err = s.Retrieve("file.dat")
+			if err != ErrFileCorrupted {
+				t.Errorf("Retrieve: want %#v, got %#v", ErrFileCorrupted, err)
+			}
+
+			if !reflect.DeepEqual(events, tt.wantEvents) {
+				t.Errorf("Events: want %#v, got %#v", tt.wantEvents, events)
+			}
+
+			remaining := 0
+			for i := 0; i < meta.Chunks; i++ {
+				if _, err := c.Get(buildChunkKey(meta.ID, i)); err == nil {
+					remaining++
+				}
+			}
+			if remaining != tt.wantRemaining {
+				t.Errorf("Remaining chunks: want %d, got %d", tt.wantRemaining, remaining)
+			}
+
+			err = s.Store("file.dat", []byte("some content"))
+			if err != tt.wantStoreErr {
+				t.Errorf("Store: want %#v, got %#v", tt.wantStoreErr, err)
+			}
+		})
+	}
+}
+
+func TestRepairCorrupted_DuringStore(t *testing.T) {
+	// Slow chunk writes keep the store busy while the file is retrieved, without a lock to wait for
+	c := mock.NewFaultyClient(mock.NewMemcacheClient(100), mock.FaultConfig{Faults: []mock.Fault{
+		{Ops: []string{mock.OpSet}, Keys: regexp.MustCompile(`::`), Latency: 20 * time.Millisecond},
+	}})
+
+	events := make(chan CorruptionEvent, 1)
+	s := NewMemcacheWithClient(c, MemcacheConfig{
+		ChunkSize:       5,
+		RepairCorrupted: true,
+		OnCorrupted: func(event CorruptionEvent) {
+			events <- event
+		},
+	})
+
+	done := make(chan error)
+	go func() {
+		done <- s.Store("file.dat", []byte("some content"))
+	}()
+
+	time.Sleep(30 * time.Millisecond)
+	_, err := s.Retrieve("file.dat")
+	if err != ErrFileNotFound {
+		t.Errorf("Retrieve during Store: want %#v, got %#v", ErrFileNotFound, err)
+	}
+
+	err = <-done
+	if err != nil {
+		t.Errorf("Store: want nil, got %#v", err)
+	}
+
+	if contents, err := s.Retrieve("file.dat"); err != nil || string(contents) != "some content" {
+		t.Errorf("Retrieve: want %#v, got %#v (%v)", "some content", string(contents), err)
+	}
+
+	select {
+	case event := <-events:
+		t.Errorf("Events: want none, got %#v", event)
+	default:
+	}
+}
@@ -0,0 +1,127 @@
+package filestore
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultInitialBackoff = 10 * time.Millisecond
+const defaultMaxBackoff = time.Second
+
+// RetryPolicy controls how chunk level operations are retried when the backend fails.
+// Only idempotent operations are retried: get, set and delete. A timed out add, compare-and-swap,
+// increment or decrement may have been applied, so repeating it could fail or count twice.
+// Zero value disables retries.
+type RetryPolicy struct {
+	// Total number of attempts including the first one, 0 or 1 means no retries
+	MaxAttempts int
+
+	// Delay before the second attempt, doubled for each following attempt up to MaxBackoff
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	// Fraction (0..1) of each delay which is randomised to avoid retries from many clients lining up
+	Jitter float64
+
+	// Decides if an error is worth retrying, defaults to IsRetryable
+	Retryable func(err error) bool
+}
+
+// IsRetryable reports if the error looks transient: timeouts, connection and I/O errors.
+// Definite answers from the server, like a cache miss, are never retried.
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	switch err {
+	case memcache.ErrCacheMiss, memcache.ErrCASConflict, memcache.ErrNotStored, memcache.ErrMalformedKey, memcache.ErrNoStats:
+		return false
+	}
+
+	var connectTimeoutErr *memcache.ConnectTimeoutError
+	if errors.As(err, &connectTimeoutErr) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE)
+}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.MaxAttempts < 1 {
+		p.MaxAttempts = 1
+	}
+
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = defaultInitialBackoff
+	}
+
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = defaultMaxBackoff
+	}
+
+	if p.Jitter < 0 {
+		p.Jitter = 0
+	} else if p.Jitter > 1 {
+		p.Jitter = 1
+	}
+
+	if p.Retryable == nil {
+		p.Retryable = IsRetryable
+	}
+
+	return p
+}
+
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	delay := p.InitialBackoff
+	for i := 1; i < attempt && delay < p.MaxBackoff; i++ {
+		delay *= 2
+	}
+
+	if delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+
+	if p.Jitter > 0 {
+		spread := float64(delay) * p.Jitter
+		delay = time.Duration(float64(delay) - spread + rand.Float64()*spread)
+	}
+
+	return delay
+}
+
+// do calls fn until it succeeds, fails with a non retryable error or runs out of attempts
+func (p RetryPolicy) do(logger log.FieldLogger, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= p.MaxAttempts || !p.Retryable(err) {
+			return err
+		}
+
+		delay := p.backoff(attempt)
+
+		logger.WithError(err).
+			WithField("attempt", attempt).
+			WithField("delay", delay).
+			Warning("Backend request failed, retrying")
+
+		time.Sleep(delay)
+	}
+}
@@ -0,0 +1,132 @@
+package filestore
+
+import (
+	"errors"
+	"filestore/client"
+	"filestore/mock"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// flakyClient fails the first N Set calls with a timeout
+type flakyClient struct {
+	client.Memcache
+	setFailures int
+}
+
+func (c *flakyClient) Set(item *memcache.Item) error {
+	if c.setFailures > 0 {
+		c.setFailures--
+		return &net.OpError{Op: "write", Net: "tcp", Err: timeoutError{}}
+	}
+
+	return c.Memcache.Set(item)
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{memcache.ErrCacheMiss, false},
+		{memcache.ErrNotStored, false},
+		{errors.New("something else"), false},
+		{&net.OpError{Op: "read", Net: "tcp", Err: timeoutError{}}, true},
+		{&memcache.ConnectTimeoutError{Addr: &net.TCPAddr{}}, true},
+		{fmt.Errorf("reading response: %w", io.ErrUnexpectedEOF), true},
+	}
+
+	for _, tt := range tests {
+		if got := IsRetryable(tt.err); got != tt.want {
+			t.Errorf("IsRetryable(%v): want %v, got %v", tt.err, tt.want, got)
+		}
+	}
+}
+
+func TestRetryPolicy_Store(t *testing.T) {
+	tests := []struct {
+		name        string
+		retry       RetryPolicy
+		setFailures int
+		wantErr     bool
+	}{
+		{
+			name:        "Without retries a single timeout fails the upload",
+			retry:       RetryPolicy{},
+			setFailures: 1,
+			wantErr:     true,
+		},
+		{
+			name:        "Transient timeouts are retried",
+			retry:       RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, Jitter: 0.5},
+			setFailures: 2,
+			wantErr:     false,
+		},
+		{
+			name:        "Gives up after max attempts",
+			retry:       RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond},
+			setFailures: 2,
+			wantErr:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &flakyClient{Memcache: mock.NewMemcacheClient(100), setFailures: tt.setFailures}
+			s := NewMemcacheWithClient(c, MemcacheConfig{ChunkSize: 10, Retry: tt.retry})
+
+			err := s.Store("file.dat", []byte("some content"))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Error: want error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestRetryPolicy_NonIdempotent(t *testing.T) {
+	// The metadata key is added, but the reply times out
+	c := mock.NewFaultyClient(mock.NewMemcacheClient(100), mock.FaultConfig{Faults: []mock.Fault{{
+		Ops:              []string{mock.OpAdd},
+		ErrorRate:        1,
+		Err:              &net.OpError{Op: "read", Net: "tcp", Err: timeoutError{}},
+		FailAfterRequest: true,
+	}}})
+	s := NewMemcacheWithClient(c, MemcacheConfig{
+		ChunkSize: 10,
+		Retry:     RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond},
+	})
+
+	// A retry would find the key it added itself and report the file as existing
+	err := s.Store("file.dat", []byte("some content"))
+	var netErr net.Error
+	if !errors.As(err, &netErr) {
+		t.Errorf("Store: want timeout, got %#v", err)
+	}
+
+	if got := c.Injected(); got != 1 {
+		t.Errorf("Add requests: want %d, got %d", 1, got)
+	}
+}
+
+func TestRetryPolicy_backoff(t *testing.T) {
+	p := RetryPolicy{InitialBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}.withDefaults()
+
+	want := []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond, 50 * time.Millisecond, 50 * time.Millisecond}
+	for i, w := range want {
+		if got := p.backoff(i + 1); got != w {
+			t.Errorf("Attempt %d: want %v, got %v", i+1, w, got)
+		}
+	}
+}
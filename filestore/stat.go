@@ -0,0 +1,88 @@
+package filestore
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// FileInfo describes a stored file without its contents
+type FileInfo struct {
+	// -1 for files stored by older versions, which didn't record it
+	Size int
+
+	// Version of the current contents, files stored without versioning are version 1
+	Version int
+
+	// Changes whenever the contents change. It's derived from checksums of the chunks, so it can't be compared
+	// with checksums of local files. Empty for files stored by older versions.
+	Checksum string
+}
+
+// Stater is implemented by stores which can describe files without retrieving them
+type Stater interface {
+	Stat(filename string) (FileInfo, error)
+}
+
+// Stat fails with ErrFileNotFound if the file doesn't exist. Files whose chunks were evicted are still
+// described, retrieving them fails with ErrFileCorrupted.
+func Stat(store Store, filename string) (FileInfo, error) {
+	stater, ok := store.(Stater)
+	if !ok {
+		return FileInfo{}, fmt.Errorf("%w: store can't describe files", ErrNotSupported)
+	}
+
+	return stater.Stat(filename)
+}
+
+// Stat only reads metadata
+func (s memcacheStore) Stat(filename string) (FileInfo, error) {
+	start := time.Now()
+
+	info := FileInfo{}
+	err := s.normalizeFilenames(&filename)
+	if err == nil {
+		info, err = s.stat(filename)
+	}
+	s.metrics.ObserveOperation(OpStat, time.Since(start), err)
+
+	return info, err
+}
+
+func (s memcacheStore) stat(filename string) (FileInfo, error) {
+	meta, err := s.getMetadata(filename)
+	if err != nil {
+		if err == memcache.ErrCacheMiss {
+			return FileInfo{}, ErrFileNotFound
+		}
+
+		if err == errMetadataInvalid {
+			return FileInfo{}, ErrFileCorrupted
+		}
+
+		return FileInfo{}, fmt.Errorf("Unable to stat file: %w", err)
+	}
+
+	size := meta.Size
+	if size < 0 {
+		size = -1
+	}
+
+	return FileInfo{
+		Size:     size,
+		Version:  meta.version(),
+		Checksum: meta.contentsChecksum(),
+	}, nil
+}
+
+// contentsChecksum combines checksums of the chunks followed by their number, like ETags of multipart uploads
+func (m metadata) contentsChecksum() string {
+	if len(m.Checksums) != m.Chunks {
+		return ""
+	}
+
+	return checksum([]byte(strings.Join(m.Checksums, ""))) + "-" + strconv.Itoa(len(m.Checksums))
+}
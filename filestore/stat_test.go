@@ -0,0 +1,52 @@
+package filestore
+
+import (
+	"filestore/mock"
+	"regexp"
+	"testing"
+)
+
+func TestStat(t *testing.T) {
+	c := mock.NewMemcacheClient(100)
+	s := NewMemcacheWithClient(c, MemcacheConfig{ChunkSize: 5, Versions: 2})
+
+	_, err := Stat(s, "file.dat")
+	if err != ErrFileNotFound {
+		t.Errorf("Stat of a missing file: want %#v, got %#v", ErrFileNotFound, err)
+	}
+
+	_ = s.Store("file.dat", []byte("some content"))
+	_ = s.Store("file.dat", []byte("other content"))
+
+	info, err := Stat(s, "file.dat")
+	if err != nil || info.Size != 13 || info.Version != 2 {
+		t.Errorf("Stat: want size %d and version %d, got %#v (%v)", 13, 2, info, err)
+	}
+
+	if !regexp.MustCompile(`^[0-9a-f]{32}-3$`).MatchString(info.Checksum) {
+		t.Errorf("Checksum: want the checksum of 3 chunks, got %#v", info.Checksum)
+	}
+
+	// Only metadata is read, evicted chunks show up once the file is retrieved
+	item, _ := c.Get(keyPrefix + MD5Key("file.dat"))
+	meta, _ := decodeMetadata(item.Value)
+	_ = c.Delete(meta.chunkKey(1))
+
+	evicted, err := Stat(s, "file.dat")
+	if err != nil || evicted != info {
+		t.Errorf("Stat of an evicted file: want %#v, got %#v (%v)", info, evicted, err)
+	}
+
+	// The checksum changes with the contents, not with the file ID
+	_ = s.Store("same.dat", []byte("other content"))
+	same, _ := Stat(s, "same.dat")
+	if same.Checksum != info.Checksum {
+		t.Errorf("Checksum of the same contents: want %#v, got %#v", info.Checksum, same.Checksum)
+	}
+
+	_ = WriteAt(s, "same.dat", 0, []byte("O"))
+	changed, _ := Stat(s, "same.dat")
+	if changed.Checksum == info.Checksum || changed.Size != info.Size {
+		t.Errorf("Stat after WriteAt: want another checksum, got %#v", changed)
+	}
+}
@@ -0,0 +1,261 @@
+package filestore
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// VersionedStore is implemented by stores which keep previous versions of files
+type VersionedStore interface {
+	// RetrieveVersion returns the given version of the file, ErrVersionNotFound if it was pruned or evicted
+	RetrieveVersion(filename string, version int) ([]byte, error)
+
+	// Versions lists versions of the file which are kept, newest first
+	Versions(filename string) ([]int, error)
+}
+
+func RetrieveVersion(store Store, filename string, version int) ([]byte, error) {
+	versioned, ok := store.(VersionedStore)
+	if !ok {
+		return []byte{}, fmt.Errorf("%w: store does not keep versions", ErrNotSupported)
+	}
+
+	return versioned.RetrieveVersion(filename, version)
+}
+
+func Versions(store Store, filename string) ([]int, error) {
+	versioned, ok := store.(VersionedStore)
+	if !ok {
+		return nil, fmt.Errorf("%w: store does not keep versions", ErrNotSupported)
+	}
+
+	return versioned.Versions(filename)
+}
+
+func (s memcacheStore) RetrieveVersion(filename string, version int) ([]byte, error) {
+	start := time.Now()
+
+	contents := []byte{}
+	err := s.normalizeFilenames(&filename)
+	if err == nil {
+		contents, err = s.retrieveVersion(filename, version)
+	}
+	s.metrics.ObserveOperation(OpRetrieveVersion, time.Since(start), err)
+	if err == nil {
+		s.metrics.AddBytesOut(len(contents))
+	}
+
+	if err == ErrFileCorrupted {
+		s.reportCorruption(filename)
+	}
+
+	return contents, err
+}
+
+func (s memcacheStore) Versions(filename string) ([]int, error) {
+	err := s.normalizeFilenames(&filename)
+	if err != nil {
+		return nil, err
+	}
+
+	meta, err := s.getMetadata(filename)
+	if err != nil {
+		if err == memcache.ErrCacheMiss {
+			return nil, ErrFileNotFound
+		}
+
+		if err == errMetadataInvalid {
+			return nil, ErrFileCorrupted
+		}
+
+		return nil, fmt.Errorf("Unable to list file versions: %w", err)
+	}
+
+	versions := []int{meta.version()}
+	for _, previous := range meta.Previous {
+		versions = append(versions, previous.version())
+	}
+
+	return versions, nil
+}
+
+func (s memcacheStore) retrieveVersion(filename string, version int) ([]byte, error) {
+	logger := s.logger.WithField("filename", filename).WithField("version", version)
+	logger.Debug("Retrieving file version")
+
+	meta, err := s.getMetadata(filename)
+	if err != nil {
+		if err == memcache.ErrCacheMiss {
+			return []byte{}, ErrFileNotFound
+		}
+
+		if err == errMetadataInvalid {
+			return []byte{}, ErrFileCorrupted
+		}
+
+		return []byte{}, fmt.Errorf("Unable to retrieve file: %w", err)
+	}
+
+	if version == meta.version() {
+		contents, err := s.getChunks(meta)
+		if err == errKeysMissing {
+			return []byte{}, ErrFileCorrupted
+		} else if err != nil {
+			return []byte{}, fmt.Errorf("Unable to retrieve file: %w", err)
+		}
+
+		logger.WithField("size", len(contents)).Info("Retrieved file version")
+
+		return contents, nil
+	}
+
+	for _, previous := range meta.Previous {
+		if previous.version() != version {
+			continue
+		}
+
+		// Older versions being evicted doesn't make the file itself corrupted
+		contents, err := s.getChunks(previous)
+		if err == errKeysMissing {
+			return []byte{}, fmt.Errorf("%w: version %d was evicted", ErrVersionNotFound, version)
+		} else if err != nil {
+			return []byte{}, fmt.Errorf("Unable to retrieve file: %w", err)
+		}
+
+		logger.WithField("size", len(contents)).Info("Retrieved file version")
+
+		return contents, nil
+	}
+
+	return []byte{}, ErrVersionNotFound
+}
+
+// storeVersion stores the file as a new version if it exists already. Chunks are written under a new file ID
+// before metadata is switched over, so readers keep getting the previous version until the new one is complete.
+func (s memcacheStore) storeVersion(filename string, contents []byte) error {
+	logger := s.logger.WithField("filename", filename)
+	metadataKey := s.buildKey(filename)
+
+	current, err := s.getItem(metadataKey)
+	if err != nil && err != memcache.ErrCacheMiss {
+		return fmt.Errorf("Unable to store file: %w", err)
+	}
+
+	meta := s.newMetadata(filename, contents)
+	meta.Version = 1
+
+	var pruned []metadata
+	if current.Item != nil {
+		previous, err := decodeMetadata(current.Value)
+		if err != nil {
+			logger.WithError(err).Warning("Unable to decode metadata")
+			return ErrFileCorrupted
+		}
+
+		if !previous.belongsTo(filename) {
+			logger.WithField("owner", previous.Filename).Warning("Key collides with another file")
+			return ErrFileAlreadyExists
+		}
+
+		if previous.ID == "" {
+			previous.ID = legacyFileID(filename)
+		}
+
+		meta.Version = previous.version() + 1
+		meta.Previous, pruned = s.pruneVersions(previous)
+	}
+
+	// Check quota before anything is written, a new version of an existing file doesn't add to the file count
+	added := usage{bytes: meta.Size}
+	if current.Item == nil {
+		added.files = 1
+	}
+
+	err = s.reserveQuota(filename, added)
+	if err != nil {
+		return err
+	}
+
+	// Registered before anything is written like a file stored for the first time. The registry keeps
+	// pointing to the new version if storing it fails, Check sorts that out
+	err = s.registerFile(filename, meta)
+	if err != nil {
+		s.releaseQuota(filename, added)
+
+		return fmt.Errorf("Unable to store file: %w", err)
+	}
+
+	// Only a new file is unregistered again, the registry entry of an existing one is left to Check
+	cleanup := s.cleanupFailedChunks
+	if current.Item == nil {
+		cleanup = s.cleanupUnstoredFile
+	}
+
+	err = s.writeChunks(meta, contents)
+	if err != nil {
+		cleanup(filename, meta, added)
+
+		return fmt.Errorf("Unable to store file: %w", err)
+	}
+
+	if current.Item == nil {
+		err = s.addKey(metadataKey, meta.encode())
+	} else {
+		current.Value = meta.encode()
+		err = s.compareAndSwapKey(current)
+	}
+	if err == memcache.ErrNotStored || err == memcache.ErrCASConflict {
+		// Someone else stored, changed or deleted the file since we read metadata
+		s.cleanupFailedChunks(filename, meta, added)
+
+		return ErrFileModified
+	} else if err != nil {
+		cleanup(filename, meta, added)
+
+		return fmt.Errorf("Unable to store file: %w", err)
+	}
+
+	// The file is stored at this point, failing to purge old versions is not fatal
+
+	for _, old := range pruned {
+		err := s.purgeChunks(old)
+		if err != nil {
+			s.metrics.IncPurgeFailures()
+			logger.WithField("version", old.version()).WithError(err).Error("Unable to purge old version")
+			continue
+		}
+
+		s.releaseQuota(filename, usage{bytes: old.Size})
+	}
+
+	storedContents, err := s.retrieve(filename)
+	if err != nil {
+		return fmt.Errorf("Unable to store file: %w", err)
+	}
+
+	if checksum(contents) != checksum(storedContents) {
+		return ErrChecksumFailed
+	}
+
+	logger.WithField("size", len(storedContents)).WithField("version", meta.Version).Info("Stored file")
+
+	return nil
+}
+
+// pruneVersions returns versions to keep once the file is stored again and versions which no longer fit
+func (s memcacheStore) pruneVersions(previous metadata) ([]metadata, []metadata) {
+	latest := previous
+	latest.Previous = nil
+
+	versions := make([]metadata, 0, len(previous.Previous)+1)
+	versions = append(versions, latest)
+	versions = append(versions, previous.Previous...)
+
+	if len(versions) <= s.keepVersions {
+		return versions, nil
+	}
+
+	return versions[:s.keepVersions], versions[s.keepVersions:]
+}
@@ -0,0 +1,149 @@
+package filestore
+
+import (
+	"errors"
+	"filestore/mock"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+func TestVersions(t *testing.T) {
+	c := mock.NewMemcacheClient(100)
+	s := NewMemcacheWithClient(c, MemcacheConfig{ChunkSize: 5, Versions: 2})
+
+	ids := []string{}
+	for v := 1; v <= 4; v++ {
+		err := s.Store("file.dat", []byte(fmt.Sprintf("version %d", v)))
+		if err != nil {
+			t.Fatalf("Store version %d: want nil, got %#v", v, err)
+		}
+
+		item, _ := c.Get(keyPrefix + MD5Key("file.dat"))
+		meta, _ := decodeMetadata(item.Value)
+		ids = append(ids, meta.ID)
+	}
+
+	versions, err := Versions(s, "file.dat")
+	if err != nil || !reflect.DeepEqual(versions, []int{4, 3, 2}) {
+		t.Errorf("Versions: want %#v, got %#v (%v)", []int{4, 3, 2}, versions, err)
+	}
+
+	contents, err := s.Retrieve("file.dat")
+	if err != nil || string(contents) != "version 4" {
+		t.Errorf("Retrieve: want %#v, got %#v (%v)", "version 4", string(contents), err)
+	}
+
+	for v := 2; v <= 4; v++ {
+		want := fmt.Sprintf("version %d", v)
+		contents, err := RetrieveVersion(s, "file.dat", v)
+		if err != nil || string(contents) != want {
+			t.Errorf("RetrieveVersion %d: want %#v, got %#v (%v)", v, want, string(contents), err)
+		}
+	}
+
+	_, err = RetrieveVersion(s, "file.dat", 1)
+	if err != ErrVersionNotFound {
+		t.Errorf("RetrieveVersion 1: want %#v, got %#v", ErrVersionNotFound, err)
+	}
+
+	// Chunks of the pruned version are gone
+	if _, err := c.Get(buildChunkKey(ids[0], 0)); err != memcache.ErrCacheMiss {
+		t.Errorf("Pruned chunk: want %#v, got %#v", memcache.ErrCacheMiss, err)
+	}
+
+	// Evicted old version doesn't affect the current one
+	_ = c.Delete(buildChunkKey(ids[1], 1))
+
+	_, err = RetrieveVersion(s, "file.dat", 2)
+	if !errors.Is(err, ErrVersionNotFound) {
+		t.Errorf("RetrieveVersion 2: want %#v, got %#v", ErrVersionNotFound, err)
+	}
+
+	contents, err = s.Retrieve("file.dat")
+	if err != nil || string(contents) != "version 4" {
+		t.Errorf("Retrieve: want %#v, got %#v (%v)", "version 4", string(contents), err)
+	}
+
+	// Deleting the file purges all versions
+	err = s.Delete("file.dat")
+	if err != nil {
+		t.Fatalf("Delete: want nil, got %#v", err)
+	}
+
+	for _, id := range ids[2:] {
+		if _, err := c.Get(buildChunkKey(id, 0)); err != memcache.ErrCacheMiss {
+			t.Errorf("Chunk of %s: want %#v, got %#v", id, memcache.ErrCacheMiss, err)
+		}
+	}
+}
+
+func TestVersions_Disabled(t *testing.T) {
+	s := NewMemcacheWithClient(mock.NewMemcacheClient(100), MemcacheConfig{ChunkSize: 5})
+
+	err := s.Store("file.dat", []byte("some content"))
+	if err != nil {
+		panic(err)
+	}
+
+	err = s.Store("file.dat", []byte("other content"))
+	if err != ErrFileAlreadyExists {
+		t.Errorf("Store: want %#v, got %#v", ErrFileAlreadyExists, err)
+	}
+
+	// The only version there is
+	contents, err := RetrieveVersion(s, "file.dat", 1)
+	if err != nil || string(contents) != "some content" {
+		t.Errorf("RetrieveVersion 1: want %#v, got %#v (%v)", "some content", string(contents), err)
+	}
+
+	_, err = RetrieveVersion(s, "file.dat", 2)
+	if err != ErrVersionNotFound {
+		t.Errorf("RetrieveVersion 2: want %#v, got %#v", ErrVersionNotFound, err)
+	}
+
+	_, err = RetrieveVersion(s, "missing.dat", 1)
+	if err != ErrFileNotFound {
+		t.Errorf("RetrieveVersion of a missing file: want %#v, got %#v", ErrFileNotFound, err)
+	}
+}
+
+func TestVersions_Copy(t *testing.T) {
+	s := NewMemcacheWithClient(mock.NewMemcacheClient(100), MemcacheConfig{ChunkSize: 5, Versions: 2})
+
+	for filename, contents := range map[string]string{"file.dat": "some content", "other.dat": "other content"} {
+		err := s.Store(filename, []byte(contents))
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	// A copy doesn't become a new version of an existing file
+	err := Copy(s, "file.dat", "other.dat")
+	if err != ErrFileAlreadyExists {
+		t.Errorf("Copy to an existing file: want %#v, got %#v", ErrFileAlreadyExists, err)
+	}
+
+	versions, err := Versions(s, "other.dat")
+	if err != nil || !reflect.DeepEqual(versions, []int{1}) {
+		t.Errorf("Versions: want %#v, got %#v (%v)", []int{1}, versions, err)
+	}
+
+	err = Copy(s, "file.dat", "copy.dat")
+	if err != nil {
+		t.Fatalf("Copy: want nil, got %#v", err)
+	}
+
+	// The copy gets versions of its own from then on
+	err = s.Store("copy.dat", []byte("new content"))
+	if err != nil {
+		t.Fatalf("Store of the copy: want nil, got %#v", err)
+	}
+
+	versions, err = Versions(s, "copy.dat")
+	if err != nil || !reflect.DeepEqual(versions, []int{2, 1}) {
+		t.Errorf("Versions of the copy: want %#v, got %#v (%v)", []int{2, 1}, versions, err)
+	}
+}